@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	adminTokenFlag = "admin-token"
+	adminTokenEnv  = "TEGAMI_ADMIN_TOKEN"
+)
+
+// AdminApi is the HTTP API used for inspecting Tegami and operating on its delivery queue. Its
+// requests are authenticated by a bearer token.
+type AdminApi struct {
+	token    string
+	services []Service
+	// queue contains the deliveries.
+	queue  *DeliveryQueue
+	health *HealthChecker
+	// config contains the effective configuration with its secrets masked.
+	config map[string]interface{}
+}
+
+// NewAdminApi creates the admin API operating on the services and the queue. The configuration is
+// made of the values of the flags along with the notification URLs.
+func NewAdminApi(token string, services []Service, queue *DeliveryQueue, health *HealthChecker, flags map[string]string, notifyUrls []string) *AdminApi {
+	redactor.AddSecret(token)
+	return &AdminApi{
+		token:    token,
+		services: services,
+		queue:    queue,
+		health:   health,
+		config:   maskConfig(flags, notifyUrls),
+	}
+}
+
+// createAdminApi creates the admin API configured by the flags, or returns nil when it is disabled.
+// The API operates on the deliveries of the queue, so it isn't served when the retries are disabled.
+func createAdminApi(flags map[string]string, notifyUrls []string, services []Service, queue *DeliveryQueue, health *HealthChecker) (*AdminApi, error) {
+	if err := validateAdminApi(flags); err != nil || queue == nil || len(flags[adminTokenFlag]) == 0 {
+		return nil, err
+	}
+
+	return NewAdminApi(flags[adminTokenFlag], services, queue, health, flags, notifyUrls), nil
+}
+
+// validateAdminApi returns an error when the admin token is set while the retries are disabled,
+// unless the token protects the web UI.
+func validateAdminApi(flags map[string]string) error {
+	if len(flags[adminTokenFlag]) == 0 {
+		return nil
+	}
+
+	if retries, err := parseOptionalInt(flags[queueRetriesFlag], 0); err != nil || retries > 0 {
+		// Invalid retries are reported by the queue.
+		return nil
+	}
+
+	if capacity, _ := parseWebUiHistory(flags); capacity > 0 {
+		return nil
+	}
+
+	return errors.New("admin api requires the queue retries")
+}
+
+// maskConfig returns the configuration with the credentials of the services, the admin token and
+// the notification URLs masked. Only the schemes of the notification URLs are kept since their
+// credentials may be anywhere in the URL.
+func maskConfig(flags map[string]string, notifyUrls []string) map[string]interface{} {
+	secrets := map[string]bool{adminTokenFlag: true}
+
+	for _, definition := range serviceDefinitions {
+		for _, name := range definition.Secrets {
+			secrets[name] = true
+		}
+	}
+
+	config := make(map[string]interface{})
+
+	for name, value := range flags {
+		if len(value) > 0 && secrets[name] {
+			value = redactedValue
+		}
+		config[name] = redactor.Redact(value)
+	}
+
+	urls := make([]string, 0, len(notifyUrls))
+
+	for _, notifyUrl := range notifyUrls {
+		if schemeEnd := strings.Index(notifyUrl, "://"); schemeEnd > 0 {
+			urls = append(urls, notifyUrl[:schemeEnd+3]+redactedValue)
+		} else {
+			urls = append(urls, redactedValue)
+		}
+	}
+
+	config[notifyFlag] = urls
+	return config
+}
+
+// Register adds the endpoints of the API to a multiplexer.
+func (a *AdminApi) Register(mux *http.ServeMux) {
+	mux.Handle("GET /api/config", a.authenticate(a.serveConfig))
+	mux.Handle("GET /api/services", a.authenticate(a.serveServices))
+	mux.Handle("GET /api/deliveries", a.authenticate(a.serveDeliveries))
+	mux.Handle("POST /api/deliveries/{id}/retry", a.authenticate(a.serveRetry))
+	mux.Handle("DELETE /api/deliveries/{id}", a.authenticate(a.serveDelete))
+	mux.Handle("GET /api/messages/{id}", a.authenticate(a.serveMessage))
+	mux.Handle("GET /api/messages/{id}/raw", a.authenticate(a.serveRawMessage))
+}
+
+// authenticate only lets the requests having the token of the API through.
+func (a *AdminApi) authenticate(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tegami"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	})
+}
+
+// serveConfig answers the effective configuration with its secrets masked.
+func (a *AdminApi) serveConfig(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.config)
+}
+
+// serveServices answers the status of each service as reported by the readiness endpoint.
+func (a *AdminApi) serveServices(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.health.Readiness())
+}
+
+// serveDeliveries answers the deliveries of the queue, optionally filtered by their state.
+func (a *AdminApi) serveDeliveries(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+
+	if len(state) > 0 && state != deliveryPending && state != deliveryDeadLetter {
+		http.Error(w, "state must be either pending or dead_letter", http.StatusBadRequest)
+		return
+	}
+
+	deliveries := []DeliveryStatus{}
+
+	for _, status := range a.queue.Statuses() {
+		if len(state) == 0 || status.State == state {
+			deliveries = append(deliveries, status)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// serveRetry attempts a delivery again immediately, with the service given by the service query
+// parameter if it is set.
+func (a *AdminApi) serveRetry(w http.ResponseWriter, r *http.Request) {
+	var service Service
+
+	if name := r.URL.Query().Get("service"); len(name) > 0 {
+		if service = a.findService(name); service == nil {
+			http.Error(w, fmt.Sprintf("unknown service %s, expected one of: %s", name, strings.Join(a.serviceNames(), ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeQueueResult(w, a.queue.Retry(r.PathValue("id"), service))
+}
+
+// serveDelete removes a delivery from the queue.
+func (a *AdminApi) serveDelete(w http.ResponseWriter, r *http.Request) {
+	writeQueueResult(w, a.queue.Remove(r.PathValue("id")))
+}
+
+// writeQueueResult answers the result of an operation on the queue.
+func writeQueueResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, deliveryNotFoundError):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// AdminMessage is a message of the queue as answered by the admin API.
+type AdminMessage struct {
+	ID          string              `json:"id"`
+	SessionID   string              `json:"session_id"`
+	From        string              `json:"from"`
+	To          []string            `json:"to"`
+	Subject     string              `json:"subject"`
+	Date        time.Time           `json:"date"`
+	Received    time.Time           `json:"received"`
+	Size        int                 `json:"size"`
+	Attachments []AdminAttachment   `json:"attachments"`
+	HTML        string              `json:"html"`
+	Markdown    string              `json:"markdown"`
+	Deliveries  []DeliveryStatus    `json:"deliveries"`
+	Headers     map[string][]string `json:"headers"`
+}
+
+// AdminAttachment describes an attachment of a message without its content.
+type AdminAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// serveMessage answers a message of the queue along with its deliveries.
+func (a *AdminApi) serveMessage(w http.ResponseWriter, r *http.Request) {
+	msg, deliveries := a.queue.FindMessage(r.PathValue("id"))
+	if msg == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	response := AdminMessage{
+		ID:          msg.ID,
+		SessionID:   msg.SessionID,
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		Date:        msg.Date,
+		Received:    msg.Received,
+		Size:        len(msg.Raw),
+		Attachments: []AdminAttachment{},
+		HTML:        msg.HTML,
+		Markdown:    msg.Markdown,
+		Deliveries:  deliveries,
+		Headers:     make(map[string][]string),
+	}
+
+	for _, attachment := range msg.Attachments {
+		response.Attachments = append(response.Attachments, AdminAttachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        len(attachment.Data),
+		})
+	}
+
+	fields := msg.Header.Fields()
+
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		response.Headers[fields.Key()] = append(response.Headers[fields.Key()], value)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// serveRawMessage answers a message of the queue as it was received.
+func (a *AdminApi) serveRawMessage(w http.ResponseWriter, r *http.Request) {
+	msg, _ := a.queue.FindMessage(r.PathValue("id"))
+	if msg == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write(msg.Raw)
+}
+
+// findService returns the service having a name regardless of its case, or nil if there is none.
+func (a *AdminApi) findService(name string) Service {
+	for _, service := range a.services {
+		if strings.EqualFold(serviceName(service), name) {
+			return service
+		}
+	}
+	return nil
+}
+
+// serviceNames returns the sorted names of the services.
+func (a *AdminApi) serviceNames() []string {
+	var names []string
+
+	for _, service := range a.services {
+		names = append(names, serviceName(service))
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// writeJSON answers a document encoded as JSON with a status code.
+func writeJSON(w http.ResponseWriter, statusCode int, document interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(document)
+}
+
+// adminCLIFlags returns the flags used for configuring the admin API.
+func adminCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    adminTokenFlag,
+			Usage:   "Bearer token of the admin API served by the HTTP server for managing the queue, which requires the queue retries. The API is disabled if not set (Optional)",
+			EnvVars: []string{adminTokenEnv},
+		},
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	archiveFormatFlag      = "archive-format"
+	archivePathFlag        = "archive-path"
+	archiveEmlTemplateFlag = "archive-eml-template"
+	archiveFormatEnv       = "TEGAMI_ARCHIVE_FORMAT"
+	archivePathEnv         = "TEGAMI_ARCHIVE_PATH"
+	archiveEmlTemplateEnv  = "TEGAMI_ARCHIVE_EML_TEMPLATE"
+)
+
+// Formats in which the emails are archived.
+const (
+	archiveFormatMaildir = "maildir"
+	archiveFormatMbox    = "mbox"
+	archiveFormatEml     = "eml"
+)
+
+const (
+	// archiveLockTimeout is the maximum time spent waiting for the lock of an mbox file.
+	archiveLockTimeout = 30 * time.Second
+	// archiveStaleLockAge is the age after which the lock of an mbox file is considered abandoned.
+	archiveStaleLockAge = 5 * time.Minute
+)
+
+var (
+	archiveFromLinePattern   = regexp.MustCompile(`(?m)^(>*From )`)
+	archiveFilenameCharacter = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]+`)
+	archiveDeliveries        uint64
+)
+
+// ArchiveService stores the original emails locally, either in a Maildir, in an mbox
+// file or as separate .eml files.
+type ArchiveService struct {
+	format      string
+	path        string
+	emlTemplate *template.Template
+	mutex       sync.Mutex
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:      "Archive",
+		Prefix:    "archive",
+		Flags:     archiveCLIFlags,
+		Required:  [][]string{{archiveFormatFlag}, {archivePathFlag}},
+		Templates: []string{archiveEmlTemplateFlag},
+		New:       func() Service { return &ArchiveService{} },
+		Schemes:   []string{"maildir", "mbox", "eml"},
+		ParseURL:  parseArchiveNotifyURL,
+	})
+}
+
+func (s *ArchiveService) Init(flags map[string]string) error {
+	s.format = strings.ToLower(flags[archiveFormatFlag])
+	s.path = flags[archivePathFlag]
+
+	if len(s.path) == 0 {
+		return errors.New("archive path not set")
+	}
+
+	var directories []string
+
+	switch s.format {
+	case archiveFormatMaildir:
+		for _, directory := range []string{"tmp", "new", "cur"} {
+			directories = append(directories, filepath.Join(s.path, directory))
+		}
+	case archiveFormatMbox:
+		directories = []string{filepath.Dir(s.path)}
+	case archiveFormatEml:
+		emlTemplate := flags[archiveEmlTemplateFlag]
+
+		if len(emlTemplate) == 0 {
+			emlTemplate = "{{.Date}}/{{.Subject}}.eml"
+		}
+
+		tmpl, err := ParseMessageTemplate(archiveEmlTemplateFlag, emlTemplate)
+		if err != nil {
+			return err
+		}
+
+		s.emlTemplate = tmpl
+		directories = []string{s.path}
+	case "":
+		return errors.New("archive format not set")
+	default:
+		return fmt.Errorf("archive format is invalid: %s", s.format)
+	}
+
+	if isOfflineInit(flags) {
+		return nil
+	}
+
+	for _, directory := range directories {
+		if err := os.MkdirAll(directory, 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ArchiveService) Send(_ context.Context, msg *Message) error {
+	if msg.Raw == nil {
+		return errors.New("archive requires the original email")
+	}
+
+	switch s.format {
+	case archiveFormatMaildir:
+		return s.writeMaildir(msg)
+	case archiveFormatMbox:
+		return s.writeMbox(msg)
+	default:
+		return s.writeEml(msg)
+	}
+}
+
+func (s *ArchiveService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *ArchiveService) Close() error {
+	return nil
+}
+
+// writeMaildir delivers the email in the new directory of the Maildir. The email is written
+// in the tmp directory first so it never appears partially written.
+func (s *ArchiveService) writeMaildir(msg *Message) error {
+	name := maildirFilename()
+	tmpPath := filepath.Join(s.path, "tmp", name)
+
+	if err := writeFileSync(tmpPath, msg.Raw, os.O_WRONLY|os.O_CREATE|os.O_EXCL); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(s.path, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// writeMbox appends the email to the mbox file using the mboxrd format. The file is
+// locked using a lock file so other programs, such as mail clients, can read it safely.
+func (s *ArchiveService) writeMbox(msg *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	unlock, err := lockMbox(s.path)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	sender := msg.From
+
+	if len(sender) == 0 {
+		sender = "MAILER-DAEMON"
+	}
+
+	var entry bytes.Buffer
+	fmt.Fprintf(&entry, "From %s %s\n", sender, time.Now().UTC().Format("Mon Jan _2 15:04:05 2006"))
+
+	body := strings.ReplaceAll(string(msg.Raw), "\r\n", "\n")
+	entry.WriteString(archiveFromLinePattern.ReplaceAllString(body, ">$1"))
+
+	if !strings.HasSuffix(body, "\n") {
+		entry.WriteString("\n")
+	}
+
+	entry.WriteString("\n")
+	return writeFileSync(s.path, entry.Bytes(), os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+}
+
+// writeEml writes the email in a file whose path is rendered from the template. A number
+// is added to the name of the file when it already exists.
+func (s *ArchiveService) writeEml(msg *Message) error {
+	sanitized := *msg
+	sanitized.Subject = sanitizeFilename(msg.Subject, "no subject")
+	sanitized.From = sanitizeFilename(msg.From, "unknown")
+	recipient := sanitizeFilename(firstRecipient(msg), "unknown")
+
+	relativePath, err := ExecuteMessageTemplate(s.emlTemplate, &sanitized, recipient)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.path, filepath.Clean("/"+relativePath))
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	extension := filepath.Ext(path)
+	base := strings.TrimSuffix(path, extension)
+
+	for i := 1; ; i++ {
+		err = writeFileSync(path, msg.Raw, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+
+		if !os.IsExist(err) {
+			return err
+		}
+
+		path = fmt.Sprintf("%s-%d%s", base, i, extension)
+	}
+}
+
+// maildirFilename generates a unique filename for a Maildir as described in https://cr.yp.to/proto/maildir.html.
+func maildirFilename() string {
+	now := time.Now()
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&archiveDeliveries, 1), hostname)
+}
+
+// lockMbox creates the lock file of an mbox file, waiting for the lock to be released if it
+// is held by another program. It returns the function releasing the lock.
+func lockMbox(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(archiveLockTimeout)
+
+	for {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > archiveStaleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("mbox file locked: %s", lockPath)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// writeFileSync writes data in a file and flushes it to the disk.
+func writeFileSync(path string, data []byte, flag int) error {
+	file, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+
+	if _, err = writer.Write(data); err == nil {
+		if err = writer.Flush(); err == nil {
+			err = file.Sync()
+		}
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// sanitizeFilename removes the characters which aren't allowed in filenames, returning the fallback for empty names.
+func sanitizeFilename(name, fallback string) string {
+	name = strings.Trim(archiveFilenameCharacter.ReplaceAllString(name, "_"), " .")
+
+	if len(name) == 0 {
+		return fallback
+	}
+
+	return truncateString(name, 100)
+}
+
+// parseArchiveNotifyURL converts URLs in the form maildir://path, mbox://path or eml://path into
+// flags, the scheme being the format of the archive.
+func parseArchiveNotifyURL(u *notifyURL) (map[string]string, error) {
+	path, err := u.location()
+	if err != nil || len(path) == 0 {
+		return nil, errors.New("archive url is invalid, expected maildir:///path")
+	}
+
+	return map[string]string{archiveFormatFlag: u.scheme, archivePathFlag: path}, nil
+}
+
+// archiveCLIFlags returns the flags used for configuring the archive of the emails.
+func archiveCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    archiveFormatFlag,
+			Usage:   "The format in which the emails are archived, either 'maildir', 'mbox' or 'eml'",
+			EnvVars: []string{archiveFormatEnv},
+		},
+		&cli.StringFlag{
+			Name:    archivePathFlag,
+			Usage:   "The Maildir directory, mbox file or base directory of the .eml files in which the emails are archived",
+			EnvVars: []string{archivePathEnv},
+		},
+		&cli.StringFlag{
+			Name:    archiveEmlTemplateFlag,
+			Value:   "{{.Date}}/{{.Subject}}.eml",
+			Usage:   "Template of the path of the .eml files, relative to the archive path (Optional)",
+			EnvVars: []string{archiveEmlTemplateEnv},
+		},
+	}
+}
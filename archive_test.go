@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArchiveService(t *testing.T) {
+	raw := "Subject: Backup done\r\n\r\nBackup succeeded\r\nFrom the NAS\r\n"
+
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flags   map[string]string
+			wantErr string
+		}{
+			{"With missing path", map[string]string{archiveFormatFlag: archiveFormatMaildir}, "archive path not set"},
+			{"With missing format", map[string]string{archivePathFlag: t.TempDir()}, "archive format not set"},
+			{"With invalid format", map[string]string{archivePathFlag: t.TempDir(), archiveFormatFlag: "foo"}, "archive format is invalid: foo"},
+			{"With invalid template", map[string]string{archivePathFlag: t.TempDir(), archiveFormatFlag: archiveFormatEml,
+				archiveEmlTemplateFlag: "{{.Subject"}, "template: archive-eml-template:1: unclosed action"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := (&ArchiveService{}).Init(test.flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Maildir", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Maildir")
+		service := &ArchiveService{}
+
+		if err := service.Init(map[string]string{archiveFormatFlag: archiveFormatMaildir, archivePathFlag: path}); err != nil {
+			t.Fatalf("Could not start archive service: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := service.Send(context.Background(), &Message{Raw: []byte(raw)}); err != nil {
+				t.Fatalf("Error while we weren't supposed to get any: %v", err)
+			}
+		}
+
+		files, _ := os.ReadDir(filepath.Join(path, "new"))
+		tmpFiles, _ := os.ReadDir(filepath.Join(path, "tmp"))
+
+		if len(files) != 2 || len(tmpFiles) != 0 {
+			t.Fatalf("Expected 2 emails in new and none in tmp, got %d and %d", len(files), len(tmpFiles))
+		}
+
+		if _, err := os.Stat(filepath.Join(path, "cur")); err != nil {
+			t.Errorf("The cur directory wasn't created: %v", err)
+		}
+
+		content, _ := os.ReadFile(filepath.Join(path, "new", files[0].Name()))
+		assertMessageContent(t, t.Name(), string(content), raw)
+	})
+
+	t.Run("Mbox", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "mail", "tegami.mbox")
+		service := &ArchiveService{}
+
+		if err := service.Init(map[string]string{archiveFormatFlag: archiveFormatMbox, archivePathFlag: path}); err != nil {
+			t.Fatalf("Could not start archive service: %v", err)
+		}
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := service.Send(context.Background(), &Message{From: "nas@example.com", Raw: []byte(raw)}); err != nil {
+					t.Errorf("Error while we weren't supposed to get any: %v", err)
+				}
+			}()
+		}
+
+		wg.Wait()
+		content, _ := os.ReadFile(path)
+		entries := strings.Split(string(content), "From nas@example.com ")
+
+		if len(entries) != 6 {
+			t.Fatalf("Expected 5 emails in the mbox file, got %d", len(entries)-1)
+		}
+
+		entry := entries[1][strings.Index(entries[1], "\n")+1:]
+		assertMessageContent(t, t.Name(), entry, "Subject: Backup done\n\nBackup succeeded\n>From the NAS\n\n")
+
+		if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+			t.Errorf("The lock file wasn't removed")
+		}
+	})
+
+	t.Run("Mbox locked by another program", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tegami.mbox")
+		service := &ArchiveService{}
+
+		if err := service.Init(map[string]string{archiveFormatFlag: archiveFormatMbox, archivePathFlag: path}); err != nil {
+			t.Fatalf("Could not start archive service: %v", err)
+		}
+
+		os.WriteFile(path+".lock", nil, 0600)
+
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			os.Remove(path + ".lock")
+		}()
+
+		if err := service.Send(context.Background(), &Message{Raw: []byte(raw)}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		content, _ := os.ReadFile(path)
+
+		if !strings.HasPrefix(string(content), "From MAILER-DAEMON ") {
+			t.Errorf("Unexpected mbox content: %q", content)
+		}
+	})
+
+	t.Run("Eml", func(t *testing.T) {
+		path := t.TempDir()
+		service := &ArchiveService{}
+		flags := map[string]string{archiveFormatFlag: archiveFormatEml, archivePathFlag: path}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start archive service: %v", err)
+		}
+
+		date := time.Date(2021, 10, 2, 15, 4, 5, 0, time.UTC)
+		messages := []*Message{
+			{Subject: "Backup: done/failed", Date: date, Raw: []byte(raw)},
+			{Subject: "Backup: done/failed", Date: date, Raw: []byte(raw)},
+			{Subject: "../..", Date: date, Raw: []byte(raw)},
+		}
+
+		for _, msg := range messages {
+			if err := service.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Error while we weren't supposed to get any: %v", err)
+			}
+		}
+
+		for _, name := range []string{"Backup_ done_failed.eml", "Backup_ done_failed-1.eml", "_.eml"} {
+			content, err := os.ReadFile(filepath.Join(path, "2021-10-02", name))
+
+			if err != nil {
+				t.Fatalf("Could not read archived email: %v", err)
+			}
+
+			assertMessageContent(t, t.Name(), string(content), raw)
+		}
+	})
+
+	t.Run("Without original email", func(t *testing.T) {
+		service := &ArchiveService{}
+		service.Init(map[string]string{archiveFormatFlag: archiveFormatEml, archivePathFlag: t.TempDir()})
+		err := service.Send(context.Background(), &Message{})
+		assertErrorContent(t, err.Error(), "archive requires the original email")
+	})
+}
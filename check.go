@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// ConfigCheck is the result of validating a part of the configuration.
+type ConfigCheck struct {
+	Name string
+	Err  error
+}
+
+// checkConfigCommand returns the command validating the configuration and the credentials of the services.
+func checkConfigCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "check-config",
+		Usage:     "Validates the configuration and the credentials of the services without sending any email",
+		UsageText: "tegami [options] check-config",
+		Description: "Each configured service is initialized and probed, Telegram for example verifying that the bot " +
+			"can access its chat. The exit code is not zero when a problem is found.",
+		Action: handleCheckConfig,
+	}
+}
+
+// handleCheckConfig is the action of the check-config command, printing a report of the checks.
+func handleCheckConfig(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	flags := RetrieveFlags(c)
+	settings := checkSettings(flags)
+	templates := checkTemplatesAndRoutes(flags)
+	services := checkServices(ctx, flags)
+	notifyServices := checkNotifyServices(ctx, splitNotifyURLs(c.StringSlice(notifyFlag)))
+
+	if len(services) == 0 && len(notifyServices) == 0 {
+		services = append(services, ConfigCheck{Name: "Services", Err: errors.New("no messaging service is configured")})
+	}
+
+	problems := printConfigChecks(c.App.Writer, "Settings", settings)
+	problems += printConfigChecks(c.App.Writer, "Templates and routes", templates)
+	problems += printConfigChecks(c.App.Writer, "Services", services)
+	problems += printConfigChecks(c.App.Writer, "Notification URLs", notifyServices)
+
+	if problems > 0 {
+		return cli.Exit("The configuration is invalid", 1)
+	}
+
+	fmt.Fprintln(c.App.Writer, "The configuration is valid")
+	return nil
+}
+
+// checkSettings validates the settings of the SMTP server, the queue and the HTTP endpoints.
+func checkSettings(flags map[string]string) []ConfigCheck {
+	return []ConfigCheck{
+		{"SMTP server", checkPort(flags[smtpPortFlag], "smtp port")},
+		{"SMTP TLS certificate", checkSmtpTlsConfig(flags)},
+		{"Shutdown timeout", checkShutdownTimeout(flags)},
+		{"Queue", checkDeliveryQueue(flags)},
+		{"SMTP transcript", checkTranscriptRecorder(flags)},
+		{"HTTP server", checkHttpServer(flags)},
+		{"Health checks", checkHealthProbeInterval(flags)},
+		{"Web UI", checkWebUi(flags)},
+		{"Admin API", checkAdminApi(flags)},
+	}
+}
+
+// checkTemplatesAndRoutes compiles the templates and the routes of the services which are configured,
+// each flag being reported on its own line.
+func checkTemplatesAndRoutes(flags map[string]string) []ConfigCheck {
+	var checks []ConfigCheck
+
+	for _, definition := range serviceDefinitions {
+		if len(definition.missingFlags(flags)) == len(definition.Required) {
+			continue
+		}
+
+		for _, name := range definition.Templates {
+			if len(flags[name]) > 0 {
+				_, err := ParseMessageTemplate(name, flags[name])
+				checks = append(checks, ConfigCheck{Name: name, Err: err})
+			}
+		}
+
+		for _, flag := range definition.Flags() {
+			if name := flag.Names()[0]; strings.HasSuffix(name, "-routes") && len(flags[name]) > 0 {
+				_, err := ParseRoutes(flags[name])
+				checks = append(checks, ConfigCheck{Name: name, Err: err})
+			}
+		}
+	}
+
+	return checks
+}
+
+// checkServices initializes and probes the services configured by the flags. The services which
+// aren't configured at all are skipped.
+func checkServices(ctx context.Context, flags map[string]string) []ConfigCheck {
+	var checks []ConfigCheck
+
+	for _, definition := range serviceDefinitions {
+		service, err := definition.createService(flags)
+
+		if err == nil && service == nil {
+			continue
+		}
+
+		checks = append(checks, checkService(ctx, definition.Name, definition, service, err))
+	}
+
+	return checks
+}
+
+// checkNotifyServices initializes and probes the services described by notification URLs. The URLs
+// aren't printed since they contain the credentials of the services.
+func checkNotifyServices(ctx context.Context, urls []string) []ConfigCheck {
+	var checks []ConfigCheck
+
+	for i, rawUrl := range urls {
+		name := fmt.Sprintf("URL %d", i+1)
+		definition, flags, err := notifyServiceFlags(rawUrl)
+		var service Service
+
+		if err == nil {
+			name = fmt.Sprintf("URL %d (%s)", i+1, definition.Name)
+			service, err = definition.initService(flags)
+		}
+
+		checks = append(checks, checkService(ctx, name, definition, service, err))
+	}
+
+	return checks
+}
+
+// checkService probes a service which was initialized, then closes it.
+func checkService(ctx context.Context, name string, definition *ServiceDefinition, service Service, initErr error) ConfigCheck {
+	if initErr != nil {
+		if definition != nil {
+			// The name of the service is already part of the check.
+			initErr = errors.New(strings.TrimPrefix(initErr.Error(), definition.Name+": "))
+		}
+		return ConfigCheck{Name: name, Err: initErr}
+	}
+
+	defer closeServices([]Service{service})
+	err := probeService(ctx, service)
+
+	if errors.Is(err, errNoProbe) {
+		// The service was initialized, which is all that can be verified without sending a message.
+		err = nil
+	}
+
+	return ConfigCheck{Name: name, Err: err}
+}
+
+// checkPort validates a TCP port.
+func checkPort(value, name string) error {
+	port, err := parseOptionalInt(value, 0)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("%s is invalid", name)
+	}
+	return nil
+}
+
+func checkSmtpTlsConfig(flags map[string]string) error {
+	_, err := loadSmtpTlsConfig(flags)
+	return err
+}
+
+func checkShutdownTimeout(flags map[string]string) error {
+	timeout, err := parseOptionalInt(flags[shutdownTimeoutFlag], 30)
+	if err != nil || timeout < 0 {
+		return errors.New("shutdown timeout is invalid")
+	}
+	return nil
+}
+
+func checkDeliveryQueue(flags map[string]string) error {
+	queue, err := createDeliveryQueue(flags)
+	if queue != nil {
+		queue.Shutdown(context.Background())
+	}
+	return err
+}
+
+func checkTranscriptRecorder(flags map[string]string) error {
+	_, err := createTranscriptRecorder(flags)
+	return err
+}
+
+func checkHttpServer(flags map[string]string) error {
+	return checkPort(flags[httpPortFlag], "http port")
+}
+
+func checkHealthProbeInterval(flags map[string]string) error {
+	_, err := parseHealthProbeInterval(flags)
+	return err
+}
+
+func checkWebUi(flags map[string]string) error {
+	_, err := parseWebUiHistory(flags)
+	return err
+}
+
+func checkAdminApi(flags map[string]string) error {
+	return validateAdminApi(flags)
+}
+
+// printConfigChecks writes the results of a group of checks, returning the number of problems found.
+func printConfigChecks(w io.Writer, group string, checks []ConfigCheck) int {
+	if len(checks) == 0 {
+		return 0
+	}
+
+	problems := 0
+	fmt.Fprintf(w, "%s:\n", group)
+
+	for _, check := range checks {
+		if check.Err != nil {
+			problems++
+			fmt.Fprintf(w, "  [FAIL] %s: %v\n", check.Name, check.Err)
+		} else {
+			fmt.Fprintf(w, "  [OK]   %s\n", check.Name)
+		}
+	}
+
+	return problems
+}
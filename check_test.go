@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigCommand(t *testing.T) {
+	setupTestLogging(t, map[string]string{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/bot%s/getChat", telegramBotToken), func(w http.ResponseWriter, r *http.Request) {
+		var params map[string]string
+		json.NewDecoder(r.Body).Decode(&params)
+
+		if params["chat_id"] != telegramRoom {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"ok": false, "error_code": 400, "description": "Bad Request: chat not found"}`)
+			return
+		}
+
+		io.WriteString(w, `{"ok": true, "result": {"id": 123456, "type": "group", "title": "Ops"}}`)
+	})
+	_, server := createStubTelegramBotServer(t, mux)
+	defer server.Close()
+
+	telegramArgs := []string{"tegami", "--telegram-api-url", server.URL, "--telegram-token", telegramBotToken}
+
+	t.Run("Valid configuration", func(t *testing.T) {
+		output, exitCode := runCheckConfig(t, append(telegramArgs, "--telegram-chat-id", telegramRoom, "check-config"))
+
+		if exitCode != 0 || !strings.Contains(output, "[OK]   Telegram") || !strings.Contains(output, "The configuration is valid") {
+			t.Errorf("Expected the configuration valid, got %d %q", exitCode, output)
+		}
+	})
+
+	t.Run("Web UI", func(t *testing.T) {
+		args := append(telegramArgs, "--telegram-chat-id", telegramRoom, "--web-ui", "true", "--web-ui-history", "5", "--admin-token", testAdminToken, "check-config")
+		output, exitCode := runCheckConfig(t, args)
+
+		if exitCode != 0 || !strings.Contains(output, "[OK]   Web UI") {
+			t.Errorf("Expected the web UI valid, got %d %q", exitCode, output)
+		}
+
+		if messageHistory.capacity != 0 {
+			t.Errorf("Expected the message history left untouched, got a capacity of %d", messageHistory.capacity)
+		}
+	})
+
+	t.Run("Admin token without queue", func(t *testing.T) {
+		output, exitCode := runCheckConfig(t, append(telegramArgs, "--telegram-chat-id", telegramRoom, "--admin-token", testAdminToken, "check-config"))
+
+		if exitCode != 1 || !strings.Contains(output, "[FAIL] Admin API: admin api requires the queue retries") {
+			t.Errorf("Expected the admin token reported, got %d %q", exitCode, output)
+		}
+	})
+
+	t.Run("Wrong chat id", func(t *testing.T) {
+		output, exitCode := runCheckConfig(t, append(telegramArgs, "--telegram-chat-id", "42", "check-config"))
+
+		if exitCode != 1 || !strings.Contains(output, "[FAIL] Telegram: chat 42: telegram: chat not found (400)") {
+			t.Errorf("Expected the chat reported, got %d %q", exitCode, output)
+		}
+	})
+
+	t.Run("Invalid settings", func(t *testing.T) {
+		args := []string{"tegami", "--queue-retries", "-1", "--http-port", "http", "--notify", "tgram://s3cr3t", "check-config"}
+		output, exitCode := runCheckConfig(t, args)
+
+		for _, line := range []string{"[FAIL] Queue: queue retries is invalid", "[FAIL] HTTP server: http port is invalid",
+			"[OK]   Web UI", "[FAIL] URL 1: telegram url is invalid"} {
+			if !strings.Contains(output, line) {
+				t.Errorf("Expected the report to contain %q, got %q", line, output)
+			}
+		}
+
+		if exitCode != 1 || strings.Contains(output, "s3cr3t") {
+			t.Errorf("Expected a failure without the URL printed, got %d %q", exitCode, output)
+		}
+	})
+
+	t.Run("Revoked token", func(t *testing.T) {
+		args := []string{"tegami", "--telegram-api-url", server.URL, "--telegram-token", "999:revoked", "--telegram-chat-id", telegramRoom, "check-config"}
+		output, exitCode := runCheckConfig(t, args)
+
+		if exitCode != 1 || !strings.Contains(output, "[FAIL] Telegram: ") || strings.Contains(output, "The configuration is valid") {
+			t.Errorf("Expected the token reported, got %d %q", exitCode, output)
+		}
+	})
+
+	t.Run("Broken template and route", func(t *testing.T) {
+		args := []string{"tegami", "--google-chat-webhook-url", server.URL, "--google-chat-thread-key", "{{.Subject",
+			"--google-chat-routes", "alerts@example.com=" + server.URL + "/alerts,oops", "check-config"}
+		output, exitCode := runCheckConfig(t, args)
+
+		for _, line := range []string{"Templates and routes:",
+			"[FAIL] google-chat-thread-key: template: google-chat-thread-key:1: unclosed action",
+			"[FAIL] google-chat-routes: invalid route: oops"} {
+			if !strings.Contains(output, line) {
+				t.Errorf("Expected the report to contain %q, got %q", line, output)
+			}
+		}
+
+		if exitCode != 1 {
+			t.Errorf("Expected a failure, got %d", exitCode)
+		}
+	})
+
+	t.Run("TLS certificate", func(t *testing.T) {
+		certFile, keyFile := writeTestCertificate(t)
+		args := append(telegramArgs, "--telegram-chat-id", telegramRoom, "--smtp-tls-cert", certFile, "--smtp-tls-key", keyFile, "check-config")
+		output, _ := runCheckConfig(t, args)
+
+		if !strings.Contains(output, "[OK]   SMTP TLS certificate") {
+			t.Errorf("Expected the certificate loaded, got %q", output)
+		}
+
+		output, exitCode := runCheckConfig(t, append(telegramArgs, "--telegram-chat-id", telegramRoom, "--smtp-tls-cert", keyFile, "check-config"))
+
+		if exitCode != 1 || !strings.Contains(output, "[FAIL] SMTP TLS certificate: smtp tls cert and key must both be set") {
+			t.Errorf("Expected the incomplete certificate reported, got %d %q", exitCode, output)
+		}
+	})
+
+	t.Run("Without services", func(t *testing.T) {
+		output, exitCode := runCheckConfig(t, []string{"tegami", "check-config"})
+
+		if exitCode != 1 || !strings.Contains(output, "[FAIL] Services: no messaging service is configured") {
+			t.Errorf("Expected the missing services reported, got %d %q", exitCode, output)
+		}
+	})
+}
+
+// runCheckConfig runs the application, returning its output and its exit code.
+func runCheckConfig(t *testing.T, args []string) (string, int) {
+	t.Helper()
+	exitCode := 0
+	cli.OsExiter = func(code int) { exitCode = code }
+	t.Cleanup(func() { cli.OsExiter = os.Exit })
+
+	var stdout bytes.Buffer
+	app := newApp()
+	app.Writer = &stdout
+	app.ErrWriter = &bytes.Buffer{}
+	app.Run(args)
+
+	return stdout.String(), exitCode
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	debugOutputFlag = "debug-output"
+	debugOutputEnv  = "TEGAMI_DEBUG_OUTPUT"
+)
+
+// DebugService writes each message as a JSON object on its own line, either on the standard
+// output or in a file. It doesn't need any account, which is useful for testing the devices
+// sending emails or for collecting the emails using existing log pipelines.
+type DebugService struct {
+	writer io.Writer
+	file   *os.File
+	mutex  sync.Mutex
+}
+
+// debugDocument is the JSON object written for a message.
+type debugDocument struct {
+	Received    time.Time             `json:"received"`
+	DurationMs  float64               `json:"duration_ms"`
+	From        string                `json:"from"`
+	To          []string              `json:"to"`
+	Subject     string                `json:"subject"`
+	Date        time.Time             `json:"date"`
+	Headers     map[string][]string   `json:"headers"`
+	HTML        string                `json:"html"`
+	Markdown    string                `json:"markdown"`
+	Attachments []debugAttachmentInfo `json:"attachments"`
+}
+
+type debugAttachmentInfo struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Debug",
+		Prefix:   "debug",
+		Flags:    debugCLIFlags,
+		Required: [][]string{{debugOutputFlag}},
+		New:      func() Service { return &DebugService{} },
+		Schemes:  []string{"debug"},
+		ParseURL: parseDebugNotifyURL,
+	})
+}
+
+func (s *DebugService) Init(flags map[string]string) error {
+	output := flags[debugOutputFlag]
+
+	switch output {
+	case "":
+		return errors.New("debug output not set")
+	case "-", "stdout":
+		s.writer = os.Stdout
+	default:
+		if isOfflineInit(flags) {
+			s.writer = io.Discard
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(output), 0700); err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+
+		s.file = file
+		s.writer = file
+	}
+
+	return nil
+}
+
+func (s *DebugService) Send(_ context.Context, msg *Message) error {
+	line, err := json.Marshal(createDebugDocument(msg))
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (s *DebugService) Render(msg *Message) (string, string, error) {
+	return renderJSON(createDebugDocument(msg))
+}
+
+func (s *DebugService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *DebugService) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
+
+func createDebugDocument(msg *Message) *debugDocument {
+	document := &debugDocument{
+		Received:    msg.Received,
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		Date:        msg.Date,
+		Headers:     map[string][]string{},
+		HTML:        msg.HTML,
+		Markdown:    msg.Markdown,
+		Attachments: []debugAttachmentInfo{},
+	}
+
+	if !msg.Received.IsZero() {
+		document.DurationMs = float64(time.Since(msg.Received).Microseconds()) / 1000
+	}
+
+	if document.To == nil {
+		document.To = []string{}
+	}
+
+	fields := msg.Header.Fields()
+
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		document.Headers[fields.Key()] = append(document.Headers[fields.Key()], value)
+	}
+
+	for _, attachment := range msg.Attachments {
+		document.Attachments = append(document.Attachments, debugAttachmentInfo{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        len(attachment.Data),
+		})
+	}
+
+	return document
+}
+
+// parseDebugNotifyURL converts URLs in the form debug:///path/to/file into flags, writing on the
+// standard output when no path is given.
+func parseDebugNotifyURL(u *notifyURL) (map[string]string, error) {
+	output, err := u.location()
+	if err != nil {
+		return nil, errors.New("debug url is invalid, expected debug:///path/to/file")
+	}
+
+	if len(output) == 0 {
+		output = "-"
+	}
+
+	return map[string]string{debugOutputFlag: output}, nil
+}
+
+// debugCLIFlags returns the flags used for configuring the output of the messages as JSON lines.
+func debugCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    debugOutputFlag,
+			Usage:   "Writes each message as a JSON line in this file, or on the standard output when set to '-'",
+			EnvVars: []string{debugOutputEnv},
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDebugService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			output  string
+			wantErr string
+		}{
+			{"With standard output", "-", ""},
+			{"With file", filepath.Join(t.TempDir(), "tegami.jsonl"), ""},
+			{"With missing directory", filepath.Join(t.TempDir(), "logs", "tegami.jsonl"), ""},
+			{"With missing output", "", "debug output not set"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				service := &DebugService{}
+				err := service.Init(map[string]string{debugOutputFlag: test.output})
+				assertInitError(t, err, test.wantErr)
+				service.Close()
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tegami.jsonl")
+		service := &DebugService{}
+
+		if err := service.Init(map[string]string{debugOutputFlag: path}); err != nil {
+			t.Fatalf("Could not start debug service: %v", err)
+		}
+
+		raw := "Subject: Backup done\r\nFrom: NAS <nas@example.com>\r\nDate: Sat, 02 Oct 2021 15:04:05 +0000\r\n" +
+			"Content-Type: text/html\r\n\r\nBackup <b>succeeded</b>\r\n"
+		msg, err := ProcessMessage(strings.NewReader(raw))
+
+		if err != nil {
+			t.Fatalf("Could not process message: %v", err)
+		}
+
+		msg.From = "nas@example.com"
+		msg.To = []string{"admin@example.com"}
+		msg.Attachments = []*Attachment{{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report")}}
+
+		for i := 0; i < 2; i++ {
+			if err = service.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Error while we weren't supposed to get any: %v", err)
+			}
+		}
+
+		service.Close()
+		file, _ := os.Open(path)
+		defer file.Close()
+
+		var documents []debugDocument
+		scanner := bufio.NewScanner(file)
+
+		for scanner.Scan() {
+			var document debugDocument
+			if err = json.Unmarshal(scanner.Bytes(), &document); err != nil {
+				t.Fatalf("Invalid JSON line %q: %v", scanner.Text(), err)
+			}
+			documents = append(documents, document)
+		}
+
+		if len(documents) != 2 {
+			t.Fatalf("Expected 2 lines, got %d", len(documents))
+		}
+
+		document := documents[0]
+		assertMessageContent(t, t.Name(), document.Subject, "Backup done")
+		assertMessageContent(t, t.Name(), document.From, "nas@example.com")
+		assertMessageContent(t, t.Name(), fmt.Sprint(document.To), "[admin@example.com]")
+		assertMessageContent(t, t.Name(), fmt.Sprint(document.Headers["From"]), "[NAS <nas@example.com>]")
+		assertMessageContent(t, t.Name(), document.HTML, "Backup <b>succeeded</b>")
+		assertMessageContent(t, t.Name(), document.Markdown, "Backup **succeeded**")
+		assertMessageContent(t, t.Name(), fmt.Sprint(document.Attachments), "[{report.txt text/plain 6}]")
+
+		if document.Received.IsZero() || document.DurationMs <= 0 {
+			t.Errorf("Unexpected reception time %v and duration %v", document.Received, document.DurationMs)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/urfave/cli/v2"
+	"net/http"
+	"net/url"
+)
+
+const (
+	discordWebhookUrlFlag = "discord-webhook-url"
+	discordUsernameFlag   = "discord-username"
+	discordWebhookUrlEnv  = "TEGAMI_DISCORD_WEBHOOK_URL"
+	discordUsernameEnv    = "TEGAMI_DISCORD_USERNAME"
+)
+
+// The limits of the embeds of Discord.
+const (
+	discordMaxTitleLength       = 256
+	discordMaxDescriptionLength = 4096
+)
+
+// DiscordService manages Discord related components.
+type DiscordService struct {
+	client     *http.Client
+	webhookUrl string
+	username   string
+}
+
+type discordPayload struct {
+	Username string         `json:"username,omitempty"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Footer      *discordFooter `json:"footer,omitempty"`
+}
+
+type discordFooter struct {
+	Text string `json:"text"`
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Discord",
+		Prefix:   "discord",
+		Flags:    discordCLIFlags,
+		Required: [][]string{{discordWebhookUrlFlag}},
+		Secrets:  []string{discordWebhookUrlFlag},
+		New:      func() Service { return &DiscordService{} },
+		Schemes:  []string{"discord"},
+		ParseURL: parseDiscordNotifyURL,
+	})
+}
+
+func (s *DiscordService) Init(flags map[string]string) error {
+	webhookUrl := flags[discordWebhookUrlFlag]
+
+	if len(webhookUrl) == 0 {
+		return errors.New("discord webhook url not set")
+	}
+
+	if _, err := url.ParseRequestURI(webhookUrl); err != nil {
+		return errors.New("discord webhook url is invalid")
+	}
+
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.webhookUrl = webhookUrl
+	s.username = flags[discordUsernameFlag]
+	return nil
+}
+
+func (s *DiscordService) Send(ctx context.Context, msg *Message) error {
+	return postJSON(ctx, s.client, s.webhookUrl, nil, createDiscordPayload(msg, s.username), nil)
+}
+
+func (s *DiscordService) Render(msg *Message) (string, string, error) {
+	return renderJSON(createDiscordPayload(msg, s.username))
+}
+
+func (s *DiscordService) IsMarkdownService() bool {
+	return true
+}
+
+func (s *DiscordService) Close() error {
+	return nil
+}
+
+// createDiscordPayload creates the embed sent to Discord for a message.
+func createDiscordPayload(msg *Message, username string) *discordPayload {
+	embed := discordEmbed{
+		Title:       truncateString(msg.Subject, discordMaxTitleLength),
+		Description: truncateString(msg.Markdown, discordMaxDescriptionLength),
+	}
+
+	if sender := msg.Sender(); len(sender) > 0 {
+		embed.Footer = &discordFooter{Text: sender}
+	}
+
+	return &discordPayload{Username: username, Embeds: []discordEmbed{embed}}
+}
+
+// parseDiscordNotifyURL converts URLs in the form discord://webhook-id/webhook-token into flags.
+func parseDiscordNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 || len(u.segments) != 1 {
+		return nil, errors.New("discord url is invalid, expected discord://webhook-id/webhook-token")
+	}
+
+	webhookUrl := "https://discord.com/api/webhooks/" + url.PathEscape(u.host) + "/" + url.PathEscape(u.segments[0])
+	return map[string]string{discordWebhookUrlFlag: webhookUrl}, nil
+}
+
+// discordCLIFlags returns the flags used for configuring Discord.
+func discordCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    discordWebhookUrlFlag,
+			Usage:   "The Discord webhook url receiving the messages",
+			EnvVars: []string{discordWebhookUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    discordUsernameFlag,
+			Usage:   "The name of the webhook shown in the messages, the one configured in Discord being used if not set (Optional)",
+			EnvVars: []string{discordUsernameEnv},
+		},
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestDiscordService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flags   map[string]string
+			wantErr string
+		}{
+			{"With valid arguments", map[string]string{discordWebhookUrlFlag: "https://discord.com/api/webhooks/1/abc"}, ""},
+			{"With missing webhook url", map[string]string{}, "discord webhook url not set"},
+			{"With invalid webhook url", map[string]string{discordWebhookUrlFlag: "foo"}, "discord webhook url is invalid"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := (&DiscordService{}).Init(test.flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		var payload discordPayload
+		srv := createStubWebhookServer(t, &payload, http.StatusNoContent)
+		defer srv.Close()
+
+		service := &DiscordService{}
+		if err := service.Init(map[string]string{discordWebhookUrlFlag: srv.URL, discordUsernameFlag: "tegami"}); err != nil {
+			t.Fatalf("Could not start Discord service: %v", err)
+		}
+
+		msg := &Message{From: "nas@example.com", Subject: "Backup done", Markdown: "Backup **succeeded**"}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		embed := payload.Embeds[0]
+		assertMessageContent(t, t.Name(), payload.Username, "tegami")
+		assertMessageContent(t, t.Name(), embed.Title, "Backup done")
+		assertMessageContent(t, t.Name(), embed.Description, "Backup **succeeded**")
+		assertMessageContent(t, t.Name(), embed.Footer.Text, "nas@example.com")
+	})
+}
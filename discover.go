@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/tucnak/telebot.v2"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	discoverDurationFlag = "duration"
+	discoverWriteFlag    = "write"
+)
+
+// TelegramChat is a chat in which the bot was messaged or added.
+type TelegramChat struct {
+	ID    int64
+	Type  string
+	Title string
+}
+
+// telegramCommand returns the commands helping with the setup of Telegram.
+func telegramCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "telegram",
+		Usage: "Helps with the setup of Telegram",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "discover",
+				Usage:     "Prints the ids of the chats in which the bot is messaged or added",
+				UsageText: "tegami --telegram-token <token> telegram discover [--duration seconds] [--write path]",
+				Description: "The bot listens for updates for a while, during which it can be messaged directly or added " +
+					"to a group or a channel. Each chat is printed as a TEGAMI_TELEGRAM_CHAT_ID line ready to be " +
+					"copied in the environment of Tegami, or written in an environment file with --write.",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: discoverDurationFlag, Value: 60, Usage: "The number of seconds during which the bot listens for updates"},
+					&cli.StringFlag{Name: discoverWriteFlag, Usage: "The environment file, as used by Docker, in which the chosen chat id is written"},
+				},
+				Action: handleTelegramDiscover,
+			},
+		},
+	}
+}
+
+// handleTelegramDiscover is the action of the telegram discover command. Each chat is printed as
+// a comment describing it followed by the variable setting its id. When an environment file is
+// given, the id is written in it, the chat being chosen when several were found.
+func handleTelegramDiscover(c *cli.Context) error {
+	token := c.String(telegramTokenFlag)
+	if len(token) == 0 {
+		return errors.New("telegram token not set")
+	}
+
+	redactor.AddSecret(token)
+	duration := c.Int(discoverDurationFlag)
+	if duration <= 0 {
+		return errors.New("duration is invalid")
+	}
+
+	bot, err := newTelegramBot(c.String(telegramApiUrlFlag), token, false)
+	if err != nil {
+		return fmt.Errorf("the bot couldn't be started: %v", telegramError(err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(c.App.Writer, "Waiting %d seconds for @%s to be messaged or added to a chat...\n", duration, bot.Me.Username)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(duration)*time.Second)
+	defer cancel()
+
+	chats := discoverTelegramChats(ctx, bot, func(chat TelegramChat) {
+		fmt.Fprintf(c.App.Writer, "# %s %s\n%s=%d\n", chat.Type, chat.Title, telegramChatIdEnv, chat.ID)
+	})
+
+	if len(chats) == 0 {
+		return errors.New("no chat found, message the bot or add it to a chat while it is listening")
+	}
+
+	envFile := c.String(discoverWriteFlag)
+	if len(envFile) == 0 {
+		return nil
+	}
+
+	chat, err := chooseTelegramChat(c.App.Reader, c.App.Writer, chats)
+	if err != nil {
+		return err
+	}
+
+	if err = writeEnvFile(envFile, telegramChatIdEnv, strconv.FormatInt(chat.ID, 10)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.App.Writer, "%s=%d written to %s\n", telegramChatIdEnv, chat.ID, envFile)
+	return nil
+}
+
+// discoverTelegramChats listens for the updates of the bot until the context is done, returning
+// the chats in which the bot was messaged or added. Each chat is reported once when it is found.
+func discoverTelegramChats(ctx context.Context, bot *telebot.Bot, found func(TelegramChat)) []TelegramChat {
+	updates := make(chan telebot.Update, 100)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// The poller stops after its current request, which may take the duration of its timeout.
+	go bot.Poller.Poll(bot, updates, stop)
+
+	var chats []TelegramChat
+	seen := make(map[int64]bool)
+
+	for {
+		select {
+		case update := <-updates:
+			chat := updateChat(update)
+
+			if chat != nil && !seen[chat.ID] {
+				seen[chat.ID] = true
+				telegramChat := newTelegramChat(chat)
+				chats = append(chats, telegramChat)
+				found(telegramChat)
+			}
+		case <-ctx.Done():
+			return chats
+		}
+	}
+}
+
+// updateChat returns the chat of a message or of a change of the membership of the bot, or nil for
+// the other updates.
+func updateChat(update telebot.Update) *telebot.Chat {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat
+	case update.EditedMessage != nil:
+		return update.EditedMessage.Chat
+	case update.ChannelPost != nil:
+		return update.ChannelPost.Chat
+	case update.MyChatMember != nil:
+		return &update.MyChatMember.Chat
+	default:
+		return nil
+	}
+}
+
+// newTelegramChat describes a chat, private chats being titled with the name of the user.
+func newTelegramChat(chat *telebot.Chat) TelegramChat {
+	title := chat.Title
+
+	if len(title) == 0 {
+		title = strings.TrimSpace(chat.FirstName + " " + chat.LastName)
+	}
+
+	if len(chat.Username) > 0 {
+		title = strings.TrimSpace(title + " (@" + chat.Username + ")")
+	}
+
+	// The title is printed in a comment, which a line break would end.
+	return TelegramChat{ID: chat.ID, Type: string(chat.Type), Title: strings.Join(strings.Fields(title), " ")}
+}
+
+// chooseTelegramChat asks which chat to use when several were found.
+func chooseTelegramChat(r io.Reader, w io.Writer, chats []TelegramChat) (TelegramChat, error) {
+	if len(chats) == 1 {
+		return chats[0], nil
+	}
+
+	for i, chat := range chats {
+		fmt.Fprintf(w, "%d) %s %s\n", i+1, chat.Type, chat.Title)
+	}
+
+	fmt.Fprintf(w, "Chat to use [1-%d]: ", len(chats))
+	line, err := bufio.NewReader(r).ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		return TelegramChat{}, err
+	}
+
+	choice, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || choice < 1 || choice > len(chats) {
+		return TelegramChat{}, errors.New("chat choice is invalid")
+	}
+
+	return chats[choice-1], nil
+}
+
+// writeEnvFile sets a variable in an environment file, replacing its existing value or adding it
+// at the end. The other lines are kept as is and the file is created when it doesn't exist.
+func writeEnvFile(path, key, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var lines []string
+	replaced := false
+
+	if content := strings.TrimRight(string(data), "\n"); len(content) > 0 {
+		lines = strings.Split(content, "\n")
+	}
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		variable := strings.TrimPrefix(trimmed, "export ")
+
+		if strings.HasPrefix(variable, key+"=") {
+			lines[i] = strings.TrimSuffix(trimmed, variable) + key + "=" + value
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		lines = append(lines, key+"="+value)
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTelegramDiscoverCommand(t *testing.T) {
+	setupTestLogging(t, map[string]string{})
+	var once sync.Once
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/bot%s/getUpdates", telegramBotToken), func(w http.ResponseWriter, r *http.Request) {
+		updates := "[]"
+
+		once.Do(func() {
+			updates = `[
+				{"update_id": 1, "message": {"message_id": 1, "chat": {"id": 42, "type": "private", "first_name": "Ada", "username": "ada"}, "text": "hi"}},
+				{"update_id": 2, "my_chat_member": {"chat": {"id": -1001234, "type": "supergroup", "title": "Ops"}, "from": {"id": 42}, "date": 0}},
+				{"update_id": 3, "message": {"message_id": 2, "chat": {"id": 42, "type": "private", "first_name": "Ada", "username": "ada"}, "text": "again"}}
+			]`
+		})
+
+		if updates == "[]" {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		io.WriteString(w, `{"ok": true, "result": `+updates+`}`)
+	})
+	_, server := createStubTelegramBotServer(t, mux)
+	defer server.Close()
+
+	envFile := filepath.Join(t.TempDir(), "tegami.env")
+	os.WriteFile(envFile, []byte("TEGAMI_TELEGRAM_TOKEN=abc123\nTEGAMI_TELEGRAM_CHAT_ID=1\n"), 0600)
+
+	var stdout bytes.Buffer
+	app := newApp()
+	app.Writer = &stdout
+	app.Reader = strings.NewReader("2\n")
+	err := app.Run([]string{"tegami", "--telegram-api-url", server.URL, "--telegram-token", telegramBotToken,
+		"telegram", "discover", "--duration", "1", "--write", envFile})
+
+	if err != nil {
+		t.Fatalf("Could not discover the chats: %v", err)
+	}
+
+	output := stdout.String()
+
+	if strings.Count(output, "# private Ada (@ada)\nTEGAMI_TELEGRAM_CHAT_ID=42\n") != 1 || !strings.Contains(output, "# supergroup Ops\nTEGAMI_TELEGRAM_CHAT_ID=-1001234\n") {
+		t.Errorf("Expected each chat printed once, got %q", output)
+	}
+
+	if data, _ := os.ReadFile(envFile); string(data) != "TEGAMI_TELEGRAM_TOKEN=abc123\nTEGAMI_TELEGRAM_CHAT_ID=-1001234\n" {
+		t.Errorf("Expected the chosen chat id written, got %q", data)
+	}
+}
+
+func TestWriteEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tegami.env")
+
+	if err := writeEnvFile(path, telegramChatIdEnv, "42"); err != nil {
+		t.Fatalf("Could not create the file: %v", err)
+	}
+
+	writeEnvFile(path, telegramTokenEnv, "abc123")
+
+	if data, _ := os.ReadFile(path); string(data) != "TEGAMI_TELEGRAM_CHAT_ID=42\nTEGAMI_TELEGRAM_TOKEN=abc123\n" {
+		t.Errorf("Expected the variables added, got %q", data)
+	}
+
+	os.WriteFile(path, []byte("# Tegami\nexport TEGAMI_TELEGRAM_CHAT_ID=1\nTEGAMI_TELEGRAM_TOKEN=abc123\n"), 0600)
+	writeEnvFile(path, telegramChatIdEnv, "42")
+
+	if data, _ := os.ReadFile(path); string(data) != "# Tegami\nexport TEGAMI_TELEGRAM_CHAT_ID=42\nTEGAMI_TELEGRAM_TOKEN=abc123\n" {
+		t.Errorf("Expected only the chat id replaced, got %q", data)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	execCommandFlag            = "exec-command"
+	execBodyFormatFlag         = "exec-body-format"
+	execTimeoutFlag            = "exec-timeout"
+	execConcurrencyFlag        = "exec-concurrency"
+	execTemporaryExitCodesFlag = "exec-temporary-exit-codes"
+	execCommandEnv             = "TEGAMI_EXEC_COMMAND"
+	execBodyFormatEnv          = "TEGAMI_EXEC_BODY_FORMAT"
+	execTimeoutEnv             = "TEGAMI_EXEC_TIMEOUT"
+	execConcurrencyEnv         = "TEGAMI_EXEC_CONCURRENCY"
+	execTemporaryExitCodesEnv  = "TEGAMI_EXEC_TEMPORARY_EXIT_CODES"
+)
+
+// execMaxStderrLength is the maximum number of characters of the error output of the command written in the logs.
+const execMaxStderrLength = 2048
+
+// ExecService runs a command for each message. The body of the message is written on the
+// standard input of the command and the other values of the message are available in
+// environment variables. The attachments are written in a temporary directory.
+type ExecService struct {
+	command            string
+	markdown           bool
+	timeout            time.Duration
+	slots              chan struct{}
+	temporaryExitCodes map[int]bool
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Exec",
+		Prefix:   "exec",
+		Flags:    execCLIFlags,
+		Required: [][]string{{execCommandFlag}},
+		New:      func() Service { return &ExecService{} },
+		Schemes:  []string{"exec"},
+		ParseURL: parseExecNotifyURL,
+	})
+}
+
+func (s *ExecService) Init(flags map[string]string) error {
+	s.command = flags[execCommandFlag]
+
+	if len(s.command) == 0 {
+		return errors.New("exec command not set")
+	}
+
+	switch strings.ToLower(flags[execBodyFormatFlag]) {
+	case "", "markdown":
+		s.markdown = true
+	case "html":
+		s.markdown = false
+	default:
+		return fmt.Errorf("exec body format is invalid: %s", flags[execBodyFormatFlag])
+	}
+
+	timeout, err := parseOptionalInt(flags[execTimeoutFlag], 30)
+	if err != nil || timeout <= 0 {
+		return errors.New("exec timeout is invalid")
+	}
+
+	concurrency, err := parseOptionalInt(flags[execConcurrencyFlag], 4)
+	if err != nil || concurrency <= 0 {
+		return errors.New("exec concurrency is invalid")
+	}
+
+	temporaryExitCodes := flags[execTemporaryExitCodesFlag]
+
+	if len(temporaryExitCodes) == 0 {
+		temporaryExitCodes = "75"
+	}
+
+	s.temporaryExitCodes = make(map[int]bool)
+
+	for _, value := range splitList(temporaryExitCodes) {
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("exec temporary exit code is invalid: %s", value)
+		}
+		s.temporaryExitCodes[code] = true
+	}
+
+	s.timeout = time.Duration(timeout) * time.Second
+	s.slots = make(chan struct{}, concurrency)
+	return nil
+}
+
+// Send runs the command for the message. Exit codes listed as temporary and timeouts result in
+// a TemporaryError while the other non-zero exit codes result in a permanent error.
+func (s *ExecService) Send(ctx context.Context, msg *Message) error {
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		return &TemporaryError{Err: ctx.Err()}
+	}
+
+	env, attachmentDir, err := createExecEnv(msg)
+
+	if len(attachmentDir) > 0 {
+		defer os.RemoveAll(attachmentDir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The error output is written in a file rather than a pipe so waiting for the command
+	// doesn't depend on the processes it started in the background.
+	stderr, err := os.CreateTemp("", "tegami-stderr-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Env = append(execEnviron(), env...)
+	cmd.Stdin = strings.NewReader(s.body(msg))
+	cmd.Stderr = stderr
+	err = cmd.Run()
+
+	if output, readErr := os.ReadFile(stderr.Name()); readErr == nil && len(strings.TrimSpace(string(output))) > 0 {
+		msg.Logger().Warn("Exec command error output", "stderr", truncateString(strings.TrimSpace(string(output)), execMaxStderrLength))
+	}
+
+	if ctx.Err() != nil {
+		return &TemporaryError{Err: fmt.Errorf("exec command stopped: %v", ctx.Err())}
+	}
+
+	var exitError *exec.ExitError
+
+	if errors.As(err, &exitError) {
+		code := exitError.ExitCode()
+		err = fmt.Errorf("exec command failed with exit code %d", code)
+
+		if s.temporaryExitCodes[code] {
+			return &TemporaryError{Err: err}
+		}
+	}
+
+	return err
+}
+
+func (s *ExecService) Render(msg *Message) (string, string, error) {
+	if s.markdown {
+		return "Markdown", s.body(msg), nil
+	}
+	return "HTML", s.body(msg), nil
+}
+
+// body returns the body of the message given to the command on its standard input.
+func (s *ExecService) body(msg *Message) string {
+	if s.markdown {
+		return formatMarkdownMessage(msg)
+	}
+	return msg.HTML
+}
+
+func (s *ExecService) IsMarkdownService() bool {
+	return s.markdown
+}
+
+func (s *ExecService) Close() error {
+	return nil
+}
+
+// execEnviron returns the environment of Tegami without its own variables, so the command doesn't
+// see the secrets configuring the services nor the admin token.
+func execEnviron() []string {
+	var environ []string
+
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "TEGAMI_") {
+			environ = append(environ, variable)
+		}
+	}
+
+	return environ
+}
+
+// createExecEnv returns the environment variables describing a message. The attachments are
+// written in a temporary directory which is returned along with the variables.
+func createExecEnv(msg *Message) ([]string, string, error) {
+	messageId, _ := msg.Header.MessageID()
+	env := []string{
+		"TEGAMI_SUBJECT=" + msg.Subject,
+		"TEGAMI_FROM=" + msg.From,
+		"TEGAMI_TO=" + strings.Join(msg.To, ","),
+		"TEGAMI_SENDER=" + msg.Sender(),
+		"TEGAMI_RECIPIENTS=" + msg.Recipients(),
+		"TEGAMI_DATE=" + msg.Date.Format(time.RFC3339),
+		"TEGAMI_MESSAGE_ID=" + messageId,
+		"TEGAMI_ATTACHMENT_COUNT=" + strconv.Itoa(len(msg.Attachments)),
+	}
+
+	if len(msg.Attachments) == 0 {
+		return env, "", nil
+	}
+
+	attachmentDir, err := os.MkdirTemp("", "tegami-attachments-*")
+	if err != nil {
+		return nil, "", err
+	}
+
+	for i, attachment := range msg.Attachments {
+		filename := sanitizeFilename(attachment.Filename, fmt.Sprintf("attachment-%d", i+1))
+		path := filepath.Join(attachmentDir, filename)
+
+		if _, err = os.Stat(path); err == nil {
+			path = filepath.Join(attachmentDir, fmt.Sprintf("%d-%s", i+1, filename))
+		}
+
+		if err = os.WriteFile(path, attachment.Data, 0600); err != nil {
+			return nil, attachmentDir, err
+		}
+	}
+
+	return append(env, "TEGAMI_ATTACHMENT_DIR="+attachmentDir), attachmentDir, nil
+}
+
+// parseExecNotifyURL converts URLs in the form exec:///path/to/command into flags.
+func parseExecNotifyURL(u *notifyURL) (map[string]string, error) {
+	command, err := u.location()
+	if err != nil || len(command) == 0 {
+		return nil, errors.New("exec url is invalid, expected exec:///path/to/command")
+	}
+
+	return map[string]string{execCommandFlag: command}, nil
+}
+
+// execCLIFlags returns the flags used for configuring the command run for each message.
+func execCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    execCommandFlag,
+			Usage:   "The shell command run for each message, receiving the body of the message on its standard input",
+			EnvVars: []string{execCommandEnv},
+		},
+		&cli.StringFlag{
+			Name:    execBodyFormatFlag,
+			Value:   "markdown",
+			Usage:   "The format of the body written on the standard input, either 'markdown' or 'html' (Optional)",
+			EnvVars: []string{execBodyFormatEnv},
+		},
+		&cli.StringFlag{
+			Name:    execTimeoutFlag,
+			Value:   "30",
+			Usage:   "The number of seconds after which the command is stopped (Optional)",
+			EnvVars: []string{execTimeoutEnv},
+		},
+		&cli.StringFlag{
+			Name:    execConcurrencyFlag,
+			Value:   "4",
+			Usage:   "The maximum number of commands running at the same time (Optional)",
+			EnvVars: []string{execConcurrencyEnv},
+		},
+		&cli.StringFlag{
+			Name:    execTemporaryExitCodesFlag,
+			Value:   "75",
+			Usage:   "The exit codes meaning that the message can be sent again later, separated by commas (Optional)",
+			EnvVars: []string{execTemporaryExitCodesEnv},
+		},
+	}
+}
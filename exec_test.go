@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With valid arguments", "", "", ""},
+			{"With missing command", execCommandFlag, "", "exec command not set"},
+			{"With invalid body format", execBodyFormatFlag, "foo", "exec body format is invalid: foo"},
+			{"With invalid timeout", execTimeoutFlag, "0", "exec timeout is invalid"},
+			{"With invalid concurrency", execConcurrencyFlag, "foo", "exec concurrency is invalid"},
+			{"With invalid exit codes", execTemporaryExitCodesFlag, "75,foo", "exec temporary exit code is invalid: foo"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := map[string]string{execCommandFlag: "cat"}
+				if len(test.flag) > 0 {
+					flags[test.flag] = test.value
+				}
+
+				err := (&ExecService{}).Init(flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "output")
+		command := fmt.Sprintf(`{ cat; echo; echo "$TEGAMI_SUBJECT|$TEGAMI_FROM|$TEGAMI_TO|$TEGAMI_ATTACHMENT_COUNT"; `+
+			`cat "$TEGAMI_ATTACHMENT_DIR/report.txt"; } > %s`, output)
+
+		service := &ExecService{}
+		if err := service.Init(map[string]string{execCommandFlag: command}); err != nil {
+			t.Fatalf("Could not start exec service: %v", err)
+		}
+
+		msg := &Message{
+			From:        "nas@example.com",
+			To:          []string{"admin@example.com", "alerts@example.com"},
+			Subject:     "Backup done",
+			Markdown:    "Backup **succeeded**",
+			Attachments: []*Attachment{{Filename: "report.txt", Data: []byte("report")}},
+		}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		content, _ := os.ReadFile(output)
+		assertMessageContent(t, t.Name(), string(content),
+			"**Backup done**\n\nBackup **succeeded**\nBackup done|nas@example.com|admin@example.com,alerts@example.com|1\nreport")
+	})
+
+	t.Run("Without the configuration of Tegami", func(t *testing.T) {
+		t.Setenv(telegramTokenEnv, "123:secret")
+		t.Setenv("PATH_FOR_TEST", "kept")
+		output := filepath.Join(t.TempDir(), "output")
+
+		service := &ExecService{}
+		service.Init(map[string]string{execCommandFlag: fmt.Sprintf(`echo "$TEGAMI_TELEGRAM_TOKEN|$PATH_FOR_TEST|$TEGAMI_SUBJECT" > %s`, output)})
+
+		if err := service.Send(context.Background(), &Message{Subject: "Backup done"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		content, _ := os.ReadFile(output)
+		assertMessageContent(t, t.Name(), string(content), "|kept|Backup done\n")
+	})
+
+	t.Run("Exit codes", func(t *testing.T) {
+		var tests = []struct {
+			name          string
+			command       string
+			wantErr       string
+			wantTemporary bool
+		}{
+			{"With success", "exit 0", "", false},
+			{"With permanent failure", "echo failed >&2; exit 1", "exec command failed with exit code 1", false},
+			{"With temporary failure", "exit 75", "exec command failed with exit code 75", true},
+			{"With timeout", "sleep 5", "exec command stopped: context deadline exceeded", true},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				service := &ExecService{}
+				if err := service.Init(map[string]string{execCommandFlag: test.command, execTimeoutFlag: "1"}); err != nil {
+					t.Fatalf("Could not start exec service: %v", err)
+				}
+
+				err := service.Send(context.Background(), &Message{})
+				assertInitError(t, err, test.wantErr)
+
+				if IsTemporaryError(err) != test.wantTemporary {
+					t.Errorf("Unexpected temporary error: %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("Error output logged", func(t *testing.T) {
+		logs := setupTestLogging(t, map[string]string{})
+		service := &ExecService{}
+		if err := service.Init(map[string]string{execCommandFlag: "echo 'disk full' >&2; exit 1"}); err != nil {
+			t.Fatalf("Could not start exec service: %v", err)
+		}
+
+		service.Send(context.Background(), &Message{ID: "5f0c3d1e2a4b6c7d", SessionID: "0123456789abcdef"})
+
+		if output := logs.String(); !strings.Contains(output, `stderr="disk full"`) || !strings.Contains(output, "message=5f0c3d1e2a4b6c7d") ||
+			!strings.Contains(output, "session=0123456789abcdef") {
+			t.Errorf("Expected the error output logged with the message, got %s", output)
+		}
+	})
+
+	t.Run("Concurrency limit", func(t *testing.T) {
+		service := &ExecService{}
+		if err := service.Init(map[string]string{execCommandFlag: "sleep 0.3", execConcurrencyFlag: "2"}); err != nil {
+			t.Fatalf("Could not start exec service: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		start := time.Now()
+
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				service.Send(context.Background(), &Message{})
+			}()
+		}
+
+		wg.Wait()
+
+		if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+			t.Errorf("Commands weren't limited, ran in %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"net/http"
+	"net/url"
+	"text/template"
+)
+
+const (
+	googleChatWebhookUrlFlag = "google-chat-webhook-url"
+	googleChatThreadKeyFlag  = "google-chat-thread-key"
+	googleChatRoutesFlag     = "google-chat-routes"
+	googleChatWebhookUrlEnv  = "TEGAMI_GOOGLE_CHAT_WEBHOOK_URL"
+	googleChatThreadKeyEnv   = "TEGAMI_GOOGLE_CHAT_THREAD_KEY"
+	googleChatRoutesEnv      = "TEGAMI_GOOGLE_CHAT_ROUTES"
+)
+
+// googleChatMaxTextLength keeps the card below the 32 KB limit of Google Chat messages.
+const googleChatMaxTextLength = 25000
+
+// googleChatHTML is the subset of HTML supported by the text paragraphs of Google Chat cards.
+var googleChatHTML = &htmlSubset{
+	tags: map[string]string{
+		"b": "b", "strong": "b", "h1": "b", "h2": "b", "h3": "b", "h4": "b", "h5": "b", "h6": "b", "th": "b",
+		"i": "i", "em": "i", "cite": "i",
+		"u": "u", "ins": "u",
+		"s": "s", "strike": "s", "del": "s",
+	},
+	lineBreak: "<br>",
+}
+
+// GoogleChatService manages Google Chat related components.
+type GoogleChatService struct {
+	client     *http.Client
+	webhookUrl string
+	threadKey  *template.Template
+	routes     Routes
+}
+
+type googleChatPayload struct {
+	CardsV2 []googleChatCardWithId `json:"cardsV2"`
+	Thread  *googleChatThread      `json:"thread,omitempty"`
+}
+
+type googleChatCardWithId struct {
+	CardId string         `json:"cardId"`
+	Card   googleChatCard `json:"card"`
+}
+
+type googleChatCard struct {
+	Header   googleChatCardHeader    `json:"header"`
+	Sections []googleChatCardSection `json:"sections"`
+}
+
+type googleChatCardHeader struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle,omitempty"`
+}
+
+type googleChatCardSection struct {
+	Widgets []googleChatWidget `json:"widgets"`
+}
+
+type googleChatWidget struct {
+	TextParagraph googleChatTextParagraph `json:"textParagraph"`
+}
+
+type googleChatTextParagraph struct {
+	Text string `json:"text"`
+}
+
+type googleChatThread struct {
+	ThreadKey string `json:"threadKey"`
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:      "Google Chat",
+		Prefix:    "google-chat",
+		Flags:     googleChatCLIFlags,
+		Required:  [][]string{{googleChatWebhookUrlFlag}},
+		Secrets:   []string{googleChatWebhookUrlFlag, googleChatRoutesFlag},
+		Templates: []string{googleChatThreadKeyFlag},
+		New:       func() Service { return &GoogleChatService{} },
+		Schemes:   []string{"gchat"},
+		ParseURL:  parseGoogleChatNotifyURL,
+	})
+}
+
+func (s *GoogleChatService) Init(flags map[string]string) error {
+	webhookUrl := flags[googleChatWebhookUrlFlag]
+
+	if len(webhookUrl) == 0 {
+		return errors.New("google chat webhook url not set")
+	}
+
+	if _, err := url.ParseRequestURI(webhookUrl); err != nil {
+		return errors.New("google chat webhook url is invalid")
+	}
+
+	routes, err := ParseRoutes(flags[googleChatRoutesFlag])
+	if err != nil {
+		return err
+	}
+
+	if threadKey := flags[googleChatThreadKeyFlag]; len(threadKey) > 0 {
+		s.threadKey, err = ParseMessageTemplate(googleChatThreadKeyFlag, threadKey)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.webhookUrl = webhookUrl
+	s.routes = routes
+	return nil
+}
+
+func (s *GoogleChatService) Send(ctx context.Context, msg *Message) error {
+	webhookUrls := s.routes.Match(msg.To)
+
+	if len(webhookUrls) == 0 {
+		webhookUrls = []string{s.webhookUrl}
+	}
+
+	payload, err := s.payload(msg)
+	if err != nil {
+		return err
+	}
+
+	return sendToEach(len(webhookUrls), func(i int) error {
+		requestUrl := webhookUrls[i]
+
+		if payload.Thread != nil {
+			var err error
+			requestUrl, err = addQueryParameter(requestUrl, "messageReplyOption", "REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return postJSON(ctx, s.client, requestUrl, nil, payload, nil)
+	})
+}
+
+func (s *GoogleChatService) Render(msg *Message) (string, string, error) {
+	payload, err := s.payload(msg)
+	if err != nil {
+		return "", "", err
+	}
+	return renderJSON(payload)
+}
+
+// payload creates the card of a message, in the thread of its thread key if there is one.
+func (s *GoogleChatService) payload(msg *Message) (*googleChatPayload, error) {
+	payload := createGoogleChatPayload(msg)
+
+	if s.threadKey != nil {
+		threadKey, err := ExecuteMessageTemplate(s.threadKey, msg, firstRecipient(msg))
+		if err != nil {
+			return nil, err
+		}
+
+		payload.Thread = &googleChatThread{ThreadKey: threadKey}
+	}
+
+	return payload, nil
+}
+
+func (s *GoogleChatService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *GoogleChatService) Close() error {
+	return nil
+}
+
+// createGoogleChatPayload creates the card sent to Google Chat for a message.
+func createGoogleChatPayload(msg *Message) *googleChatPayload {
+	title := msg.Subject
+
+	if len(title) == 0 {
+		title = "(no subject)"
+	}
+
+	text := formatGoogleChatText(msg.HTML, googleChatMaxTextLength)
+
+	return &googleChatPayload{
+		CardsV2: []googleChatCardWithId{
+			{
+				CardId: "tegami",
+				Card: googleChatCard{
+					Header: googleChatCardHeader{Title: title, Subtitle: msg.Sender()},
+					Sections: []googleChatCardSection{
+						{Widgets: []googleChatWidget{{TextParagraph: googleChatTextParagraph{Text: text}}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// formatGoogleChatText converts the body of a message into the subset of HTML supported by Google
+// Chat, in which line breaks are explicit.
+func formatGoogleChatText(body string, maxLength int) string {
+	return formatHTMLSubset(body, maxLength, googleChatHTML)
+}
+
+// parseGoogleChatNotifyURL converts URLs in the form gchat://workspace/key/token into flags.
+func parseGoogleChatNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 || len(u.segments) != 2 {
+		return nil, errors.New("google chat url is invalid, expected gchat://workspace/key/token")
+	}
+
+	webhookUrl := fmt.Sprintf("https://chat.googleapis.com/v1/spaces/%s/messages?key=%s&token=%s",
+		url.PathEscape(u.host), url.QueryEscape(u.segments[0]), url.QueryEscape(u.segments[1]))
+	return map[string]string{googleChatWebhookUrlFlag: webhookUrl}, nil
+}
+
+// googleChatCLIFlags returns the flags used for configuring the Google Chat service.
+func googleChatCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    googleChatWebhookUrlFlag,
+			Usage:   "The Google Chat webhook url receiving the messages",
+			EnvVars: []string{googleChatWebhookUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    googleChatThreadKeyFlag,
+			Usage:   "Template of the key grouping messages in threads, for example '{{.Subject}}' (Optional)",
+			EnvVars: []string{googleChatThreadKeyEnv},
+		},
+		&cli.StringFlag{
+			Name:    googleChatRoutesFlag,
+			Usage:   "Per recipient webhook urls in the form 'recipient=url', separated by commas (Optional)",
+			EnvVars: []string{googleChatRoutesEnv},
+		},
+	}
+}
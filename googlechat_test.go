@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGoogleChatService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flags   map[string]string
+			wantErr string
+		}{
+			{"With valid arguments", map[string]string{googleChatWebhookUrlFlag: "https://example.com/webhook"}, ""},
+			{"With missing webhook url", map[string]string{}, "google chat webhook url not set"},
+			{"With invalid webhook url", map[string]string{googleChatWebhookUrlFlag: "foo"}, "google chat webhook url is invalid"},
+			{
+				"With invalid thread key",
+				map[string]string{googleChatWebhookUrlFlag: "https://example.com/webhook", googleChatThreadKeyFlag: "{{.Subject"},
+				"template: google-chat-thread-key:1: unclosed action",
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := (&GoogleChatService{}).Init(test.flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		var payload googleChatPayload
+		var query string
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &payload)
+			query = r.URL.RawQuery
+			io.WriteString(w, "{}")
+		}))
+		defer srv.Close()
+
+		service := &GoogleChatService{}
+		flags := map[string]string{
+			googleChatWebhookUrlFlag: srv.URL + "?key=abc",
+			googleChatThreadKeyFlag:  "{{.Recipient}}-{{.Subject}}",
+		}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start Google Chat service: %v", err)
+		}
+
+		msg := &Message{
+			From:    "nas@example.com",
+			To:      []string{"alerts@example.com"},
+			Subject: "Backup done",
+			HTML:    "Backup <b>succeeded</b>\nSee you tomorrow",
+		}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		card := payload.CardsV2[0].Card
+		assertMessageContent(t, t.Name(), card.Header.Title, "Backup done")
+		assertMessageContent(t, t.Name(), card.Header.Subtitle, "nas@example.com")
+		assertMessageContent(t, t.Name(), card.Sections[0].Widgets[0].TextParagraph.Text, "Backup <b>succeeded</b><br>See you tomorrow")
+		assertMessageContent(t, t.Name(), payload.Thread.ThreadKey, "alerts@example.com-Backup done")
+		assertMessageContent(t, t.Name(), query, "key=abc&messageReplyOption=REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+	})
+
+	t.Run("Send with partial failure", func(t *testing.T) {
+		delivered := createStubWebhookServer(t, nil, http.StatusOK)
+		defer delivered.Close()
+		failing := createStubWebhookServer(t, nil, http.StatusInternalServerError)
+		defer failing.Close()
+
+		service := &GoogleChatService{}
+		service.Init(map[string]string{
+			googleChatWebhookUrlFlag: delivered.URL,
+			googleChatRoutesFlag:     "ops@example.com=" + failing.URL + ",dev@example.com=" + delivered.URL,
+		})
+
+		err := service.Send(context.Background(), &Message{To: []string{"ops@example.com", "dev@example.com"}, HTML: "Backup done"})
+
+		if err == nil || IsTemporaryError(err) {
+			t.Errorf("Expected a permanent error once a webhook received the message, got %v", err)
+		}
+	})
+}
+
+func TestFormatGoogleChatText(t *testing.T) {
+	multiLine := `<html>
+<head><style>p { color: red; }</style></head>
+<body>
+  <div>
+    <p>Disk <strong>2</strong> failed</p>
+    <p>See <a href="https://nas.example.com/?a=1&amp;b=2">the NAS</a></p>
+    <ul>
+      <li>Pool degraded</li>
+      <li>Rebuild pending</li>
+    </ul>
+  </div>
+</body>
+</html>`
+
+	var tests = []struct {
+		name      string
+		body      string
+		maxLength int
+		want      string
+	}{
+		{"Plain text", "Line 1\nLine 2\n\n\n\nLine 3", 100, "Line 1<br>Line 2<br><br>Line 3"},
+		{"Multi-line HTML", multiLine, 1000, `Disk <b>2</b> failed<br><br>See <a href="https://nas.example.com/?a=1&amp;b=2">the NAS</a>` +
+			"<br><br>• Pool degraded<br>• Rebuild pending"},
+		{"Unsupported tags", `<span style="color: red">a</span> <code>b</code> <img src="x.png"> &lt;c&gt;`, 100, "a b &lt;c&gt;"},
+		{"Styles", "<em>i</em> <u>u</u> <del>s</del> <h1>Title</h1>", 100, "<i>i</i> <u>u</u> <s>s</s><br><br><b>Title</b>"},
+		{"Unclosed tags", "<b>bold <i>both</b> after", 100, "<b>bold <i>both</i></b> after"},
+		{"Truncated text", "<b>Hello &amp; welcome</b> to the NAS", 20, "<b>Hello &amp; …</b>"},
+		{"Truncated before a tag", "Hello <b>world</b>", 10, "Hello …"},
+		{"Truncated unicode", "héllo wörld", 8, "héllo w…"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertMessageContent(t, test.name, formatGoogleChatText(test.body, test.maxLength), test.want)
+		})
+	}
+}
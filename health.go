@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthProbeIntervalFlag = "health-probe-interval"
+	healthProbeIntervalEnv  = "TEGAMI_HEALTH_PROBE_INTERVAL"
+)
+
+// healthProbeTimeout is the maximum duration of the probe of a service.
+const healthProbeTimeout = 10 * time.Second
+
+// Prober is implemented by the services able to verify that they can still send messages, for
+// example by checking their credentials or their connection. Probes mustn't send any message.
+type Prober interface {
+	// Probe returns an error if the service can't send messages.
+	Probe(ctx context.Context) error
+}
+
+// errNoProbe is returned when a service can't be verified without sending a message.
+var errNoProbe = errors.New("service has no probe")
+
+// States of the services reported by the readiness endpoint.
+const (
+	serviceReady    = "ready"
+	serviceNotReady = "not_ready"
+	// serviceUnknown is the state of the services which have no probe. They don't prevent
+	// Tegami from being ready.
+	serviceUnknown = "unknown"
+)
+
+// ServiceStatus is the result of the last probe of a service.
+type ServiceStatus struct {
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	Ready   bool      `json:"ready"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// HealthChecker probes the services periodically and reports whether Tegami is able to receive
+// and send messages.
+type HealthChecker struct {
+	services []Service
+	// initErrors contains the errors of the services which couldn't be initialized.
+	initErrors []string
+	// accepting reports whether the SMTP server accepts connections.
+	accepting func() bool
+	mutex     sync.Mutex
+	statuses  []ServiceStatus
+}
+
+// NewHealthChecker creates a checker of the initialized services. The services which couldn't be
+// initialized are reported by their errors.
+func NewHealthChecker(services []Service, initErrors []error, accepting func() bool) *HealthChecker {
+	h := &HealthChecker{services: services, accepting: accepting, statuses: make([]ServiceStatus, len(services))}
+
+	for _, err := range initErrors {
+		h.initErrors = append(h.initErrors, err.Error())
+	}
+
+	for i, service := range services {
+		h.statuses[i] = ServiceStatus{Name: serviceName(service), State: serviceNotReady, Error: "not probed yet"}
+	}
+
+	return h
+}
+
+// Run probes the services at each interval until the context is done, starting immediately.
+func (h *HealthChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.ProbeServices(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ProbeServices probes each service, logging the services whose readiness changed.
+func (h *HealthChecker) ProbeServices(ctx context.Context) {
+	for i, service := range h.services {
+		status := ServiceStatus{Name: serviceName(service), State: serviceReady, Ready: true, Checked: time.Now()}
+
+		if err := probeService(ctx, service); errors.Is(err, errNoProbe) {
+			status.State = serviceUnknown
+			status.Ready = false
+		} else if err != nil {
+			status.State = serviceNotReady
+			status.Ready = false
+			status.Error = err.Error()
+		}
+
+		h.mutex.Lock()
+		previous := h.statuses[i]
+		h.statuses[i] = status
+		h.mutex.Unlock()
+
+		if status.State == serviceNotReady && (previous.State != serviceNotReady || previous.Checked.IsZero()) {
+			slog.Warn("Service is not ready", "service", status.Name, "error", status.Error)
+		} else if status.State == serviceReady && previous.State == serviceNotReady && !previous.Checked.IsZero() {
+			slog.Info("Service is ready again", "service", status.Name)
+		}
+	}
+}
+
+// probeService probes a service within the probe timeout, returning errNoProbe if it isn't a Prober.
+func probeService(ctx context.Context, service Service) error {
+	if wrapper, ok := service.(*timeoutService); ok {
+		service = wrapper.Service
+	}
+
+	prober, ok := service.(Prober)
+	if !ok {
+		return errNoProbe
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+	return prober.Probe(ctx)
+}
+
+// probeOnInit probes a service while it is initialized, within the probe timeout. A failed probe
+// doesn't prevent the service from being initialized: it is logged and the service is reported as
+// not ready until it passes the periodic probes, the messages being sent meanwhile if possible.
+// The service isn't probed when it is initialized offline.
+func probeOnInit(flags map[string]string, name string, prober Prober) {
+	if isOfflineInit(flags) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+	defer cancel()
+
+	if err := prober.Probe(ctx); err != nil {
+		slog.Warn("Service is not ready, it will be probed again", "service", name, "error", err)
+	}
+}
+
+// ReadinessReport is the document returned by the readiness endpoint.
+type ReadinessReport struct {
+	Ready      bool            `json:"ready"`
+	Smtp       bool            `json:"smtp"`
+	Services   []ServiceStatus `json:"services"`
+	InitErrors []string        `json:"init_errors,omitempty"`
+}
+
+// Readiness returns whether the SMTP server accepts connections and each service was initialized
+// and passed its last probe, the services without a probe being considered able to send messages.
+func (h *HealthChecker) Readiness() ReadinessReport {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	r := ReadinessReport{
+		Smtp:       h.accepting(),
+		Services:   append([]ServiceStatus{}, h.statuses...),
+		InitErrors: h.initErrors,
+	}
+	r.Ready = r.Smtp && len(r.InitErrors) == 0 && len(r.Services) > 0
+
+	for _, status := range r.Services {
+		r.Ready = r.Ready && status.State != serviceNotReady
+	}
+
+	return r
+}
+
+// ServeHealth answers whether the process is alive and its SMTP server accepts connections.
+func (h *HealthChecker) ServeHealth(w http.ResponseWriter, _ *http.Request) {
+	if !h.accepting() {
+		http.Error(w, "smtp server not accepting connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// ServeReadiness answers whether Tegami is able to send messages, describing each service as JSON.
+func (h *HealthChecker) ServeReadiness(w http.ResponseWriter, _ *http.Request) {
+	r := h.Readiness()
+	w.Header().Set("Content-Type", "application/json")
+
+	if !r.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(r)
+}
+
+// parseHealthProbeInterval returns the interval between the probes of the services.
+func parseHealthProbeInterval(flags map[string]string) (time.Duration, error) {
+	interval, err := parseOptionalInt(flags[healthProbeIntervalFlag], 60)
+	if err != nil || interval <= 0 {
+		return 0, errors.New("health probe interval is invalid")
+	}
+
+	return time.Duration(interval) * time.Second, nil
+}
+
+// healthCLIFlags returns the flags used for configuring the health checks.
+func healthCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    healthProbeIntervalFlag,
+			Value:   "60",
+			Usage:   "The number of seconds between the checks of the services reported by the readiness endpoint (Optional)",
+			EnvVars: []string{healthProbeIntervalEnv},
+		},
+	}
+}
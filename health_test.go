@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// probedService is a service whose probe returns an error which can be changed.
+type probedService struct {
+	RecorderService
+	probeErr error
+}
+
+func (s *probedService) Probe(_ context.Context) error {
+	return s.probeErr
+}
+
+func TestHealthChecker(t *testing.T) {
+	probed := &probedService{}
+	services := []Service{&timeoutService{Service: probed, name: "Probed"}, &RecorderService{}}
+	accepting := true
+	health := NewHealthChecker(services, nil, func() bool { return accepting })
+	server := httptest.NewServer(newHttpHandler(health, nil, nil))
+	defer server.Close()
+
+	t.Run("Before the first probe", func(t *testing.T) {
+		assertReadiness(t, server.URL, http.StatusServiceUnavailable, "not probed yet")
+	})
+
+	t.Run("With passing probes", func(t *testing.T) {
+		health.ProbeServices(context.Background())
+		report := assertReadiness(t, server.URL, http.StatusOK, "")
+
+		if report.Services[0].State != serviceReady || report.Services[1].State != serviceUnknown || report.Services[1].Ready {
+			t.Errorf("Expected the service without probe in an unknown state: %+v", report.Services)
+		}
+	})
+
+	t.Run("With failing probe", func(t *testing.T) {
+		probed.probeErr = errors.New("telegram: Unauthorized (401)")
+		health.ProbeServices(context.Background())
+		assertReadiness(t, server.URL, http.StatusServiceUnavailable, "telegram: Unauthorized (401)")
+	})
+
+	t.Run("With recovered probe", func(t *testing.T) {
+		probed.probeErr = nil
+		health.ProbeServices(context.Background())
+		assertReadiness(t, server.URL, http.StatusOK, "")
+	})
+
+	t.Run("With service not initialized", func(t *testing.T) {
+		health := NewHealthChecker(services, []error{errors.New("Telegram: telegram-chat-id not set")}, func() bool { return true })
+		health.ProbeServices(context.Background())
+		report := health.Readiness()
+
+		if report.Ready || fmt.Sprint(report.InitErrors) != "[Telegram: telegram-chat-id not set]" {
+			t.Errorf("Unexpected readiness: %+v", report)
+		}
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		assertStatus(t, server.URL+"/healthz", http.StatusOK)
+		accepting = false
+		assertStatus(t, server.URL+"/healthz", http.StatusServiceUnavailable)
+		assertReadiness(t, server.URL, http.StatusServiceUnavailable, "")
+	})
+}
+
+func TestServiceProbes(t *testing.T) {
+	t.Run("Telegram", func(t *testing.T) {
+		service, server := createStubTelegramBotServer(t, http.NewServeMux())
+		defer server.Close()
+
+		if err := service.Probe(context.Background()); err != nil {
+			t.Errorf("Unexpected probe error: %v", err)
+		}
+	})
+
+	t.Run("Telegram with revoked token", func(t *testing.T) {
+		service, server := createStubTelegramBotServer(t, http.NewServeMux())
+		server.Close()
+		mux := http.NewServeMux()
+		mux.HandleFunc(fmt.Sprintf("/bot%s/getMe", telegramBotToken), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"ok":false,"error_code":401,"description":"Unauthorized"}`)
+		})
+		server = httptest.NewServer(mux)
+		defer server.Close()
+		service.bot.URL = server.URL
+
+		if err := service.Probe(context.Background()); err == nil || IsTemporaryError(err) {
+			t.Errorf("Expected a permanent probe error, got %v", err)
+		}
+	})
+
+	t.Run("Pushover", func(t *testing.T) {
+		_, server := createStubPushoverServer(t)
+		service := &PushoverService{}
+
+		if err := service.Init(generatePushoverTestFlags(server.URL)); err != nil {
+			t.Fatalf("Could not start Pushover service: %v", err)
+		}
+
+		if err := service.Probe(context.Background()); err != nil {
+			t.Errorf("Unexpected probe error: %v", err)
+		}
+
+		server.Close()
+
+		if err := service.Probe(context.Background()); !IsTemporaryError(err) {
+			t.Errorf("Expected a temporary probe error, got %v", err)
+		}
+	})
+
+	t.Run("Pushover unreachable on init", func(t *testing.T) {
+		logs := setupTestLogging(t, map[string]string{})
+		_, server := createStubPushoverServer(t)
+		server.Close()
+		service := &PushoverService{}
+
+		if err := service.Init(generatePushoverTestFlags(server.URL)); err != nil {
+			t.Fatalf("Expected the service started despite its failed probe, got %v", err)
+		}
+
+		if output := logs.String(); !strings.Contains(output, "Service is not ready, it will be probed again") || !strings.Contains(output, "service=Pushover") {
+			t.Errorf("Expected the failed probe logged, got %s", output)
+		}
+	})
+
+	t.Run("Mattermost", func(t *testing.T) {
+		server, _ := createStubMattermostServer(t)
+		defer server.Close()
+		service := &MattermostService{}
+
+		if err := service.Init(generateMattermostTestFlags(server.URL)); err != nil {
+			t.Fatalf("Could not start Mattermost service: %v", err)
+		}
+
+		if err := service.Probe(context.Background()); err != nil {
+			t.Errorf("Unexpected probe error: %v", err)
+		}
+	})
+
+	t.Run("Mattermost with webhook", func(t *testing.T) {
+		service := &MattermostService{}
+		service.Init(map[string]string{mattermostWebhookUrlFlag: "https://example.com/hooks/abc"})
+
+		if err := probeService(context.Background(), service); !errors.Is(err, errNoProbe) {
+			t.Errorf("Expected no probe for webhooks, got %v", err)
+		}
+	})
+
+	t.Run("Rocket.Chat", func(t *testing.T) {
+		server, _, _ := createStubRocketChatServer(t)
+		defer server.Close()
+		service := &RocketChatService{}
+
+		if err := service.Init(generateRocketChatTestFlags(server.URL)); err != nil {
+			t.Fatalf("Could not start Rocket.Chat service: %v", err)
+		}
+
+		if err := service.Probe(context.Background()); err != nil {
+			t.Errorf("Unexpected probe error: %v", err)
+		}
+	})
+
+	t.Run("Service without probe", func(t *testing.T) {
+		if err := probeService(context.Background(), &RecorderService{}); !errors.Is(err, errNoProbe) {
+			t.Errorf("Expected no probe, got %v", err)
+		}
+	})
+
+	t.Run("IRC not connected", func(t *testing.T) {
+		err := (&IrcService{}).Probe(context.Background())
+		assertErrorContent(t, fmt.Sprint(err), "irc server not connected")
+	})
+
+	t.Run("XMPP not connected", func(t *testing.T) {
+		err := (&XmppService{}).Probe(context.Background())
+		assertErrorContent(t, fmt.Sprint(err), "xmpp server not connected")
+	})
+}
+
+// initAndProbe initializes a service and probes it, returning the first error. The error of the
+// probe isn't returned by Init, which only logs it.
+func initAndProbe(service Service, flags map[string]string) error {
+	if err := service.Init(flags); err != nil {
+		return err
+	}
+
+	if err := probeService(context.Background(), service); !errors.Is(err, errNoProbe) {
+		return err
+	}
+
+	return nil
+}
+
+// assertReadiness checks the status of the readiness endpoint and the error of the first service.
+func assertReadiness(t *testing.T, url string, wantStatus int, wantError string) ReadinessReport {
+	t.Helper()
+	resp, err := http.Get(url + "/readyz")
+
+	if err != nil {
+		t.Fatalf("Could not get the readiness: %v", err)
+	}
+
+	defer resp.Body.Close()
+	var report ReadinessReport
+
+	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Could not decode the readiness: %v", err)
+	}
+
+	if resp.StatusCode != wantStatus {
+		t.Errorf("Unexpected status %d: %+v", resp.StatusCode, report)
+	}
+
+	if len(report.Services) != 2 || report.Services[0].Name != "Probed" {
+		t.Fatalf("Unexpected services: %+v", report.Services)
+	}
+
+	assertErrorContent(t, report.Services[0].Error, wantError)
+	return report
+}
+
+func assertStatus(t *testing.T, url string, wantStatus int) {
+	t.Helper()
+	resp, err := http.Get(url)
+
+	if err != nil {
+		t.Fatalf("Could not get %s: %v", url, err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != wantStatus {
+		t.Errorf("Unexpected status for %s: got %d, want %d", url, resp.StatusCode, wantStatus)
+	}
+}
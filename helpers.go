@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceHttpTimeout is the maximum duration of a request made to a third-party messaging service.
+const serviceHttpTimeout = 30 * time.Second
+
+// maxErrorBodyLength is the maximum number of bytes of a response body included in an error.
+const maxErrorBodyLength = 512
+
+// postJSON sends the payload encoded as JSON to a url. The response is decoded into the response
+// argument if it is not nil. It returns an error if the server didn't answer with a successful status code.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, payload interface{}, response interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	return doRequest(client, req, response)
+}
+
+// renderJSON encodes the payload of a service as indented JSON, for the Render method of the
+// services. The HTML characters aren't escaped so the payload stays readable.
+func renderJSON(payload interface{}) (string, string, error) {
+	var body strings.Builder
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(payload); err != nil {
+		return "", "", err
+	}
+
+	return "JSON", strings.TrimSuffix(body.String(), "\n"), nil
+}
+
+// doRequest executes an HTTP request and decodes its JSON response into the response argument
+// if it is not nil. It returns an error if the server didn't answer with a successful status code,
+// which is temporary when the server couldn't be reached, is rate limiting or has an internal issue.
+func doRequest(client *http.Client, req *http.Request, response interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return &TemporaryError{Err: err}
+	}
+
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError(resp.StatusCode, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, truncateString(string(respBody), maxErrorBodyLength)))
+	}
+
+	if response != nil {
+		return json.Unmarshal(respBody, response)
+	}
+
+	return nil
+}
+
+// statusError returns the error for an unsuccessful HTTP status code, marking it as temporary for
+// rate limiting and server errors.
+func statusError(statusCode int, err error) error {
+	if statusCode == http.StatusTooManyRequests || statusCode >= 500 {
+		return &TemporaryError{Err: err}
+	}
+	return err
+}
+
+// runWithContext runs a function of a library which doesn't support contexts, returning early
+// when the context is done. The function keeps running in the background in this case.
+func runWithContext(ctx context.Context, fn func() error) error {
+	result := make(chan error, 1)
+
+	go func() {
+		result <- fn()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return &TemporaryError{Err: ctx.Err()}
+	}
+}
+
+// sendToEach sends a message to each destination of a service, even after a failure. When the message
+// could only be sent to some of them, the error is permanent since sending the message again would
+// deliver it twice to the others. Otherwise, the error is temporary if one of the failures is.
+func sendToEach(count int, send func(i int) error) error {
+	var failures []error
+	var messages []string
+
+	for i := 0; i < count; i++ {
+		if err := send(i); err != nil {
+			failures = append(failures, err)
+			messages = append(messages, err.Error())
+		}
+	}
+
+	switch {
+	case len(failures) == 0:
+		return nil
+	case len(failures) == 1 && count == 1:
+		return failures[0]
+	case len(failures) < count:
+		return fmt.Errorf("message sent to %d of %d destinations: %s", count-len(failures), count, strings.Join(messages, "; "))
+	}
+
+	err := errors.New(strings.Join(messages, "; "))
+
+	for _, failure := range failures {
+		if IsTemporaryError(failure) {
+			return &TemporaryError{Err: err}
+		}
+	}
+
+	return err
+}
+
+// dialContext opens a connection, secured with TLS if the configuration is not nil. The deadline of
+// the connection is the earliest of the timeout and the deadline of the context. Connection failures
+// are temporary errors.
+func dialContext(ctx context.Context, network, address string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+
+	if tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, network, address)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+
+	if err != nil {
+		return nil, &TemporaryError{Err: err}
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// networkError marks the errors of a connection, such as timeouts or interrupted connections, as temporary.
+func networkError(err error) error {
+	var netError net.Error
+
+	if errors.As(err, &netError) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &TemporaryError{Err: err}
+	}
+
+	return err
+}
+
+// addQueryParameter adds a query parameter to a url.
+func addQueryParameter(rawUrl, key, value string) (string, error) {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	query := parsedUrl.Query()
+	query.Set(key, value)
+	parsedUrl.RawQuery = query.Encode()
+	return parsedUrl.String(), nil
+}
+
+// firstRecipient returns the first envelope recipient of a message.
+func firstRecipient(msg *Message) string {
+	if len(msg.To) == 0 {
+		return ""
+	}
+	return msg.To[0]
+}
+
+// formatMarkdownMessage formats a message for services supporting Markdown by
+// showing its subject as a header above its body.
+func formatMarkdownMessage(msg *Message) string {
+	if len(msg.Subject) == 0 {
+		return msg.Markdown
+	}
+
+	if len(msg.Markdown) == 0 {
+		return fmt.Sprintf("**%s**", msg.Subject)
+	}
+
+	return fmt.Sprintf("**%s**\n\n%s", msg.Subject, msg.Markdown)
+}
+
+// writeMultipartFile adds an attachment as a file field of a multipart form.
+func writeMultipartFile(writer *multipart.Writer, field string, attachment *Attachment) error {
+	filename := attachment.Filename
+
+	if len(filename) == 0 {
+		filename = "attachment"
+	}
+
+	header := make(map[string][]string)
+	header["Content-Disposition"] = []string{
+		fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, strings.ReplaceAll(filename, `"`, "")),
+	}
+	header["Content-Type"] = []string{attachment.ContentType}
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = part.Write(attachment.Data)
+	return err
+}
+
+// containsKeyword validates whether the text contains one of the keywords.
+func containsKeyword(text string, keywords []string) bool {
+	for _, keyword := range keywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitKeywords splits a comma separated list of keywords into lowercase keywords.
+func splitKeywords(value string) []string {
+	return splitList(strings.ToLower(value))
+}
+
+// splitList splits a comma separated list of values, ignoring the empty ones.
+func splitList(value string) []string {
+	var values []string
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+
+		if len(item) > 0 {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
+
+// parseOptionalInt parses an integer flag value, returning the default value if it is not set.
+func parseOptionalInt(value string, defaultValue int) (int, error) {
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseOptionalBool parses a boolean flag value, returning the default value if it is not set.
+func parseOptionalBool(value string, defaultValue bool) (bool, error) {
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// truncateString shortens the text to a maximum number of characters.
+func truncateString(text string, length int) string {
+	runes := []rune(text)
+
+	if len(runes) <= length {
+		return text
+	}
+
+	return string(runes[:length-1]) + "…"
+}
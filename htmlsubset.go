@@ -0,0 +1,287 @@
+package main
+
+import (
+	"golang.org/x/net/html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// htmlSubset describes the subset of HTML supported by a service.
+type htmlSubset struct {
+	// tags maps the HTML tags to the supported tags rendering them, the other tags being dropped.
+	tags map[string]string
+	// lineBreak replaces the newlines of the text, they are kept when it is empty.
+	lineBreak string
+}
+
+// formatHTMLSubset converts the body of a message into a subset of HTML. The newlines of the text
+// are kept as line breaks while the whitespace formatting the HTML around block elements is dropped.
+// The text is truncated to the maximum length between two tags, the tags still open being closed.
+func formatHTMLSubset(body string, maxLength int, subset *htmlSubset) string {
+	f := &htmlSubsetFormatter{subset: subset, maxLength: maxLength}
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	skipped := 0
+
+	for !f.truncated {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+
+		switch tokenType {
+		case html.TextToken:
+			if skipped == 0 {
+				f.writeText(token.Data)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch token.Data {
+			case "head", "script", "style", "title":
+				if tokenType == html.StartTagToken {
+					skipped++
+				}
+			case "br":
+				f.writeText("\n")
+			case "li":
+				f.block(token.Data)
+				f.writeText("• ")
+			case "a":
+				if href := attributeValue(token, "href"); strings.HasPrefix(href, "http") || strings.HasPrefix(href, "mailto:") {
+					f.open("a", token.Data, `<a href="`+html.EscapeString(href)+`">`)
+				}
+			default:
+				if isBlockElement(token.Data) {
+					f.block(token.Data)
+				}
+
+				if tag := subset.tags[token.Data]; len(tag) > 0 && tokenType == html.StartTagToken {
+					f.open(tag, token.Data, "<"+tag+">")
+				}
+			}
+		case html.EndTagToken:
+			switch token.Data {
+			case "head", "script", "style", "title":
+				if skipped > 0 {
+					skipped--
+				}
+			case "td", "th":
+				f.close(token.Data)
+				f.writeText(" ")
+			default:
+				f.close(token.Data)
+
+				if isBlockElement(token.Data) || token.Data == "li" {
+					f.block(token.Data)
+				}
+			}
+		}
+	}
+
+	return f.finish()
+}
+
+// htmlSubsetFormatter builds a text in a subset of HTML while tracking the tags still open.
+type htmlSubsetFormatter struct {
+	subset *htmlSubset
+	// text contains the formatted text, its line breaks being newlines until it is finished.
+	text      strings.Builder
+	length    int
+	maxLength int
+	truncated bool
+	opened    []htmlSubsetOpenTag
+	// blockStart is set when the text starts or follows a block, the whitespace formatting the HTML being dropped.
+	blockStart bool
+}
+
+type htmlSubsetOpenTag struct {
+	tag    string
+	source string
+}
+
+// writeText escapes a text, collapsing its spaces and keeping its newlines. The spaces around the
+// newlines are dropped, as the ones indenting the lines.
+func (f *htmlSubsetFormatter) writeText(text string) {
+	lines := strings.Split(text, "\n")
+
+	for i, line := range lines {
+		collapsed := strings.Join(strings.Fields(line), " ")
+
+		if i == 0 && len(line) > 0 && unicode.IsSpace(rune(line[0])) {
+			collapsed = " " + collapsed
+		}
+
+		if i == len(lines)-1 && len(line) > 0 && unicode.IsSpace(rune(line[len(line)-1])) && !strings.HasSuffix(collapsed, " ") {
+			collapsed += " "
+		}
+
+		lines[i] = collapsed
+	}
+
+	text = strings.Join(lines, "\n")
+
+	if f.blockStart || f.text.Len() == 0 {
+		text = strings.TrimLeft(text, " \n")
+	} else if current := f.text.String(); strings.HasSuffix(current, " ") || strings.HasSuffix(current, "\n") {
+		text = strings.TrimLeft(text, " ")
+	}
+
+	if len(text) == 0 {
+		return
+	}
+
+	f.blockStart = false
+	text = html.EscapeString(text)
+
+	if remaining := f.maxLength - f.closingLength() - f.length; f.textLength(text) > remaining {
+		text = f.truncateEscapedText(text, remaining)
+		f.truncated = true
+	}
+
+	f.write(text)
+}
+
+// write adds formatted text, counting its length.
+func (f *htmlSubsetFormatter) write(text string) {
+	f.text.WriteString(text)
+	f.length += f.textLength(text)
+}
+
+// open adds an opening tag if it fits, along with the closing tag, within the maximum length. The
+// text is truncated otherwise.
+func (f *htmlSubsetFormatter) open(tag, source, openingTag string) {
+	if f.length+len(openingTag)+len(tag)+3+f.closingLength() > f.maxLength {
+		f.truncated = true
+
+		if f.length+f.closingLength() < f.maxLength {
+			f.write("…")
+		}
+		return
+	}
+
+	f.write(openingTag)
+	f.opened = append(f.opened, htmlSubsetOpenTag{tag: tag, source: source})
+}
+
+// close closes the most recent tag opened by a source tag, along with the tags opened after it.
+func (f *htmlSubsetFormatter) close(source string) {
+	for i := len(f.opened) - 1; i >= 0; i-- {
+		if f.opened[i].source != source {
+			continue
+		}
+
+		for len(f.opened) > i {
+			f.write("</" + f.opened[len(f.opened)-1].tag + ">")
+			f.opened = f.opened[:len(f.opened)-1]
+		}
+		return
+	}
+}
+
+// closingLength returns the length of the closing tags of the tags still open.
+func (f *htmlSubsetFormatter) closingLength() int {
+	length := 0
+
+	for _, opened := range f.opened {
+		length += len(opened.tag) + 3
+	}
+
+	return length
+}
+
+// block ends the current line at the boundary of a block element, keeping at most one empty line
+// between paragraphs.
+func (f *htmlSubsetFormatter) block(tag string) {
+	f.blockStart = true
+	text := f.text.String()
+	trimmed := strings.TrimRight(text, " \n")
+
+	if len(trimmed) == 0 {
+		return
+	}
+
+	newlines := 1
+	if tag == "p" || tag == "div" || tag == "pre" || tag == "blockquote" || tag == "table" || strings.HasPrefix(tag, "h") {
+		newlines = 2
+	}
+
+	newlines = max(newlines, min(strings.Count(text[len(trimmed):], "\n"), 2))
+
+	f.text.Reset()
+	f.text.WriteString(trimmed)
+	f.length -= f.textLength(text[len(trimmed):])
+	f.write(strings.Repeat("\n", newlines))
+}
+
+// finish closes the tags still open and converts the newlines into line breaks.
+func (f *htmlSubsetFormatter) finish() string {
+	for len(f.opened) > 0 {
+		f.close(f.opened[len(f.opened)-1].source)
+	}
+
+	text := strings.TrimSpace(f.text.String())
+
+	for strings.Contains(text, "\n\n\n") {
+		text = strings.ReplaceAll(text, "\n\n\n", "\n\n")
+	}
+
+	if len(f.subset.lineBreak) == 0 {
+		return text
+	}
+
+	return strings.ReplaceAll(text, "\n", f.subset.lineBreak)
+}
+
+// lineBreakLength returns the number of characters of a newline once the text is finished.
+func (f *htmlSubsetFormatter) lineBreakLength() int {
+	return max(len(f.subset.lineBreak), 1)
+}
+
+// textLength returns the number of characters of a formatted text once its newlines are converted
+// into line breaks.
+func (f *htmlSubsetFormatter) textLength(text string) int {
+	return utf8.RuneCountInString(text) + strings.Count(text, "\n")*(f.lineBreakLength()-1)
+}
+
+// truncateEscapedText shortens an escaped text to a maximum number of characters, ending with an
+// ellipsis, without cutting an entity.
+func (f *htmlSubsetFormatter) truncateEscapedText(text string, length int) string {
+	if length <= 0 {
+		return ""
+	}
+
+	end, count := 0, 0
+
+	for i, r := range text {
+		size := 1
+		if r == '\n' {
+			size = f.lineBreakLength()
+		}
+
+		if count+size > length-1 {
+			break
+		}
+
+		count += size
+		end = i + utf8.RuneLen(r)
+	}
+
+	text = text[:end]
+
+	if i := strings.LastIndex(text, "&"); i >= 0 && !strings.Contains(text[i:], ";") {
+		text = text[:i]
+	}
+
+	return text + "…"
+}
+
+// isBlockElement returns whether an HTML element is a block, its boundaries being line breaks.
+func isBlockElement(tag string) bool {
+	switch tag {
+	case "p", "div", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "pre", "blockquote", "table", "ul", "ol":
+		return true
+	}
+	return false
+}
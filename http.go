@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	httpHostFlag = "http-host"
+	httpPortFlag = "http-port"
+	httpHostEnv  = "TEGAMI_HTTP_HOST"
+	httpPortEnv  = "TEGAMI_HTTP_PORT"
+)
+
+// httpShutdownTimeout is the duration given to the HTTP requests in progress to finish when stopping.
+const httpShutdownTimeout = 5 * time.Second
+
+// newHttpHandler returns the handler of the HTTP endpoints of Tegami. The admin API and the web UI
+// are only served when they are not nil.
+func newHttpHandler(health *HealthChecker, admin *AdminApi, ui *WebUi) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/healthz", health.ServeHealth)
+	mux.HandleFunc("/readyz", health.ServeReadiness)
+
+	if admin != nil {
+		admin.Register(mux)
+	}
+
+	if ui != nil {
+		ui.Register(mux)
+	}
+
+	return mux
+}
+
+// startHttpServer starts serving the HTTP endpoints when the HTTP port is set. It returns the
+// function stopping the server.
+func startHttpServer(flags map[string]string, health *HealthChecker, admin *AdminApi, ui *WebUi) (func(), error) {
+	if len(flags[httpPortFlag]) == 0 {
+		return func() {}, nil
+	}
+
+	addr := fmt.Sprintf("%s:%s", flags[httpHostFlag], flags[httpPortFlag])
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: newHttpHandler(health, admin, ui), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server stopped", "error", err)
+		}
+	}()
+
+	slog.Info("Starting HTTP server", "address", addr)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
+
+// httpCLIFlags returns the flags used for configuring the HTTP endpoints.
+func httpCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    httpHostFlag,
+			Value:   "127.0.0.1",
+			Usage:   "IP address to bind the HTTP server exposing the metrics, health checks, admin API and web UI to (Optional)",
+			EnvVars: []string{httpHostEnv},
+		},
+		&cli.StringFlag{
+			Name:    httpPortFlag,
+			Usage:   "TCP port to bind the HTTP server exposing the metrics, health checks, admin API and web UI to, the server is disabled if not set (Optional)",
+			EnvVars: []string{httpPortEnv},
+		},
+	}
+}
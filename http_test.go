@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStartHttpServer(t *testing.T) {
+	health := NewHealthChecker(nil, nil, func() bool { return true })
+	stop, err := startHttpServer(map[string]string{httpHostFlag: "127.0.0.1"}, health, nil, nil)
+
+	if err != nil || stop == nil {
+		t.Fatalf("Unexpected error with the HTTP server disabled: %v", err)
+	}
+
+	stop()
+
+	if _, err = startHttpServer(map[string]string{httpHostFlag: "127.0.0.1", httpPortFlag: "invalid"}, health, nil, nil); err == nil {
+		t.Errorf("Expected an error with an invalid port")
+	}
+
+	stop, err = startHttpServer(map[string]string{httpHostFlag: "127.0.0.1", httpPortFlag: "0"}, health, nil, nil)
+
+	if err != nil {
+		t.Fatalf("Could not start the HTTP server: %v", err)
+	}
+
+	stop()
+}
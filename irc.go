@@ -0,0 +1,824 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ircServerFlag     = "irc-server"
+	ircTlsFlag        = "irc-tls"
+	ircNicknameFlag   = "irc-nickname"
+	ircPasswordFlag   = "irc-password"
+	ircAuthMethodFlag = "irc-auth-method"
+	ircChannelsFlag   = "irc-channels"
+	ircThrottleFlag   = "irc-throttle"
+	ircRoutesFlag     = "irc-routes"
+	ircServerEnv      = "TEGAMI_IRC_SERVER"
+	ircTlsEnv         = "TEGAMI_IRC_TLS"
+	ircNicknameEnv    = "TEGAMI_IRC_NICKNAME"
+	ircPasswordEnv    = "TEGAMI_IRC_PASSWORD"
+	ircAuthMethodEnv  = "TEGAMI_IRC_AUTH_METHOD"
+	ircChannelsEnv    = "TEGAMI_IRC_CHANNELS"
+	ircThrottleEnv    = "TEGAMI_IRC_THROTTLE"
+	ircRoutesEnv      = "TEGAMI_IRC_ROUTES"
+)
+
+const (
+	ircAuthSasl     = "sasl"
+	ircAuthNickServ = "nickserv"
+)
+
+const (
+	ircTimeout           = 30 * time.Second
+	ircMinReconnectDelay = time.Second
+	ircMaxReconnectDelay = 5 * time.Minute
+	// ircMaxLineLength is the maximum length of a line, including its CRLF ending.
+	ircMaxLineLength = 512
+	// ircPrefixLength is the space kept for the prefix added by the server when relaying a
+	// message, made of the nickname, a username of up to 10 characters and a hostname of up to 63.
+	ircPrefixLength = 1 + 1 + 10 + 1 + 63 + 1
+	// ircBurst is the number of lines sent without delay before throttling.
+	ircBurst = 5
+	// ircMaxQueuedLines is the maximum number of lines kept while the server is not connected.
+	ircMaxQueuedLines = 1000
+)
+
+// IrcService manages IRC related components. A single connection is kept open with the
+// server and is reestablished whenever it is interrupted. Lines are queued and sent at a
+// limited rate, so messages received while the server is not connected are sent once the
+// connection is reestablished.
+type IrcService struct {
+	server         string
+	useTls         bool
+	nickname       string
+	password       string
+	authMethod     string
+	channels       []string
+	routes         Routes
+	throttle       time.Duration
+	tlsConfig      *tls.Config
+	reconnectDelay time.Duration
+
+	mutex  sync.Mutex
+	conn   *ircConn
+	queue  []string
+	queued chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// ircConn is a connection to an IRC server.
+type ircConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	nickname  string
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ircMessage is a line received from an IRC server.
+type ircMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+var (
+	ircEscapedPattern       = regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!~|>])")
+	ircCodePattern          = regexp.MustCompile("`([^`\n]+)`")
+	ircLinkPattern          = regexp.MustCompile(`\[([^\]\n]*)\]\(([^)\s]+)\)`)
+	ircHeadingPattern       = regexp.MustCompile(`(?m)^#{1,6}[ \t]+(.+?)[ \t#]*$`)
+	ircBoldPattern          = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	ircItalicPattern        = regexp.MustCompile(`\*([^*\s][^*\n]*)\*|\b_([^_\s][^_\n]*)_\b`)
+	ircStrikethroughPattern = regexp.MustCompile(`~~([^~\n]+)~~`)
+)
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "IRC",
+		Prefix:   "irc",
+		Flags:    ircCLIFlags,
+		Required: [][]string{{ircServerFlag}, {ircChannelsFlag, ircRoutesFlag}},
+		Secrets:  []string{ircPasswordFlag},
+		New:      func() Service { return &IrcService{} },
+		Schemes:  []string{"irc", "ircs"},
+		ParseURL: parseIrcNotifyURL,
+	})
+}
+
+func (s *IrcService) Init(flags map[string]string) error {
+	s.server = flags[ircServerFlag]
+	s.nickname = flags[ircNicknameFlag]
+	s.password = flags[ircPasswordFlag]
+	s.authMethod = strings.ToLower(flags[ircAuthMethodFlag])
+	s.channels = splitList(flags[ircChannelsFlag])
+
+	if len(s.server) == 0 {
+		return errors.New("irc server not set")
+	}
+
+	host, _, err := net.SplitHostPort(s.server)
+	if err != nil {
+		return errors.New("irc server is invalid")
+	}
+
+	if len(s.nickname) == 0 {
+		s.nickname = "tegami"
+	}
+
+	if len(s.authMethod) == 0 {
+		s.authMethod = ircAuthSasl
+	}
+
+	if s.authMethod != ircAuthSasl && s.authMethod != ircAuthNickServ {
+		return fmt.Errorf("irc auth method is invalid: %s", s.authMethod)
+	}
+
+	if s.useTls, err = parseOptionalBool(flags[ircTlsFlag], true); err != nil {
+		return errors.New("irc tls is invalid")
+	}
+
+	throttle, err := parseOptionalInt(flags[ircThrottleFlag], 2000)
+	if err != nil || throttle < 0 {
+		return errors.New("irc throttle is invalid")
+	}
+
+	routes, err := ParseRoutes(flags[ircRoutesFlag])
+	if err != nil {
+		return err
+	}
+
+	if len(s.channels) == 0 && len(routes) == 0 {
+		return errors.New("irc channels or routes not set")
+	}
+
+	s.throttle = time.Duration(throttle) * time.Millisecond
+	s.routes = routes
+	s.queued = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+
+	if s.tlsConfig == nil {
+		s.tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	if s.reconnectDelay == 0 {
+		s.reconnectDelay = ircMinReconnectDelay
+	}
+
+	if isOfflineInit(flags) {
+		return nil
+	}
+
+	return s.establish()
+}
+
+func (s *IrcService) Send(_ context.Context, msg *Message) error {
+	targets, err := s.targets(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.enqueue(s.lines(targets, msg))
+}
+
+func (s *IrcService) Render(msg *Message) (string, string, error) {
+	targets, err := s.targets(msg)
+	if err != nil {
+		return "", "", err
+	}
+
+	return "IRC", strings.Join(s.lines(targets, msg), "\n"), nil
+}
+
+// targets returns the channels or the nicknames receiving a message, the routes matching its
+// recipients having precedence over the channels.
+func (s *IrcService) targets(msg *Message) ([]string, error) {
+	targets := s.routes.Match(msg.To)
+
+	if len(targets) == 0 {
+		targets = s.channels
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("irc channel not set for the recipients")
+	}
+
+	return targets, nil
+}
+
+// lines returns the PRIVMSG commands sending a message to the targets, its text being split
+// into lines short enough to be relayed by the server.
+func (s *IrcService) lines(targets []string, msg *Message) []string {
+	text := formatIrcText(formatMarkdownMessage(msg))
+	var lines []string
+
+	for _, target := range targets {
+		prefix := fmt.Sprintf("PRIVMSG %s :", target)
+		length := ircMaxLineLength - 2 - ircPrefixLength - len(s.nickname) - len(prefix)
+
+		for _, part := range splitIrcText(text, length) {
+			lines = append(lines, prefix+part)
+		}
+	}
+
+	return lines
+}
+
+func (s *IrcService) IsMarkdownService() bool {
+	return true
+}
+
+// Probe verifies that the service is connected to the server. Messages received while it is not
+// connected are queued, but they are lost if the connection can't be reestablished.
+func (s *IrcService) Probe(_ context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		return errors.New("irc server not connected")
+	}
+
+	return nil
+}
+
+// Close disconnects from the server and stops reconnecting to it. Queued lines are discarded.
+func (s *IrcService) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.done == nil {
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+
+	if s.conn == nil {
+		return nil
+	}
+
+	fmt.Fprint(s.conn, "QUIT :Tegami stopped\r\n")
+	s.conn.close()
+	s.conn = nil
+	return nil
+}
+
+// establish connects and registers to the server, joins the channels and starts
+// sending the queued lines.
+func (s *IrcService) establish() error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range s.joinedChannels() {
+		if err = c.writeLine("JOIN " + channel); err != nil {
+			c.close()
+			return err
+		}
+	}
+
+	c.SetDeadline(time.Time{})
+	s.mutex.Lock()
+
+	if s.closed {
+		s.mutex.Unlock()
+		c.close()
+		return errors.New("irc service closed")
+	}
+
+	s.conn = c
+	s.mutex.Unlock()
+
+	go s.read(c)
+	go s.write(c)
+	return nil
+}
+
+// connect opens a connection with the server and registers the nickname, authenticating
+// using SASL if configured. The registration is completed when the server welcomes the client.
+func (s *IrcService) connect() (*ircConn, error) {
+	dialer := &net.Dialer{Timeout: ircTimeout}
+	var conn net.Conn
+	var err error
+
+	if s.useTls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.server, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.server)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ircConn{Conn: conn, reader: bufio.NewReader(conn), nickname: s.nickname, closed: make(chan struct{})}
+	c.SetDeadline(time.Now().Add(ircTimeout))
+
+	if err = s.register(c); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if s.authMethod == ircAuthNickServ && len(s.password) > 0 {
+		if err = c.writeLine(fmt.Sprintf("PRIVMSG NickServ :IDENTIFY %s %s", s.nickname, s.password)); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// register sends the registration commands and handles the replies of the server until it welcomes the client.
+func (s *IrcService) register(c *ircConn) error {
+	useSasl := s.authMethod == ircAuthSasl && len(s.password) > 0
+
+	if useSasl {
+		if err := c.writeLine("CAP REQ :sasl"); err != nil {
+			return err
+		}
+	}
+
+	if err := c.writeLine("NICK " + c.nickname); err != nil {
+		return err
+	}
+
+	if err := c.writeLine(fmt.Sprintf("USER %s 0 * :Tegami", s.nickname)); err != nil {
+		return err
+	}
+
+	for {
+		message, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch message.Command {
+		case "PING":
+			err = c.writeLine("PONG :" + message.param(0))
+		case "CAP":
+			if !useSasl {
+				break
+			}
+			switch message.param(1) {
+			case "ACK":
+				err = c.writeLine("AUTHENTICATE PLAIN")
+			case "NAK":
+				return errors.New("irc server does not support sasl")
+			}
+		case "AUTHENTICATE":
+			credentials := base64.StdEncoding.EncodeToString([]byte(s.nickname + "\x00" + s.nickname + "\x00" + s.password))
+			err = c.writeLine("AUTHENTICATE " + credentials)
+		case "903":
+			err = c.writeLine("CAP END")
+		case "902", "904", "905", "906":
+			return errors.New("irc sasl authentication failed")
+		case "432", "433":
+			c.nickname += "_"
+			err = c.writeLine("NICK " + c.nickname)
+		case "001":
+			c.nickname = message.param(0)
+			return nil
+		case "ERROR":
+			return fmt.Errorf("irc server error: %s", message.param(0))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// read handles the messages received from the server until the connection is interrupted.
+func (s *IrcService) read(c *ircConn) {
+	for {
+		message, err := c.readMessage()
+
+		if err == nil {
+			switch message.Command {
+			case "PING":
+				err = c.writeLine("PONG :" + message.param(0))
+			case "KICK":
+				if strings.EqualFold(message.param(1), c.nickname) {
+					err = c.writeLine("JOIN " + message.param(0))
+				}
+			case "NICK":
+				if strings.EqualFold(message.nickname(), c.nickname) {
+					c.nickname = message.param(0)
+				}
+			case "ERROR":
+				err = fmt.Errorf("irc server error: %s", message.param(0))
+			}
+		}
+
+		if err != nil {
+			s.disconnected(c, err)
+			return
+		}
+	}
+}
+
+// write sends the queued lines on the connection until it is interrupted. A burst of
+// lines is sent right away, then the lines are sent at the throttled rate.
+func (s *IrcService) write(c *ircConn) {
+	penalty := time.Now()
+
+	for {
+		line, ok := s.nextLine(c)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+
+		if penalty.Before(now) {
+			penalty = now
+		}
+
+		if wait := penalty.Sub(now) - (ircBurst-1)*s.throttle; wait > 0 {
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if err := c.writeLine(line); err != nil {
+			s.disconnected(c, err)
+			return
+		}
+
+		s.mutex.Lock()
+		if len(s.queue) > 0 && s.queue[0] == line {
+			s.queue = s.queue[1:]
+		}
+		s.mutex.Unlock()
+
+		penalty = penalty.Add(s.throttle)
+	}
+}
+
+// nextLine waits for a line to be queued and returns it without removing it from the queue.
+// It returns false when the connection is interrupted.
+func (s *IrcService) nextLine(c *ircConn) (string, bool) {
+	for {
+		s.mutex.Lock()
+		if len(s.queue) > 0 {
+			line := s.queue[0]
+			s.mutex.Unlock()
+			return line, true
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-c.closed:
+			return "", false
+		case <-s.queued:
+		}
+	}
+}
+
+// enqueue adds lines to the queue, discarding the oldest ones if the queue is full.
+func (s *IrcService) enqueue(lines []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return errors.New("irc service closed")
+	}
+
+	s.queue = append(s.queue, lines...)
+
+	if overflow := len(s.queue) - ircMaxQueuedLines; overflow > 0 {
+		slog.Warn("IRC queue full, discarding lines", "lines", overflow)
+		s.queue = s.queue[overflow:]
+	}
+
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// disconnected closes an interrupted connection and reconnects to the server in the background.
+func (s *IrcService) disconnected(c *ircConn, err error) {
+	c.close()
+	s.mutex.Lock()
+
+	if s.conn != c {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.conn = nil
+	closed := s.closed
+	s.mutex.Unlock()
+
+	if !closed {
+		slog.Warn("IRC connection interrupted", "error", err)
+		go s.reconnect()
+	}
+}
+
+// reconnect tries to reestablish the connection with an exponential backoff until it succeeds or the service is closed.
+func (s *IrcService) reconnect() {
+	delay := s.reconnectDelay
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(delay):
+		}
+
+		err := s.establish()
+		if err == nil {
+			return
+		}
+
+		slog.Warn("Error while reconnecting to the IRC server", "error", err)
+		delay *= 2
+
+		if delay > ircMaxReconnectDelay {
+			delay = ircMaxReconnectDelay
+		}
+	}
+}
+
+// joinedChannels returns the configured channels along with the channels used in the routes.
+func (s *IrcService) joinedChannels() []string {
+	channels := append([]string(nil), s.channels...)
+	known := make(map[string]bool)
+
+	for _, channel := range channels {
+		known[strings.ToLower(channel)] = true
+	}
+
+	for _, destination := range s.routes {
+		if isIrcChannel(destination) && !known[strings.ToLower(destination)] {
+			known[strings.ToLower(destination)] = true
+			channels = append(channels, destination)
+		}
+	}
+
+	return channels
+}
+
+func (c *ircConn) writeLine(line string) error {
+	_, err := fmt.Fprintf(c, "%s\r\n", line)
+	return err
+}
+
+func (c *ircConn) readMessage() (*ircMessage, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return parseIrcMessage(line), nil
+}
+
+func (c *ircConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.Close()
+	})
+}
+
+func (m *ircMessage) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// nickname returns the nickname of the user who sent the message.
+func (m *ircMessage) nickname() string {
+	return strings.SplitN(m.Prefix, "!", 2)[0]
+}
+
+// parseIrcMessage parses a line received from the server, ignoring its tags.
+func parseIrcMessage(line string) *ircMessage {
+	line = strings.TrimRight(line, "\r\n")
+	message := &ircMessage{}
+
+	if strings.HasPrefix(line, "@") {
+		if i := strings.Index(line, " "); i >= 0 {
+			line = strings.TrimLeft(line[i:], " ")
+		}
+	}
+
+	if strings.HasPrefix(line, ":") {
+		parts := strings.SplitN(line[1:], " ", 2)
+		message.Prefix = parts[0]
+		line = ""
+
+		if len(parts) == 2 {
+			line = strings.TrimLeft(parts[1], " ")
+		}
+	}
+
+	for len(line) > 0 {
+		if strings.HasPrefix(line, ":") {
+			message.Params = append(message.Params, line[1:])
+			break
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+
+		if len(message.Command) == 0 {
+			message.Command = strings.ToUpper(parts[0])
+		} else {
+			message.Params = append(message.Params, parts[0])
+		}
+
+		line = ""
+
+		if len(parts) == 2 {
+			line = strings.TrimLeft(parts[1], " ")
+		}
+	}
+
+	return message
+}
+
+// formatIrcText converts the Markdown formatting of a text into mIRC control codes.
+// Characters escaped by a backslash and the content of code spans are kept as is.
+func formatIrcText(markdown string) string {
+	text := ircCodePattern.ReplaceAllStringFunc(markdown, func(match string) string {
+		return "\x11" + protectIrcText(match[1:len(match)-1]) + "\x11"
+	})
+
+	text = ircEscapedPattern.ReplaceAllStringFunc(text, func(match string) string {
+		return protectIrcText(match[1:])
+	})
+
+	text = ircLinkPattern.ReplaceAllStringFunc(text, func(match string) string {
+		groups := ircLinkPattern.FindStringSubmatch(match)
+
+		if len(groups[1]) == 0 || groups[1] == groups[2] {
+			return protectIrcText(groups[2])
+		}
+
+		return groups[1] + " (" + protectIrcText(groups[2]) + ")"
+	})
+
+	text = ircHeadingPattern.ReplaceAllString(text, "\x02$1\x02")
+	text = ircBoldPattern.ReplaceAllString(text, "\x02$1$2\x02")
+	text = ircItalicPattern.ReplaceAllString(text, "\x1d$1$2\x1d")
+	text = ircStrikethroughPattern.ReplaceAllString(text, "\x1e$1\x1e")
+
+	return strings.Map(func(r rune) rune {
+		if r >= 0xE000 && r < 0xE080 {
+			return r - 0xE000
+		}
+		return r
+	}, text)
+}
+
+// protectIrcText replaces the ASCII punctuation of a text by private use characters
+// so it isn't interpreted as formatting. formatIrcText restores the original characters.
+func protectIrcText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x80 && strings.ContainsRune("\\`*_{}[]()#+-.!~|>", r) {
+			return 0xE000 + r
+		}
+		return r
+	}, text)
+}
+
+// splitIrcText splits a text into non-empty lines of a maximum length in bytes. Long
+// lines are split at the last space before the limit when possible.
+func splitIrcText(text string, length int) []string {
+	var lines []string
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		for len(line) > length {
+			cut := length
+
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+
+			if i := strings.LastIndex(line[:cut], " "); i > 0 {
+				cut = i
+			}
+
+			lines = append(lines, line[:cut])
+			line = strings.TrimLeft(line[cut:], " ")
+		}
+
+		if len(strings.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func isIrcChannel(target string) bool {
+	return strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&")
+}
+
+// parseIrcNotifyURL converts URLs in the form irc[s]://[nickname[:password]@]host[:port]/channel... into
+// flags. The channels can be written without their leading '#'.
+func parseIrcNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 || len(u.segments) == 0 {
+		return nil, errors.New("irc url is invalid, expected ircs://nickname@host/channel")
+	}
+
+	port := "6667"
+	secure := "false"
+
+	if u.scheme == "ircs" {
+		port = "6697"
+		secure = "true"
+	}
+
+	var channels []string
+
+	for _, channel := range u.segments {
+		if !strings.ContainsAny(channel[:1], "#&") {
+			channel = "#" + channel
+		}
+		channels = append(channels, channel)
+	}
+
+	flags := map[string]string{
+		ircServerFlag:   u.hostWithPort(port),
+		ircTlsFlag:      secure,
+		ircChannelsFlag: strings.Join(channels, ","),
+	}
+
+	if len(u.username) > 0 {
+		flags[ircNicknameFlag] = u.username
+		flags[ircPasswordFlag] = u.password
+	}
+
+	return flags, nil
+}
+
+// ircCLIFlags returns the flags used for configuring the IRC service.
+func ircCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    ircServerFlag,
+			Usage:   "The address of the IRC server in the form 'host:port'",
+			EnvVars: []string{ircServerEnv},
+		},
+		&cli.StringFlag{
+			Name:    ircTlsFlag,
+			Value:   "true",
+			Usage:   "Whether the connection with the IRC server is secured with TLS (Optional)",
+			EnvVars: []string{ircTlsEnv},
+		},
+		&cli.StringFlag{
+			Name:    ircNicknameFlag,
+			Value:   "tegami",
+			Usage:   "The nickname used on the IRC server (Optional)",
+			EnvVars: []string{ircNicknameEnv},
+		},
+		&cli.StringFlag{
+			Name:    ircPasswordFlag,
+			Usage:   "The password of the account registered for the nickname (Optional)",
+			EnvVars: []string{ircPasswordEnv},
+		},
+		&cli.StringFlag{
+			Name:    ircAuthMethodFlag,
+			Value:   ircAuthSasl,
+			Usage:   "The authentication method used with the password, either 'sasl' or 'nickserv' (Optional)",
+			EnvVars: []string{ircAuthMethodEnv},
+		},
+		&cli.StringFlag{
+			Name:    ircChannelsFlag,
+			Usage:   "The channels joined and receiving the messages, separated by commas. Can be left unset when routes are set",
+			EnvVars: []string{ircChannelsEnv},
+		},
+		&cli.StringFlag{
+			Name:    ircThrottleFlag,
+			Value:   "2000",
+			Usage:   "The delay in milliseconds between two lines once a burst of lines was sent (Optional)",
+			EnvVars: []string{ircThrottleEnv},
+		},
+		&cli.StringFlag{
+			Name:    ircRoutesFlag,
+			Usage:   "Per recipient channels or nicknames in the form 'recipient=channel', separated by commas (Optional)",
+			EnvVars: []string{ircRoutesEnv},
+		},
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIrcServer is a minimal IRC server recording the lines sent by the clients once registered.
+type fakeIrcServer struct {
+	listener      net.Listener
+	mutex         sync.Mutex
+	connections   []net.Conn
+	registrations int
+	lines         []fakeIrcLine
+}
+
+type fakeIrcLine struct {
+	text     string
+	received time.Time
+}
+
+func TestIrcService(t *testing.T) {
+	server := startFakeIrcServer(t)
+	defer server.listener.Close()
+
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With missing server", ircServerFlag, "", "irc server not set"},
+			{"With invalid server", ircServerFlag, "localhost", "irc server is invalid"},
+			{"With invalid auth method", ircAuthMethodFlag, "foo", "irc auth method is invalid: foo"},
+			{"With invalid tls", ircTlsFlag, "foo", "irc tls is invalid"},
+			{"With invalid throttle", ircThrottleFlag, "-1", "irc throttle is invalid"},
+			{"With invalid password", ircPasswordFlag, "foo", "irc sasl authentication failed"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := generateIrcTestFlags(server)
+				flags[test.flag] = test.value
+
+				service := &IrcService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+				err := service.Init(flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Without channels nor routes", func(t *testing.T) {
+		flags := generateIrcTestFlags(server)
+		flags[ircChannelsFlag] = ""
+		flags[ircRoutesFlag] = ""
+
+		err := (&IrcService{}).Init(flags)
+		assertInitError(t, err, "irc channels or routes not set")
+	})
+
+	t.Run("NickServ", func(t *testing.T) {
+		flags := generateIrcTestFlags(server)
+		flags[ircNicknameFlag] = "taken"
+		flags[ircAuthMethodFlag] = ircAuthNickServ
+
+		service := &IrcService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start IRC service: %v", err)
+		}
+
+		defer service.Close()
+		waitForCondition(t, "identified", func() bool {
+			return server.hasLine("PRIVMSG NickServ :IDENTIFY taken secret")
+		})
+	})
+
+	service := &IrcService{tlsConfig: &tls.Config{InsecureSkipVerify: true}, reconnectDelay: 10 * time.Millisecond}
+
+	if err := service.Init(generateIrcTestFlags(server)); err != nil {
+		t.Fatalf("Could not start IRC service: %v", err)
+	}
+
+	defer service.Close()
+
+	t.Run("Join channels", func(t *testing.T) {
+		waitForCondition(t, "channels joined", func() bool {
+			return server.hasLine("JOIN #ops") && server.hasLine("JOIN #alerts")
+		})
+		waitForCondition(t, "ping answered", func() bool { return server.hasLine("PONG :check") })
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		msg := &Message{To: []string{"admin@example.com"}, Subject: "Backup", Markdown: "Backup **done**\n\nSee `backup.log`"}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "message received", func() bool { return len(server.privateMessages("#ops")) == 3 })
+
+		lines := server.privateMessages("#ops")
+		assertMessageContent(t, t.Name(), lines[0].text, "PRIVMSG #ops :\x02Backup\x02")
+		assertMessageContent(t, t.Name(), lines[1].text, "PRIVMSG #ops :Backup \x02done\x02")
+		assertMessageContent(t, t.Name(), lines[2].text, "PRIVMSG #ops :See \x11backup.log\x11")
+	})
+
+	t.Run("Send long message", func(t *testing.T) {
+		msg := &Message{To: []string{"pager@example.com"}, Markdown: strings.Repeat("word ", 600)}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "message received", func() bool {
+			var words []string
+			for _, line := range server.privateMessages("#alerts") {
+				words = append(words, strings.Fields(strings.TrimPrefix(line.text, "PRIVMSG #alerts :"))...)
+			}
+			return len(words) == 600
+		})
+
+		lines := server.privateMessages("#alerts")
+
+		for i, line := range lines {
+			if len(line.text)+2 > ircMaxLineLength-ircPrefixLength-len("tegami") {
+				t.Errorf("Line %d is too long: %d bytes", i, len(line.text)+2)
+			}
+		}
+
+		elapsed := lines[len(lines)-1].received.Sub(lines[0].received)
+
+		if minimum := time.Duration(len(lines)-ircBurst) * 20 * time.Millisecond; elapsed < minimum-5*time.Millisecond {
+			t.Errorf("Lines weren't throttled, sent in %v", elapsed)
+		}
+	})
+
+	t.Run("Buffer while disconnected", func(t *testing.T) {
+		server.dropConnections()
+
+		if err := service.Send(context.Background(), &Message{To: []string{"admin@example.com"}, Markdown: "Reconnected"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "message received", func() bool { return server.hasLine("PRIVMSG #ops :Reconnected") })
+
+		if server.registrationCount() < 3 {
+			t.Errorf("The service didn't register again after the interruption")
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		if err := service.Close(); err != nil {
+			t.Errorf("Error while closing the service: %v", err)
+		}
+
+		waitForCondition(t, "quit", func() bool { return server.hasLine("QUIT :Tegami stopped") })
+
+		if err := service.Send(context.Background(), &Message{Markdown: "Closed"}); err == nil {
+			t.Errorf("We didn't get any error while we were supposed to get one")
+		}
+	})
+
+	t.Run("Routes only", func(t *testing.T) {
+		flags := generateIrcTestFlags(server)
+		flags[ircChannelsFlag] = ""
+
+		service := &IrcService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start IRC service: %v", err)
+		}
+
+		defer service.Close()
+		waitForCondition(t, "routed channel joined", func() bool { return server.hasLine("JOIN #alerts") })
+
+		if err := service.Send(context.Background(), &Message{To: []string{"admin@example.com"}, Markdown: "Backup done"}); err == nil {
+			t.Errorf("Expected an error for a recipient without route")
+		}
+
+		if err := service.Send(context.Background(), &Message{To: []string{"pager@example.com"}, Markdown: "Backup done"}); err != nil {
+			t.Errorf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "message received", func() bool { return server.hasLine("PRIVMSG #alerts :Backup done") })
+	})
+}
+
+func TestFormatIrcText(t *testing.T) {
+	var tests = []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{"Plain text", "Hello world", "Hello world"},
+		{"Bold", "**Hello** __world__", "\x02Hello\x02 \x02world\x02"},
+		{"Italic", "*Hello* _world_", "\x1dHello\x1d \x1dworld\x1d"},
+		{"Strikethrough", "~~Hello~~", "\x1eHello\x1e"},
+		{"Code", "Run `rm *.tmp *.log`", "Run \x11rm *.tmp *.log\x11"},
+		{"Heading", "## Report", "\x02Report\x02"},
+		{"Link", "[Dashboard](https://example.com/a_b_c)", "Dashboard (https://example.com/a_b_c)"},
+		{"Link with url as text", "[https://example.com](https://example.com)", "https://example.com"},
+		{"Escaped characters", "2 \\* 3 \\_ 4", "2 * 3 _ 4"},
+		{"Snake case", "backup_daily_job", "backup_daily_job"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertMessageContent(t, test.name, formatIrcText(test.markdown), test.want)
+		})
+	}
+}
+
+func TestSplitIrcText(t *testing.T) {
+	var tests = []struct {
+		name   string
+		text   string
+		length int
+		want   []string
+	}{
+		{"Short text", "Hello world", 20, []string{"Hello world"}},
+		{"Empty lines", "Hello\n\n\r\nworld", 20, []string{"Hello", "world"}},
+		{"Split at spaces", "Hello wonderful world", 12, []string{"Hello", "wonderful", "world"}},
+		{"Split long words", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"Split multibyte characters", "ééé", 3, []string{"é", "é", "é"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertMessageContent(t, test.name, fmt.Sprintf("%q", splitIrcText(test.text, test.length)), fmt.Sprintf("%q", test.want))
+		})
+	}
+}
+
+func startFakeIrcServer(t *testing.T) *fakeIrcServer {
+	t.Helper()
+	config := &tls.Config{Certificates: []tls.Certificate{createTestCertificate(t)}}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+
+	if err != nil {
+		t.Fatalf("Could not start IRC server: %v", err)
+	}
+
+	server := &fakeIrcServer{listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mutex.Lock()
+			server.connections = append(server.connections, conn)
+			server.mutex.Unlock()
+			go server.handle(conn)
+		}
+	}()
+
+	return server
+}
+
+func (f *fakeIrcServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var nickname string
+	var registered, userReceived, capPending bool
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		message := parseIrcMessage(line)
+
+		switch message.Command {
+		case "CAP":
+			if message.param(0) == "END" {
+				capPending = false
+			} else {
+				capPending = true
+				fmt.Fprint(conn, ":irc.example.com CAP * ACK :sasl\r\n")
+			}
+		case "AUTHENTICATE":
+			if message.param(0) == "PLAIN" {
+				fmt.Fprint(conn, "AUTHENTICATE +\r\n")
+			} else if decoded, _ := base64.StdEncoding.DecodeString(message.param(0)); string(decoded) == "tegami\x00tegami\x00secret" {
+				fmt.Fprint(conn, ":irc.example.com 903 tegami :SASL authentication successful\r\n")
+			} else {
+				fmt.Fprint(conn, ":irc.example.com 904 tegami :SASL authentication failed\r\n")
+			}
+		case "NICK":
+			if message.param(0) == "taken" {
+				fmt.Fprint(conn, ":irc.example.com 433 * taken :Nickname is already in use\r\n")
+			} else {
+				nickname = message.param(0)
+			}
+		case "USER":
+			userReceived = true
+		default:
+			f.mutex.Lock()
+			f.lines = append(f.lines, fakeIrcLine{text: strings.TrimRight(line, "\r\n"), received: time.Now()})
+			f.mutex.Unlock()
+		}
+
+		if !registered && userReceived && !capPending && len(nickname) > 0 {
+			registered = true
+			f.mutex.Lock()
+			f.registrations++
+			f.mutex.Unlock()
+			fmt.Fprintf(conn, ":irc.example.com 001 %s :Welcome\r\nPING :check\r\n", nickname)
+		}
+	}
+}
+
+func (f *fakeIrcServer) dropConnections() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range f.connections {
+		conn.Close()
+	}
+	f.connections = nil
+}
+
+func (f *fakeIrcServer) hasLine(text string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, line := range f.lines {
+		if line.text == text {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeIrcServer) privateMessages(target string) []fakeIrcLine {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var lines []fakeIrcLine
+	for _, line := range f.lines {
+		if strings.HasPrefix(line.text, "PRIVMSG "+target+" ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (f *fakeIrcServer) registrationCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.registrations
+}
+
+func generateIrcTestFlags(server *fakeIrcServer) map[string]string {
+	flags := make(map[string]string)
+	flags[ircServerFlag] = server.listener.Addr().String()
+	flags[ircNicknameFlag] = "tegami"
+	flags[ircPasswordFlag] = "secret"
+	flags[ircChannelsFlag] = "#ops"
+	flags[ircThrottleFlag] = "20"
+	flags[ircRoutesFlag] = "pager@example.com=#alerts"
+	return flags
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	mattermostUrlFlag        = "mattermost-url"
+	mattermostTokenFlag      = "mattermost-token"
+	mattermostChannelFlag    = "mattermost-channel"
+	mattermostWebhookUrlFlag = "mattermost-webhook-url"
+	mattermostUsernameFlag   = "mattermost-username"
+	mattermostRoutesFlag     = "mattermost-routes"
+	mattermostUrlEnv         = "TEGAMI_MATTERMOST_URL"
+	mattermostTokenEnv       = "TEGAMI_MATTERMOST_TOKEN"
+	mattermostChannelEnv     = "TEGAMI_MATTERMOST_CHANNEL"
+	mattermostWebhookUrlEnv  = "TEGAMI_MATTERMOST_WEBHOOK_URL"
+	mattermostUsernameEnv    = "TEGAMI_MATTERMOST_USERNAME"
+	mattermostRoutesEnv      = "TEGAMI_MATTERMOST_ROUTES"
+)
+
+// mattermostMaxMessageLength is the maximum length of a Mattermost post.
+const mattermostMaxMessageLength = 16383
+
+// MattermostService manages Mattermost related components. Messages are either posted
+// through an incoming webhook or through the REST API of a bot account. Attachments
+// and threads are only supported by the REST API.
+type MattermostService struct {
+	client     *http.Client
+	serverUrl  string
+	token      string
+	webhookUrl string
+	channel    string
+	username   string
+	routes     Routes
+	threads    *ThreadTracker
+}
+
+type mattermostWebhookPayload struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+type mattermostPost struct {
+	Id        string   `json:"id,omitempty"`
+	ChannelId string   `json:"channel_id"`
+	Message   string   `json:"message"`
+	RootId    string   `json:"root_id,omitempty"`
+	FileIds   []string `json:"file_ids,omitempty"`
+}
+
+type mattermostFileUploadResponse struct {
+	FileInfos []struct {
+		Id string `json:"id"`
+	} `json:"file_infos"`
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Mattermost",
+		Prefix:   "mattermost",
+		Flags:    mattermostCLIFlags,
+		Required: [][]string{{mattermostUrlFlag, mattermostWebhookUrlFlag}},
+		Secrets:  []string{mattermostTokenFlag, mattermostWebhookUrlFlag},
+		New:      func() Service { return &MattermostService{} },
+		Schemes:  []string{"mmost", "mmosts"},
+		ParseURL: parseMattermostNotifyURL,
+	})
+}
+
+func (s *MattermostService) Init(flags map[string]string) error {
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.webhookUrl = flags[mattermostWebhookUrlFlag]
+	s.serverUrl = strings.TrimSuffix(flags[mattermostUrlFlag], "/")
+	s.token = flags[mattermostTokenFlag]
+	s.channel = flags[mattermostChannelFlag]
+	s.username = flags[mattermostUsernameFlag]
+	s.threads = NewThreadTracker(threadTrackerCapacity)
+
+	routes, err := ParseRoutes(flags[mattermostRoutesFlag])
+	if err != nil {
+		return err
+	}
+
+	s.routes = routes
+
+	if len(s.webhookUrl) > 0 {
+		return nil
+	}
+
+	if len(s.serverUrl) == 0 {
+		return errors.New("mattermost url or webhook url not set")
+	}
+
+	if len(s.token) == 0 {
+		return errors.New("mattermost token not set")
+	}
+
+	if len(s.channel) == 0 {
+		return errors.New("mattermost channel not set")
+	}
+
+	probeOnInit(flags, "Mattermost", s)
+	return nil
+}
+
+func (s *MattermostService) Send(ctx context.Context, msg *Message) error {
+	channels := s.routes.Match(msg.To)
+
+	if len(channels) == 0 {
+		channels = []string{s.channel}
+	}
+
+	text := formatMattermostText(msg)
+
+	return sendToEach(len(channels), func(i int) error {
+		if len(s.webhookUrl) > 0 {
+			return s.sendWebhook(ctx, channels[i], text)
+		}
+		return s.sendPost(ctx, channels[i], text, msg)
+	})
+}
+
+func (s *MattermostService) Render(msg *Message) (string, string, error) {
+	return "Markdown", formatMattermostText(msg), nil
+}
+
+func (s *MattermostService) IsMarkdownService() bool {
+	return true
+}
+
+func (s *MattermostService) Close() error {
+	return nil
+}
+
+// Probe verifies that the token of the bot is still valid. Incoming webhooks can't be verified
+// without posting a message.
+func (s *MattermostService) Probe(ctx context.Context) error {
+	if len(s.webhookUrl) > 0 {
+		return errNoProbe
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.serverUrl+"/api/v4/users/me", nil)
+	if err != nil {
+		return err
+	}
+
+	s.authorize(req)
+	return doRequest(s.client, req, nil)
+}
+
+// formatMattermostText returns the text of the post of a message, within the maximum length of the posts.
+func formatMattermostText(msg *Message) string {
+	return truncateString(formatMarkdownMessage(msg), mattermostMaxMessageLength)
+}
+
+// sendWebhook posts the message through the incoming webhook. An empty channel
+// posts the message in the default channel of the webhook.
+func (s *MattermostService) sendWebhook(ctx context.Context, channel, text string) error {
+	payload := &mattermostWebhookPayload{
+		Text:     text,
+		Channel:  channel,
+		Username: s.username,
+	}
+
+	return postJSON(ctx, s.client, s.webhookUrl, nil, payload, nil)
+}
+
+// sendPost creates a post with the attachments of the message in a channel. The post is
+// created in the thread of the email the message replies to if there is one.
+func (s *MattermostService) sendPost(ctx context.Context, channelId, text string, msg *Message) error {
+	fileIds, err := s.uploadFiles(ctx, channelId, msg.Attachments)
+	if err != nil {
+		return err
+	}
+
+	var response mattermostPost
+	rootId := s.threads.Thread(channelId, msg)
+	post := &mattermostPost{
+		ChannelId: channelId,
+		Message:   text,
+		RootId:    rootId,
+		FileIds:   fileIds,
+	}
+
+	err = postJSON(ctx, s.client, s.serverUrl+"/api/v4/posts", s.authorizationHeaders(), post, &response)
+	if err != nil {
+		return err
+	}
+
+	if len(rootId) == 0 {
+		rootId = response.Id
+	}
+
+	s.threads.Track(channelId, msg, rootId)
+	return nil
+}
+
+// uploadFiles uploads the attachments to a channel and returns their ids.
+func (s *MattermostService) uploadFiles(ctx context.Context, channelId string, attachments []*Attachment) ([]string, error) {
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+
+	var body bytes.Buffer
+	var response mattermostFileUploadResponse
+	writer := multipart.NewWriter(&body)
+
+	if err := writer.WriteField("channel_id", channelId); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range attachments {
+		if err := writeMultipartFile(writer, "files", attachment); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serverUrl+"/api/v4/files", &body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.authorize(req)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	if err = doRequest(s.client, req, &response); err != nil {
+		return nil, err
+	}
+
+	fileIds := make([]string, len(response.FileInfos))
+
+	for i, fileInfo := range response.FileInfos {
+		fileIds[i] = fileInfo.Id
+	}
+
+	return fileIds, nil
+}
+
+func (s *MattermostService) authorize(req *http.Request) {
+	for key, value := range s.authorizationHeaders() {
+		req.Header.Set(key, value)
+	}
+}
+
+func (s *MattermostService) authorizationHeaders() map[string]string {
+	return map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.token)}
+}
+
+// parseMattermostNotifyURL converts URLs in the form mmost[s]://[username@]host[:port]/webhook-token[/channel]
+// into flags, using the incoming webhook of the server.
+func parseMattermostNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 || len(u.segments) == 0 || len(u.segments) > 2 {
+		return nil, errors.New("mattermost url is invalid, expected mmost://host/webhook-token")
+	}
+
+	scheme := "http"
+
+	if u.scheme == "mmosts" {
+		scheme = "https"
+	}
+
+	flags := map[string]string{
+		mattermostWebhookUrlFlag: fmt.Sprintf("%s://%s/hooks/%s", scheme, u.host, url.PathEscape(u.segments[0])),
+		mattermostUsernameFlag:   u.username,
+	}
+
+	if len(u.segments) == 2 {
+		flags[mattermostChannelFlag] = u.segments[1]
+	}
+
+	return flags, nil
+}
+
+// mattermostCLIFlags returns the flags used for configuring the Mattermost service.
+func mattermostCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    mattermostUrlFlag,
+			Usage:   "The url of the Mattermost server used with a bot account",
+			EnvVars: []string{mattermostUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    mattermostTokenFlag,
+			Usage:   "The access token of the Mattermost bot account",
+			EnvVars: []string{mattermostTokenEnv},
+		},
+		&cli.StringFlag{
+			Name:    mattermostChannelFlag,
+			Usage:   "The Mattermost channel id, or channel name when using a webhook, receiving the messages",
+			EnvVars: []string{mattermostChannelEnv},
+		},
+		&cli.StringFlag{
+			Name:    mattermostWebhookUrlFlag,
+			Usage:   "The Mattermost incoming webhook url used instead of a bot account (Optional)",
+			EnvVars: []string{mattermostWebhookUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    mattermostUsernameFlag,
+			Usage:   "The username displayed for messages sent through the webhook (Optional)",
+			EnvVars: []string{mattermostUsernameEnv},
+		},
+		&cli.StringFlag{
+			Name:    mattermostRoutesFlag,
+			Usage:   "Per recipient channels in the form 'recipient=channel', separated by commas (Optional)",
+			EnvVars: []string{mattermostRoutesEnv},
+		},
+	}
+}
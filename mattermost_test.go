@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMattermostService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		srv, _ := createStubMattermostServer(t)
+		defer srv.Close()
+
+		var tests = []struct {
+			name    string
+			flags   map[string]string
+			wantErr string
+		}{
+			{"With bot account", generateMattermostTestFlags(srv.URL), ""},
+			{"With webhook", map[string]string{mattermostWebhookUrlFlag: srv.URL + "/hooks/abc"}, ""},
+			{"With missing url", map[string]string{}, "mattermost url or webhook url not set"},
+			{"With missing token", map[string]string{mattermostUrlFlag: srv.URL}, "mattermost token not set"},
+			{
+				"With missing channel",
+				map[string]string{mattermostUrlFlag: srv.URL, mattermostTokenFlag: "token"},
+				"mattermost channel not set",
+			},
+			{
+				"With invalid token",
+				map[string]string{mattermostUrlFlag: srv.URL, mattermostTokenFlag: "foo", mattermostChannelFlag: "abc"},
+				`unexpected status 401: {"message":"invalid token"}`,
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := initAndProbe(&MattermostService{}, test.flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send with bot account", func(t *testing.T) {
+		srv, posts := createStubMattermostServer(t)
+		defer srv.Close()
+
+		service := &MattermostService{}
+		flags := generateMattermostTestFlags(srv.URL)
+		flags[mattermostRoutesFlag] = "ops@example.com=ops"
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start Mattermost service: %v", err)
+		}
+
+		original := createThreadTestMessage("<1@example.com>", "", "")
+		original.Attachments = []*Attachment{{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report")}}
+		reply := createThreadTestMessage("<2@example.com>", "<1@example.com>", "")
+
+		if err := service.Send(context.Background(), original); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		if err := service.Send(context.Background(), reply); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), (*posts)[0].ChannelId, "town-square")
+		assertMessageContent(t, t.Name(), (*posts)[0].Message, "**Backup done**\n\nBackup **succeeded**")
+		assertMessageContent(t, t.Name(), fmt.Sprint((*posts)[0].FileIds), "[file-report.txt]")
+		assertMessageContent(t, t.Name(), (*posts)[0].RootId, "")
+		assertMessageContent(t, t.Name(), (*posts)[1].RootId, "post-1")
+
+		routed := createThreadTestMessage("<3@example.com>", "<1@example.com>", "")
+		routed.To = []string{"ops@example.com"}
+
+		if err := service.Send(context.Background(), routed); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), (*posts)[2].ChannelId, "ops")
+		assertMessageContent(t, t.Name(), (*posts)[2].RootId, "")
+	})
+
+	t.Run("Send with partial failure", func(t *testing.T) {
+		srv, posts := createStubMattermostServer(t)
+		defer srv.Close()
+
+		flags := generateMattermostTestFlags(srv.URL)
+		flags[mattermostRoutesFlag] = "ops@example.com=unavailable,dev@example.com=dev"
+		service := &MattermostService{}
+		service.Init(flags)
+		err := service.Send(context.Background(), &Message{To: []string{"ops@example.com", "dev@example.com"}, Markdown: "Backup done"})
+
+		if err == nil || IsTemporaryError(err) {
+			t.Errorf("Expected a permanent error once a channel received the message, got %v", err)
+		}
+
+		if len(*posts) != 1 || (*posts)[0].ChannelId != "dev" {
+			t.Errorf("Expected the message posted in the other channel, got %+v", *posts)
+		}
+	})
+
+	t.Run("Send with webhook", func(t *testing.T) {
+		var payload mattermostWebhookPayload
+		srv := createStubWebhookServer(t, &payload, http.StatusOK)
+		defer srv.Close()
+
+		service := &MattermostService{}
+		flags := map[string]string{
+			mattermostWebhookUrlFlag: srv.URL,
+			mattermostChannelFlag:    "alerts",
+			mattermostUsernameFlag:   "tegami",
+		}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start Mattermost service: %v", err)
+		}
+
+		if err := service.Send(context.Background(), &Message{Markdown: "Backup **succeeded**"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), payload.Text, "Backup **succeeded**")
+		assertMessageContent(t, t.Name(), payload.Channel, "alerts")
+		assertMessageContent(t, t.Name(), payload.Username, "tegami")
+	})
+}
+
+func createStubMattermostServer(t *testing.T) (*httptest.Server, *[]mattermostPost) {
+	t.Helper()
+	var posts []mattermostPost
+	mux := http.NewServeMux()
+
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"message":"invalid token"}`)
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/api/v4/users/me", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			io.WriteString(w, `{"id":"bot"}`)
+		}
+	})
+
+	mux.HandleFunc("/api/v4/files", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+
+		r.ParseMultipartForm(1 << 20)
+		var fileInfos []string
+
+		for _, file := range r.MultipartForm.File["files"] {
+			fileInfos = append(fileInfos, fmt.Sprintf(`{"id":"file-%s"}`, file.Filename))
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"file_infos":[%s]}`, fileInfos[0])
+	})
+
+	mux.HandleFunc("/api/v4/posts", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+
+		var post mattermostPost
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &post)
+
+		if post.ChannelId == "unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"message":"unavailable"}`)
+			return
+		}
+
+		posts = append(posts, post)
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":"post-%d"}`, len(posts))
+	})
+
+	return httptest.NewServer(mux), &posts
+}
+
+func generateMattermostTestFlags(serverUrl string) map[string]string {
+	flags := make(map[string]string)
+	flags[mattermostUrlFlag] = serverUrl
+	flags[mattermostTokenFlag] = "token"
+	flags[mattermostChannelFlag] = "town-square"
+	return flags
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// durationBuckets are the upper bounds in seconds of the buckets of the duration histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// sizeBuckets are the upper bounds in bytes of the buckets of the message size histogram.
+var sizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 32 << 20}
+
+// metrics contains the metrics of Tegami, written in the Prometheus text format by its HTTP handler.
+var metrics = &metricsRegistry{}
+
+var (
+	smtpConnections       = metrics.newFamily("tegami_smtp_connections_total", "Number of SMTP connections accepted.", "counter", nil)
+	smtpActiveConnections = metrics.newFamily("tegami_smtp_active_connections", "Number of SMTP connections currently open.", "gauge", nil)
+	smtpAuthFailures      = metrics.newFamily("tegami_smtp_auth_failures_total", "Number of failed SMTP authentications.", "counter", nil)
+	messagesReceived      = metrics.newFamily("tegami_messages_received_total", "Number of messages received by the SMTP server.", "counter", nil)
+	messagesRejected      = metrics.newFamily("tegami_messages_rejected_total", "Number of messages rejected by the SMTP server, by reason.", "counter", nil, "reason")
+	messageSize           = metrics.newFamily("tegami_message_size_bytes", "Size of the messages received.", "histogram", sizeBuckets)
+	messageProcessing     = metrics.newFamily("tegami_message_processing_seconds", "Time spent parsing the messages received.", "histogram", durationBuckets)
+	serviceSends          = metrics.newFamily("tegami_service_sends_total", "Number of messages sent with each service, by result.", "counter", nil, "service", "result")
+	serviceRetries        = metrics.newFamily("tegami_service_retries_total", "Number of messages sent again with each service from the queue.", "counter", nil, "service")
+	serviceSendDuration   = metrics.newFamily("tegami_service_send_duration_seconds", "Time spent sending the messages with each service.", "histogram", durationBuckets, "service")
+	queueDepth            = metrics.newFamily("tegami_queue_depth", "Number of messages in the delivery queue, by state.", "gauge", nil, "state")
+	telegramRateLimits    = metrics.newFamily("tegami_telegram_rate_limits_total", "Number of messages refused by Telegram because of its rate limits.", "counter", nil)
+)
+
+// metricsRegistry holds metric families and writes them in the Prometheus text format.
+type metricsRegistry struct {
+	mutex    sync.Mutex
+	families []*metricFamily
+}
+
+// metricFamily is a counter, gauge or histogram along with its series, one for each combination
+// of label values.
+type metricFamily struct {
+	registry   *metricsRegistry
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	// value is the value of a counter or gauge.
+	value float64
+	// bucketCounts contains the number of observations of a histogram in each bucket, excluding
+	// the observations of the lower buckets.
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// newFamily registers a metric family. The buckets are only used by histograms.
+func (r *metricsRegistry) newFamily(name, help, kind string, buckets []float64, labelNames ...string) *metricFamily {
+	family := &metricFamily{
+		registry:   r,
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+
+	// The families without labels have a single series, written even before its first change.
+	if len(labelNames) == 0 {
+		family.getSeries(nil)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, family)
+	return family
+}
+
+// Inc increments the counter or gauge having the label values.
+func (f *metricFamily) Inc(labelValues ...string) {
+	f.Add(1, labelValues...)
+}
+
+// Add adds a value to the counter or gauge having the label values.
+func (f *metricFamily) Add(value float64, labelValues ...string) {
+	f.registry.mutex.Lock()
+	defer f.registry.mutex.Unlock()
+	f.getSeries(labelValues).value += value
+}
+
+// Set sets the value of the gauge having the label values.
+func (f *metricFamily) Set(value float64, labelValues ...string) {
+	f.registry.mutex.Lock()
+	defer f.registry.mutex.Unlock()
+	f.getSeries(labelValues).value = value
+}
+
+// Observe adds an observation to the histogram having the label values.
+func (f *metricFamily) Observe(value float64, labelValues ...string) {
+	f.registry.mutex.Lock()
+	defer f.registry.mutex.Unlock()
+	series := f.getSeries(labelValues)
+	series.sum += value
+	series.count++
+
+	for i, bound := range f.buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+			return
+		}
+	}
+}
+
+// getSeries returns the series having the label values, creating it if needed. The mutex of the registry must be held.
+func (f *metricFamily) getSeries(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\x00")
+	series, ok := f.series[key]
+
+	if !ok {
+		series = &metricSeries{labelValues: labelValues, bucketCounts: make([]uint64, len(f.buckets))}
+		f.series[key] = series
+	}
+
+	return series
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (r *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	r.mutex.Lock()
+
+	for _, family := range r.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		keys := make([]string, 0, len(family.series))
+
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			family.writeSeries(&b, family.series[key])
+		}
+	}
+
+	r.mutex.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (f *metricFamily) writeSeries(b *strings.Builder, series *metricSeries) {
+	labels := formatLabels(f.labelNames, series.labelValues)
+
+	if f.kind != "histogram" {
+		fmt.Fprintf(b, "%s%s %s\n", f.name, wrapLabels(labels), formatMetricValue(series.value))
+		return
+	}
+
+	var cumulativeCount uint64
+
+	for i, bound := range f.buckets {
+		cumulativeCount += series.bucketCounts[i]
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, wrapLabels(append(labels, formatLabel("le", formatMetricValue(bound)))), cumulativeCount)
+	}
+
+	fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, wrapLabels(append(labels, formatLabel("le", "+Inf"))), series.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", f.name, wrapLabels(labels), formatMetricValue(series.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", f.name, wrapLabels(labels), series.count)
+}
+
+// ServeHTTP writes the metrics in response to the requests of Prometheus.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+func formatLabels(names, values []string) []string {
+	labels := make([]string, 0, len(names)+1)
+
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		labels = append(labels, formatLabel(name, value))
+	}
+
+	return labels
+}
+
+// formatLabel formats a label, escaping its value as required by the Prometheus text format.
+func formatLabel(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf(`%s="%s"`, name, value)
+}
+
+func wrapLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricsListener is a listener counting its connections.
+type metricsListener struct {
+	net.Listener
+}
+
+func (l *metricsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	smtpConnections.Inc()
+	smtpActiveConnections.Inc()
+	return &metricsConn{Conn: conn}, nil
+}
+
+// metricsConn is a connection counted as active until it is closed.
+type metricsConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *metricsConn) Close() error {
+	c.closeOnce.Do(func() {
+		smtpActiveConnections.Add(-1)
+	})
+	return c.Conn.Close()
+}
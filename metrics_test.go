@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/tucnak/telebot.v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	registry := &metricsRegistry{}
+	counter := registry.newFamily("test_sends_total", "Number of sends.", "counter", nil, "service", "result")
+	gauge := registry.newFamily("test_depth", "Depth.", "gauge", nil)
+	histogram := registry.newFamily("test_duration_seconds", "Duration.", "histogram", []float64{0.1, 1}, "service")
+
+	counter.Inc("Telegram", "success")
+	counter.Add(2, "Telegram", "success")
+	counter.Inc(`Quote"d`, "failure")
+	histogram.Observe(0.05, "Telegram")
+	histogram.Observe(0.5, "Telegram")
+	histogram.Observe(5, "Telegram")
+
+	var b bytes.Buffer
+	registry.WriteTo(&b)
+
+	want := `# HELP test_sends_total Number of sends.
+# TYPE test_sends_total counter
+test_sends_total{service="Quote\"d",result="failure"} 1
+test_sends_total{service="Telegram",result="success"} 3
+# HELP test_depth Depth.
+# TYPE test_depth gauge
+test_depth 0
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{service="Telegram",le="0.1"} 1
+test_duration_seconds_bucket{service="Telegram",le="1"} 2
+test_duration_seconds_bucket{service="Telegram",le="+Inf"} 3
+test_duration_seconds_sum{service="Telegram"} 5.55
+test_duration_seconds_count{service="Telegram"} 3
+`
+	assertMessageContent(t, t.Name(), b.String(), want)
+
+	gauge.Set(4)
+	b.Reset()
+	registry.WriteTo(&b)
+
+	if !strings.Contains(b.String(), "\ntest_depth 4\n") {
+		t.Errorf("Gauge not updated:\n%s", b.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	service := &RecorderService{sendErr: &TemporaryError{Err: errors.New("Too Many Requests: retry after 5")}}
+	server, addr, cancel, serveErr := startTestServer(t, &timeoutService{Service: service, name: "Recorder", timeout: time.Second}, time.Second)
+	c, err := smtp.Dial(addr)
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+
+	if err = c.Auth(smtp.PlainAuth("other", "user", "password", "127.0.0.1")); err == nil {
+		t.Errorf("Expected authentication with another identity to fail")
+	}
+
+	c.Close()
+
+	if err = sendTestData(addr, createTextMail(t, "Disk failure")); err != nil {
+		t.Fatalf("Could not send the message: %v", err)
+	}
+
+	waitForCondition(t, "message queued", func() bool {
+		return len(server.queue.Pending()) == 1
+	})
+
+	cancel()
+	<-serveErr
+
+	httpServer := httptest.NewServer(newHttpHandler(NewHealthChecker(nil, nil, server.Accepting), nil, nil))
+	defer httpServer.Close()
+	resp, err := http.Get(httpServer.URL + "/metrics")
+
+	if err != nil {
+		t.Fatalf("Could not get the metrics: %v", err)
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		"tegami_smtp_auth_failures_total ",
+		"tegami_messages_received_total ",
+		`tegami_service_sends_total{service="Recorder",result="temporary_failure"} 2`,
+		`tegami_service_retries_total{service="Recorder"} 1`,
+		`tegami_service_send_duration_seconds_count{service="Recorder"} 2`,
+		`tegami_queue_depth{state="dead_letter"} `,
+		"tegami_message_size_bytes_count ",
+		"tegami_smtp_active_connections 0",
+	} {
+		if !strings.Contains(string(body), "\n"+line) {
+			t.Errorf("Metric %s not found in:\n%s", line, body)
+		}
+	}
+
+	if metricValue(t, string(body), "tegami_smtp_auth_failures_total") < 1 || metricValue(t, string(body), "tegami_smtp_connections_total") < 2 {
+		t.Errorf("Connections or authentication failures not counted:\n%s", body)
+	}
+}
+
+func TestTelegramRateLimitMetric(t *testing.T) {
+	before := metricValue(t, metricsText(), "tegami_telegram_rate_limits_total")
+	telegramError(telebot.FloodError{APIError: &telebot.APIError{Code: 429, Description: "Too Many Requests: retry after 5"}, RetryAfter: 5})
+
+	if after := metricValue(t, metricsText(), "tegami_telegram_rate_limits_total"); after != before+1 {
+		t.Errorf("Rate limit not counted: %v then %v", before, after)
+	}
+}
+
+func metricsText() string {
+	var b bytes.Buffer
+	metrics.WriteTo(&b)
+	return b.String()
+}
+
+// metricValue returns the value of a metric without labels.
+func metricValue(t *testing.T, text, name string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			var value float64
+			if _, err := fmt.Sscan(strings.TrimPrefix(line, name+" "), &value); err != nil {
+				t.Fatalf("Invalid value for %s: %s", name, line)
+			}
+			return value
+		}
+	}
+	t.Fatalf("Metric %s not found", name)
+	return 0
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	mqttBrokerFlag   = "mqtt-broker"
+	mqttTopicFlag    = "mqtt-topic"
+	mqttQosFlag      = "mqtt-qos"
+	mqttRetainFlag   = "mqtt-retain"
+	mqttUsernameFlag = "mqtt-username"
+	mqttPasswordFlag = "mqtt-password"
+	mqttClientIdFlag = "mqtt-client-id"
+	mqttBrokerEnv    = "TEGAMI_MQTT_BROKER"
+	mqttTopicEnv     = "TEGAMI_MQTT_TOPIC"
+	mqttQosEnv       = "TEGAMI_MQTT_QOS"
+	mqttRetainEnv    = "TEGAMI_MQTT_RETAIN"
+	mqttUsernameEnv  = "TEGAMI_MQTT_USERNAME"
+	mqttPasswordEnv  = "TEGAMI_MQTT_PASSWORD"
+	mqttClientIdEnv  = "TEGAMI_MQTT_CLIENT_ID"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttDisconnect = 14
+)
+
+const (
+	mqttTimeout   = 30 * time.Second
+	mqttKeepAlive = 60
+)
+
+var mqttConnectErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad username or password",
+	5: "not authorized",
+}
+
+// MqttService manages MQTT related components. Each email is published as a JSON document
+// using a new connection to the broker, so no connection is kept between the emails.
+type MqttService struct {
+	address   string
+	useTls    bool
+	topic     *template.Template
+	qos       byte
+	retain    bool
+	username  string
+	password  string
+	clientId  string
+	tlsConfig *tls.Config
+
+	mutex    sync.Mutex
+	packetId uint16
+}
+
+// mqttDocument is the JSON document published for an email.
+type mqttDocument struct {
+	Subject     string               `json:"subject"`
+	From        string               `json:"from"`
+	To          []string             `json:"to"`
+	Recipient   string               `json:"recipient,omitempty"`
+	Date        time.Time            `json:"date"`
+	Text        string               `json:"text"`
+	Attachments []mqttAttachmentInfo `json:"attachments"`
+}
+
+type mqttAttachmentInfo struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// mqttConn is a connection to an MQTT broker.
+type mqttConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:      "MQTT",
+		Prefix:    "mqtt",
+		Flags:     mqttCLIFlags,
+		Required:  [][]string{{mqttBrokerFlag}},
+		Secrets:   []string{mqttPasswordFlag},
+		Templates: []string{mqttTopicFlag},
+		New:       func() Service { return &MqttService{} },
+		Schemes:   []string{"mqtt", "mqtts"},
+		ParseURL:  parseMqttNotifyURL,
+	})
+}
+
+func (s *MqttService) Init(flags map[string]string) error {
+	broker := flags[mqttBrokerFlag]
+
+	if len(broker) == 0 {
+		return errors.New("mqtt broker not set")
+	}
+
+	brokerUrl, err := url.Parse(broker)
+	if err != nil || len(brokerUrl.Hostname()) == 0 {
+		return errors.New("mqtt broker is invalid")
+	}
+
+	port := brokerUrl.Port()
+
+	switch brokerUrl.Scheme {
+	case "tcp", "mqtt":
+		s.useTls = false
+		if len(port) == 0 {
+			port = "1883"
+		}
+	case "ssl", "tls", "mqtts":
+		s.useTls = true
+		if len(port) == 0 {
+			port = "8883"
+		}
+	default:
+		return fmt.Errorf("mqtt broker scheme is invalid: %s", brokerUrl.Scheme)
+	}
+
+	topic := flags[mqttTopicFlag]
+
+	if len(topic) == 0 {
+		topic = "tegami/{{.Recipient}}"
+	}
+
+	if s.topic, err = ParseMessageTemplate(mqttTopicFlag, topic); err != nil {
+		return err
+	}
+
+	qos, err := parseOptionalInt(flags[mqttQosFlag], 0)
+	if err != nil || qos < 0 || qos > 2 {
+		return errors.New("mqtt qos is invalid")
+	}
+
+	if s.retain, err = parseOptionalBool(flags[mqttRetainFlag], false); err != nil {
+		return errors.New("mqtt retain is invalid")
+	}
+
+	s.address = net.JoinHostPort(brokerUrl.Hostname(), port)
+	s.qos = byte(qos)
+	s.username = flags[mqttUsernameFlag]
+	s.password = flags[mqttPasswordFlag]
+	s.clientId = flags[mqttClientIdFlag]
+
+	if len(s.clientId) == 0 {
+		s.clientId = "tegami"
+	}
+
+	if s.tlsConfig == nil {
+		s.tlsConfig = &tls.Config{ServerName: brokerUrl.Hostname()}
+	}
+
+	probeOnInit(flags, "MQTT", s)
+	return nil
+}
+
+// Send publishes the message once for each of its envelope recipients, so the topic
+// can be specific to the recipient. A new connection is opened for each message, so the
+// QoS doesn't prevent duplicates when the message is sent again after a failure.
+func (s *MqttService) Send(ctx context.Context, msg *Message) error {
+	recipients := mqttRecipients(msg)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.connect(ctx)
+	if err != nil {
+		return networkError(err)
+	}
+
+	for _, recipient := range recipients {
+		topic, err := ExecuteMessageTemplate(s.topic, msg, recipient)
+		if err != nil {
+			c.Close()
+			return err
+		}
+
+		payload, err := json.Marshal(createMqttDocument(msg, recipient))
+		if err != nil {
+			c.Close()
+			return err
+		}
+
+		if err = s.publish(c, topic, payload); err != nil {
+			c.Close()
+			return networkError(err)
+		}
+	}
+
+	return networkError(c.disconnect())
+}
+
+// Render returns the document published for each recipient, preceded by its topic.
+func (s *MqttService) Render(msg *Message) (string, string, error) {
+	var payloads []string
+
+	for _, recipient := range mqttRecipients(msg) {
+		topic, err := ExecuteMessageTemplate(s.topic, msg, recipient)
+		if err != nil {
+			return "", "", err
+		}
+
+		_, payload, err := renderJSON(createMqttDocument(msg, recipient))
+		if err != nil {
+			return "", "", err
+		}
+
+		payloads = append(payloads, fmt.Sprintf("Topic: %s\n%s", topic, payload))
+	}
+
+	return "JSON", strings.Join(payloads, "\n\n"), nil
+}
+
+func (s *MqttService) IsMarkdownService() bool {
+	return true
+}
+
+func (s *MqttService) Close() error {
+	return nil
+}
+
+// Probe verifies that the broker accepts a connection with the credentials of the service.
+func (s *MqttService) Probe(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, err := s.connect(ctx)
+	if err != nil {
+		return networkError(err)
+	}
+
+	return networkError(c.disconnect())
+}
+
+// connect opens a connection with the broker and waits for it to be accepted.
+func (s *MqttService) connect(ctx context.Context) (*mqttConn, error) {
+	var tlsConfig *tls.Config
+
+	if s.useTls {
+		tlsConfig = s.tlsConfig
+	}
+
+	conn, err := dialContext(ctx, "tcp", s.address, tlsConfig, mqttTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqttConn{Conn: conn, reader: bufio.NewReader(conn)}
+
+	var body bytes.Buffer
+	flags := byte(0x02)
+
+	writeMqttString(&body, "MQTT")
+	body.WriteByte(4)
+
+	if len(s.username) > 0 {
+		flags |= 0x80
+	}
+
+	if len(s.password) > 0 {
+		flags |= 0x40
+	}
+
+	body.WriteByte(flags)
+	body.Write(binary.BigEndian.AppendUint16(nil, mqttKeepAlive))
+	writeMqttString(&body, s.clientId)
+
+	if len(s.username) > 0 {
+		writeMqttString(&body, s.username)
+	}
+
+	if len(s.password) > 0 {
+		writeMqttString(&body, s.password)
+	}
+
+	if err = c.writePacket(mqttConnect<<4, body.Bytes()); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	header, payload, err := c.readPacket()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if header>>4 != mqttConnack || len(payload) != 2 {
+		c.Close()
+		return nil, errors.New("mqtt connection not acknowledged")
+	}
+
+	if payload[1] != 0 {
+		c.Close()
+
+		if reason, ok := mqttConnectErrors[payload[1]]; ok {
+			return nil, fmt.Errorf("mqtt connection refused: %s", reason)
+		}
+
+		return nil, fmt.Errorf("mqtt connection refused: code %d", payload[1])
+	}
+
+	return c, nil
+}
+
+// publish sends a message on a topic and waits for its delivery to be acknowledged according to the QoS.
+func (s *MqttService) publish(c *mqttConn, topic string, payload []byte) error {
+	var body bytes.Buffer
+	header := byte(mqttPublish<<4) | s.qos<<1
+	packetId := uint16(0)
+
+	if s.retain {
+		header |= 0x01
+	}
+
+	writeMqttString(&body, topic)
+
+	if s.qos > 0 {
+		s.packetId++
+
+		if s.packetId == 0 {
+			s.packetId++
+		}
+
+		packetId = s.packetId
+		body.Write(mqttPacketId(packetId))
+	}
+
+	body.Write(payload)
+
+	if err := c.writePacket(header, body.Bytes()); err != nil {
+		return err
+	}
+
+	switch s.qos {
+	case 1:
+		return c.expectAck(mqttPuback, packetId)
+	case 2:
+		if err := c.expectAck(mqttPubrec, packetId); err != nil {
+			return err
+		}
+
+		if err := c.writePacket(mqttPubrel<<4|0x02, mqttPacketId(packetId)); err != nil {
+			return err
+		}
+
+		return c.expectAck(mqttPubcomp, packetId)
+	}
+
+	return nil
+}
+
+// expectAck waits for an acknowledgement of a packet.
+func (c *mqttConn) expectAck(packetType byte, packetId uint16) error {
+	header, payload, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+
+	if header>>4 != packetType || len(payload) < 2 || binary.BigEndian.Uint16(payload) != packetId {
+		return fmt.Errorf("mqtt publication %d not acknowledged", packetId)
+	}
+
+	return nil
+}
+
+func (c *mqttConn) disconnect() error {
+	err := c.writePacket(mqttDisconnect<<4, nil)
+	c.Close()
+	return err
+}
+
+// writePacket writes a packet made of its fixed header byte, its remaining length and its body.
+func (c *mqttConn) writePacket(header byte, body []byte) error {
+	var packet bytes.Buffer
+	packet.WriteByte(header)
+	length := len(body)
+
+	for {
+		digit := byte(length % 128)
+		length /= 128
+
+		if length > 0 {
+			digit |= 0x80
+		}
+
+		packet.WriteByte(digit)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	packet.Write(body)
+	_, err := c.Write(packet.Bytes())
+	return err
+}
+
+// readPacket reads a packet and returns its fixed header byte along with its body.
+func (c *mqttConn) readPacket() (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+
+	for multiplier := 1; ; multiplier *= 128 {
+		digit, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		length += int(digit&0x7f) * multiplier
+
+		if digit&0x80 == 0 {
+			break
+		}
+
+		if multiplier > 128*128 {
+			return 0, nil, errors.New("mqtt packet length is invalid")
+		}
+	}
+
+	body := make([]byte, length)
+
+	if _, err = io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
+
+// mqttRecipients returns the recipients for which a message is published, an empty recipient
+// being used when the message has none.
+func mqttRecipients(msg *Message) []string {
+	if len(msg.To) == 0 {
+		return []string{""}
+	}
+	return msg.To
+}
+
+// createMqttDocument creates the JSON document published for a message and one of its recipients.
+func createMqttDocument(msg *Message, recipient string) *mqttDocument {
+	document := &mqttDocument{
+		Subject:     msg.Subject,
+		From:        msg.Sender(),
+		To:          msg.To,
+		Recipient:   recipient,
+		Date:        msg.Date,
+		Text:        msg.Markdown,
+		Attachments: []mqttAttachmentInfo{},
+	}
+
+	if document.To == nil {
+		document.To = []string{}
+	}
+
+	for _, attachment := range msg.Attachments {
+		document.Attachments = append(document.Attachments, mqttAttachmentInfo{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Size:        len(attachment.Data),
+		})
+	}
+
+	return document
+}
+
+func writeMqttString(buffer *bytes.Buffer, value string) {
+	buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(value))))
+	buffer.WriteString(value)
+}
+
+func mqttPacketId(packetId uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, packetId)
+}
+
+// parseMqttNotifyURL converts URLs in the form mqtt[s]://[username:password@]host[:port][/topic] into flags.
+func parseMqttNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 {
+		return nil, errors.New("mqtt url is invalid, expected mqtt://host:port/topic")
+	}
+
+	broker := "tcp://" + u.hostWithPort("1883")
+
+	if u.scheme == "mqtts" {
+		broker = "ssl://" + u.hostWithPort("8883")
+	}
+
+	flags := map[string]string{
+		mqttBrokerFlag:   broker,
+		mqttUsernameFlag: u.username,
+		mqttPasswordFlag: u.password,
+	}
+
+	if len(u.segments) > 0 {
+		flags[mqttTopicFlag] = strings.Join(u.segments, "/")
+	}
+
+	return flags, nil
+}
+
+// mqttCLIFlags returns the flags used for configuring the MQTT service.
+func mqttCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    mqttBrokerFlag,
+			Usage:   "The url of the MQTT broker, for example 'tcp://localhost:1883' or 'ssl://localhost:8883'",
+			EnvVars: []string{mqttBrokerEnv},
+		},
+		&cli.StringFlag{
+			Name:    mqttTopicFlag,
+			Value:   "tegami/{{.Recipient}}",
+			Usage:   "Template of the topic on which the emails are published (Optional)",
+			EnvVars: []string{mqttTopicEnv},
+		},
+		&cli.StringFlag{
+			Name:    mqttQosFlag,
+			Value:   "0",
+			Usage:   "The QoS level of the published messages, either 0, 1 or 2. A new connection is opened for each email, so the QoS doesn't prevent duplicates when an email is sent again (Optional)",
+			EnvVars: []string{mqttQosEnv},
+		},
+		&cli.StringFlag{
+			Name:    mqttRetainFlag,
+			Value:   "false",
+			Usage:   "Whether the published messages are retained by the broker (Optional)",
+			EnvVars: []string{mqttRetainEnv},
+		},
+		&cli.StringFlag{
+			Name:    mqttUsernameFlag,
+			Usage:   "The username used for connecting to the broker (Optional)",
+			EnvVars: []string{mqttUsernameEnv},
+		},
+		&cli.StringFlag{
+			Name:    mqttPasswordFlag,
+			Usage:   "The password used for connecting to the broker (Optional)",
+			EnvVars: []string{mqttPasswordEnv},
+		},
+		&cli.StringFlag{
+			Name:    mqttClientIdFlag,
+			Value:   "tegami",
+			Usage:   "The client id used for connecting to the broker (Optional)",
+			EnvVars: []string{mqttClientIdEnv},
+		},
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMqttBroker is a minimal MQTT broker recording the messages published by the clients.
+type fakeMqttBroker struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	credentials []string
+	publishes   []fakeMqttPublish
+}
+
+type fakeMqttPublish struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+func TestMqttService(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not start MQTT broker: %v", err)
+	}
+
+	broker := startFakeMqttBroker(listener)
+	defer listener.Close()
+
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With valid arguments", "", "", ""},
+			{"With missing broker", mqttBrokerFlag, "", "mqtt broker not set"},
+			{"With invalid broker", mqttBrokerFlag, "tcp://", "mqtt broker is invalid"},
+			{"With invalid scheme", mqttBrokerFlag, "http://localhost", "mqtt broker scheme is invalid: http"},
+			{"With invalid topic", mqttTopicFlag, "tegami/{{.Recipient", "template: mqtt-topic:1: unclosed action"},
+			{"With invalid qos", mqttQosFlag, "3", "mqtt qos is invalid"},
+			{"With invalid retain", mqttRetainFlag, "foo", "mqtt retain is invalid"},
+			{"With invalid password", mqttPasswordFlag, "foo", "mqtt connection refused: not authorized"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := generateMqttTestFlags("tcp://" + listener.Addr().String())
+				if len(test.flag) > 0 {
+					flags[test.flag] = test.value
+				}
+
+				err := initAndProbe(&MqttService{}, flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		for _, qos := range []string{"0", "1", "2"} {
+			t.Run("With QoS "+qos, func(t *testing.T) {
+				flags := generateMqttTestFlags("tcp://" + listener.Addr().String())
+				flags[mqttQosFlag] = qos
+				flags[mqttRetainFlag] = "true"
+
+				service := &MqttService{}
+				if err := service.Init(flags); err != nil {
+					t.Fatalf("Could not start MQTT service: %v", err)
+				}
+
+				msg := &Message{
+					From:        "nas@example.com",
+					To:          []string{"backup@example.com", "alerts@example.com"},
+					Subject:     "Backup done",
+					Date:        time.Date(2021, 10, 2, 15, 4, 5, 0, time.UTC),
+					Markdown:    "Backup **succeeded**",
+					Attachments: []*Attachment{{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report")}},
+				}
+
+				broker.reset()
+
+				if err := service.Send(context.Background(), msg); err != nil {
+					t.Fatalf("Error while we weren't supposed to get any: %v", err)
+				}
+
+				waitForCondition(t, "messages published", func() bool { return len(broker.receivedPublishes()) == 2 })
+				publishes := broker.receivedPublishes()
+
+				var document mqttDocument
+				json.Unmarshal(publishes[0].payload, &document)
+
+				assertMessageContent(t, t.Name(), publishes[0].topic, "tegami/backup@example.com")
+				assertMessageContent(t, t.Name(), publishes[1].topic, "tegami/alerts@example.com")
+				assertMessageContent(t, t.Name(), fmt.Sprint(publishes[0].qos, publishes[0].retain), qos+" true")
+				assertMessageContent(t, t.Name(), document.Subject, "Backup done")
+				assertMessageContent(t, t.Name(), document.From, "nas@example.com")
+				assertMessageContent(t, t.Name(), document.Recipient, "backup@example.com")
+				assertMessageContent(t, t.Name(), document.Text, "Backup **succeeded**")
+				assertMessageContent(t, t.Name(), document.Date.Format(time.RFC3339), "2021-10-02T15:04:05Z")
+				assertMessageContent(t, t.Name(), fmt.Sprint(document.Attachments), "[{report.txt text/plain 6}]")
+				assertMessageContent(t, t.Name(), fmt.Sprint(broker.receivedCredentials()), "[tegami:tegami:secret]")
+			})
+		}
+	})
+
+	t.Run("Probe", func(t *testing.T) {
+		service := &MqttService{}
+		if err := service.Init(generateMqttTestFlags("tcp://" + listener.Addr().String())); err != nil {
+			t.Fatalf("Could not start MQTT service: %v", err)
+		}
+
+		if err := service.Probe(context.Background()); err != nil {
+			t.Errorf("Unexpected probe error: %v", err)
+		}
+
+		service.password = "foo"
+		err := service.Probe(context.Background())
+		assertErrorContent(t, fmt.Sprint(err), "mqtt connection refused: not authorized")
+	})
+
+	t.Run("Send with TLS", func(t *testing.T) {
+		config := &tls.Config{Certificates: []tls.Certificate{createTestCertificate(t)}}
+		tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+
+		if err != nil {
+			t.Fatalf("Could not start MQTT broker: %v", err)
+		}
+
+		tlsBroker := startFakeMqttBroker(tlsListener)
+		defer tlsListener.Close()
+
+		flags := generateMqttTestFlags("ssl://" + tlsListener.Addr().String())
+		flags[mqttTopicFlag] = "home/{{.Subject}}"
+		service := &MqttService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+
+		if err = service.Init(flags); err != nil {
+			t.Fatalf("Could not start MQTT service: %v", err)
+		}
+
+		if err = service.Send(context.Background(), &Message{Subject: "doorbell"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "message published", func() bool { return len(tlsBroker.receivedPublishes()) == 1 })
+		assertMessageContent(t, t.Name(), tlsBroker.receivedPublishes()[0].topic, "home/doorbell")
+	})
+}
+
+func startFakeMqttBroker(listener net.Listener) *fakeMqttBroker {
+	broker := &fakeMqttBroker{listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.handle(&mqttConn{Conn: conn, reader: bufio.NewReader(conn)})
+		}
+	}()
+
+	return broker
+}
+
+func (f *fakeMqttBroker) handle(c *mqttConn) {
+	defer c.Close()
+
+	for {
+		header, body, err := c.readPacket()
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case mqttConnect:
+			fields, flags := readFakeMqttConnect(body)
+			code := byte(0)
+
+			if flags&0xc0 != 0xc0 || fields[1] != "tegami" || fields[2] != "secret" {
+				code = 5
+			}
+
+			f.mutex.Lock()
+			f.credentials = append(f.credentials, strings.Join(fields, ":"))
+			f.mutex.Unlock()
+			c.writePacket(mqttConnack<<4, []byte{0, code})
+		case mqttPublish:
+			publish := fakeMqttPublish{qos: header >> 1 & 0x03, retain: header&0x01 == 1}
+			topicLength := int(binary.BigEndian.Uint16(body))
+			publish.topic = string(body[2 : 2+topicLength])
+			publish.payload = body[2+topicLength:]
+
+			if publish.qos > 0 {
+				packetId := publish.payload[:2]
+				publish.payload = publish.payload[2:]
+
+				if publish.qos == 1 {
+					c.writePacket(mqttPuback<<4, packetId)
+				} else {
+					c.writePacket(mqttPubrec<<4, packetId)
+				}
+			}
+
+			f.mutex.Lock()
+			f.publishes = append(f.publishes, publish)
+			f.mutex.Unlock()
+		case mqttPubrel:
+			c.writePacket(mqttPubcomp<<4, body)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func (f *fakeMqttBroker) reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.credentials = nil
+	f.publishes = nil
+}
+
+func (f *fakeMqttBroker) receivedPublishes() []fakeMqttPublish {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]fakeMqttPublish(nil), f.publishes...)
+}
+
+func (f *fakeMqttBroker) receivedCredentials() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.credentials...)
+}
+
+// readFakeMqttConnect returns the client id, username and password of a CONNECT packet along with its flags.
+func readFakeMqttConnect(body []byte) ([]string, byte) {
+	flags := body[7]
+	body = body[10:]
+	fields := make([]string, 3)
+
+	for i := range fields {
+		if i == 1 && flags&0x80 == 0 || i == 2 && flags&0x40 == 0 || len(body) < 2 {
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(body))
+		fields[i] = string(body[2 : 2+length])
+		body = body[2+length:]
+	}
+
+	return fields, flags
+}
+
+func generateMqttTestFlags(broker string) map[string]string {
+	flags := make(map[string]string)
+	flags[mqttBrokerFlag] = broker
+	flags[mqttUsernameFlag] = "tegami"
+	flags[mqttPasswordFlag] = "secret"
+	return flags
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	notifyFlag = "notify"
+	notifyEnv  = "TEGAMI_NOTIFY"
+)
+
+// notifyURL is a notification URL such as tgram://token/chat-id. The URLs are split by hand
+// rather than using net/url since some values, such as the Telegram tokens, contain characters
+// which aren't valid in the host of a URL.
+type notifyURL struct {
+	scheme   string
+	username string
+	password string
+	// host is the part between the credentials and the path, usually in the form 'host[:port]'.
+	host string
+	// path is the escaped path of the URL, starting with a slash unless it is empty.
+	path string
+	// segments contains the unescaped non-empty segments of the path.
+	segments []string
+	query    url.Values
+}
+
+// parseNotifyURL splits a notification URL into its parts.
+func parseNotifyURL(rawUrl string) (*notifyURL, error) {
+	schemeEnd := strings.Index(rawUrl, "://")
+
+	if schemeEnd <= 0 {
+		return nil, errors.New("notify url is invalid")
+	}
+
+	u := &notifyURL{scheme: strings.ToLower(rawUrl[:schemeEnd])}
+	rest := rawUrl[schemeEnd+3:]
+	var err error
+
+	if queryStart := strings.Index(rest, "?"); queryStart >= 0 {
+		if u.query, err = url.ParseQuery(rest[queryStart+1:]); err != nil {
+			return nil, fmt.Errorf("notify url query is invalid: %v", err)
+		}
+		rest = rest[:queryStart]
+	} else {
+		u.query = url.Values{}
+	}
+
+	authority := rest
+
+	if pathStart := strings.Index(rest, "/"); pathStart >= 0 {
+		authority = rest[:pathStart]
+		u.path = rest[pathStart:]
+	}
+
+	if credentialsEnd := strings.LastIndex(authority, "@"); credentialsEnd >= 0 {
+		credentials := authority[:credentialsEnd]
+		authority = authority[credentialsEnd+1:]
+
+		if separator := strings.Index(credentials, ":"); separator >= 0 {
+			u.password = credentials[separator+1:]
+			credentials = credentials[:separator]
+		}
+
+		u.username = credentials
+
+		if u.username, err = url.PathUnescape(u.username); err != nil {
+			return nil, errors.New("notify url username is invalid")
+		}
+
+		if u.password, err = url.PathUnescape(u.password); err != nil {
+			return nil, errors.New("notify url password is invalid")
+		}
+	}
+
+	u.host = authority
+
+	for _, segment := range strings.Split(u.path, "/") {
+		if len(segment) == 0 {
+			continue
+		}
+
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, errors.New("notify url path is invalid")
+		}
+
+		u.segments = append(u.segments, unescaped)
+	}
+
+	return u, nil
+}
+
+// location returns the unescaped host and path of the URL, used by the URLs designating a file.
+func (u *notifyURL) location() (string, error) {
+	return url.PathUnescape(u.host + u.path)
+}
+
+// hostWithPort returns the host of the URL, adding the port if the host doesn't have one.
+func (u *notifyURL) hostWithPort(port string) string {
+	if strings.HasSuffix(u.host, "]") || !strings.Contains(u.host, ":") {
+		return u.host + ":" + port
+	}
+	return u.host
+}
+
+// notifyServiceFlags converts a notification URL into the definition and the flags of the service
+// handling it. The flags not found in the URL have their default value.
+func notifyServiceFlags(rawUrl string) (*ServiceDefinition, map[string]string, error) {
+	u, err := parseNotifyURL(rawUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	definition := findServiceDefinition(u.scheme)
+	if definition == nil {
+		return nil, nil, fmt.Errorf("notify url scheme is not supported: %s", u.scheme)
+	}
+
+	urlFlags, err := definition.ParseURL(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flags := make(map[string]string)
+	flagNames := make(map[string]bool)
+
+	for _, flag := range definition.CLIFlags() {
+		name := flag.Names()[0]
+		flagNames[name] = true
+
+		if stringFlag, ok := flag.(*cli.StringFlag); ok {
+			flags[name] = stringFlag.Value
+		}
+	}
+
+	for key, values := range u.query {
+		name := definition.Prefix + "-" + key
+
+		if !flagNames[name] {
+			return nil, nil, fmt.Errorf("notify url parameter is invalid: %s", key)
+		}
+
+		flags[name] = strings.Join(values, ",")
+	}
+
+	for name, value := range urlFlags {
+		flags[name] = value
+	}
+
+	return definition, flags, nil
+}
+
+// initNotifyServices creates and initializes the services described by notification URLs, offline
+// when they are only used for rendering the messages. It returns the successfully initialized
+// services and the errors of the other URLs.
+func initNotifyServices(urls []string, offline bool) ([]Service, []error) {
+	var services []Service
+	var initErrors []error
+
+	for _, rawUrl := range urls {
+		definition, flags, err := notifyServiceFlags(rawUrl)
+
+		if err == nil {
+			var service Service
+
+			if offline {
+				flags[offlineInitFlag] = "true"
+			}
+
+			if service, err = definition.initService(flags); err == nil {
+				services = append(services, service)
+				continue
+			}
+		}
+
+		slog.Error("Error while initializing notify url service", "error", err)
+		initErrors = append(initErrors, err)
+	}
+
+	return services, initErrors
+}
+
+// splitNotifyURLs splits the values of the notify flag which contain multiple URLs separated by
+// whitespace, which is convenient in environment variables and configuration files.
+func splitNotifyURLs(values []string) []string {
+	var urls []string
+
+	for _, value := range values {
+		urls = append(urls, strings.Fields(value)...)
+	}
+
+	return urls
+}
+
+// notifySchemeNames returns the supported schemes, sorted by name.
+func notifySchemeNames() []string {
+	var names []string
+
+	for _, definition := range serviceDefinitions {
+		names = append(names, definition.Schemes...)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// notifyCLIFlags returns the flags used for configuring services using notification URLs.
+func notifyCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    notifyFlag,
+			Usage:   fmt.Sprintf("Service url such as 'tgram://token/chat-id', repeated for multiple services. Supported schemes: %s (Optional)", strings.Join(notifySchemeNames(), ", ")),
+			EnvVars: []string{notifyEnv},
+		},
+	}
+}
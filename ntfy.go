@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/urfave/cli/v2"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	ntfyUrlFlag      = "ntfy-url"
+	ntfyTopicFlag    = "ntfy-topic"
+	ntfyTokenFlag    = "ntfy-token"
+	ntfyPriorityFlag = "ntfy-priority"
+	ntfyUrlEnv       = "TEGAMI_NTFY_URL"
+	ntfyTopicEnv     = "TEGAMI_NTFY_TOPIC"
+	ntfyTokenEnv     = "TEGAMI_NTFY_TOKEN"
+	ntfyPriorityEnv  = "TEGAMI_NTFY_PRIORITY"
+)
+
+// ntfyDefaultUrl is the public ntfy server.
+const ntfyDefaultUrl = "https://ntfy.sh"
+
+// ntfyMaxMessageLength keeps the messages below the 4096 bytes after which ntfy turns them into attachments.
+const ntfyMaxMessageLength = 4000
+
+// NtfyService manages ntfy related components.
+type NtfyService struct {
+	client   *http.Client
+	url      string
+	topic    string
+	token    string
+	priority int
+}
+
+type ntfyPayload struct {
+	Topic    string `json:"topic"`
+	Title    string `json:"title,omitempty"`
+	Message  string `json:"message"`
+	Markdown bool   `json:"markdown"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "ntfy",
+		Prefix:   "ntfy",
+		Flags:    ntfyCLIFlags,
+		Required: [][]string{{ntfyTopicFlag}},
+		Secrets:  []string{ntfyTokenFlag},
+		New:      func() Service { return &NtfyService{} },
+		Schemes:  []string{"ntfy", "ntfys"},
+		ParseURL: parseNtfyNotifyURL,
+	})
+}
+
+func (s *NtfyService) Init(flags map[string]string) error {
+	serverUrl := strings.TrimSuffix(flags[ntfyUrlFlag], "/")
+	topic := flags[ntfyTopicFlag]
+
+	if len(topic) == 0 {
+		return errors.New("ntfy topic not set")
+	}
+
+	if len(serverUrl) == 0 {
+		serverUrl = ntfyDefaultUrl
+	}
+
+	if _, err := url.ParseRequestURI(serverUrl); err != nil {
+		return errors.New("ntfy url is invalid")
+	}
+
+	priority, err := parseOptionalInt(flags[ntfyPriorityFlag], 0)
+	if err != nil || priority < 0 || priority > 5 {
+		return errors.New("ntfy priority is invalid")
+	}
+
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.url = serverUrl
+	s.topic = topic
+	s.token = flags[ntfyTokenFlag]
+	s.priority = priority
+	return nil
+}
+
+func (s *NtfyService) Send(ctx context.Context, msg *Message) error {
+	var headers map[string]string
+
+	if len(s.token) > 0 {
+		headers = map[string]string{"Authorization": "Bearer " + s.token}
+	}
+
+	return postJSON(ctx, s.client, s.url, headers, s.payload(msg), nil)
+}
+
+func (s *NtfyService) Render(msg *Message) (string, string, error) {
+	return renderJSON(s.payload(msg))
+}
+
+// payload creates the notification of a message.
+func (s *NtfyService) payload(msg *Message) *ntfyPayload {
+	return &ntfyPayload{
+		Topic:    s.topic,
+		Title:    msg.Subject,
+		Message:  truncateString(msg.Markdown, ntfyMaxMessageLength),
+		Markdown: true,
+		Priority: s.priority,
+	}
+}
+
+func (s *NtfyService) IsMarkdownService() bool {
+	return true
+}
+
+func (s *NtfyService) Close() error {
+	return nil
+}
+
+// parseNtfyNotifyURL converts URLs in the form ntfy://topic for the public server, or
+// ntfy[s]://[token@]host/topic for another server, into flags.
+func parseNtfyNotifyURL(u *notifyURL) (map[string]string, error) {
+	flags := map[string]string{ntfyTokenFlag: u.username}
+
+	switch {
+	case len(u.host) > 0 && len(u.segments) == 0 && u.scheme == "ntfy":
+		flags[ntfyUrlFlag] = ntfyDefaultUrl
+		flags[ntfyTopicFlag] = u.host
+	case len(u.host) > 0 && len(u.segments) == 1:
+		scheme := "http"
+		if u.scheme == "ntfys" {
+			scheme = "https"
+		}
+
+		flags[ntfyUrlFlag] = scheme + "://" + u.host
+		flags[ntfyTopicFlag] = u.segments[0]
+	default:
+		return nil, errors.New("ntfy url is invalid, expected ntfy://topic or ntfy[s]://[token@]host/topic")
+	}
+
+	return flags, nil
+}
+
+// ntfyCLIFlags returns the flags used for configuring ntfy.
+func ntfyCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    ntfyUrlFlag,
+			Value:   ntfyDefaultUrl,
+			Usage:   "The url of the ntfy server (Optional)",
+			EnvVars: []string{ntfyUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    ntfyTopicFlag,
+			Usage:   "The ntfy topic receiving the messages",
+			EnvVars: []string{ntfyTopicEnv},
+		},
+		&cli.StringFlag{
+			Name:    ntfyTokenFlag,
+			Usage:   "The access token used for publishing to a protected topic (Optional)",
+			EnvVars: []string{ntfyTokenEnv},
+		},
+		&cli.StringFlag{
+			Name:    ntfyPriorityFlag,
+			Usage:   "The priority of the notifications, from 1 (min) to 5 (max), the default priority of ntfy being used if not set (Optional)",
+			EnvVars: []string{ntfyPriorityEnv},
+		},
+	}
+}
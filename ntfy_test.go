@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNtfyService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flags   map[string]string
+			wantErr string
+		}{
+			{"With valid arguments", map[string]string{ntfyTopicFlag: "alerts", ntfyPriorityFlag: "5"}, ""},
+			{"With missing topic", map[string]string{ntfyUrlFlag: "https://ntfy.example.com"}, "ntfy topic not set"},
+			{"With invalid url", map[string]string{ntfyUrlFlag: "foo", ntfyTopicFlag: "alerts"}, "ntfy url is invalid"},
+			{"With invalid priority", map[string]string{ntfyTopicFlag: "alerts", ntfyPriorityFlag: "6"}, "ntfy priority is invalid"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := (&NtfyService{}).Init(test.flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		var payload ntfyPayload
+		var authorization string
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &payload)
+			authorization = r.Header.Get("Authorization")
+			io.WriteString(w, "{}")
+		}))
+		defer srv.Close()
+
+		service := &NtfyService{}
+		flags := map[string]string{ntfyUrlFlag: srv.URL + "/", ntfyTopicFlag: "alerts", ntfyTokenFlag: "tk_abc", ntfyPriorityFlag: "4"}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start ntfy service: %v", err)
+		}
+
+		if err := service.Send(context.Background(), &Message{Subject: "Backup done", Markdown: "Backup **succeeded**"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), payload.Topic, "alerts")
+		assertMessageContent(t, t.Name(), payload.Title, "Backup done")
+		assertMessageContent(t, t.Name(), payload.Message, "Backup **succeeded**")
+		assertMessageContent(t, t.Name(), authorization, "Bearer tk_abc")
+
+		if !payload.Markdown || payload.Priority != 4 {
+			t.Errorf("Unexpected payload: %+v", payload)
+		}
+	})
+}
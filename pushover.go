@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/html"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	pushoverApiUrlFlag            = "pushover-api-url"
+	pushoverTokenFlag             = "pushover-token"
+	pushoverUserFlag              = "pushover-user"
+	pushoverDeviceFlag            = "pushover-device"
+	pushoverRoutesFlag            = "pushover-routes"
+	pushoverEmergencyKeywordsFlag = "pushover-emergency-keywords"
+	pushoverHighKeywordsFlag      = "pushover-high-keywords"
+	pushoverRetryFlag             = "pushover-retry"
+	pushoverExpireFlag            = "pushover-expire"
+	pushoverApiUrlEnv             = "TEGAMI_PUSHOVER_API_URL"
+	pushoverTokenEnv              = "TEGAMI_PUSHOVER_TOKEN"
+	pushoverUserEnv               = "TEGAMI_PUSHOVER_USER"
+	pushoverDeviceEnv             = "TEGAMI_PUSHOVER_DEVICE"
+	pushoverRoutesEnv             = "TEGAMI_PUSHOVER_ROUTES"
+	pushoverEmergencyKeywordsEnv  = "TEGAMI_PUSHOVER_EMERGENCY_KEYWORDS"
+	pushoverHighKeywordsEnv       = "TEGAMI_PUSHOVER_HIGH_KEYWORDS"
+	pushoverRetryEnv              = "TEGAMI_PUSHOVER_RETRY"
+	pushoverExpireEnv             = "TEGAMI_PUSHOVER_EXPIRE"
+)
+
+// Pushover priority levels, as defined in https://pushover.net/api#priority
+const (
+	pushoverLowestPriority    = -2
+	pushoverLowPriority       = -1
+	pushoverNormalPriority    = 0
+	pushoverHighPriority      = 1
+	pushoverEmergencyPriority = 2
+)
+
+const (
+	pushoverMaxMessageLength  = 1024
+	pushoverMaxTitleLength    = 250
+	pushoverMaxAttachmentSize = 5 * 1024 * 1024
+	pushoverMinRetry          = 30
+	pushoverMaxExpire         = 10800
+)
+
+// pushoverHTML is the subset of HTML supported by the Pushover messages, their newlines being kept.
+var pushoverHTML = &htmlSubset{
+	tags: map[string]string{
+		"b": "b", "strong": "b", "h1": "b", "h2": "b", "h3": "b", "h4": "b", "h5": "b", "h6": "b", "th": "b",
+		"i": "i", "em": "i", "cite": "i",
+		"u": "u", "ins": "u",
+	},
+}
+
+// PushoverRecipient identifies a Pushover user or group key and optionally the
+// devices of the user the notification is sent to.
+type PushoverRecipient struct {
+	user   string
+	device string
+}
+
+// PushoverService manages Pushover related components.
+type PushoverService struct {
+	client            *http.Client
+	apiUrl            string
+	token             string
+	recipient         *PushoverRecipient
+	routes            Routes
+	emergencyKeywords []string
+	highKeywords      []string
+	retry             int
+	expire            int
+}
+
+type pushoverResponse struct {
+	Status int
+	Errors []string
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Pushover",
+		Prefix:   "pushover",
+		Flags:    pushoverCLIFlags,
+		Required: [][]string{{pushoverTokenFlag}, {pushoverUserFlag}},
+		Secrets:  []string{pushoverTokenFlag, pushoverUserFlag, pushoverRoutesFlag},
+		New:      func() Service { return &PushoverService{} },
+		Schemes:  []string{"pover"},
+		ParseURL: parsePushoverNotifyURL,
+	})
+}
+
+func (s *PushoverService) Init(flags map[string]string) error {
+	token := flags[pushoverTokenFlag]
+	user := flags[pushoverUserFlag]
+
+	if len(token) == 0 {
+		return errors.New("pushover token not set")
+	}
+
+	if len(user) == 0 {
+		return errors.New("pushover user not set")
+	}
+
+	routes, err := ParseRoutes(flags[pushoverRoutesFlag])
+	if err != nil {
+		return err
+	}
+
+	retry, err := parseOptionalInt(flags[pushoverRetryFlag], 60)
+	if err != nil || retry < pushoverMinRetry {
+		return fmt.Errorf("pushover retry must be at least %d seconds", pushoverMinRetry)
+	}
+
+	expire, err := parseOptionalInt(flags[pushoverExpireFlag], 3600)
+	if err != nil || expire <= 0 || expire > pushoverMaxExpire {
+		return fmt.Errorf("pushover expire must be between 1 and %d seconds", pushoverMaxExpire)
+	}
+
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.apiUrl = strings.TrimSuffix(flags[pushoverApiUrlFlag], "/")
+	s.token = token
+	s.recipient = &PushoverRecipient{user: user, device: flags[pushoverDeviceFlag]}
+	s.routes = routes
+	s.emergencyKeywords = splitKeywords(flags[pushoverEmergencyKeywordsFlag])
+	s.highKeywords = splitKeywords(flags[pushoverHighKeywordsFlag])
+	s.retry = retry
+	s.expire = expire
+
+	if len(s.apiUrl) == 0 {
+		s.apiUrl = "https://api.pushover.net"
+	}
+
+	probeOnInit(flags, "Pushover", s)
+	return nil
+}
+
+func (s *PushoverService) Send(ctx context.Context, msg *Message) error {
+	recipients := s.recipients(msg)
+
+	return sendToEach(len(recipients), func(i int) error {
+		return s.sendTo(ctx, recipients[i], msg)
+	})
+}
+
+func (s *PushoverService) Render(msg *Message) (string, string, error) {
+	return "HTML", formatPushoverMessage(msg), nil
+}
+
+func (s *PushoverService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *PushoverService) Close() error {
+	return nil
+}
+
+// Probe verifies that the application token and the default recipient are still accepted by Pushover.
+func (s *PushoverService) Probe(ctx context.Context) error {
+	return s.validate(ctx, s.recipient)
+}
+
+// Priority determines the Pushover priority of a message. Subject keywords have precedence
+// over the X-Priority and Importance headers of the email.
+func (s *PushoverService) Priority(msg *Message) int {
+	subject := strings.ToLower(msg.Subject)
+
+	if containsKeyword(subject, s.emergencyKeywords) {
+		return pushoverEmergencyPriority
+	}
+
+	if containsKeyword(subject, s.highKeywords) {
+		return pushoverHighPriority
+	}
+
+	// X-Priority values range from 1 (Highest) to 5 (Lowest).
+	if xPriority := strings.TrimSpace(msg.Header.Get("X-Priority")); len(xPriority) > 0 {
+		switch xPriority[0] {
+		case '1', '2':
+			return pushoverHighPriority
+		case '4':
+			return pushoverLowPriority
+		case '5':
+			return pushoverLowestPriority
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(msg.Header.Get("Importance"))) {
+	case "high":
+		return pushoverHighPriority
+	case "low":
+		return pushoverLowPriority
+	}
+
+	return pushoverNormalPriority
+}
+
+// recipients returns the recipients of the routes matching the message or the default one.
+func (s *PushoverService) recipients(msg *Message) []*PushoverRecipient {
+	destinations := s.routes.Match(msg.To)
+
+	if len(destinations) == 0 {
+		return []*PushoverRecipient{s.recipient}
+	}
+
+	recipients := make([]*PushoverRecipient, len(destinations))
+
+	for i, destination := range destinations {
+		parts := strings.SplitN(destination, ":", 2)
+		recipients[i] = &PushoverRecipient{user: parts[0]}
+
+		if len(parts) == 2 {
+			recipients[i].device = parts[1]
+		}
+	}
+
+	return recipients
+}
+
+// validate ensures the application token and the default recipient are accepted by Pushover.
+func (s *PushoverService) validate(ctx context.Context, recipient *PushoverRecipient) error {
+	values := url.Values{}
+	values.Set("token", s.token)
+	values.Set("user", recipient.user)
+
+	if len(recipient.device) > 0 {
+		values.Set("device", recipient.device)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiUrl+"/1/users/validate.json", strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return &TemporaryError{Err: err}
+	}
+
+	return readPushoverResponse(resp)
+}
+
+// sendTo sends the message to a single Pushover recipient.
+func (s *PushoverService) sendTo(ctx context.Context, recipient *PushoverRecipient, msg *Message) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	priority := s.Priority(msg)
+
+	fields := map[string]string{
+		"token":    s.token,
+		"user":     recipient.user,
+		"title":    truncateString(msg.Subject, pushoverMaxTitleLength),
+		"message":  formatPushoverMessage(msg),
+		"html":     "1",
+		"priority": strconv.Itoa(priority),
+	}
+
+	if !msg.Date.IsZero() {
+		fields["timestamp"] = strconv.FormatInt(msg.Date.Unix(), 10)
+	}
+
+	if len(recipient.device) > 0 {
+		fields["device"] = recipient.device
+	}
+
+	if priority == pushoverEmergencyPriority {
+		fields["retry"] = strconv.Itoa(s.retry)
+		fields["expire"] = strconv.Itoa(s.expire)
+	}
+
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+
+	if image := msg.FirstImage(); image != nil && len(image.Data) <= pushoverMaxAttachmentSize {
+		if err := writeMultipartFile(writer, "attachment", image); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiUrl+"/1/messages.json", &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return &TemporaryError{Err: err}
+	}
+
+	return readPushoverResponse(resp)
+}
+
+// formatPushoverMessage converts the message into the HTML supported by Pushover, within the
+// maximum length of the notifications.
+func formatPushoverMessage(msg *Message) string {
+	return formatHTMLSubset(pushoverMessageText(msg), pushoverMaxMessageLength, pushoverHTML)
+}
+
+// pushoverMessageText returns the HTML text of the notification as Pushover refuses empty messages.
+func pushoverMessageText(msg *Message) string {
+	if len(msg.HTML) > 0 {
+		return msg.HTML
+	}
+
+	if len(msg.Subject) > 0 {
+		return html.EscapeString(msg.Subject)
+	}
+
+	return "(no content)"
+}
+
+// readPushoverResponse validates the response of the Pushover API and closes its body.
+func readPushoverResponse(resp *http.Response) error {
+	var response pushoverResponse
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(body, &response); err != nil {
+		return statusError(resp.StatusCode, fmt.Errorf("invalid pushover response (status %d): %s", resp.StatusCode, body))
+	}
+
+	if response.Status != 1 {
+		return statusError(resp.StatusCode, fmt.Errorf("pushover error (status %d): %s", resp.StatusCode, strings.Join(response.Errors, ", ")))
+	}
+
+	return nil
+}
+
+// parsePushoverNotifyURL converts URLs in the form pover://user@token[/device...] into flags.
+func parsePushoverNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.username) == 0 || len(u.host) == 0 {
+		return nil, errors.New("pushover url is invalid, expected pover://user@token")
+	}
+
+	return map[string]string{
+		pushoverUserFlag:   u.username,
+		pushoverTokenFlag:  u.host,
+		pushoverDeviceFlag: strings.Join(u.segments, ","),
+	}, nil
+}
+
+// pushoverCLIFlags returns the flags used for configuring the Pushover service.
+func pushoverCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    pushoverApiUrlFlag,
+			Value:   "https://api.pushover.net",
+			Usage:   "The API url used for communicating with Pushover (Optional)",
+			EnvVars: []string{pushoverApiUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverTokenFlag,
+			Usage:   "The application token used for Pushover",
+			EnvVars: []string{pushoverTokenEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverUserFlag,
+			Usage:   "The Pushover user or group key receiving the notifications",
+			EnvVars: []string{pushoverUserEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverDeviceFlag,
+			Usage:   "The Pushover devices receiving the notifications, separated by commas (Optional)",
+			EnvVars: []string{pushoverDeviceEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverRoutesFlag,
+			Usage:   "Per recipient user keys in the form 'recipient=user[:device]', separated by commas (Optional)",
+			EnvVars: []string{pushoverRoutesEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverEmergencyKeywordsFlag,
+			Usage:   "Subject keywords sending emergency notifications, separated by commas (Optional)",
+			EnvVars: []string{pushoverEmergencyKeywordsEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverHighKeywordsFlag,
+			Usage:   "Subject keywords sending high priority notifications, separated by commas (Optional)",
+			EnvVars: []string{pushoverHighKeywordsEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverRetryFlag,
+			Value:   "60",
+			Usage:   "Seconds between retries of unacknowledged emergency notifications (Optional)",
+			EnvVars: []string{pushoverRetryEnv},
+		},
+		&cli.StringFlag{
+			Name:    pushoverExpireFlag,
+			Value:   "3600",
+			Usage:   "Seconds during which emergency notifications are retried (Optional)",
+			EnvVars: []string{pushoverExpireEnv},
+		},
+	}
+}
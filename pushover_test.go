@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type pushoverRequest struct {
+	fields     map[string]string
+	attachment string
+}
+
+func TestPushoverService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		_, srv := createStubPushoverServer(t)
+		defer srv.Close()
+
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With valid arguments", "", "", ""},
+			{"With missing token", pushoverTokenFlag, "", "pushover token not set"},
+			{"With missing user", pushoverUserFlag, "", "pushover user not set"},
+			{"With invalid user", pushoverUserFlag, "foo", "pushover error (status 400): user key is invalid"},
+			{"With short retry", pushoverRetryFlag, "10", "pushover retry must be at least 30 seconds"},
+			{"With long expire", pushoverExpireFlag, "20000", "pushover expire must be between 1 and 10800 seconds"},
+			{"With invalid routes", pushoverRoutesFlag, "foo", "invalid route: foo"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := generatePushoverTestFlags(srv.URL)
+
+				if len(test.flag) > 0 {
+					flags[test.flag] = test.value
+				}
+
+				err := initAndProbe(&PushoverService{}, flags)
+
+				if len(test.wantErr) == 0 && err != nil {
+					t.Errorf("Could not start Pushover service: %v", err)
+				}
+
+				if len(test.wantErr) > 0 {
+					if err == nil {
+						t.Fatalf("Could start Pushover service even though we should not")
+					}
+					assertErrorContent(t, err.Error(), test.wantErr)
+				}
+			})
+		}
+	})
+
+	t.Run("Priority", func(t *testing.T) {
+		service := &PushoverService{
+			emergencyKeywords: splitKeywords("DOWN, Critical"),
+			highKeywords:      splitKeywords("warning"),
+		}
+
+		var tests = []struct {
+			name    string
+			subject string
+			headers map[string]string
+			want    int
+		}{
+			{"No importance", "Backup done", nil, pushoverNormalPriority},
+			{"Emergency keyword", "Server is down", nil, pushoverEmergencyPriority},
+			{"High keyword", "Disk WARNING", nil, pushoverHighPriority},
+			{"Keyword over header", "critical failure", map[string]string{"X-Priority": "5 (Lowest)"}, pushoverEmergencyPriority},
+			{"Highest X-Priority", "", map[string]string{"X-Priority": "1 (Highest)"}, pushoverHighPriority},
+			{"Low X-Priority", "", map[string]string{"X-Priority": "4"}, pushoverLowPriority},
+			{"Lowest X-Priority", "", map[string]string{"X-Priority": "5"}, pushoverLowestPriority},
+			{"High importance", "", map[string]string{"Importance": "High"}, pushoverHighPriority},
+			{"Low importance", "", map[string]string{"Importance": "low"}, pushoverLowPriority},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				var header mail.Header
+
+				for key, value := range test.headers {
+					header.Set(key, value)
+				}
+
+				got := service.Priority(&Message{Subject: test.subject, Header: header})
+
+				if got != test.want {
+					t.Errorf("Priority %d different than expected %d", got, test.want)
+				}
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		requests, srv := createStubPushoverServer(t)
+		defer srv.Close()
+
+		flags := generatePushoverTestFlags(srv.URL)
+		flags[pushoverRoutesFlag] = "ops@example.com=ops:pager"
+		flags[pushoverEmergencyKeywordsFlag] = "down"
+		service := &PushoverService{}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start Pushover service: %v", err)
+		}
+
+		t.Run("Emergency message with image", func(t *testing.T) {
+			msg := &Message{
+				To:      []string{"root@example.com"},
+				Subject: "Server down",
+				HTML:    "<b>web01</b> is not responding",
+				Attachments: []*Attachment{
+					{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report")},
+					{Filename: "graph.png", ContentType: "image/png", Data: []byte("png data")},
+				},
+			}
+
+			if err := service.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Error while we weren't supposed to get any: %v", err)
+			}
+
+			request := (*requests)[len(*requests)-1]
+			assertMessageContent(t, t.Name(), request.fields["user"], "abc123")
+			assertMessageContent(t, t.Name(), request.fields["title"], "Server down")
+			assertMessageContent(t, t.Name(), request.fields["message"], msg.HTML)
+			assertMessageContent(t, t.Name(), request.fields["html"], "1")
+			assertMessageContent(t, t.Name(), request.fields["priority"], "2")
+			assertMessageContent(t, t.Name(), request.fields["retry"], "60")
+			assertMessageContent(t, t.Name(), request.fields["expire"], "3600")
+			assertMessageContent(t, t.Name(), request.attachment, "png data")
+		})
+
+		t.Run("Routed message", func(t *testing.T) {
+			msg := &Message{To: []string{"ops@example.com"}, Subject: "Backup done"}
+
+			if err := service.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Error while we weren't supposed to get any: %v", err)
+			}
+
+			request := (*requests)[len(*requests)-1]
+			assertMessageContent(t, t.Name(), request.fields["user"], "ops")
+			assertMessageContent(t, t.Name(), request.fields["device"], "pager")
+			assertMessageContent(t, t.Name(), request.fields["message"], "Backup done")
+			assertMessageContent(t, t.Name(), request.fields["priority"], "0")
+
+			if _, ok := request.fields["retry"]; ok {
+				t.Errorf("Retry set for a non emergency message")
+			}
+		})
+
+		t.Run("Rejected message", func(t *testing.T) {
+			msg := &Message{To: []string{"bad@example.com"}, Subject: "Backup done"}
+			service.routes = Routes{"bad@example.com": "invalid"}
+
+			if err := service.Send(context.Background(), msg); err == nil {
+				t.Errorf("We didn't get any error while we were supposed to get one")
+			}
+		})
+
+		t.Run("Partially delivered message", func(t *testing.T) {
+			msg := &Message{To: []string{"ops@example.com", "bad@example.com"}, Subject: "Backup done"}
+			service.routes = Routes{"ops@example.com": "ops", "bad@example.com": "invalid"}
+			sent := len(*requests)
+			err := service.Send(context.Background(), msg)
+
+			if err == nil || IsTemporaryError(err) {
+				t.Errorf("Expected a permanent error, got %v", err)
+			}
+
+			assertErrorContent(t, fmt.Sprint(err), "message sent to 1 of 2 destinations: pushover error (status 400): user identifier is invalid")
+
+			if len(*requests)-sent != 2 {
+				t.Errorf("Expected the message to be sent to every recipient, got %d requests", len(*requests)-sent)
+			}
+		})
+
+		t.Run("HTML email", func(t *testing.T) {
+			body := `<html><head><style>td { color: red; }</style></head><body>
+<p>Disk <strong>2</strong> <del>failed</del></p>
+<table><tr><td>Pool</td><td><font color="red">degraded</font></td></tr></table>
+</body></html>`
+			msg := &Message{To: []string{"root@example.com"}, HTML: body}
+			service.routes = nil
+
+			if err := service.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Error while we weren't supposed to get any: %v", err)
+			}
+
+			request := (*requests)[len(*requests)-1]
+			assertMessageContent(t, t.Name(), request.fields["message"], "Disk <b>2</b> failed\n\nPool degraded")
+		})
+
+		t.Run("Long HTML message", func(t *testing.T) {
+			msg := &Message{To: []string{"root@example.com"}, HTML: strings.Repeat("a", 1010) + `<a href="https://example.com">link</a>`}
+			service.routes = nil
+
+			if err := service.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Error while we weren't supposed to get any: %v", err)
+			}
+
+			request := (*requests)[len(*requests)-1]
+			assertMessageContent(t, t.Name(), request.fields["message"], strings.Repeat("a", 1010)+"…")
+		})
+	})
+}
+
+func createStubPushoverServer(t *testing.T) (*[]pushoverRequest, *httptest.Server) {
+	t.Helper()
+	var requests []pushoverRequest
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/1/users/validate.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("user") != "abc123" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"status":0,"errors":["user key is invalid"]}`)
+			return
+		}
+		io.WriteString(w, `{"status":1}`)
+	})
+
+	mux.HandleFunc("/1/messages.json", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"status":0,"errors":["invalid form"]}`)
+			return
+		}
+
+		request := pushoverRequest{fields: make(map[string]string)}
+
+		for key, values := range r.MultipartForm.Value {
+			request.fields[key] = values[0]
+		}
+
+		if file, _, err := r.FormFile("attachment"); err == nil {
+			data, _ := io.ReadAll(file)
+			request.attachment = string(data)
+		}
+
+		requests = append(requests, request)
+
+		if strings.HasPrefix(request.fields["user"], "invalid") {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"status":0,"errors":["user identifier is invalid"]}`)
+			return
+		}
+		io.WriteString(w, `{"status":1}`)
+	})
+
+	return &requests, httptest.NewServer(mux)
+}
+
+func generatePushoverTestFlags(apiUrl string) map[string]string {
+	flags := make(map[string]string)
+	flags[pushoverApiUrlFlag] = apiUrl
+	flags[pushoverTokenFlag] = "token"
+	flags[pushoverUserFlag] = "abc123"
+	return flags
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"sync"
+	"time"
+)
+
+const (
+	queueRetriesFlag     = "queue-retries"
+	queueRetryDelayFlag  = "queue-retry-delay"
+	queueDeadLettersFlag = "queue-dead-letters"
+	queueRetriesEnv      = "TEGAMI_QUEUE_RETRIES"
+	queueRetryDelayEnv   = "TEGAMI_QUEUE_RETRY_DELAY"
+	queueDeadLettersEnv  = "TEGAMI_QUEUE_DEAD_LETTERS"
+)
+
+// queueMaxRetryDelay is the maximum delay between two attempts of a delivery.
+const queueMaxRetryDelay = 6 * time.Hour
+
+// The states of the deliveries, as reported by the metrics and the admin API.
+const (
+	deliveryPending    = "pending"
+	deliveryDeadLetter = "dead_letter"
+)
+
+// deliveryNotFoundError is returned when operating on a delivery which isn't in the queue, such as
+// a delivery being attempted.
+var deliveryNotFoundError = errors.New("delivery not found")
+
+// queueClosedError is returned when operating on the deliveries once the queue is shut down.
+var queueClosedError = errors.New("the queue is shut down")
+
+// Delivery is a message which couldn't be sent with a service yet.
+type Delivery struct {
+	// ID identifies the delivery in the admin API.
+	ID      string
+	Message *Message
+	Service Service
+	// Attempts is the number of times sending the message was attempted.
+	Attempts int
+	// LastError is the error returned by the last attempt.
+	LastError error
+	// NextAttempt is the time at which the message is sent again.
+	NextAttempt time.Time
+}
+
+// DeliveryQueue sends again in the background the messages which couldn't be sent because of a
+// temporary issue. The delay between the attempts doubles after each failure. Deliveries which
+// fail permanently or still fail after all their retries are moved to the dead letters, the oldest
+// ones being dropped once there are too many.
+type DeliveryQueue struct {
+	retries int
+	delay   time.Duration
+	// maxDeadLetters is the number of dead letters kept.
+	maxDeadLetters int
+	mutex          sync.Mutex
+	pending        []*Delivery
+	deadLetters    []*Delivery
+	closed         bool
+	// wake tells the worker that the pending deliveries changed.
+	wake chan struct{}
+	// done is closed once the worker stopped.
+	done chan struct{}
+	// ctx is the context of the attempts made by the worker, cancelled if the shutdown takes too long.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewDeliveryQueue creates a queue retrying each delivery a number of times and keeping a maximum
+// number of dead letters, and starts its worker.
+func NewDeliveryQueue(retries int, delay time.Duration, maxDeadLetters int) *DeliveryQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &DeliveryQueue{
+		retries:        retries,
+		delay:          delay,
+		maxDeadLetters: maxDeadLetters,
+		wake:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	go q.run()
+	return q
+}
+
+// createDeliveryQueue creates the queue configured by the flags, or returns nil when retries are disabled.
+func createDeliveryQueue(flags map[string]string) (*DeliveryQueue, error) {
+	retries, err := parseOptionalInt(flags[queueRetriesFlag], 0)
+	if err != nil || retries < 0 {
+		return nil, errors.New("queue retries is invalid")
+	}
+
+	delay, err := parseOptionalInt(flags[queueRetryDelayFlag], 30)
+	if err != nil || delay <= 0 {
+		return nil, errors.New("queue retry delay is invalid")
+	}
+
+	deadLetters, err := parseOptionalInt(flags[queueDeadLettersFlag], 100)
+	if err != nil || deadLetters < 0 {
+		return nil, errors.New("queue dead letters is invalid")
+	}
+
+	if retries == 0 {
+		return nil, nil
+	}
+
+	return NewDeliveryQueue(retries, time.Duration(delay)*time.Second, deadLetters), nil
+}
+
+// Add queues a message whose first attempt failed with a temporary error.
+func (q *DeliveryQueue) Add(msg *Message, service Service, err error) {
+	delivery := &Delivery{ID: newCorrelationId(), Message: msg, Service: service, Attempts: 1, LastError: err}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		msg.Logger().Error("Message lost, the queue is shut down", "service", serviceName(service), "error", err)
+		q.addDeadLetter(delivery)
+		q.updateDepth()
+		return
+	}
+
+	delivery.NextAttempt = time.Now().Add(retryDelay(q.delay, delivery.Attempts))
+	q.pending = append(q.pending, delivery)
+	q.updateDepth()
+	q.notify()
+}
+
+// Pending returns the deliveries waiting for their next attempt.
+func (q *DeliveryQueue) Pending() []*Delivery {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]*Delivery(nil), q.pending...)
+}
+
+// DeadLetters returns the deliveries which won't be attempted again.
+func (q *DeliveryQueue) DeadLetters() []*Delivery {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]*Delivery(nil), q.deadLetters...)
+}
+
+// DeliveryStatus describes a delivery of the queue at the time it was retrieved.
+type DeliveryStatus struct {
+	ID          string     `json:"id"`
+	MessageID   string     `json:"message_id"`
+	Subject     string     `json:"subject"`
+	Service     string     `json:"service"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	Received    time.Time  `json:"received"`
+}
+
+// Statuses returns the status of each pending delivery followed by the dead letters.
+func (q *DeliveryQueue) Statuses() []DeliveryStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	statuses := make([]DeliveryStatus, 0, len(q.pending)+len(q.deadLetters))
+
+	for _, delivery := range q.pending {
+		statuses = append(statuses, delivery.status(deliveryPending))
+	}
+
+	for _, delivery := range q.deadLetters {
+		statuses = append(statuses, delivery.status(deliveryDeadLetter))
+	}
+
+	return statuses
+}
+
+// FindMessage returns a message of the queue along with the status of each of its deliveries, or
+// nil if none of its deliveries are in the queue.
+func (q *DeliveryQueue) FindMessage(id string) (*Message, []DeliveryStatus) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var msg *Message
+	var statuses []DeliveryStatus
+
+	for _, delivery := range q.pending {
+		if delivery.Message.ID == id {
+			msg = delivery.Message
+			statuses = append(statuses, delivery.status(deliveryPending))
+		}
+	}
+
+	for _, delivery := range q.deadLetters {
+		if delivery.Message.ID == id {
+			msg = delivery.Message
+			statuses = append(statuses, delivery.status(deliveryDeadLetter))
+		}
+	}
+
+	return msg, statuses
+}
+
+// Retry attempts a delivery again as soon as possible, including a dead letter. The delivery is
+// sent with another service when the service is not nil.
+func (q *DeliveryQueue) Retry(id string, service Service) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return queueClosedError
+	}
+
+	delivery, state, index := q.find(id)
+	if delivery == nil {
+		return deliveryNotFoundError
+	}
+
+	if service != nil {
+		delivery.Service = service
+	}
+
+	if state == deliveryDeadLetter {
+		q.deadLetters = append(q.deadLetters[:index], q.deadLetters[index+1:]...)
+		q.pending = append(q.pending, delivery)
+	}
+
+	delivery.NextAttempt = time.Now()
+	q.updateDepth()
+	q.notify()
+	return nil
+}
+
+// Remove deletes a delivery, which won't be attempted again.
+func (q *DeliveryQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delivery, state, index := q.find(id)
+	if delivery == nil {
+		return deliveryNotFoundError
+	}
+
+	if state == deliveryPending {
+		q.pending = append(q.pending[:index], q.pending[index+1:]...)
+	} else {
+		q.deadLetters = append(q.deadLetters[:index], q.deadLetters[index+1:]...)
+	}
+
+	q.updateDepth()
+	return nil
+}
+
+// find returns a delivery with its state and its index in the deliveries having this state, or
+// nil if it isn't in the queue. The mutex must be held.
+func (q *DeliveryQueue) find(id string) (*Delivery, string, int) {
+	for i, delivery := range q.pending {
+		if delivery.ID == id {
+			return delivery, deliveryPending, i
+		}
+	}
+
+	for i, delivery := range q.deadLetters {
+		if delivery.ID == id {
+			return delivery, deliveryDeadLetter, i
+		}
+	}
+
+	return nil, "", -1
+}
+
+// status returns the status of the delivery, the mutex of its queue must be held.
+func (d *Delivery) status(state string) DeliveryStatus {
+	status := DeliveryStatus{
+		ID:        d.ID,
+		MessageID: d.Message.ID,
+		Subject:   d.Message.Subject,
+		Service:   serviceName(d.Service),
+		State:     state,
+		Attempts:  d.Attempts,
+		Received:  d.Message.Received,
+	}
+
+	if d.LastError != nil {
+		status.LastError = d.LastError.Error()
+	}
+
+	if state == deliveryPending {
+		nextAttempt := d.NextAttempt
+		status.NextAttempt = &nextAttempt
+	}
+
+	return status
+}
+
+// Shutdown stops the worker once its current attempt is done and makes a last attempt for each
+// pending delivery without waiting for its retry delay. The attempts are abandoned once the context
+// is done. It returns an error when some messages couldn't be sent.
+func (q *DeliveryQueue) Shutdown(ctx context.Context) error {
+	q.mutex.Lock()
+	q.closed = true
+	q.notify()
+	q.mutex.Unlock()
+
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+	}
+
+	q.cancel()
+
+	q.mutex.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.updateDepth()
+	q.mutex.Unlock()
+
+	failed := 0
+
+	for _, delivery := range pending {
+		if ctx.Err() != nil {
+			delivery.LastError = ctx.Err()
+		} else {
+			serviceRetries.Inc(serviceName(delivery.Service))
+			delivery.LastError = delivery.Service.Send(ctx, delivery.Message)
+			delivery.Attempts++
+		}
+
+		if delivery.LastError == nil {
+			delivery.Message.Logger().Info("Message sent before shutting down", "service", serviceName(delivery.Service), "attempts", delivery.Attempts)
+			continue
+		}
+
+		delivery.Message.Logger().Error("Message lost while shutting down", "service", serviceName(delivery.Service), "attempts", delivery.Attempts,
+			"error", delivery.LastError)
+		failed++
+
+		q.mutex.Lock()
+		q.addDeadLetter(delivery)
+		q.updateDepth()
+		q.mutex.Unlock()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d queued messages couldn't be sent", failed)
+	}
+
+	return nil
+}
+
+// addDeadLetter moves a delivery to the dead letters, dropping the oldest ones beyond the maximum.
+// The mutex must be held.
+func (q *DeliveryQueue) addDeadLetter(delivery *Delivery) {
+	q.deadLetters = append(q.deadLetters, delivery)
+
+	if dropped := len(q.deadLetters) - q.maxDeadLetters; dropped > 0 {
+		for _, deadLetter := range q.deadLetters[:dropped] {
+			deadLetter.Message.Logger().Warn("Dead letter dropped, too many messages couldn't be sent", "service", serviceName(deadLetter.Service))
+		}
+		q.deadLetters = append([]*Delivery(nil), q.deadLetters[dropped:]...)
+	}
+}
+
+// updateDepth updates the metrics of the number of deliveries, the mutex must be held.
+func (q *DeliveryQueue) updateDepth() {
+	queueDepth.Set(float64(len(q.pending)), deliveryPending)
+	queueDepth.Set(float64(len(q.deadLetters)), deliveryDeadLetter)
+}
+
+// notify wakes the worker up, the mutex must be held.
+func (q *DeliveryQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run attempts the deliveries once their retry delay has elapsed, until the queue is shut down.
+func (q *DeliveryQueue) run() {
+	defer close(q.done)
+
+	for {
+		q.mutex.Lock()
+
+		if q.closed {
+			q.mutex.Unlock()
+			return
+		}
+
+		delivery, wait := q.nextDelivery()
+		q.mutex.Unlock()
+
+		if delivery != nil {
+			q.attempt(delivery)
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-timeout:
+		case <-q.wake:
+		case <-q.ctx.Done():
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// nextDelivery removes and returns the first delivery whose retry delay has elapsed. Otherwise,
+// it returns the time until the next attempt, or 0 if there are no pending deliveries. The mutex
+// must be held.
+func (q *DeliveryQueue) nextDelivery() (*Delivery, time.Duration) {
+	var wait time.Duration
+	now := time.Now()
+
+	for i, delivery := range q.pending {
+		until := delivery.NextAttempt.Sub(now)
+
+		if until <= 0 {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.updateDepth()
+			return delivery, 0
+		}
+
+		if wait == 0 || until < wait {
+			wait = until
+		}
+	}
+
+	return nil, wait
+}
+
+// attempt sends a queued message again, queuing it for later or moving it to the dead letters if it fails.
+func (q *DeliveryQueue) attempt(delivery *Delivery) {
+	name := serviceName(delivery.Service)
+	serviceRetries.Inc(name)
+	err := delivery.Service.Send(q.ctx, delivery.Message)
+	delivery.Attempts++
+	delivery.LastError = err
+
+	logger := delivery.Message.Logger().With("service", name, "attempts", delivery.Attempts)
+
+	if err == nil {
+		logger.Info("Message sent from the queue")
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	defer q.updateDepth()
+
+	if IsTemporaryError(err) && delivery.Attempts <= q.retries {
+		delivery.NextAttempt = time.Now().Add(retryDelay(q.delay, delivery.Attempts))
+		logger.Warn("Message queued for another retry", "error", err, "next_attempt", delivery.NextAttempt)
+		q.pending = append(q.pending, delivery)
+		return
+	}
+
+	logger.Error("Message moved to the dead letters", "error", err)
+	q.addDeadLetter(delivery)
+}
+
+// retryDelay returns the delay before the attempt following a number of failed attempts.
+func retryDelay(delay time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && delay < queueMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > queueMaxRetryDelay {
+		return queueMaxRetryDelay
+	}
+
+	return delay
+}
+
+// queueCLIFlags returns the flags used for configuring the retries of the messages which couldn't be sent.
+func queueCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    queueRetriesFlag,
+			Value:   "0",
+			Usage:   "The number of times a message which couldn't be sent because of a temporary issue is sent again, or 0 for rejecting it with a temporary error so the sender retries it. The queued messages are only kept in memory and are lost on a crash or when the shutdown timeout expires (Optional)",
+			EnvVars: []string{queueRetriesEnv},
+		},
+		&cli.StringFlag{
+			Name:    queueRetryDelayFlag,
+			Value:   "30",
+			Usage:   "The number of seconds before sending a message again, doubled after each attempt (Optional)",
+			EnvVars: []string{queueRetryDelayEnv},
+		},
+		&cli.StringFlag{
+			Name:    queueDeadLettersFlag,
+			Value:   "100",
+			Usage:   "The number of messages which couldn't be sent kept for the admin API, the oldest ones being dropped (Optional)",
+			EnvVars: []string{queueDeadLettersEnv},
+		},
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyService fails with an error until it has been called a number of times.
+type flakyService struct {
+	mutex    sync.Mutex
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyService) Init(_ map[string]string) error {
+	return nil
+}
+
+func (s *flakyService) Send(_ context.Context, _ *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *flakyService) Close() error {
+	return nil
+}
+
+func (s *flakyService) callCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	temporaryErr := &TemporaryError{Err: errors.New("server unavailable")}
+	msg := &Message{Subject: "Disk failure"}
+
+	t.Run("Retried until sent", func(t *testing.T) {
+		service := &flakyService{failures: 2, err: temporaryErr}
+		queue := NewDeliveryQueue(5, 10*time.Millisecond, 100)
+		defer queue.Shutdown(context.Background())
+
+		queue.Add(msg, service, temporaryErr)
+		waitForCondition(t, "message sent", func() bool {
+			return service.callCount() == 3 && len(queue.Pending()) == 0
+		})
+
+		if len(queue.DeadLetters()) != 0 {
+			t.Errorf("Expected no dead letters, got %d", len(queue.DeadLetters()))
+		}
+	})
+
+	t.Run("Dead letter after the retries", func(t *testing.T) {
+		service := &flakyService{failures: 100, err: temporaryErr}
+		queue := NewDeliveryQueue(2, 10*time.Millisecond, 100)
+		defer queue.Shutdown(context.Background())
+
+		queue.Add(msg, service, temporaryErr)
+		waitForCondition(t, "message moved to the dead letters", func() bool {
+			return len(queue.DeadLetters()) == 1
+		})
+
+		delivery := queue.DeadLetters()[0]
+
+		if delivery.Attempts != 3 || delivery.LastError != temporaryErr || service.callCount() != 2 {
+			t.Errorf("Unexpected dead letter after %d attempts and %d calls: %v", delivery.Attempts, service.callCount(), delivery.LastError)
+		}
+	})
+
+	t.Run("Dead letter after a permanent error", func(t *testing.T) {
+		service := &flakyService{failures: 100, err: errors.New("invalid token")}
+		queue := NewDeliveryQueue(5, 10*time.Millisecond, 100)
+		defer queue.Shutdown(context.Background())
+
+		queue.Add(msg, service, temporaryErr)
+		waitForCondition(t, "message moved to the dead letters", func() bool {
+			return len(queue.DeadLetters()) == 1
+		})
+
+		if service.callCount() != 1 {
+			t.Errorf("Expected a single retry, got %d", service.callCount())
+		}
+	})
+
+	t.Run("Sent when shutting down", func(t *testing.T) {
+		service := &flakyService{}
+		queue := NewDeliveryQueue(5, time.Hour, 100)
+		queue.Add(msg, service, temporaryErr)
+
+		if err := queue.Shutdown(context.Background()); err != nil {
+			t.Errorf("Unexpected shutdown error: %v", err)
+		}
+
+		if service.callCount() != 1 || len(queue.Pending()) != 0 {
+			t.Errorf("The queued message wasn't sent when shutting down")
+		}
+	})
+
+	t.Run("Lost when shutting down", func(t *testing.T) {
+		service := &flakyService{failures: 100, err: temporaryErr}
+		queue := NewDeliveryQueue(5, time.Hour, 100)
+		queue.Add(msg, service, temporaryErr)
+		err := queue.Shutdown(context.Background())
+
+		if err == nil {
+			t.Fatalf("Expected a shutdown error")
+		}
+
+		assertErrorContent(t, err.Error(), "1 queued messages couldn't be sent")
+
+		if len(queue.DeadLetters()) != 1 {
+			t.Errorf("Expected the lost message in the dead letters")
+		}
+	})
+}
+
+func TestDeliveryQueueRetryDeadLetter(t *testing.T) {
+	service := &flakyService{failures: 1, err: errors.New("invalid token")}
+	queue := NewDeliveryQueue(5, time.Hour, 100)
+	defer queue.Shutdown(context.Background())
+
+	queue.Add(&Message{Subject: "Disk failure"}, service, &TemporaryError{Err: errors.New("server unavailable")})
+	id := queue.Statuses()[0].ID
+
+	if err := queue.Retry(id, nil); err != nil {
+		t.Fatalf("Could not retry the delivery: %v", err)
+	}
+
+	waitForCondition(t, "delivery moved to the dead letters", func() bool {
+		return len(queue.DeadLetters()) == 1
+	})
+
+	if status := queue.Statuses()[0]; status.State != deliveryDeadLetter || status.LastError != "invalid token" || status.NextAttempt != nil {
+		t.Errorf("Unexpected dead letter status: %+v", status)
+	}
+
+	if err := queue.Retry(id, nil); err != nil {
+		t.Fatalf("Could not retry the dead letter: %v", err)
+	}
+
+	waitForCondition(t, "dead letter sent", func() bool {
+		return service.callCount() == 2 && len(queue.Statuses()) == 0
+	})
+
+	if err := queue.Remove(id); !errors.Is(err, deliveryNotFoundError) {
+		t.Errorf("Expected the sent delivery not found, got %v", err)
+	}
+}
+
+func TestDeliveryQueueDeadLetterLimit(t *testing.T) {
+	service := &flakyService{failures: 10, err: errors.New("invalid token")}
+	queue := NewDeliveryQueue(5, 10*time.Millisecond, 2)
+	defer queue.Shutdown(context.Background())
+
+	for _, subject := range []string{"First", "Second", "Third"} {
+		queue.Add(&Message{Subject: subject}, service, &TemporaryError{Err: errors.New("server unavailable")})
+		waitForCondition(t, "delivery moved to the dead letters", func() bool {
+			deadLetters := queue.DeadLetters()
+			return len(deadLetters) > 0 && deadLetters[len(deadLetters)-1].Message.Subject == subject
+		})
+	}
+
+	deadLetters := queue.DeadLetters()
+
+	if len(deadLetters) != 2 || deadLetters[0].Message.Subject != "Second" || deadLetters[1].Message.Subject != "Third" {
+		t.Errorf("Expected the oldest dead letter dropped, got %d dead letters", len(deadLetters))
+	}
+}
+
+func TestCreateDeliveryQueue(t *testing.T) {
+	var tests = []struct {
+		name      string
+		flags     map[string]string
+		wantQueue bool
+		wantErr   string
+	}{
+		{"With default values", map[string]string{}, false, ""},
+		{"With retries enabled", map[string]string{queueRetriesFlag: "5"}, true, ""},
+		{"With invalid retries", map[string]string{queueRetriesFlag: "-1"}, false, "queue retries is invalid"},
+		{"With invalid retry delay", map[string]string{queueRetryDelayFlag: "0"}, false, "queue retry delay is invalid"},
+		{"With invalid dead letters", map[string]string{queueDeadLettersFlag: "-1"}, false, "queue dead letters is invalid"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue, err := createDeliveryQueue(test.flags)
+
+			if queue != nil {
+				defer queue.Shutdown(context.Background())
+			}
+
+			if len(test.wantErr) > 0 {
+				assertInitError(t, err, test.wantErr)
+				return
+			}
+
+			if err != nil || (queue != nil) != test.wantQueue {
+				t.Errorf("Unexpected queue %v with error %v", queue, err)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	var tests = []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{100, queueMaxRetryDelay},
+	}
+
+	for _, test := range tests {
+		if got := retryDelay(30*time.Second, test.attempts); got != test.want {
+			t.Errorf("Retry delay after %d attempts: got %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceDefinition describes a service supported by Tegami. Each service registers its
+// definition from the init function of its file.
+type ServiceDefinition struct {
+	// Name is the name of the service, used as the category of its flags in the help.
+	Name string
+	// Prefix is the prefix of the names of the flags of the service.
+	Prefix string
+	// Flags returns the CLI flags of the service.
+	Flags func() []cli.Flag
+	// Required lists the flags needed for enabling the service. Each entry contains
+	// alternative flags, at least one of which must be set.
+	Required [][]string
+	// Secrets lists the flags containing credentials, which are redacted from the logs and the admin API.
+	Secrets []string
+	// Templates lists the flags containing message templates, compiled on their own by the check-config command.
+	Templates []string
+	// New creates an uninitialized instance of the service.
+	New func() Service
+	// Schemes contains the schemes of the notification URLs configuring the service.
+	Schemes []string
+	// ParseURL returns the flags of the service found in a notification URL. The query
+	// parameters consumed by ParseURL are removed from the URL.
+	ParseURL func(u *notifyURL) (map[string]string, error)
+}
+
+// offlineInitFlag is set in the flags given to Init when the services are only created for rendering
+// their messages, as by the dry runs. They then skip their connections, probes and files, so that
+// creating them has no side effect. It isn't a CLI flag.
+const offlineInitFlag = "offline-init"
+
+// isOfflineInit returns whether the services are initialized without side effects.
+func isOfflineInit(flags map[string]string) bool {
+	return flags[offlineInitFlag] == "true"
+}
+
+// defaultSendTimeout is the number of seconds after which sending a message with a service is abandoned by default.
+const defaultSendTimeout = 30
+
+// timeoutService is a service whose messages are sent within a timeout.
+type timeoutService struct {
+	Service
+	name    string
+	timeout time.Duration
+}
+
+func (s *timeoutService) Send(ctx context.Context, msg *Message) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	logger := msg.Logger().With("service", s.name)
+	logger.Debug("Sending message")
+
+	start := time.Now()
+	err := s.Service.Send(ctx, msg)
+	duration := time.Since(start)
+	serviceSendDuration.Observe(duration.Seconds(), s.name)
+	serviceSends.Inc(s.name, sendResult(err))
+	messageHistory.RecordDelivery(msg, s, err)
+
+	if err != nil {
+		logger.Warn("Message couldn't be sent", "error", err, "temporary", IsTemporaryError(err), "duration", duration)
+	} else {
+		logger.Info("Message sent", "duration", duration)
+	}
+
+	return err
+}
+
+// sendResult returns the result of sending a message used in the metrics.
+func sendResult(err error) string {
+	if err == nil {
+		return "success"
+	} else if IsTemporaryError(err) {
+		return "temporary_failure"
+	}
+	return "permanent_failure"
+}
+
+// serviceName returns the name of the definition of a service created from the registry, or its type otherwise.
+func serviceName(service Service) string {
+	if service, ok := service.(*timeoutService); ok {
+		return service.name
+	}
+	return fmt.Sprintf("%T", service)
+}
+
+// renderMessage returns the payload sent by a service for a message along with its format. The
+// services which don't implement Renderer send the HTML or the Markdown body of the message.
+func renderMessage(service Service, msg *Message) (string, string, error) {
+	if wrapper, ok := service.(*timeoutService); ok {
+		service = wrapper.Service
+	}
+
+	if renderer, ok := service.(Renderer); ok {
+		return renderer.Render(msg)
+	}
+
+	if service.IsMarkdownService() {
+		return "Markdown", msg.Markdown, nil
+	}
+
+	return "HTML", msg.HTML, nil
+}
+
+// serviceDefinitions contains the registered services, in the order of their registration.
+var serviceDefinitions []*ServiceDefinition
+
+// RegisterService adds a service to the ones supported by Tegami.
+func RegisterService(definition *ServiceDefinition) {
+	serviceDefinitions = append(serviceDefinitions, definition)
+}
+
+// findServiceDefinition returns the service configured by the notification URLs using a scheme, or nil if there is none.
+func findServiceDefinition(scheme string) *ServiceDefinition {
+	for _, definition := range serviceDefinitions {
+		for _, definitionScheme := range definition.Schemes {
+			if definitionScheme == scheme {
+				return definition
+			}
+		}
+	}
+	return nil
+}
+
+// sendTimeoutFlag returns the name of the flag containing the send timeout of the service.
+func (d *ServiceDefinition) sendTimeoutFlag() string {
+	return d.Prefix + "-send-timeout"
+}
+
+// CLIFlags returns the flags of the service, grouped under the name of the service in the help,
+// along with the send timeout flag common to all services.
+func (d *ServiceDefinition) CLIFlags() []cli.Flag {
+	flags := append(d.Flags(), &cli.StringFlag{
+		Name:    d.sendTimeoutFlag(),
+		Value:   strconv.Itoa(defaultSendTimeout),
+		Usage:   fmt.Sprintf("The number of seconds after which sending a message with %s is abandoned (Optional)", d.Name),
+		EnvVars: []string{"TEGAMI_" + strings.ToUpper(strings.ReplaceAll(d.sendTimeoutFlag(), "-", "_"))},
+	})
+
+	for _, flag := range flags {
+		switch flag := flag.(type) {
+		case *cli.StringFlag:
+			flag.Category = d.Name
+		case *cli.StringSliceFlag:
+			flag.Category = d.Name
+		}
+	}
+
+	return flags
+}
+
+// missingFlags returns the required flags which aren't set, alternative flags being joined by "or".
+func (d *ServiceDefinition) missingFlags(flags map[string]string) []string {
+	var missing []string
+
+	for _, alternatives := range d.Required {
+		set := false
+
+		for _, name := range alternatives {
+			if len(flags[name]) > 0 {
+				set = true
+				break
+			}
+		}
+
+		if !set {
+			missing = append(missing, strings.Join(alternatives, " or "))
+		}
+	}
+
+	return missing
+}
+
+// createService creates and initializes the service if its required flags are set. It returns nil
+// when the service isn't configured at all, and an error when it is only partially configured or
+// couldn't be initialized.
+func (d *ServiceDefinition) createService(flags map[string]string) (Service, error) {
+	missing := d.missingFlags(flags)
+
+	if len(missing) == len(d.Required) {
+		return nil, nil
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: %s not set", d.Name, strings.Join(missing, ", "))
+	}
+
+	return d.initService(flags)
+}
+
+// initService creates and initializes the service, sending its messages within its send timeout.
+func (d *ServiceDefinition) initService(flags map[string]string) (Service, error) {
+	redactor.addSecretFlags(d, flags)
+
+	timeout, err := parseOptionalInt(flags[d.sendTimeoutFlag()], defaultSendTimeout)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("%s: send timeout is invalid", d.Name)
+	}
+
+	service := d.New()
+
+	if err = service.Init(flags); err != nil {
+		return nil, fmt.Errorf("%s: %v", d.Name, err)
+	}
+
+	return &timeoutService{Service: service, name: d.Name, timeout: time.Duration(timeout) * time.Second}, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceDefinitions(t *testing.T) {
+	schemes := make(map[string]string)
+
+	for _, definition := range serviceDefinitions {
+		t.Run(definition.Name, func(t *testing.T) {
+			flags := make(map[string]*cli.StringFlag)
+
+			for _, flag := range definition.CLIFlags() {
+				stringFlag := flag.(*cli.StringFlag)
+				flags[stringFlag.Name] = stringFlag
+
+				if !strings.HasPrefix(stringFlag.Name, definition.Prefix+"-") {
+					t.Errorf("Flag %s doesn't start with the prefix %s", stringFlag.Name, definition.Prefix)
+				}
+
+				if stringFlag.Category != definition.Name {
+					t.Errorf("Unexpected category of flag %s: %s", stringFlag.Name, stringFlag.Category)
+				}
+			}
+
+			for _, alternatives := range definition.Required {
+				for _, name := range alternatives {
+					if flag, ok := flags[name]; !ok || len(flag.Value) > 0 {
+						t.Errorf("Required flag %s is unknown or has a default value", name)
+					}
+				}
+			}
+
+			for _, scheme := range definition.Schemes {
+				if other, ok := schemes[scheme]; ok {
+					t.Errorf("Scheme %s already used by %s", scheme, other)
+				}
+				schemes[scheme] = definition.Name
+			}
+		})
+	}
+}
+
+func TestInitServices(t *testing.T) {
+	var tests = []struct {
+		name         string
+		flags        map[string]string
+		wantServices string
+		wantErrors   string
+	}{
+		{"Without configured services", map[string]string{}, "[]", "[]"},
+		{"With partially configured service", map[string]string{telegramTokenFlag: telegramBotToken}, "[]",
+			"[Telegram: telegram-chat-id not set]"},
+		{"With configured service", map[string]string{debugOutputFlag: filepath.Join(t.TempDir(), "tegami.jsonl"),
+			execTimeoutFlag: "10"}, "[*main.DebugService]", "[]"},
+		{"With invalid send timeout", map[string]string{debugOutputFlag: "-", "debug-send-timeout": "foo"}, "[]",
+			"[Debug: send timeout is invalid]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, services, initErrors := initServices(test.flags)
+			defer closeServices(services)
+			assertMessageContent(t, t.Name(), fmt.Sprint(initErrors), test.wantErrors)
+
+			var types []string
+			for _, service := range services {
+				types = append(types, fmt.Sprintf("%T", service.(*timeoutService).Service))
+			}
+
+			assertMessageContent(t, t.Name(), fmt.Sprint(types), test.wantServices)
+
+			if count != len(services) {
+				t.Errorf("Unexpected number of services: %d", count)
+			}
+		})
+	}
+
+	t.Run("Missing flags", func(t *testing.T) {
+		definition := findServiceDefinition("xmpp")
+		_, err := definition.createService(map[string]string{xmppJidFlag: "tegami@example.com"})
+		assertErrorContent(t, fmt.Sprint(err), "XMPP: xmpp-password, xmpp-recipients or xmpp-rooms not set")
+	})
+}
+
+func TestHelpCategories(t *testing.T) {
+	var output bytes.Buffer
+	app := cli.NewApp()
+	app.Flags = GenerateCLIFlags()
+	app.Writer = &output
+
+	if err := app.Run([]string{"tegami", "--help"}); err != nil {
+		t.Fatalf("Error while we weren't supposed to get any: %v", err)
+	}
+
+	for _, definition := range serviceDefinitions {
+		if !strings.Contains(output.String(), definition.Name+"\n") {
+			t.Errorf("The help doesn't contain the category %s", definition.Name)
+		}
+	}
+}
+
+// blockingService is a service whose messages are only sent once its context is done.
+type blockingService struct {
+	RecorderService
+}
+
+func (s *blockingService) Send(ctx context.Context, _ *Message) error {
+	<-ctx.Done()
+	return &TemporaryError{Err: ctx.Err()}
+}
+
+func TestTimeoutService(t *testing.T) {
+	service := &timeoutService{Service: &blockingService{}, timeout: 50 * time.Millisecond}
+	start := time.Now()
+	err := service.Send(context.Background(), &Message{})
+
+	if !IsTemporaryError(err) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a temporary deadline error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("The send timeout wasn't applied, took %v", elapsed)
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	msg := &Message{Subject: "Disk failure", HTML: "<p>Disk <b>2</b> failed</p>", Markdown: "Disk **2** failed"}
+
+	var tests = []struct {
+		name       string
+		service    Service
+		wantFormat string
+		wantBody   string
+	}{
+		{"HTML body", &RecorderService{}, "HTML", msg.HTML},
+		{"Markdown body", &RecorderService{isMarkdownService: true}, "Markdown", msg.Markdown},
+		{"Rendered payload", &timeoutService{Service: &PushoverService{}, name: "Pushover"}, "HTML", "Disk <b>2</b> failed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format, body, err := renderMessage(test.service, msg)
+
+			if err != nil || format != test.wantFormat || body != test.wantBody {
+				t.Errorf("Unexpected %s payload %q with error %v", format, body, err)
+			}
+		})
+	}
+}
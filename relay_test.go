@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// relayTestBackend is an upstream SMTP server backend recording the emails it receives.
+type relayTestBackend struct {
+	mutex    sync.Mutex
+	messages []relayTestMessage
+}
+
+type relayTestMessage struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+}
+
+type relayTestSession struct {
+	backend *relayTestBackend
+	message relayTestMessage
+}
+
+func (b *relayTestBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if username != "tegami" || password != "secret" {
+		return nil, errors.New("invalid credentials")
+	}
+
+	return &relayTestSession{backend: b, message: relayTestMessage{tls: state.TLS.HandshakeComplete}}, nil
+}
+
+func (b *relayTestBackend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
+	return nil, smtp.ErrAuthRequired
+}
+
+func (s *relayTestSession) Mail(from string, _ smtp.MailOptions) error {
+	s.message.from = from
+	return nil
+}
+
+func (s *relayTestSession) Rcpt(to string) error {
+	s.message.to = append(s.message.to, to)
+	return nil
+}
+
+func (s *relayTestSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	s.message.data = string(data)
+	s.backend.mutex.Lock()
+	s.backend.messages = append(s.backend.messages, s.message)
+	s.backend.mutex.Unlock()
+	return err
+}
+
+func (s *relayTestSession) Reset() {}
+
+func (s *relayTestSession) Logout() error {
+	return nil
+}
+
+func TestRelayService(t *testing.T) {
+	backend := &relayTestBackend{}
+	server := smtp.NewServer(backend)
+	server.Domain = "localhost"
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{createTestCertificate(t)}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Could not start upstream SMTP server: %v", err)
+	}
+
+	go server.Serve(listener)
+	defer server.Close()
+
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With valid arguments", "", "", ""},
+			{"With missing server", relayServerFlag, "", "relay server not set"},
+			{"With invalid server", relayServerFlag, "localhost", "relay server is invalid"},
+			{"With invalid tls mode", relayTlsFlag, "foo", "relay tls mode is invalid: foo"},
+			{"With invalid routes", relayRoutesFlag, "foo", "invalid route: foo"},
+			{"With invalid password", relayPasswordFlag, "foo", "invalid credentials"},
+			{"Without starttls", relayTlsFlag, relayTlsNone, "TLS is required"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := generateRelayTestFlags(listener.Addr().String())
+				if len(test.flag) > 0 {
+					flags[test.flag] = test.value
+				}
+
+				service := &RelayService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+				err := initAndProbe(service, flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		raw := "Subject: Backup done\r\nFrom: nas@example.com\r\n\r\nBackup <b>succeeded</b>\r\n"
+		var tests = []struct {
+			name     string
+			flags    map[string]string
+			to       []string
+			wantFrom string
+			wantTo   string
+		}{
+			{"With original envelope", nil, []string{"admin@example.com"}, "nas@example.com", "[admin@example.com]"},
+			{"With rewritten envelope", map[string]string{relayFromFlag: "tegami@example.com", relayToFlag: "inbox@example.org"},
+				[]string{"admin@example.com"}, "tegami@example.com", "[inbox@example.org]"},
+			{"With routes", map[string]string{relayToFlag: "inbox@example.org", relayRoutesFlag: "admin@example.com=admin@example.org"},
+				[]string{"admin@example.com", "other@example.com"}, "nas@example.com", "[admin@example.org]"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := generateRelayTestFlags(listener.Addr().String())
+				for key, value := range test.flags {
+					flags[key] = value
+				}
+
+				service := &RelayService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+				if err := service.Init(flags); err != nil {
+					t.Fatalf("Could not start relay service: %v", err)
+				}
+
+				msg, err := ProcessMessage(strings.NewReader(raw))
+				if err != nil {
+					t.Fatalf("Could not process message: %v", err)
+				}
+
+				msg.From = "nas@example.com"
+				msg.To = test.to
+				backend.messages = nil
+
+				if err = service.Send(context.Background(), msg); err != nil {
+					t.Fatalf("Error while we weren't supposed to get any: %v", err)
+				}
+
+				received := backend.messages[0]
+				assertMessageContent(t, t.Name(), received.from, test.wantFrom)
+				assertMessageContent(t, t.Name(), fmt.Sprint(received.to), test.wantTo)
+				assertMessageContent(t, t.Name(), received.data, raw)
+
+				if !received.tls {
+					t.Errorf("The email wasn't sent over TLS")
+				}
+			})
+		}
+
+		err := (&RelayService{}).Send(context.Background(), &Message{To: []string{"admin@example.com"}})
+		assertErrorContent(t, fmt.Sprint(err), "relay requires the original email")
+	})
+
+	t.Run("Probe", func(t *testing.T) {
+		service := &RelayService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+		if err := service.Init(generateRelayTestFlags(listener.Addr().String())); err != nil {
+			t.Fatalf("Could not start relay service: %v", err)
+		}
+
+		backend.messages = nil
+
+		if err := service.Probe(context.Background()); err != nil {
+			t.Errorf("Unexpected probe error: %v", err)
+		}
+
+		if len(backend.messages) != 0 {
+			t.Errorf("The probe sent an email: %+v", backend.messages)
+		}
+
+		service.password = "foo"
+		err := service.Probe(context.Background())
+		assertErrorContent(t, fmt.Sprint(err), "invalid credentials")
+	})
+}
+
+func generateRelayTestFlags(server string) map[string]string {
+	flags := make(map[string]string)
+	flags[relayServerFlag] = server
+	flags[relayUsernameFlag] = "tegami"
+	flags[relayPasswordFlag] = "secret"
+	return flags
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type rocketChatUpload struct {
+	roomId   string
+	threadId string
+	filename string
+}
+
+func TestRocketChatService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		srv, _, _ := createStubRocketChatServer(t)
+		defer srv.Close()
+
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With valid arguments", "", "", ""},
+			{"With missing url", rocketChatUrlFlag, "", "rocket.chat url not set"},
+			{"With missing token", rocketChatTokenFlag, "", "rocket.chat user id or token not set"},
+			{"With missing channel", rocketChatChannelFlag, "", "rocket.chat channel not set"},
+			{"With invalid token", rocketChatTokenFlag, "foo", `unexpected status 401: {"success":false,"error":"unauthorized"}`},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := generateRocketChatTestFlags(srv.URL)
+
+				if len(test.flag) > 0 {
+					flags[test.flag] = test.value
+				}
+
+				err := initAndProbe(&RocketChatService{}, flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		srv, messages, uploads := createStubRocketChatServer(t)
+		defer srv.Close()
+
+		service := &RocketChatService{}
+		if err := service.Init(generateRocketChatTestFlags(srv.URL)); err != nil {
+			t.Fatalf("Could not start Rocket.Chat service: %v", err)
+		}
+
+		original := createThreadTestMessage("<1@example.com>", "", "")
+		original.From = "nas@example.com"
+		original.Attachments = []*Attachment{{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report")}}
+		reply := createThreadTestMessage("<2@example.com>", "<1@example.com>", "")
+
+		if err := service.Send(context.Background(), original); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		if err := service.Send(context.Background(), reply); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		first := (*messages)[0]
+		assertMessageContent(t, t.Name(), first.Channel, "#alerts")
+		assertMessageContent(t, t.Name(), first.Text, "Backup **succeeded**")
+		assertMessageContent(t, t.Name(), first.Alias, "Tegami")
+		assertMessageContent(t, t.Name(), first.Emoji, ":e-mail:")
+		assertMessageContent(t, t.Name(), first.Attachments[0].Title, "Backup done")
+		assertMessageContent(t, t.Name(), first.Attachments[0].Fields[0].Value, "nas@example.com")
+		assertMessageContent(t, t.Name(), first.ThreadId, "")
+		assertMessageContent(t, t.Name(), (*messages)[1].ThreadId, "msg-1")
+
+		if len(*uploads) != 1 {
+			t.Fatalf("Unexpected number of uploads: %d", len(*uploads))
+		}
+
+		assertMessageContent(t, t.Name(), (*uploads)[0].roomId, "room")
+		assertMessageContent(t, t.Name(), (*uploads)[0].threadId, "msg-1")
+		assertMessageContent(t, t.Name(), (*uploads)[0].filename, "report.txt")
+	})
+
+	t.Run("Send with failed upload", func(t *testing.T) {
+		srv, messages, _ := createStubRocketChatServer(t)
+		defer srv.Close()
+
+		service := &RocketChatService{}
+		service.Init(generateRocketChatTestFlags(srv.URL))
+		msg := createThreadTestMessage("<1@example.com>", "", "")
+		msg.Attachments = []*Attachment{{Filename: "unavailable.txt", ContentType: "text/plain", Data: []byte("report")}}
+		err := service.Send(context.Background(), msg)
+
+		if err == nil || IsTemporaryError(err) {
+			t.Errorf("Expected a permanent error once the message is posted, got %v", err)
+		}
+
+		if len(*messages) != 1 {
+			t.Errorf("Unexpected number of messages: %d", len(*messages))
+		}
+	})
+}
+
+func createStubRocketChatServer(t *testing.T) (*httptest.Server, *[]rocketChatMessage, *[]rocketChatUpload) {
+	t.Helper()
+	var messages []rocketChatMessage
+	var uploads []rocketChatUpload
+	mux := http.NewServeMux()
+
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-User-Id") != "user" || r.Header.Get("X-Auth-Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"success":false,"error":"unauthorized"}`)
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/api/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			io.WriteString(w, `{"success":true}`)
+		}
+	})
+
+	mux.HandleFunc("/api/v1/chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+
+		var msg rocketChatMessage
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &msg)
+		messages = append(messages, msg)
+
+		fmt.Fprintf(w, `{"success":true,"message":{"_id":"msg-%d","rid":"room"}}`, len(messages))
+	})
+
+	mux.HandleFunc("/api/v1/rooms.upload/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+
+		_, header, _ := r.FormFile("file")
+
+		if header.Filename == "unavailable.txt" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"success":false,"error":"unavailable"}`)
+			return
+		}
+		uploads = append(uploads, rocketChatUpload{
+			roomId:   r.URL.Path[len("/api/v1/rooms.upload/"):],
+			threadId: r.FormValue("tmid"),
+			filename: header.Filename,
+		})
+
+		io.WriteString(w, `{"success":true}`)
+	})
+
+	return httptest.NewServer(mux), &messages, &uploads
+}
+
+func generateRocketChatTestFlags(serverUrl string) map[string]string {
+	flags := make(map[string]string)
+	flags[rocketChatUrlFlag] = serverUrl
+	flags[rocketChatUserIdFlag] = "user"
+	flags[rocketChatTokenFlag] = "token"
+	flags[rocketChatChannelFlag] = "#alerts"
+	flags[rocketChatAliasFlag] = "Tegami"
+	flags[rocketChatEmojiFlag] = ":e-mail:"
+	return flags
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Routes associates email recipients with service specific destinations. A route
+// can match a complete address (alerts@example.com), every address of a
+// domain (@example.com) or any address (*).
+type Routes map[string]string
+
+// ParseRoutes parses routes written as a comma separated list of
+// "recipient=destination" pairs. It returns an error if one of the routes is malformed.
+func ParseRoutes(value string) (Routes, error) {
+	routes := make(Routes)
+
+	for _, route := range strings.Split(value, ",") {
+		route = strings.TrimSpace(route)
+
+		if len(route) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(route, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid route: %s", route)
+		}
+
+		recipient := strings.ToLower(strings.TrimSpace(parts[0]))
+		destination := strings.TrimSpace(parts[1])
+
+		if len(recipient) == 0 || len(destination) == 0 {
+			return nil, fmt.Errorf("invalid route: %s", route)
+		}
+
+		routes[recipient] = destination
+	}
+
+	return routes, nil
+}
+
+// Match returns the destinations of the routes matching the recipients. The most specific
+// route is used for each recipient and a destination is only returned once.
+func (r Routes) Match(recipients []string) []string {
+	var destinations []string
+	seen := make(map[string]bool)
+
+	for _, recipient := range recipients {
+		destination, found := r.lookup(strings.ToLower(recipient))
+
+		if found && !seen[destination] {
+			seen[destination] = true
+			destinations = append(destinations, destination)
+		}
+	}
+
+	return destinations
+}
+
+// lookup finds the destination of a single recipient.
+func (r Routes) lookup(recipient string) (string, bool) {
+	if destination, ok := r[recipient]; ok {
+		return destination, true
+	}
+
+	if at := strings.LastIndex(recipient, "@"); at >= 0 {
+		if destination, ok := r[recipient[at:]]; ok {
+			return destination, true
+		}
+	}
+
+	destination, ok := r["*"]
+	return destination, ok
+}
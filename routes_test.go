@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	t.Run("Parse", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			value   string
+			isValid bool
+		}{
+			{"Empty routes", "", true},
+			{"Single route", "alerts@example.com=abc", true},
+			{"Multiple routes", "alerts@example.com=abc, @example.com=def,*=ghi", true},
+			{"Missing destination", "alerts@example.com=", false},
+			{"Missing separator", "alerts@example.com", false},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				_, err := ParseRoutes(test.value)
+
+				if test.isValid && err != nil {
+					t.Errorf("Error while we weren't supposed to get any: %v", err)
+				}
+
+				if !test.isValid && err == nil {
+					t.Errorf("We didn't get any error while we were supposed to get one")
+				}
+			})
+		}
+	})
+
+	t.Run("Match", func(t *testing.T) {
+		routes, _ := ParseRoutes("alerts@example.com=abc,@example.com=def,*=ghi")
+
+		var tests = []struct {
+			name       string
+			recipients []string
+			want       string
+		}{
+			{"Exact address", []string{"Alerts@Example.com"}, "abc"},
+			{"Domain", []string{"backup@example.com"}, "def"},
+			{"Any address", []string{"root@localhost"}, "ghi"},
+			{"Deduplicated destinations", []string{"a@example.com", "b@example.com", "alerts@example.com"}, "def,abc"},
+			{"No recipients", nil, ""},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				got := strings.Join(routes.Match(test.recipients), ",")
+				assertMessageContent(t, test.name, got, test.want)
+			})
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/urfave/cli/v2"
+	"io"
+	"mime"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	sendFromFlag    = "from"
+	sendToFlag      = "to"
+	sendSubjectFlag = "subject"
+	sendBodyFlag    = "body"
+	sendHtmlFlag    = "html"
+	sendAttachFlag  = "attach"
+	sendFileFlag    = "file"
+	sendDryRunFlag  = "dry-run"
+)
+
+// sendCommand returns the command sending a message with the configured services without running the SMTP server.
+func sendCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "send",
+		Usage:     "Sends an email with the configured services without running the SMTP server",
+		UsageText: "tegami [options] send [--from address] [--to address] [--subject text] [--body text] [--file path]",
+		Description: "The email is built from the flags, or read from a file in the RFC 5322 format. It is read from the " +
+			"standard input when neither a body nor a file are given.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: sendFromFlag, Usage: "The sender of the email, taken from the From header of the file if not set"},
+			&cli.StringSliceFlag{Name: sendToFlag, Usage: "The recipients of the email, taken from the To header of the file if not set"},
+			&cli.StringFlag{Name: sendSubjectFlag, Usage: "The subject of the email"},
+			&cli.StringFlag{Name: sendBodyFlag, Usage: "The body of the email"},
+			&cli.BoolFlag{Name: sendHtmlFlag, Usage: "Whether the body of the email is HTML rather than plain text"},
+			&cli.StringSliceFlag{Name: sendAttachFlag, Usage: "Files attached to the email"},
+			&cli.StringFlag{Name: sendFileFlag, Usage: "The file containing the email in the RFC 5322 format, or - for the standard input"},
+			&cli.BoolFlag{Name: sendDryRunFlag, Usage: "Prints the payload each service would send instead of sending the email, without connecting to the services"},
+		},
+		Action: handleSend,
+	}
+}
+
+// handleSend is the action of the send command. The exit code is not zero when a service couldn't send the message.
+func handleSend(c *cli.Context) error {
+	raw, err := readSendMessage(c)
+	if err != nil {
+		return err
+	}
+
+	msg, err := newLocalMessage(bytes.NewReader(raw), c.String(sendFromFlag), c.StringSlice(sendToFlag))
+	if err != nil {
+		return fmt.Errorf("the email couldn't be parsed: %v", err)
+	}
+
+	services, err := initLocalServices(c, c.Bool(sendDryRunFlag))
+	if err != nil {
+		return err
+	}
+
+	defer closeServices(services)
+
+	if c.Bool(sendDryRunFlag) {
+		for _, service := range services {
+			printServiceMessage(c.App.Writer, service, msg)
+		}
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err = deliverMessage(ctx, msg, services); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	fmt.Fprintf(c.App.Writer, "Email %s sent with %d services\n", msg.ID, len(services))
+	return nil
+}
+
+// readSendMessage returns the email given to the send command, either read from a file or the
+// standard input, or built from the flags.
+func readSendMessage(c *cli.Context) ([]byte, error) {
+	file := c.String(sendFileFlag)
+
+	if len(file) == 0 && !c.IsSet(sendBodyFlag) && !c.IsSet(sendSubjectFlag) && len(c.StringSlice(sendAttachFlag)) == 0 {
+		file = "-"
+	}
+
+	switch file {
+	case "":
+		return buildMessage(c.String(sendFromFlag), c.StringSlice(sendToFlag), c.String(sendSubjectFlag),
+			c.String(sendBodyFlag), c.Bool(sendHtmlFlag), c.StringSlice(sendAttachFlag))
+	case "-":
+		return io.ReadAll(c.App.Reader)
+	default:
+		return os.ReadFile(file)
+	}
+}
+
+// buildMessage creates an email in the RFC 5322 format from its parts.
+func buildMessage(from string, to []string, subject, body string, html bool, attachments []string) ([]byte, error) {
+	var header mail.Header
+	var buffer bytes.Buffer
+
+	header.SetDate(time.Now())
+	header.SetSubject(subject)
+
+	if len(from) > 0 {
+		header.SetAddressList("From", []*mail.Address{{Address: from}})
+	}
+
+	if len(to) > 0 {
+		var addresses []*mail.Address
+		for _, address := range to {
+			addresses = append(addresses, &mail.Address{Address: address})
+		}
+		header.SetAddressList("To", addresses)
+	}
+
+	contentType := "text/plain"
+	if html {
+		contentType = "text/html"
+	}
+
+	if len(attachments) == 0 {
+		header.SetContentType(contentType, map[string]string{"charset": "utf-8"})
+
+		writer, err := mail.CreateSingleInlineWriter(&buffer, header)
+		if err != nil {
+			return nil, err
+		}
+
+		io.WriteString(writer, body)
+
+		if err = writer.Close(); err != nil {
+			return nil, err
+		}
+
+		return buffer.Bytes(), nil
+	}
+
+	writer, err := mail.CreateWriter(&buffer, header)
+	if err != nil {
+		return nil, err
+	}
+
+	var inlineHeader mail.InlineHeader
+	inlineHeader.SetContentType(contentType, map[string]string{"charset": "utf-8"})
+
+	inlineWriter, err := writer.CreateSingleInline(inlineHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	io.WriteString(inlineWriter, body)
+	inlineWriter.Close()
+
+	for _, path := range attachments {
+		if err = writeAttachment(writer, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// writeAttachment attaches a file to an email, its content type being guessed from its extension.
+func writeAttachment(writer *mail.Writer, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	var header mail.AttachmentHeader
+	header.SetContentType(contentType, nil)
+	header.SetFilename(filepath.Base(path))
+
+	attachmentWriter, err := writer.CreateAttachment(header)
+	if err != nil {
+		return err
+	}
+
+	attachmentWriter.Write(data)
+	return attachmentWriter.Close()
+}
+
+// newLocalMessage processes an email which wasn't received by the SMTP server. The envelope is
+// taken from the From and To headers when the sender or the recipients aren't given.
+func newLocalMessage(raw io.Reader, from string, to []string) (*Message, error) {
+	msg, err := ProcessMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(from) == 0 {
+		if addresses, err := msg.Header.AddressList("From"); err == nil && len(addresses) > 0 {
+			from = addresses[0].Address
+		}
+	}
+
+	if len(to) == 0 {
+		for _, key := range []string{"To", "Cc", "Bcc"} {
+			addresses, _ := msg.Header.AddressList(key)
+			for _, address := range addresses {
+				to = append(to, address.Address)
+			}
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	msg.ID = newCorrelationId()
+	msg.SessionID = newCorrelationId()
+	msg.From = from
+	msg.To = to
+	msg.addTraceHeaders(hostname, "local")
+	return msg, nil
+}
+
+// initLocalServices initializes the services configured by the flags and the notification URLs,
+// failing if one of them couldn't be initialized. Offline services only validate their
+// configuration, without connecting to their servers.
+func initLocalServices(c *cli.Context, offline bool) ([]Service, error) {
+	flags := RetrieveFlags(c)
+
+	if offline {
+		flags[offlineInitFlag] = "true"
+	}
+
+	_, services, initErrors := initServices(flags)
+	notifyServices, notifyErrors := initNotifyServices(splitNotifyURLs(c.StringSlice(notifyFlag)), offline)
+	services = append(services, notifyServices...)
+	initErrors = append(initErrors, notifyErrors...)
+
+	if len(initErrors) > 0 {
+		closeServices(services)
+		return nil, errors.Join(initErrors...)
+	}
+
+	if len(services) == 0 {
+		return nil, errors.New("no messaging service is configured")
+	}
+
+	return services, nil
+}
+
+// deliverMessage sends a message with each service, returning the errors of the services which couldn't send it.
+func deliverMessage(ctx context.Context, msg *Message, services []Service) error {
+	var errs []error
+
+	for _, service := range services {
+		if err := service.Send(ctx, msg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", serviceName(service), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// printServiceMessage writes the payload of the message rendered by a service.
+func printServiceMessage(w io.Writer, service Service, msg *Message) {
+	format, body, err := renderMessage(service, msg)
+
+	if err != nil {
+		fmt.Fprintf(w, "=== %s\nThe message couldn't be rendered: %v\n\n", serviceName(service), err)
+		return
+	}
+
+	fmt.Fprintf(w, "=== %s (%s)\n", serviceName(service), format)
+	fmt.Fprintf(w, "From: %s\n", msg.Sender())
+	fmt.Fprintf(w, "To: %s\n", msg.Recipients())
+	fmt.Fprintf(w, "Subject: %s\n", msg.Subject)
+
+	for _, attachment := range msg.Attachments {
+		fmt.Fprintf(w, "Attachment: %s (%s, %d bytes)\n", attachment.Filename, attachment.ContentType, len(attachment.Data))
+	}
+
+	fmt.Fprintf(w, "\n%s\n\n", strings.TrimSpace(body))
+}
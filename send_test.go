@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildMessage(t *testing.T) {
+	attachment := filepath.Join(t.TempDir(), "smart.txt")
+	os.WriteFile(attachment, []byte("Reallocated sectors: 12"), 0600)
+
+	raw, err := buildMessage("nas@example.com", []string{"admin@example.com", "ops@example.com"}, "Disk failure",
+		"<b>Disk 2</b> failed", true, []string{attachment})
+
+	if err != nil {
+		t.Fatalf("Could not build the message: %v", err)
+	}
+
+	msg, err := newLocalMessage(bytes.NewReader(raw), "", nil)
+	if err != nil {
+		t.Fatalf("Could not parse the message: %v", err)
+	}
+
+	if msg.From != "nas@example.com" || strings.Join(msg.To, ",") != "admin@example.com,ops@example.com" {
+		t.Errorf("Expected the envelope taken from the headers, got %s %v", msg.From, msg.To)
+	}
+
+	if msg.Subject != "Disk failure" || msg.HTML != "<b>Disk 2</b> failed" || msg.Markdown != "**Disk 2** failed" {
+		t.Errorf("Unexpected message: %q %q %q", msg.Subject, msg.HTML, msg.Markdown)
+	}
+
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "smart.txt" || string(msg.Attachments[0].Data) != "Reallocated sectors: 12" {
+		t.Errorf("Expected the file attached, got %+v", msg.Attachments)
+	}
+
+	if id, _ := msg.Header.Text("X-Tegami-Id"); len(msg.ID) == 0 || id != msg.ID {
+		t.Errorf("Expected the message identified, got %q", id)
+	}
+
+	if _, err = buildMessage("", nil, "", "", false, []string{filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Errorf("Expected an error with a missing attachment")
+	}
+}
+
+func TestSendCommand(t *testing.T) {
+	setupTestLogging(t, map[string]string{})
+	output := filepath.Join(t.TempDir(), "emails.jsonl")
+
+	t.Run("From the flags", func(t *testing.T) {
+		var stdout bytes.Buffer
+		app := newApp()
+		app.Writer = &stdout
+		err := app.Run([]string{"tegami", "--debug-output", output, "send", "--from", "nas@example.com", "--to", "admin@example.com",
+			"--subject", "Disk failure", "--body", "Disk 2 failed"})
+
+		if err != nil {
+			t.Fatalf("Could not send the message: %v", err)
+		}
+
+		var document debugDocument
+		data, _ := os.ReadFile(output)
+
+		if err = json.Unmarshal(data, &document); err != nil {
+			t.Fatalf("Expected the message sent with the debug service, got %q", data)
+		}
+
+		if document.Subject != "Disk failure" || document.From != "nas@example.com" || document.HTML != "Disk 2 failed" {
+			t.Errorf("Unexpected message sent: %+v", document)
+		}
+
+		if !strings.Contains(stdout.String(), "sent with 1 services") {
+			t.Errorf("Expected the message reported as sent, got %q", stdout.String())
+		}
+	})
+
+	t.Run("Dry run from the standard input", func(t *testing.T) {
+		os.Remove(output)
+		var stdout bytes.Buffer
+		app := newApp()
+		app.Writer = &stdout
+		app.Reader = strings.NewReader("From: nas@example.com\r\nTo: admin@example.com\r\nSubject: Disk failure\r\n" +
+			"Content-Type: text/html\r\n\r\n<p>Disk <i>2</i> failed</p>")
+		err := app.Run([]string{"tegami", "--debug-output", output, "send", "--dry-run"})
+
+		if err != nil {
+			t.Fatalf("Could not run the dry run: %v", err)
+		}
+
+		if data, _ := os.ReadFile(output); len(data) > 0 {
+			t.Errorf("Expected no message sent during the dry run, got %q", data)
+		}
+
+		for _, line := range []string{"=== Debug (JSON)", "From: nas@example.com", "Subject: Disk failure", `"html": "<p>Disk <i>2</i> failed</p>"`} {
+			if !strings.Contains(stdout.String(), line) {
+				t.Errorf("Expected the dry run to print %q, got %q", line, stdout.String())
+			}
+		}
+	})
+
+	t.Run("Dry run without connecting", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		var stdout bytes.Buffer
+		app := newApp()
+		app.Writer = &stdout
+		app.Reader = strings.NewReader("Subject: Disk failure\r\nContent-Type: text/html\r\n\r\n<p>Disk <i>2</i> failed</p><p>Pool degraded</p>")
+		args := []string{"tegami", "--pushover-api-url", server.URL, "--pushover-token", "token", "--pushover-user", "abc123",
+			"--telegram-api-url", server.URL, "--telegram-token", telegramBotToken, "--telegram-chat-id", telegramRoom, "send", "--dry-run"}
+
+		if err := app.Run(args); err != nil {
+			t.Fatalf("Could not run the dry run: %v", err)
+		}
+
+		if requests > 0 {
+			t.Errorf("Expected the services not to connect, got %d requests", requests)
+		}
+
+		for _, line := range []string{"=== Pushover (HTML)\n", "Disk <i>2</i> failed\n\nPool degraded", "=== Telegram (HTML)\n"} {
+			if !strings.Contains(stdout.String(), line) {
+				t.Errorf("Expected the dry run to print %q, got %q", line, stdout.String())
+			}
+		}
+	})
+
+	t.Run("Without services", func(t *testing.T) {
+		app := newApp()
+		app.Reader = strings.NewReader("Subject: Disk failure\r\n\r\nDisk 2 failed")
+
+		if err := app.Run([]string{"tegami", "send"}); err == nil {
+			t.Errorf("Expected an error without services")
+		}
+	})
+}
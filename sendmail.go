@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/urfave/cli/v2"
+	"io"
+	"log/slog"
+	"net"
+	"net/smtp"
+	nettextproto "net/textproto"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	sendmailServerFlag = "sendmail-server"
+	sendmailServerEnv  = "TEGAMI_SENDMAIL_SERVER"
+)
+
+// sendmailTimeout is the maximum duration of the submission of an email to a running instance of Tegami.
+const sendmailTimeout = 30 * time.Second
+
+// The exit codes of sendmail, from sysexits.h.
+const (
+	sendmailUsageExitCode       = 64
+	sendmailUnavailableExitCode = 69
+	sendmailTempFailExitCode    = 75
+)
+
+// sendmailArgumentOptions are the options of sendmail taking an argument, either attached to the
+// option or as the next argument. Only -f, -r and -F are used, the others are ignored.
+const sendmailArgumentOptions = "BCFLNORVXfhr"
+
+// sendmailOptions are the options of a sendmail invocation.
+type sendmailOptions struct {
+	// from is the envelope sender, given by -f or -r.
+	from string
+	// fullName is the name of the sender used in the From header when it is missing, given by -F.
+	fullName string
+	// recipients are the addresses given as arguments.
+	recipients []string
+	// readRecipients adds the recipients of the To, Cc and Bcc headers of the message (-t).
+	readRecipients bool
+	// ignoreDots doesn't end the message at a line containing a single dot (-i, -oi).
+	ignoreDots bool
+}
+
+// sendmailArgs runs the sendmail command when the binary was started through a link named sendmail,
+// returning the arguments unchanged otherwise.
+func sendmailArgs(args []string) []string {
+	if len(args) == 0 || filepath.Base(args[0]) != "sendmail" {
+		return args
+	}
+
+	return append([]string{args[0], "sendmail"}, args[1:]...)
+}
+
+// sendmailCommand returns the command accepting the options of sendmail, used when the binary is
+// started through a link named sendmail. Its arguments aren't parsed by the CLI library since the
+// options of sendmail, such as -oi, don't follow its conventions.
+func sendmailCommand() *cli.Command {
+	return &cli.Command{
+		Name:            "sendmail",
+		Usage:           "Sends an email read from the standard input like sendmail, for scripts and cron jobs",
+		UsageText:       "tegami [options] sendmail [-t] [-i] [-f sender] [recipients...]",
+		SkipFlagParsing: true,
+		Action:          handleSendmail,
+	}
+}
+
+// handleSendmail is the action of the sendmail command. The email is submitted to the running
+// instance of Tegami when its server is set, and sent directly with the services otherwise. The exit
+// codes follow the ones of sendmail.
+func handleSendmail(c *cli.Context) error {
+	options, err := parseSendmailArgs(c.Args().Slice())
+	if err != nil {
+		return cli.Exit(err.Error(), sendmailUsageExitCode)
+	}
+
+	data, err := readSendmailMessage(c.App.Reader, options.ignoreDots)
+	if err != nil {
+		return cli.Exit(err.Error(), sendmailUsageExitCode)
+	}
+
+	raw, recipients, err := prepareSendmailMessage(data, options)
+	if err != nil {
+		return cli.Exit(err.Error(), sendmailUsageExitCode)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if server := c.String(sendmailServerFlag); len(server) > 0 {
+		err = submitMessage(ctx, server, options.from, recipients, raw)
+	} else {
+		err = deliverSendmailMessage(ctx, c, raw, options.from, recipients)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	var smtpError *nettextproto.Error
+	if IsTemporaryError(err) || errors.As(err, &smtpError) && smtpError.Code/100 == 4 {
+		return cli.Exit(err.Error(), sendmailTempFailExitCode)
+	}
+
+	return cli.Exit(err.Error(), sendmailUnavailableExitCode)
+}
+
+// parseSendmailArgs parses the options and the recipients given to sendmail. The options which
+// don't matter to Tegami, such as the delivery mode, are ignored.
+func parseSendmailArgs(args []string) (*sendmailOptions, error) {
+	options := &sendmailOptions{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			options.recipients = append(options.recipients, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") || len(arg) < 2 {
+			options.recipients = append(options.recipients, arg)
+			continue
+		}
+
+		option := arg[1]
+		value := arg[2:]
+
+		if strings.IndexByte(sendmailArgumentOptions, option) >= 0 && len(value) == 0 {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("option -%c requires an argument", option)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch option {
+		case 't':
+			options.readRecipients = true
+		case 'i':
+			options.ignoreDots = true
+		case 'o':
+			options.ignoreDots = options.ignoreDots || value == "i"
+		case 'f', 'r':
+			options.from = value
+		case 'F':
+			options.fullName = value
+		case 'b':
+			if value != "m" {
+				return nil, fmt.Errorf("mode -b%s is not supported", value)
+			}
+		default:
+			slog.Debug("Ignoring sendmail option", "option", arg)
+		}
+	}
+
+	if len(options.from) == 0 {
+		options.from = defaultSendmailSender()
+	}
+
+	return options, nil
+}
+
+// defaultSendmailSender returns the address of the current user on the local host.
+func defaultSendmailSender() string {
+	name := "root"
+
+	if current, err := user.Current(); err == nil && len(current.Username) > 0 {
+		name = current.Username
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "localhost"
+	}
+
+	return name + "@" + hostname
+}
+
+// readSendmailMessage reads the email from the standard input until its end, or until a line
+// containing a single dot unless the dots are ignored.
+func readSendmailMessage(r io.Reader, ignoreDots bool) ([]byte, error) {
+	if ignoreDots {
+		return io.ReadAll(r)
+	}
+
+	var data bytes.Buffer
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if string(bytes.TrimRight(line, "\r\n")) == "." {
+			break
+		}
+
+		data.Write(line)
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return data.Bytes(), nil
+}
+
+// prepareSendmailMessage adds the From and Date headers when they are missing and removes the
+// Bcc header, like sendmail. It returns the email along with its recipients.
+func prepareSendmailMessage(data []byte, options *sendmailOptions) ([]byte, []string, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	header, err := textproto.ReadHeader(reader)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("the email couldn't be parsed: %v", err)
+	}
+
+	mailHeader := mail.Header{Header: message.Header{Header: header}}
+	recipients := options.recipients
+
+	if options.readRecipients {
+		for _, key := range []string{"To", "Cc", "Bcc"} {
+			addresses, err := mailHeader.AddressList(key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("the %s header is invalid: %v", key, err)
+			}
+
+			for _, address := range addresses {
+				recipients = append(recipients, address.Address)
+			}
+		}
+	}
+
+	if len(recipients) == 0 {
+		return nil, nil, errors.New("no recipients given")
+	}
+
+	if !mailHeader.Has("From") {
+		mailHeader.SetAddressList("From", []*mail.Address{{Name: options.fullName, Address: options.from}})
+	}
+
+	if !mailHeader.Has("Date") {
+		mailHeader.SetDate(time.Now())
+	}
+
+	mailHeader.Del("Bcc")
+
+	var raw bytes.Buffer
+	if err = textproto.WriteHeader(&raw, mailHeader.Header.Header); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = reader.WriteTo(&raw); err != nil {
+		return nil, nil, err
+	}
+
+	return raw.Bytes(), recipients, nil
+}
+
+// deliverSendmailMessage sends the email directly with the configured services.
+func deliverSendmailMessage(ctx context.Context, c *cli.Context, raw []byte, from string, recipients []string) error {
+	msg, err := newLocalMessage(bytes.NewReader(raw), from, recipients)
+	if err != nil {
+		return err
+	}
+
+	services, err := initLocalServices(c, false)
+	if err != nil {
+		return err
+	}
+
+	defer closeServices(services)
+	return deliverMessage(ctx, msg, services)
+}
+
+// submitMessage submits the email to the SMTP server of a running instance of Tegami, within the
+// submission timeout.
+func submitMessage(ctx context.Context, server, from string, recipients []string, raw []byte) error {
+	err := sendSubmission(ctx, server, from, recipients, raw)
+
+	var smtpError *nettextproto.Error
+	if err != nil && !errors.As(err, &smtpError) && !IsTemporaryError(err) {
+		// The server couldn't be reached or the connection was interrupted.
+		return &TemporaryError{Err: err}
+	}
+
+	return err
+}
+
+// sendSubmission sends the email through the SMTP server, securing the connection with STARTTLS
+// when the server supports it.
+func sendSubmission(ctx context.Context, server, from string, recipients []string, raw []byte) error {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialContext(ctx, "tcp", server, nil, sendmailTimeout)
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+
+	for _, recipient := range recipients {
+		if err = c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(raw); err != nil {
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// sendmailCLIFlags returns the flags used for configuring the sendmail command.
+func sendmailCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    sendmailServerFlag,
+			Usage:   "Address of the SMTP server of a running Tegami instance receiving the emails of the sendmail command, which sends them directly with the services if not set (Optional)",
+			EnvVars: []string{sendmailServerEnv},
+		},
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/urfave/cli/v2"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSendmailArgs(t *testing.T) {
+	options, err := parseSendmailArgs([]string{"-oi", "-t", "-fnas@example.com", "-F", "NAS", "-odb", "-bm", "admin@example.com", "--", "-ops@example.com"})
+	if err != nil {
+		t.Fatalf("Could not parse the arguments: %v", err)
+	}
+
+	if !options.ignoreDots || !options.readRecipients || options.from != "nas@example.com" || options.fullName != "NAS" {
+		t.Errorf("Unexpected options: %+v", options)
+	}
+
+	if strings.Join(options.recipients, ",") != "admin@example.com,-ops@example.com" {
+		t.Errorf("Unexpected recipients: %v", options.recipients)
+	}
+
+	if options, _ = parseSendmailArgs([]string{"-r", "cron@example.com", "admin@example.com"}); options.from != "cron@example.com" || options.ignoreDots {
+		t.Errorf("Unexpected options with -r: %+v", options)
+	}
+
+	if options, _ = parseSendmailArgs([]string{"admin@example.com"}); !strings.Contains(options.from, "@") {
+		t.Errorf("Expected a default sender, got %q", options.from)
+	}
+
+	for _, args := range [][]string{{"-bp"}, {"admin@example.com", "-f"}} {
+		if _, err = parseSendmailArgs(args); err == nil {
+			t.Errorf("Expected an error with %v", args)
+		}
+	}
+}
+
+func TestReadSendmailMessage(t *testing.T) {
+	input := "Subject: Backup\n\nDone\n.\nIgnored\n"
+
+	if data, _ := readSendmailMessage(strings.NewReader(input), false); string(data) != "Subject: Backup\n\nDone\n" {
+		t.Errorf("Expected the message to end at the dot, got %q", data)
+	}
+
+	if data, _ := readSendmailMessage(strings.NewReader(input), true); string(data) != input {
+		t.Errorf("Expected the dot ignored, got %q", data)
+	}
+}
+
+func TestPrepareSendmailMessage(t *testing.T) {
+	data := []byte("To: admin@example.com\r\nCc: Ops <ops@example.com>\r\nBcc: audit@example.com\r\nSubject: Backup\r\n\r\nDone\r\n")
+	options := &sendmailOptions{from: "cron@example.com", fullName: "Cron", recipients: []string{"root@example.com"}, readRecipients: true}
+	raw, recipients, err := prepareSendmailMessage(data, options)
+
+	if err != nil {
+		t.Fatalf("Could not prepare the message: %v", err)
+	}
+
+	if strings.Join(recipients, ",") != "root@example.com,admin@example.com,ops@example.com,audit@example.com" {
+		t.Errorf("Unexpected recipients: %v", recipients)
+	}
+
+	msg, err := newLocalMessage(bytes.NewReader(raw), "cron@example.com", recipients)
+	if err != nil {
+		t.Fatalf("Could not parse the message: %v", err)
+	}
+
+	if from := msg.Header.Get("From"); from != `"Cron" <cron@example.com>` {
+		t.Errorf("Expected the From header added, got %q", from)
+	}
+
+	if msg.Header.Has("Bcc") || !msg.Header.Has("Date") || msg.Subject != "Backup" || strings.TrimSpace(msg.HTML) != "Done" {
+		t.Errorf("Unexpected message: %q", raw)
+	}
+
+	if _, _, err = prepareSendmailMessage(data, &sendmailOptions{from: "cron@example.com"}); err == nil {
+		t.Errorf("Expected an error without recipients")
+	}
+}
+
+func TestSendmailCommand(t *testing.T) {
+	setupTestLogging(t, map[string]string{})
+	output := filepath.Join(t.TempDir(), "emails.jsonl")
+
+	t.Run("Direct delivery through a link", func(t *testing.T) {
+		t.Setenv(debugOutputEnv, output)
+		app := newApp()
+		app.Reader = strings.NewReader("Subject: Backup\n\nDone\n")
+		err := app.Run(sendmailArgs([]string{"/usr/sbin/sendmail", "-oi", "-f", "cron@example.com", "admin@example.com"}))
+
+		if err != nil {
+			t.Fatalf("Could not send the message: %v", err)
+		}
+
+		var document debugDocument
+		data, _ := os.ReadFile(output)
+
+		if err = json.Unmarshal(data, &document); err != nil {
+			t.Fatalf("Expected the message sent with the debug service, got %q", data)
+		}
+
+		if document.Subject != "Backup" || document.From != "cron@example.com" || strings.Join(document.To, ",") != "admin@example.com" {
+			t.Errorf("Unexpected message sent: %+v", document)
+		}
+	})
+
+	t.Run("Unreachable server", func(t *testing.T) {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := listener.Addr().String()
+		listener.Close()
+
+		exitCode := assertSendmailExitCode(t, []string{"tegami", "--sendmail-server", addr, "sendmail", "admin@example.com"})
+		if exitCode != sendmailTempFailExitCode {
+			t.Errorf("Expected a temporary failure, got %d", exitCode)
+		}
+	})
+
+	t.Run("Invalid usage", func(t *testing.T) {
+		if exitCode := assertSendmailExitCode(t, []string{"tegami", "sendmail", "-bp"}); exitCode != sendmailUsageExitCode {
+			t.Errorf("Expected a usage error, got %d", exitCode)
+		}
+	})
+}
+
+func TestSubmitMessageTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		// The server accepts the connection but never answers.
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = submitMessage(ctx, listener.Addr().String(), "cron@example.com", []string{"admin@example.com"}, []byte("Subject: Backup\r\n\r\nDone\r\n"))
+
+	if !IsTemporaryError(err) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+// assertSendmailExitCode runs the application, returning the exit code of its failure.
+func assertSendmailExitCode(t *testing.T, args []string) int {
+	t.Helper()
+	exitCode := 0
+	cli.OsExiter = func(code int) { exitCode = code }
+	t.Cleanup(func() { cli.OsExiter = os.Exit })
+
+	app := newApp()
+	app.Reader = strings.NewReader("Subject: Backup\n\nDone\n")
+	app.ErrWriter = &bytes.Buffer{}
+
+	if err := app.Run(args); err == nil {
+		t.Fatalf("Expected %v to fail", args)
+	}
+
+	return exitCode
+}
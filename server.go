@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Server runs the SMTP server of Tegami until it is asked to stop, then shuts it down gracefully.
+type Server struct {
+	smtp    *smtp.Server
+	backend *TegamiBackend
+	queue   *DeliveryQueue
+	// accepting is set to 1 while the server accepts connections.
+	accepting int32
+}
+
+// NewServer creates a server sending the messages with the services. The queue retries the
+// messages which failed temporarily and may be nil.
+func NewServer(config *SmtpConfig, services []Service, queue *DeliveryQueue) *Server {
+	backend := &TegamiBackend{
+		services:          services,
+		ctx:               context.Background(),
+		queue:             queue,
+		transcript:        config.transcript,
+		failedMessagesDir: config.failedMessagesDir,
+	}
+	return &Server{smtp: newSmtpServer(config, backend), backend: backend, queue: queue}
+}
+
+// Serve accepts the SMTP connections of the listener until the context is done, then shuts the
+// server down within the timeout. It returns an error when the listener failed or when some
+// messages may have been lost during the shutdown.
+func (s *Server) Serve(ctx context.Context, listener net.Listener, timeout time.Duration) error {
+	serveErr := make(chan error, 1)
+
+	var smtpListener net.Listener = &metricsListener{Listener: listener}
+
+	if s.backend.transcript != nil {
+		smtpListener = s.backend.transcript.Listener(smtpListener)
+	}
+
+	go func() {
+		serveErr <- s.smtp.Serve(smtpListener)
+	}()
+
+	atomic.StoreInt32(&s.accepting, 1)
+	var err error
+
+	select {
+	case err = <-serveErr:
+		slog.Error("SMTP server stopped", "error", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down the SMTP server")
+		listener.Close()
+	}
+
+	atomic.StoreInt32(&s.accepting, 0)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if shutdownErr := s.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+
+	return err
+}
+
+// Accepting returns whether the server accepts connections.
+func (s *Server) Accepting() bool {
+	return atomic.LoadInt32(&s.accepting) == 1
+}
+
+// Shutdown stops the server gracefully: the mail transactions in progress are given until the
+// context is done to finish while the new ones are refused, the remaining connections are closed
+// and the queued messages get a last attempt. It returns an error when some messages may have been lost.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var issues []string
+
+	if err := s.backend.waitTransactions(ctx); err != nil {
+		issues = append(issues, "mail transactions in progress were interrupted")
+	}
+
+	// Closing the server also closes the listener, which is already closed when the context of Serve is done.
+	_ = s.smtp.Close()
+
+	if s.queue != nil {
+		if err := s.queue.Shutdown(ctx); err != nil {
+			issues = append(issues, err.Error())
+		}
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("shutdown incomplete: %s", strings.Join(issues, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowService blocks each message until it is released or its context is done.
+type slowService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowService() *slowService {
+	return &slowService{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s *slowService) Init(_ map[string]string) error {
+	return nil
+}
+
+func (s *slowService) Send(ctx context.Context, _ *Message) error {
+	s.started <- struct{}{}
+
+	select {
+	case <-s.release:
+		return nil
+	case <-ctx.Done():
+		return &TemporaryError{Err: ctx.Err()}
+	}
+}
+
+func (s *slowService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *slowService) Close() error {
+	return nil
+}
+
+func TestServerShutdown(t *testing.T) {
+	t.Run("During a slow send", func(t *testing.T) {
+		service := newSlowService()
+		server, addr, cancel, serveErr := startTestServer(t, service, 5*time.Second)
+		sendErr := sendTestMessage(t, addr)
+		waitForSend(t, service)
+
+		idleClient, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+
+		defer idleClient.Close()
+		cancel()
+
+		waitForCondition(t, "listener closed", func() bool {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			return err != nil
+		})
+
+		if err = idleClient.Mail("nas@example.com"); err == nil || !strings.HasPrefix(err.Error(), "421") {
+			t.Errorf("Expected new transactions to be refused, got %v", err)
+		}
+
+		close(service.release)
+
+		if err = <-sendErr; err != nil {
+			t.Errorf("The message being sent was interrupted: %v", err)
+		}
+
+		if err = <-serveErr; err != nil {
+			t.Errorf("Unexpected shutdown error: %v", err)
+		}
+
+		if len(server.queue.Pending()) != 0 || len(server.queue.DeadLetters()) != 0 {
+			t.Errorf("Unexpected queued messages")
+		}
+	})
+
+	t.Run("With a send exceeding the timeout", func(t *testing.T) {
+		service := newSlowService()
+		server, addr, cancel, serveErr := startTestServer(t, service, 100*time.Millisecond)
+		sendErr := sendTestMessage(t, addr)
+		waitForSend(t, service)
+		cancel()
+
+		if err := <-sendErr; err == nil {
+			t.Errorf("Expected the message to be interrupted")
+		}
+
+		err := <-serveErr
+
+		if err == nil {
+			t.Fatalf("Expected a shutdown error")
+		}
+
+		assertErrorContent(t, err.Error(), "shutdown incomplete: mail transactions in progress were interrupted")
+
+		// The client didn't get a reply and sends the message again, so it mustn't be queued.
+		if len(server.queue.Pending()) != 0 || len(server.queue.DeadLetters()) != 0 {
+			t.Errorf("Unexpected queued messages")
+		}
+	})
+}
+
+// startTestServer starts a server with a queue on a random port, returning the server, its address,
+// the function stopping it and the channel receiving the result of Serve.
+func startTestServer(t *testing.T, service Service, timeout time.Duration) (*Server, string, context.CancelFunc, chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewServer(&SmtpConfig{}, []Service{service}, NewDeliveryQueue(5, time.Hour, 100))
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.Serve(ctx, listener, timeout)
+	}()
+
+	t.Cleanup(cancel)
+	return server, listener.Addr().String(), cancel, serveErr
+}
+
+// sendTestMessage sends a message in the background, returning the channel receiving the reply to
+// its data. The connection may be closed by the shutdown once the message is accepted, so the
+// client doesn't wait for the reply to QUIT.
+func sendTestMessage(t *testing.T, addr string) chan error {
+	t.Helper()
+	msg := createTextMail(t, "Disk failure")
+	sendErr := make(chan error, 1)
+
+	go func() {
+		sendErr <- sendTestData(addr, msg)
+	}()
+
+	return sendErr
+}
+
+func sendTestData(addr string, msg string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	if err = c.Mail("nas@example.com"); err != nil {
+		return err
+	}
+
+	if err = c.Rcpt("admin@example.com"); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(w, msg); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// waitForSend waits until the service started sending a message.
+func waitForSend(t *testing.T, service *slowService) {
+	t.Helper()
+	select {
+	case <-service.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the message to be sent")
+	}
+}
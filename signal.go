@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+const (
+	signalUrlFlag        = "signal-url"
+	signalAccountFlag    = "signal-account"
+	signalRecipientsFlag = "signal-recipients"
+	signalGroupsFlag     = "signal-groups"
+	signalRoutesFlag     = "signal-routes"
+	signalUrlEnv         = "TEGAMI_SIGNAL_URL"
+	signalAccountEnv     = "TEGAMI_SIGNAL_ACCOUNT"
+	signalRecipientsEnv  = "TEGAMI_SIGNAL_RECIPIENTS"
+	signalGroupsEnv      = "TEGAMI_SIGNAL_GROUPS"
+	signalRoutesEnv      = "TEGAMI_SIGNAL_ROUTES"
+)
+
+// signalRpcPath is the path of the JSON-RPC endpoint of the signal-cli HTTP daemon.
+const signalRpcPath = "/api/v1/rpc"
+
+// SignalService manages Signal related components. Messages are sent through a signal-cli
+// daemon using JSON-RPC, either over its Unix socket or over its HTTP endpoint.
+type SignalService struct {
+	client     *http.Client
+	rpcUrl     string
+	socketPath string
+	account    string
+	recipients []string
+	groups     []string
+	routes     Routes
+	nextId     uint64
+}
+
+type signalRequest struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	Id      string      `json:"id"`
+}
+
+type signalResponse struct {
+	Id     string          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type signalSendParams struct {
+	Account     string   `json:"account,omitempty"`
+	Recipient   []string `json:"recipient,omitempty"`
+	GroupId     string   `json:"groupId,omitempty"`
+	Message     string   `json:"message"`
+	TextStyle   []string `json:"textStyle,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// signalStyle is a style applied to a range of text, in UTF-16 code units as expected by Signal.
+type signalStyle struct {
+	start  int
+	length int
+	style  string
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Signal",
+		Prefix:   "signal",
+		Flags:    signalCLIFlags,
+		Required: [][]string{{signalUrlFlag}, {signalRecipientsFlag, signalGroupsFlag}},
+		New:      func() Service { return &SignalService{} },
+		Schemes:  []string{"signal", "signals"},
+		ParseURL: parseSignalNotifyURL,
+	})
+}
+
+func (s *SignalService) Init(flags map[string]string) error {
+	rawUrl := flags[signalUrlFlag]
+
+	if len(rawUrl) == 0 {
+		return errors.New("signal url not set")
+	}
+
+	if strings.HasPrefix(rawUrl, "http://") || strings.HasPrefix(rawUrl, "https://") {
+		parsedUrl, err := url.ParseRequestURI(rawUrl)
+		if err != nil {
+			return errors.New("signal url is invalid")
+		}
+
+		if len(strings.Trim(parsedUrl.Path, "/")) == 0 {
+			parsedUrl.Path = signalRpcPath
+		}
+
+		s.rpcUrl = parsedUrl.String()
+	} else {
+		s.socketPath = strings.TrimPrefix(rawUrl, "unix://")
+	}
+
+	routes, err := ParseRoutes(flags[signalRoutesFlag])
+	if err != nil {
+		return err
+	}
+
+	s.recipients = splitList(flags[signalRecipientsFlag])
+	s.groups = splitList(flags[signalGroupsFlag])
+
+	if len(s.recipients) == 0 && len(s.groups) == 0 {
+		return errors.New("signal recipients or groups not set")
+	}
+
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.account = flags[signalAccountFlag]
+	s.routes = routes
+
+	probeOnInit(flags, "Signal", s)
+	return nil
+}
+
+func (s *SignalService) Send(ctx context.Context, msg *Message) error {
+	destinations := s.routes.Match(msg.To)
+
+	if len(destinations) == 0 {
+		destinations = append(append(destinations, s.recipients...), s.groups...)
+	}
+
+	text, styles := formatSignalText(msg.Subject, msg.HTML)
+	params := signalSendParams{
+		Account: s.account,
+		Message: text,
+	}
+
+	for _, style := range styles {
+		params.TextStyle = append(params.TextStyle, fmt.Sprintf("%d:%d:%s", style.start, style.length, style.style))
+	}
+
+	for _, attachment := range msg.Attachments {
+		params.Attachments = append(params.Attachments, signalDataUri(attachment))
+	}
+
+	for _, destination := range destinations {
+		destinationParams := params
+
+		if s.isGroup(destination) {
+			destinationParams.GroupId = destination
+		} else {
+			destinationParams.Recipient = []string{destination}
+		}
+
+		if err := s.call(ctx, "send", &destinationParams); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SignalService) Render(msg *Message) (string, string, error) {
+	text, _ := formatSignalText(msg.Subject, msg.HTML)
+	return "Text", text, nil
+}
+
+func (s *SignalService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *SignalService) Close() error {
+	return nil
+}
+
+// Probe verifies that the signal-cli daemon answers its requests.
+func (s *SignalService) Probe(ctx context.Context) error {
+	return s.call(ctx, "version", nil)
+}
+
+// call invokes a JSON-RPC method of the signal-cli daemon.
+func (s *SignalService) call(ctx context.Context, method string, params interface{}) error {
+	var response signalResponse
+	var err error
+
+	request := &signalRequest{
+		JsonRpc: "2.0",
+		Method:  method,
+		Params:  params,
+		Id:      fmt.Sprintf("tegami-%d", atomic.AddUint64(&s.nextId, 1)),
+	}
+
+	if len(s.rpcUrl) > 0 {
+		err = postJSON(ctx, s.client, s.rpcUrl, nil, request, &response)
+	} else {
+		err = networkError(s.callSocket(ctx, request, &response))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if response.Error != nil {
+		return fmt.Errorf("signal error: %s", response.Error.Message)
+	}
+
+	return nil
+}
+
+// callSocket sends a request on the Unix socket of the daemon and waits for its response.
+// Notifications sent by the daemon on the same socket are ignored.
+func (s *SignalService) callSocket(ctx context.Context, request *signalRequest, response *signalResponse) error {
+	conn, err := dialContext(ctx, "unix", s.socketPath, nil, serviceHttpTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if err = json.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(conn)
+
+	for {
+		if err = decoder.Decode(response); err != nil {
+			return err
+		}
+
+		if response.Id == request.Id {
+			return nil
+		}
+
+		*response = signalResponse{}
+	}
+}
+
+// isGroup returns whether a destination is a group id rather than a phone number.
+func (s *SignalService) isGroup(destination string) bool {
+	return !strings.HasPrefix(destination, "+")
+}
+
+// signalDataUri encodes an attachment as a data URI, as accepted by signal-cli.
+func signalDataUri(attachment *Attachment) string {
+	contentType := attachment.ContentType
+
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	filename := ""
+
+	if len(attachment.Filename) > 0 {
+		filename = ";filename=" + attachment.Filename
+	}
+
+	return fmt.Sprintf("data:%s%s;base64,%s", contentType, filename, base64.StdEncoding.EncodeToString(attachment.Data))
+}
+
+// formatSignalText converts the HTML body of a message into plain text along with the ranges of
+// the text to display in bold, italic, strikethrough or monospace. The subject is added in bold
+// at the beginning of the text.
+func formatSignalText(subject, body string) (string, []signalStyle) {
+	f := &signalFormatter{}
+
+	if len(subject) > 0 {
+		f.open("BOLD", "")
+		f.write(subject)
+		f.closeStyle("")
+		f.write("\n\n")
+	}
+
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	skipped := 0
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+
+		switch tokenType {
+		case html.TextToken:
+			if skipped == 0 {
+				f.write(token.Data)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch token.Data {
+			case "head", "script", "style", "title":
+				if tokenType == html.StartTagToken {
+					skipped++
+				}
+			case "br":
+				f.write("\n")
+			case "a":
+				f.links = append(f.links, attributeValue(token, "href"))
+				f.linkStarts = append(f.linkStarts, f.text.Len())
+			default:
+				if style := signalTagStyle(token.Data); len(style) > 0 && tokenType == html.StartTagToken {
+					f.open(style, token.Data)
+				}
+			}
+		case html.EndTagToken:
+			switch token.Data {
+			case "head", "script", "style", "title":
+				if skipped > 0 {
+					skipped--
+				}
+			case "a":
+				f.closeLink()
+			case "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "pre", "blockquote", "table", "ul", "ol":
+				f.closeStyle(token.Data)
+				f.paragraph(token.Data)
+			default:
+				f.closeStyle(token.Data)
+			}
+		}
+	}
+
+	return f.finish()
+}
+
+// signalFormatter builds the text of a Signal message while tracking the styles applied to it.
+type signalFormatter struct {
+	text       strings.Builder
+	length     int
+	opened     []signalOpenStyle
+	styles     []signalStyle
+	links      []string
+	linkStarts []int
+}
+
+type signalOpenStyle struct {
+	tag   string
+	style string
+	start int
+}
+
+func (f *signalFormatter) write(text string) {
+	if f.text.Len() == 0 {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+	}
+
+	f.text.WriteString(text)
+
+	for _, r := range text {
+		f.length += utf16Length(r)
+	}
+}
+
+func (f *signalFormatter) open(style, tag string) {
+	f.opened = append(f.opened, signalOpenStyle{tag: tag, style: style, start: f.length})
+}
+
+// closeStyle closes the most recent style opened by a tag.
+func (f *signalFormatter) closeStyle(tag string) {
+	for i := len(f.opened) - 1; i >= 0; i-- {
+		if f.opened[i].tag != tag {
+			continue
+		}
+
+		if length := f.length - f.opened[i].start; length > 0 {
+			f.styles = append(f.styles, signalStyle{start: f.opened[i].start, length: length, style: f.opened[i].style})
+		}
+
+		f.opened = append(f.opened[:i], f.opened[i+1:]...)
+		return
+	}
+}
+
+// closeLink adds the url of a link after its text when they differ.
+func (f *signalFormatter) closeLink() {
+	if len(f.links) == 0 {
+		return
+	}
+
+	href := f.links[len(f.links)-1]
+	start := f.linkStarts[len(f.linkStarts)-1]
+	f.links = f.links[:len(f.links)-1]
+	f.linkStarts = f.linkStarts[:len(f.linkStarts)-1]
+
+	if len(href) == 0 || strings.HasPrefix(href, "mailto:") || f.text.String()[start:] == href {
+		return
+	}
+
+	f.write(" (" + href + ")")
+}
+
+// paragraph ends a block element with a line break, keeping at most one empty line between blocks.
+func (f *signalFormatter) paragraph(tag string) {
+	text := f.text.String()
+
+	if len(text) == 0 || strings.HasSuffix(text, "\n\n") {
+		return
+	}
+
+	if tag == "p" || tag == "div" || strings.HasPrefix(tag, "h") || tag == "pre" || tag == "blockquote" || tag == "table" {
+		if strings.HasSuffix(text, "\n") {
+			f.write("\n")
+		} else {
+			f.write("\n\n")
+		}
+		return
+	}
+
+	if !strings.HasSuffix(text, "\n") {
+		f.write("\n")
+	}
+}
+
+// finish trims the trailing spaces of the text and returns it along with the styles, limited to the text.
+func (f *signalFormatter) finish() (string, []signalStyle) {
+	for len(f.opened) > 0 {
+		f.closeStyle(f.opened[len(f.opened)-1].tag)
+	}
+
+	text := f.text.String()
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+
+	for _, r := range text[len(trimmed):] {
+		f.length -= utf16Length(r)
+	}
+
+	var styles []signalStyle
+
+	for _, style := range f.styles {
+		if style.start+style.length > f.length {
+			style.length = f.length - style.start
+		}
+
+		if style.length > 0 {
+			styles = append(styles, style)
+		}
+	}
+
+	return trimmed, styles
+}
+
+// signalTagStyle returns the Signal style matching an HTML tag, if any.
+func signalTagStyle(tag string) string {
+	switch tag {
+	case "b", "strong", "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		return "BOLD"
+	case "i", "em", "cite":
+		return "ITALIC"
+	case "s", "strike", "del":
+		return "STRIKETHROUGH"
+	case "code", "pre", "tt", "kbd", "samp":
+		return "MONOSPACE"
+	}
+	return ""
+}
+
+func attributeValue(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// utf16Length returns the number of UTF-16 code units used to encode a rune.
+func utf16Length(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// parseSignalNotifyURL converts URLs in the form signal[s]://[account@]host:port/recipient... into flags,
+// using the HTTP interface of the daemon.
+func parseSignalNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 {
+		return nil, errors.New("signal url is invalid, expected signal://account@host:port/recipient")
+	}
+
+	scheme := "http"
+
+	if u.scheme == "signals" {
+		scheme = "https"
+	}
+
+	return map[string]string{
+		signalUrlFlag:        scheme + "://" + u.host,
+		signalAccountFlag:    u.username,
+		signalRecipientsFlag: strings.Join(u.segments, ","),
+	}, nil
+}
+
+// signalCLIFlags returns the flags used for configuring the Signal service.
+func signalCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    signalUrlFlag,
+			Usage:   "The Unix socket path or HTTP url of the signal-cli daemon",
+			EnvVars: []string{signalUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    signalAccountFlag,
+			Usage:   "The phone number of the account sending the messages, when the daemon manages multiple accounts (Optional)",
+			EnvVars: []string{signalAccountEnv},
+		},
+		&cli.StringFlag{
+			Name:    signalRecipientsFlag,
+			Usage:   "The phone numbers receiving the messages, separated by commas",
+			EnvVars: []string{signalRecipientsEnv},
+		},
+		&cli.StringFlag{
+			Name:    signalGroupsFlag,
+			Usage:   "The ids of the groups receiving the messages, separated by commas",
+			EnvVars: []string{signalGroupsEnv},
+		},
+		&cli.StringFlag{
+			Name:    signalRoutesFlag,
+			Usage:   "Per recipient phone numbers or group ids in the form 'recipient=number', separated by commas (Optional)",
+			EnvVars: []string{signalRoutesEnv},
+		},
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+type signalTestRequest struct {
+	Method string           `json:"method"`
+	Id     string           `json:"id"`
+	Params signalSendParams `json:"params"`
+}
+
+func TestSignalService(t *testing.T) {
+	var requests []signalTestRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request signalTestRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		if r.URL.Path != signalRpcPath || request.Params.Recipient != nil && request.Params.Recipient[0] == "+15550000000" {
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","error":{"code":-1,"message":"Unregistered user"},"id":"%s"}`, request.Id)
+			return
+		}
+
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","result":{"timestamp":1},"id":"%s"}`, request.Id)
+	}))
+	defer srv.Close()
+
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With valid arguments", "", "", ""},
+			{"With missing url", signalUrlFlag, "", "signal url not set"},
+			{"With invalid url", signalUrlFlag, "http://%zz", "signal url is invalid"},
+			{"With missing recipients", signalRecipientsFlag, "", "signal recipients or groups not set"},
+			{"With unreachable daemon", signalUrlFlag, srv.URL + "/foo", "signal error: Unregistered user"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := map[string]string{signalUrlFlag: srv.URL, signalRecipientsFlag: "+15551234567"}
+				if len(test.flag) > 0 {
+					flags[test.flag] = test.value
+				}
+
+				err := initAndProbe(&SignalService{}, flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		service := &SignalService{}
+		flags := map[string]string{
+			signalUrlFlag:        srv.URL,
+			signalAccountFlag:    "+15559876543",
+			signalRecipientsFlag: "+15551234567",
+			signalGroupsFlag:     "Z3JvdXA=",
+			signalRoutesFlag:     "unknown@example.com=+15550000000",
+		}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start Signal service: %v", err)
+		}
+
+		requests = nil
+		msg := &Message{
+			Subject:     "Backup",
+			HTML:        "<p>Backup <b>done</b></p>",
+			Attachments: []*Attachment{{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report")}},
+		}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		if len(requests) != 2 {
+			t.Fatalf("Expected 2 requests, got %d", len(requests))
+		}
+
+		params := requests[0].Params
+		assertMessageContent(t, t.Name(), requests[0].Method, "send")
+		assertMessageContent(t, t.Name(), params.Account, "+15559876543")
+		assertMessageContent(t, t.Name(), fmt.Sprint(params.Recipient), "[+15551234567]")
+		assertMessageContent(t, t.Name(), params.Message, "Backup\n\nBackup done")
+		assertMessageContent(t, t.Name(), fmt.Sprint(params.TextStyle), "[0:6:BOLD 15:4:BOLD]")
+		assertMessageContent(t, t.Name(), fmt.Sprint(params.Attachments), "[data:text/plain;filename=report.txt;base64,cmVwb3J0]")
+		assertMessageContent(t, t.Name(), requests[1].Params.GroupId, "Z3JvdXA=")
+
+		err := service.Send(context.Background(), &Message{To: []string{"unknown@example.com"}, HTML: "Hello"})
+		assertErrorContent(t, fmt.Sprint(err), "signal error: Unregistered user")
+	})
+
+	t.Run("Send through Unix socket", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "signal.sock")
+		listener, err := net.Listen("unix", socketPath)
+
+		if err != nil {
+			t.Fatalf("Could not start signal-cli socket: %v", err)
+		}
+
+		defer listener.Close()
+		requests = nil
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				var request signalTestRequest
+				json.NewDecoder(bufio.NewReader(conn)).Decode(&request)
+				requests = append(requests, request)
+				fmt.Fprintf(conn, "{\"jsonrpc\":\"2.0\",\"method\":\"receive\",\"params\":{}}\n")
+				fmt.Fprintf(conn, "{\"jsonrpc\":\"2.0\",\"result\":{},\"id\":\"%s\"}\n", request.Id)
+				conn.Close()
+			}
+		}()
+
+		service := &SignalService{}
+
+		if err = service.Init(map[string]string{signalUrlFlag: "unix://" + socketPath, signalGroupsFlag: "Z3JvdXA="}); err != nil {
+			t.Fatalf("Could not start Signal service: %v", err)
+		}
+
+		if err = service.Send(context.Background(), &Message{HTML: "Hello"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), requests[0].Method, "version")
+		assertMessageContent(t, t.Name(), requests[1].Params.Message, "Hello")
+		assertMessageContent(t, t.Name(), requests[1].Params.GroupId, "Z3JvdXA=")
+	})
+}
+
+func TestFormatSignalText(t *testing.T) {
+	var tests = []struct {
+		name       string
+		subject    string
+		body       string
+		wantText   string
+		wantStyles string
+	}{
+		{"Plain text", "", "Line 1\nLine 2", "Line 1\nLine 2", "[]"},
+		{"Subject", "Hello", "world", "Hello\n\nworld", "[{0 5 BOLD}]"},
+		{"Styles", "", "<b>bold</b> <i>italic</i> <code>code</code> <del>gone</del>", "bold italic code gone",
+			"[{0 4 BOLD} {5 6 ITALIC} {12 4 MONOSPACE} {17 4 STRIKETHROUGH}]"},
+		{"Nested styles", "", "<strong>bold <em>both</em></strong>", "bold both", "[{5 4 ITALIC} {0 9 BOLD}]"},
+		{"Paragraphs", "", "<div><p>First</p><p>Second</p></div><ul><li>One</li><li>Two</li></ul>",
+			"First\n\nSecond\n\nOne\nTwo", "[]"},
+		{"Line breaks", "", "One<br>Two", "One\nTwo", "[]"},
+		{"UTF-16 offsets", "", "📦 <b>done</b> é", "📦 done é", "[{3 4 BOLD}]"},
+		{"Links", "", `<a href="https://example.com">Site</a> <a href="https://example.org">https://example.org</a>`,
+			"Site (https://example.com) https://example.org", "[]"},
+		{"Hidden content", "", "<html><head><title>Title</title><style>p {}</style></head><body>Text</body></html>", "Text", "[]"},
+		{"Entities", "", "a &lt; b &amp;&amp; c", "a < b && c", "[]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, styles := formatSignalText(test.subject, test.body)
+			assertMessageContent(t, test.name, text, test.wantText)
+			assertMessageContent(t, test.name, fmt.Sprint(styles), test.wantStyles)
+		})
+	}
+}
@@ -1,98 +1,367 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	md "github.com/JohannesKaufmann/html-to-markdown"
 	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"io"
+	"log/slog"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 var IsNotMultipartError = errors.New("message is not multipart")
 
+// Message is an email received by Tegami once it has been processed.
+type Message struct {
+	// From is the envelope sender of the message.
+	From string
+	// To contains the envelope recipients of the message.
+	To []string
+	// Header contains the headers of the email.
+	Header mail.Header
+	// Subject is the decoded subject of the email.
+	Subject string
+	// Date is the date of the email, or the reception time if the email has none.
+	Date time.Time
+	// Received is the time at which the SMTP server started receiving the email.
+	Received time.Time
+	// HTML is the body of the email in its HTML form.
+	HTML string
+	// Markdown is the body of the email in its Markdown form.
+	Markdown string
+	// Attachments contains the non-textual parts of the email.
+	Attachments []*Attachment
+	// Raw contains the original email as received by the SMTP server, preceded by the trace headers added by Tegami.
+	Raw []byte
+	// ID identifies the message in the logs and in its X-Tegami-Id header.
+	ID string
+	// SessionID identifies the SMTP session the message was received in.
+	SessionID string
+}
+
+// Attachment is a file attached to an email.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
 // TegamiBackend is a concrete implementation of an
 // SMTP backend for Tegami.
 type TegamiBackend struct {
 	services []Service
+	// ctx is the context of the server, the contexts of the sessions are derived from it.
+	ctx context.Context
+	// queue sends again the messages which failed temporarily. When it is nil, the temporary
+	// failures are reported to the clients instead.
+	queue *DeliveryQueue
+	// transcript logs the SMTP conversations, it is nil when they aren't logged.
+	transcript *TranscriptRecorder
+	// failedMessagesDir is the directory where the messages which couldn't be parsed are saved, if set.
+	failedMessagesDir string
+	// mutex protects closing, which is set once the server is shutting down.
+	mutex   sync.Mutex
+	closing bool
+	// transactions tracks the mail transactions in progress, from MAIL to the end of DATA.
+	transactions sync.WaitGroup
 }
 
+// shuttingDownError is returned to the clients starting a mail transaction during the shutdown.
+var shuttingDownError = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Service shutting down, try again later"}
+
 func (bkd *TegamiBackend) Login(_ *smtp.ConnectionState, _, _ string) (smtp.Session, error) {
 	return nil, nil
 }
 
-func (bkd *TegamiBackend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
-	return &TegamiSession{bkd.services}, nil
+func (bkd *TegamiBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	ctx, cancel := context.WithCancel(bkd.ctx)
+	session := &TegamiSession{
+		services:          bkd.services,
+		backend:           bkd,
+		queue:             bkd.queue,
+		id:                newCorrelationId(),
+		hostname:          state.Hostname,
+		failedMessagesDir: bkd.failedMessagesDir,
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+
+	// The transcript of the connection is logged with the ID of its session.
+	if bkd.transcript != nil {
+		if id, ok := bkd.transcript.SessionId(state.RemoteAddr); ok {
+			session.id = id
+		}
+	}
+
+	if state.RemoteAddr != nil {
+		session.remoteAddr = state.RemoteAddr.String()
+	}
+
+	slog.Debug("SMTP session started", "session", session.id, "remote_addr", session.remoteAddr, "hostname", session.hostname)
+	return session, nil
+}
+
+// beginTransaction registers a new mail transaction, returning false if the server is shutting down.
+func (bkd *TegamiBackend) beginTransaction() bool {
+	bkd.mutex.Lock()
+	defer bkd.mutex.Unlock()
+
+	if bkd.closing {
+		return false
+	}
+
+	bkd.transactions.Add(1)
+	return true
+}
+
+// waitTransactions refuses the new mail transactions and waits for the ones in progress to end
+// or for the context to be done, in which case it returns the error of the context.
+func (bkd *TegamiBackend) waitTransactions(ctx context.Context) error {
+	bkd.mutex.Lock()
+	bkd.closing = true
+	bkd.mutex.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		bkd.transactions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // TegamiSession is a concrete implementation of an SMTP
 // session for Tegami.
 type TegamiSession struct {
 	services []Service
+	backend  *TegamiBackend
+	queue    *DeliveryQueue
+	// id identifies the session in the logs.
+	id string
+	// hostname is the name given by the client in its greeting.
+	hostname   string
+	remoteAddr string
+	from       string
+	to         []string
+	// inTransaction is set from the MAIL command until the transaction is reset.
+	inTransaction bool
+	// failedMessagesDir is the directory where the messages which couldn't be parsed are saved, if set.
+	failedMessagesDir string
+	// ctx is cancelled once the client disconnects, abandoning the messages being sent.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (s *TegamiSession) AuthPlain(_, _ string) error {
 	return nil
 }
 
-func (s *TegamiSession) Mail(_ string, _ smtp.MailOptions) error {
+func (s *TegamiSession) Mail(from string, _ smtp.MailOptions) error {
+	if s.backend != nil && !s.inTransaction {
+		if !s.backend.beginTransaction() {
+			return shuttingDownError
+		}
+		s.inTransaction = true
+	}
+
+	slog.Debug("Mail transaction started", "session", s.id, "from", from)
+	s.from = from
 	return nil
 }
 
-func (s *TegamiSession) Rcpt(_ string) error {
+func (s *TegamiSession) Rcpt(to string) error {
+	slog.Debug("Recipient accepted", "session", s.id, "to", to)
+	s.to = append(s.to, to)
 	return nil
 }
 
 func (s *TegamiSession) Data(r io.Reader) error {
-	htmlMessage, markdownMessage, err := ProcessMessage(r)
+	messagesReceived.Inc()
+	start := time.Now()
+	var data bytes.Buffer
+
+	if len(s.failedMessagesDir) > 0 {
+		r = io.TeeReader(r, &data)
+	}
+
+	msg, err := ProcessMessage(r)
+	messageProcessing.Observe(time.Since(start).Seconds())
 
 	if err != nil {
+		messagesRejected.Inc("invalid")
+		slog.Warn("Message rejected, it couldn't be parsed", "session", s.id, "error", err)
+		s.saveFailedMessage(data.Bytes())
 		return err
 	}
 
+	messageSize.Observe(float64(len(msg.Raw)))
+
+	msg.ID = newCorrelationId()
+	msg.SessionID = s.id
+	msg.From = s.from
+	msg.To = s.to
+	msg.addTraceHeaders(s.hostname, s.remoteAddr)
+	messageHistory.Add(msg)
+
+	logger := msg.Logger()
+	logger.Info("Message received", "from", msg.From, "to", msg.To, "subject", msg.Subject, "size", len(msg.Raw),
+		"attachments", len(msg.Attachments))
+	logger.Debug("Message content", "body", msg.HTML)
+
 	for _, service := range s.services {
-		var messageToSend string
+		err = service.Send(s.ctx, msg)
 
-		if service.IsMarkdownService() {
-			messageToSend = markdownMessage
-		} else {
-			messageToSend = htmlMessage
+		if err == nil {
+			continue
 		}
 
-		if err = service.Send(messageToSend); err != nil {
-			return err
+		// The messages aren't queued once the client is gone since it didn't get the confirmation
+		// that its message was accepted and will send it again.
+		if IsTemporaryError(err) && s.queue != nil && s.ctx.Err() == nil {
+			logger.Warn("Message queued for a retry", "service", serviceName(service), "error", err)
+			s.queue.Add(msg, service, err)
+			continue
 		}
+
+		messagesRejected.Inc(sendResult(err))
+		logger.Warn("Message rejected", "service", serviceName(service), "error", err, "temporary", IsTemporaryError(err))
+		return sendError(err)
 	}
 
 	return nil
 }
 
-func (s *TegamiSession) Reset() {}
+// saveFailedMessage saves the data of a message which couldn't be parsed when the directory of the failed messages is set.
+func (s *TegamiSession) saveFailedMessage(data []byte) {
+	if len(s.failedMessagesDir) == 0 {
+		return
+	}
+
+	if path, err := saveFailedMessage(s.failedMessagesDir, s.id, data); err != nil {
+		slog.Error("Could not save the message which couldn't be parsed", "session", s.id, "error", err)
+	} else {
+		slog.Info("Message which couldn't be parsed saved", "session", s.id, "path", path)
+	}
+}
+
+func (s *TegamiSession) Reset() {
+	s.from = ""
+	s.to = nil
+	s.endTransaction()
+}
 
 func (s *TegamiSession) Logout() error {
+	s.endTransaction()
+	s.cancel()
 	return nil
 }
 
+// endTransaction marks the mail transaction in progress, if any, as ended.
+func (s *TegamiSession) endTransaction() {
+	if s.inTransaction {
+		s.inTransaction = false
+		s.backend.transactions.Done()
+	}
+}
+
+// sendError converts the error of a service into the SMTP reply sent to the client. Temporary
+// errors tell the client to retry later while the other errors make it give up.
+func sendError(err error) *smtp.SMTPError {
+	if IsTemporaryError(err) {
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 0}, Message: "Temporary failure: " + err.Error()}
+	}
+
+	return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 3, 0}, Message: "Permanent failure: " + err.Error()}
+}
+
 // CreateSmtpServer creates an SMTP server based on its configuration and
 // supported services. The server is not yet started.
 func CreateSmtpServer(config *SmtpConfig, services []Service) *smtp.Server {
-	be := &TegamiBackend{services}
+	return newSmtpServer(config, &TegamiBackend{services: services, ctx: context.Background()})
+}
+
+// newSmtpServer creates an SMTP server using a backend.
+func newSmtpServer(config *SmtpConfig, be *TegamiBackend) *smtp.Server {
 	srv := smtp.NewServer(be)
+	srv.EnableAuth(sasl.Plain, func(conn *smtp.Conn) sasl.Server {
+		return &metricsSaslServer{Server: newPlainSaslServer(conn, be)}
+	})
 	srv.Addr = fmt.Sprintf("%s:%s", config.host, config.port)
+	srv.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
 	srv.AllowInsecureAuth = true
+	srv.TLSConfig = config.tlsConfig
 	return srv
 }
 
+// newPlainSaslServer returns the PLAIN authentication mechanism of the server, logging in with the backend
+// as done by default by go-smtp.
+func newPlainSaslServer(conn *smtp.Conn, be smtp.Backend) sasl.Server {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return errors.New("Identities not supported")
+		}
+
+		state := conn.State()
+		session, err := be.Login(&state, username, password)
+		if err != nil {
+			return err
+		}
+
+		conn.SetSession(session)
+		return nil
+	})
+}
+
+// metricsSaslServer is an authentication mechanism counting the failed authentications.
+type metricsSaslServer struct {
+	sasl.Server
+}
+
+func (s *metricsSaslServer) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := s.Server.Next(response)
+	if err != nil {
+		smtpAuthFailures.Inc()
+	}
+	return challenge, done, err
+}
+
 // ProcessMessage retrieves the data of the message from the SMTP server
-// and processes it. Returns the message in its HTML and Markdown form. It also
+// and processes it. Returns the message with its body in HTML and Markdown form. It also
 // returns an error if the message couldn't be processed.
-func ProcessMessage(messageData io.Reader) (string, string, error) {
-	body, err := readMessageBody(messageData)
+func ProcessMessage(messageData io.Reader) (*Message, error) {
+	received := time.Now()
+	raw, err := io.ReadAll(messageData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entity, err := message.Read(bytes.NewReader(raw))
 
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	header := mail.Header{Header: entity.Header}
+	body, attachments, err := readMessageBody(entity)
+
+	if err != nil {
+		return nil, err
 	}
 
 	// Telegram doesn't accept <br> HTML tags and html-to-markdown adds two newlines instead of one.
@@ -102,32 +371,95 @@ func ProcessMessage(messageData io.Reader) (string, string, error) {
 	trimmedBody := strings.TrimSpace(body)
 	markdownBody, err := convertToMarkdown(trimmedBody)
 
-	return trimmedBody, markdownBody, err
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := header.Subject()
+	date, err := header.Date()
+
+	if err != nil || date.IsZero() {
+		date = received
+	}
+
+	return &Message{
+		Header:      header,
+		Subject:     subject,
+		Date:        date,
+		Received:    received,
+		HTML:        trimmedBody,
+		Markdown:    markdownBody,
+		Attachments: attachments,
+		Raw:         raw,
+	}, nil
 }
 
-// readMessageBody reads the message body from the SMTP server and returns the string of the body.
-// It also returns an error if it couldn't properly read the message.
-func readMessageBody(data io.Reader) (string, error) {
-	msg, err := message.Read(data)
+// addTraceHeaders adds the Received and X-Tegami-Id headers to the message, which identify it in the logs.
+func (m *Message) addTraceHeaders(hostname, remoteAddr string) {
+	if len(hostname) == 0 {
+		hostname = "unknown"
+	}
 
-	if err != nil {
-		return "", err
+	received := fmt.Sprintf("from %s (%s) by tegami with ESMTP id %s; %s", hostname, remoteAddr, m.ID, m.Received.Format(time.RFC1123Z))
+	m.Header.Add("Received", received)
+	m.Header.Set("X-Tegami-Id", m.ID)
+	m.Raw = append([]byte("Received: "+received+"\r\nX-Tegami-Id: "+m.ID+"\r\n"), m.Raw...)
+}
+
+// Logger returns the logger of the events related to the message, identifying its session and the message.
+func (m *Message) Logger() *slog.Logger {
+	return slog.With("session", m.SessionID, "message", m.ID)
+}
+
+// FirstImage returns the first image attached to the message or nil if there are none.
+func (m *Message) FirstImage() *Attachment {
+	for _, attachment := range m.Attachments {
+		if attachment.IsImage() {
+			return attachment
+		}
 	}
-	multipartBody, err := readMultipartBody(msg)
+	return nil
+}
+
+// Sender returns the sender of the message as written in its headers, or its envelope sender.
+func (m *Message) Sender() string {
+	if from, err := m.Header.Text("From"); err == nil && len(from) > 0 {
+		return from
+	}
+	return m.From
+}
+
+// Recipients returns the recipients of the message as written in its headers, or its envelope recipients.
+func (m *Message) Recipients() string {
+	if to, err := m.Header.Text("To"); err == nil && len(to) > 0 {
+		return to
+	}
+	return strings.Join(m.To, ", ")
+}
+
+// IsImage validates whether the attachment is an image.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// readMessageBody reads the message body from the SMTP server and returns the string of the body
+// along with its attachments. It also returns an error if it couldn't properly read the message.
+func readMessageBody(msg *message.Entity) (string, []*Attachment, error) {
+	multipartBody, attachments, err := readMultipartBody(msg)
 
 	if err != nil && err != IsNotMultipartError {
-		return "", err
+		return "", nil, err
 	} else if err == nil {
-		return multipartBody, nil
+		return multipartBody, attachments, nil
 	}
 
 	body, err := io.ReadAll(msg.Body)
 
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return string(body), nil
+	return string(body), nil, nil
 }
 
 // convertToMarkdown converts a string of text to its appropriate Markdown configuration.
@@ -143,43 +475,64 @@ func convertToMarkdown(body string) (string, error) {
 }
 
 // readMultipartBody reads an email's multipart body and returns its
-// textual content. For better formatting reasons, HTML based messages
-// are prioritized over plain text ones.
-func readMultipartBody(msg *message.Entity) (string, error) {
+// textual content as well as its attachments. For better formatting reasons, HTML based
+// messages are prioritized over plain text ones.
+func readMultipartBody(msg *message.Entity) (string, []*Attachment, error) {
 	var messageBody strings.Builder
-	mr := msg.MultipartReader()
+	var attachments []*Attachment
+	hasHtmlBody := false
 
-	if mr == nil {
-		return "", IsNotMultipartError
+	if mediaType, _, _ := msg.Header.ContentType(); !strings.HasPrefix(mediaType, "multipart/") {
+		return "", nil, IsNotMultipartError
 	}
 
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return "", err
+	err := msg.Walk(func(_ []int, p *message.Entity, err error) error {
+		if err != nil {
+			return err
 		}
 
-		contentType, _, _ := p.Header.ContentType()
+		contentType, params, _ := p.Header.ContentType()
 
-		if contentType == "text/plain" || contentType == "text/html" {
-			bytes, err := io.ReadAll(p.Body)
-			if err != nil {
-				return "", err
-			}
+		if strings.HasPrefix(contentType, "multipart/") {
+			return nil
+		}
+
+		bytes, err := io.ReadAll(p.Body)
+		if err != nil {
+			return err
+		}
+
+		disposition, dispositionParams, _ := p.Header.ContentDisposition()
+		isText := contentType == "text/plain" || contentType == "text/html"
 
+		if isText && disposition != "attachment" {
 			// Prioritize html messages over plain text ones
-			if contentType == "text/html" {
-				if messageBody.Len() > 0 {
-					messageBody.Reset()
-				}
+			if contentType == "text/html" && !hasHtmlBody {
+				messageBody.Reset()
 				messageBody.Write(bytes)
-				break
-			} else {
+				hasHtmlBody = true
+			} else if contentType == "text/plain" && !hasHtmlBody {
 				messageBody.Write(bytes)
 			}
+			return nil
 		}
+
+		filename := dispositionParams["filename"]
+		if len(filename) == 0 {
+			filename = params["name"]
+		}
+
+		attachments = append(attachments, &Attachment{
+			Filename:    filename,
+			ContentType: contentType,
+			Data:        bytes,
+		})
+		return nil
+	})
+
+	if err != nil {
+		return "", nil, err
 	}
-	return messageBody.String(), nil
+
+	return messageBody.String(), attachments, nil
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"github.com/emersion/go-message/mail"
 	gosmtp "github.com/emersion/go-smtp"
 	"io"
@@ -14,7 +16,7 @@ import (
 func TestSmtpSession(t *testing.T) {
 	htmlService := &RecorderService{isMarkdownService: false}
 	markdownService := &RecorderService{isMarkdownService: true}
-	session := TegamiSession{[]Service{htmlService, markdownService}}
+	session := TegamiSession{services: []Service{htmlService, markdownService}, ctx: context.Background()}
 	msgContent := "This is a <b>bold</b> message!"
 
 	t.Run("Basic HTML and markdown parsing", func(t *testing.T) {
@@ -75,6 +77,129 @@ func TestSmtpSession(t *testing.T) {
 	})
 }
 
+func TestSessionErrors(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		queue    bool
+		wantCode int
+	}{
+		{"With temporary error", &TemporaryError{Err: errors.New("server unavailable")}, false, 451},
+		{"With permanent error", errors.New("invalid token"), false, 554},
+		{"With temporary error and queue", &TemporaryError{Err: errors.New("server unavailable")}, true, 0},
+		{"With permanent error and queue", errors.New("invalid token"), true, 554},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &RecorderService{sendErr: test.err}
+			session := TegamiSession{services: []Service{recorder}, ctx: context.Background()}
+
+			if test.queue {
+				session.queue = NewDeliveryQueue(5, time.Hour, 100)
+				defer session.queue.Shutdown(context.Background())
+			}
+
+			err := session.Data(strings.NewReader(createTextMail(t, "Disk failure")))
+
+			if test.wantCode == 0 {
+				if err != nil || len(session.queue.Pending()) != 1 {
+					t.Errorf("Expected the message to be queued, got %v", err)
+				}
+				return
+			}
+
+			var smtpError *gosmtp.SMTPError
+			if !errors.As(err, &smtpError) || smtpError.Code != test.wantCode {
+				t.Errorf("Expected an SMTP error with code %d, got %v", test.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestProcessMessage(t *testing.T) {
+	t.Run("Headers and envelope", func(t *testing.T) {
+		recorder := &RecorderService{}
+		session := TegamiSession{services: []Service{recorder}, ctx: context.Background()}
+		msg := "Subject: Disk failure" + smtpLineBreak +
+			"Date: Mon, 02 Jan 2006 15:04:05 +0000" + smtpLineBreak +
+			"X-Priority: 1" + smtpLineBreak + smtpLineBreak +
+			"Disk 2 failed"
+
+		session.Mail("nas@example.com", gosmtp.MailOptions{})
+		session.Rcpt("alerts@example.com")
+
+		if err := session.Data(strings.NewReader(msg)); err != nil {
+			t.Fatalf("Something went wrong when reading the message %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), recorder.message.Subject, "Disk failure")
+		assertMessageContent(t, t.Name(), recorder.message.From, "nas@example.com")
+		assertMessageContent(t, t.Name(), strings.Join(recorder.message.To, ","), "alerts@example.com")
+		assertMessageContent(t, t.Name(), recorder.message.Header.Get("X-Priority"), "1")
+		assertMessageContent(t, t.Name(), recorder.message.Header.Get("X-Tegami-Id"), recorder.message.ID)
+
+		trace := "X-Tegami-Id: " + recorder.message.ID + smtpLineBreak
+		raw := string(recorder.message.Raw)
+
+		if !strings.HasPrefix(raw, "Received: from unknown () by tegami with ESMTP id "+recorder.message.ID) ||
+			!strings.HasSuffix(raw, trace+msg) {
+			t.Errorf("Unexpected raw message: %s", raw)
+		}
+
+		if recorder.message.Date.Year() != 2006 {
+			t.Errorf("Unexpected message date: %v", recorder.message.Date)
+		}
+
+		session.Reset()
+
+		if len(session.from) > 0 || len(session.to) > 0 {
+			t.Errorf("Envelope not cleared after reset")
+		}
+	})
+
+	t.Run("Nested multipart message with attachment", func(t *testing.T) {
+		var buf bytes.Buffer
+		var header mail.Header
+		header.SetSubject("Camera snapshot")
+		writer, err := mail.CreateWriter(&buf, header)
+
+		if err != nil {
+			t.Fatalf("Could not create mail writer: %v", err)
+		}
+
+		inlineWriter, _ := writer.CreateInline()
+		addTextMailPart(t, inlineWriter, "text/plain", "Motion detected")
+		addTextMailPart(t, inlineWriter, "text/html", "<b>Motion</b> detected")
+		inlineWriter.Close()
+
+		var attachmentHeader mail.AttachmentHeader
+		attachmentHeader.Set("Content-Type", "image/jpeg")
+		attachmentHeader.SetFilename("snapshot.jpg")
+		attachmentWriter, _ := writer.CreateAttachment(attachmentHeader)
+		io.WriteString(attachmentWriter, "jpeg data")
+		attachmentWriter.Close()
+		writer.Close()
+
+		msg, err := ProcessMessage(&buf)
+
+		if err != nil {
+			t.Fatalf("Error while processing: %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), msg.HTML, "<b>Motion</b> detected")
+
+		image := msg.FirstImage()
+
+		if image == nil {
+			t.Fatalf("Image attachment not found")
+		}
+
+		assertMessageContent(t, t.Name(), image.Filename, "snapshot.jpg")
+		assertMessageContent(t, t.Name(), string(image.Data), "jpeg data")
+	})
+}
+
 func TestServerIntegration(t *testing.T) {
 	// Init server
 	config, htmlRecorder, markdownRecorder := generateTestSmtpConfig()
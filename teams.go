@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/urfave/cli/v2"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	teamsWebhookUrlFlag = "teams-webhook-url"
+	teamsRoutesFlag     = "teams-routes"
+	teamsWebhookUrlEnv  = "TEGAMI_TEAMS_WEBHOOK_URL"
+	teamsRoutesEnv      = "TEGAMI_TEAMS_ROUTES"
+)
+
+// teamsMaxTextLength keeps the card below the 28 KB limit of Teams webhooks.
+const teamsMaxTextLength = 20000
+
+// TeamsService manages Microsoft Teams related components.
+type TeamsService struct {
+	client     *http.Client
+	webhookUrl string
+	routes     Routes
+}
+
+type teamsPayload struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string             `json:"$schema"`
+	Type    string             `json:"type"`
+	Version string             `json:"version"`
+	Body    []teamsCardElement `json:"body"`
+	MsTeams map[string]string  `json:"msteams,omitempty"`
+}
+
+type teamsCardElement struct {
+	Type   string      `json:"type"`
+	Text   string      `json:"text,omitempty"`
+	Weight string      `json:"weight,omitempty"`
+	Size   string      `json:"size,omitempty"`
+	Wrap   bool        `json:"wrap,omitempty"`
+	Facts  []teamsFact `json:"facts,omitempty"`
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Microsoft Teams",
+		Prefix:   "teams",
+		Flags:    teamsCLIFlags,
+		Required: [][]string{{teamsWebhookUrlFlag}},
+		Secrets:  []string{teamsWebhookUrlFlag, teamsRoutesFlag},
+		New:      func() Service { return &TeamsService{} },
+		Schemes:  []string{"msteams"},
+		ParseURL: parseTeamsNotifyURL,
+	})
+}
+
+func (s *TeamsService) Init(flags map[string]string) error {
+	webhookUrl := flags[teamsWebhookUrlFlag]
+
+	if len(webhookUrl) == 0 {
+		return errors.New("teams webhook url not set")
+	}
+
+	if _, err := url.ParseRequestURI(webhookUrl); err != nil {
+		return errors.New("teams webhook url is invalid")
+	}
+
+	routes, err := ParseRoutes(flags[teamsRoutesFlag])
+	if err != nil {
+		return err
+	}
+
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.webhookUrl = webhookUrl
+	s.routes = routes
+	return nil
+}
+
+func (s *TeamsService) Send(ctx context.Context, msg *Message) error {
+	webhookUrls := s.routes.Match(msg.To)
+
+	if len(webhookUrls) == 0 {
+		webhookUrls = []string{s.webhookUrl}
+	}
+
+	payload := createTeamsPayload(msg)
+
+	return sendToEach(len(webhookUrls), func(i int) error {
+		return postJSON(ctx, s.client, webhookUrls[i], nil, payload, nil)
+	})
+}
+
+func (s *TeamsService) Render(msg *Message) (string, string, error) {
+	return renderJSON(createTeamsPayload(msg))
+}
+
+func (s *TeamsService) IsMarkdownService() bool {
+	return true
+}
+
+func (s *TeamsService) Close() error {
+	return nil
+}
+
+// createTeamsPayload creates the Adaptive Card sent to Teams for a message.
+func createTeamsPayload(msg *Message) *teamsPayload {
+	title := msg.Subject
+
+	if len(title) == 0 {
+		title = "(no subject)"
+	}
+
+	body := []teamsCardElement{
+		{Type: "TextBlock", Text: title, Weight: "Bolder", Size: "Medium", Wrap: true},
+		{
+			Type: "FactSet",
+			Facts: []teamsFact{
+				{Title: "From", Value: msg.Sender()},
+				{Title: "To", Value: msg.Recipients()},
+				{Title: "Date", Value: msg.Date.Format(time.RFC1123Z)},
+			},
+		},
+	}
+
+	if len(msg.Markdown) > 0 {
+		body = append(body, teamsCardElement{
+			Type: "TextBlock",
+			Text: truncateString(msg.Markdown, teamsMaxTextLength),
+			Wrap: true,
+		})
+	}
+
+	return &teamsPayload{
+		Type: "message",
+		Attachments: []teamsAttachment{
+			{
+				ContentType: "application/vnd.microsoft.card.adaptive",
+				Content: teamsCard{
+					Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+					Type:    "AdaptiveCard",
+					Version: "1.4",
+					Body:    body,
+					MsTeams: map[string]string{"width": "Full"},
+				},
+			},
+		},
+	}
+}
+
+// parseTeamsNotifyURL converts URLs in the form msteams://host/path, the webhook url without its
+// https scheme, into flags.
+func parseTeamsNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 || len(u.segments) == 0 {
+		return nil, errors.New("teams url is invalid, expected msteams://host/path")
+	}
+
+	return map[string]string{teamsWebhookUrlFlag: "https://" + u.host + u.path}, nil
+}
+
+// teamsCLIFlags returns the flags used for configuring the Microsoft Teams service.
+func teamsCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    teamsWebhookUrlFlag,
+			Usage:   "The Teams workflow or incoming webhook url receiving the messages",
+			EnvVars: []string{teamsWebhookUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    teamsRoutesFlag,
+			Usage:   "Per recipient webhook urls in the form 'recipient=url', separated by commas (Optional)",
+			EnvVars: []string{teamsRoutesEnv},
+		},
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTeamsService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flags   map[string]string
+			wantErr string
+		}{
+			{"With valid arguments", map[string]string{teamsWebhookUrlFlag: "https://example.com/webhook"}, ""},
+			{"With missing webhook url", map[string]string{}, "teams webhook url not set"},
+			{"With invalid webhook url", map[string]string{teamsWebhookUrlFlag: "foo"}, "teams webhook url is invalid"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := (&TeamsService{}).Init(test.flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		var payload teamsPayload
+		srv := createStubWebhookServer(t, &payload, http.StatusAccepted)
+		defer srv.Close()
+
+		service := &TeamsService{}
+		if err := service.Init(map[string]string{teamsWebhookUrlFlag: srv.URL}); err != nil {
+			t.Fatalf("Could not start Teams service: %v", err)
+		}
+
+		msg := &Message{
+			From:     "nas@example.com",
+			To:       []string{"alerts@example.com"},
+			Subject:  "Backup done",
+			Date:     time.Date(2021, 10, 2, 15, 4, 5, 0, time.UTC),
+			Markdown: "Backup **succeeded**",
+		}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		card := payload.Attachments[0].Content
+		assertMessageContent(t, t.Name(), payload.Attachments[0].ContentType, "application/vnd.microsoft.card.adaptive")
+		assertMessageContent(t, t.Name(), card.Type, "AdaptiveCard")
+		assertMessageContent(t, t.Name(), card.Body[0].Text, "Backup done")
+		assertMessageContent(t, t.Name(), card.Body[1].Facts[0].Value, "nas@example.com")
+		assertMessageContent(t, t.Name(), card.Body[1].Facts[1].Value, "alerts@example.com")
+		assertMessageContent(t, t.Name(), card.Body[1].Facts[2].Value, "Sat, 02 Oct 2021 15:04:05 +0000")
+		assertMessageContent(t, t.Name(), card.Body[2].Text, "Backup **succeeded**")
+	})
+
+	t.Run("Send with error", func(t *testing.T) {
+		srv := createStubWebhookServer(t, nil, http.StatusBadRequest)
+		defer srv.Close()
+
+		service := &TeamsService{}
+		service.Init(map[string]string{teamsWebhookUrlFlag: srv.URL})
+
+		if err := service.Send(context.Background(), &Message{}); err == nil {
+			t.Errorf("We didn't get any error while we were supposed to get one")
+		}
+	})
+}
+
+func TestTeamsPartialDelivery(t *testing.T) {
+	delivered := createStubWebhookServer(t, nil, http.StatusAccepted)
+	defer delivered.Close()
+	failing := createStubWebhookServer(t, nil, http.StatusServiceUnavailable)
+	defer failing.Close()
+
+	service := &TeamsService{}
+	routes := "ops@example.com=" + delivered.URL + ",dev@example.com=" + failing.URL
+	service.Init(map[string]string{teamsWebhookUrlFlag: delivered.URL, teamsRoutesFlag: routes})
+
+	t.Run("Partially delivered message", func(t *testing.T) {
+		err := service.Send(context.Background(), &Message{To: []string{"ops@example.com", "dev@example.com"}})
+
+		if err == nil || IsTemporaryError(err) {
+			t.Errorf("Expected a permanent error, got %v", err)
+		}
+
+		assertErrorContent(t, fmt.Sprint(err), "message sent to 1 of 2 destinations: unexpected status 503: 1")
+	})
+
+	t.Run("Undelivered message", func(t *testing.T) {
+		err := service.Send(context.Background(), &Message{To: []string{"dev@example.com"}})
+
+		if !IsTemporaryError(err) {
+			t.Errorf("Expected a temporary error, got %v", err)
+		}
+	})
+}
+
+func assertInitError(t *testing.T, err error, wantErr string) {
+	t.Helper()
+	if len(wantErr) == 0 && err != nil {
+		t.Errorf("Could not start service: %v", err)
+	}
+
+	if len(wantErr) > 0 {
+		if err == nil {
+			t.Fatalf("Could start service even though we should not")
+		}
+		assertErrorContent(t, err.Error(), wantErr)
+	}
+}
+
+// createStubWebhookServer creates a server decoding the JSON payloads it receives and
+// answering with the given status code.
+func createStubWebhookServer(t *testing.T, payload interface{}, statusCode int) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if payload != nil {
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, payload)
+		}
+		w.WriteHeader(statusCode)
+		io.WriteString(w, "1")
+	}))
+}
@@ -1,43 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
-	"gopkg.in/tucnak/telebot.v2"
-	"log"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 const (
-	smtpHostFlag       = "smtp-host"
-	smtpPortFlag       = "smtp-port"
-	telegramApiUrlFlag = "telegram-api-url"
-	telegramTokenFlag  = "telegram-token"
-	telegramChatIdFlag = "telegram-chat-id"
-	smtpHostEnv        = "TEGAMI_SMTP_HOST"
-	smtpPortEnv        = "TEGAMI_SMTP_PORT"
-	telegramApiUrlEnv  = "TEGAMI_TELEGRAM_API_URL"
-	telegramTokenEnv   = "TEGAMI_TELEGRAM_TOKEN"
-	telegramChatIdEnv  = "TEGAMI_TELEGRAM_CHAT_ID"
+	smtpHostFlag        = "smtp-host"
+	smtpPortFlag        = "smtp-port"
+	smtpTlsCertFlag     = "smtp-tls-cert"
+	smtpTlsKeyFlag      = "smtp-tls-key"
+	shutdownTimeoutFlag = "shutdown-timeout"
+	smtpHostEnv         = "TEGAMI_SMTP_HOST"
+	smtpPortEnv         = "TEGAMI_SMTP_PORT"
+	smtpTlsCertEnv      = "TEGAMI_SMTP_TLS_CERT"
+	smtpTlsKeyEnv       = "TEGAMI_SMTP_TLS_KEY"
+	shutdownTimeoutEnv  = "TEGAMI_SHUTDOWN_TIMEOUT"
 )
 
-// TelegramRoom identifies Telegram chat rooms.
-type TelegramRoom struct {
-	id string
-}
-
-// TelegramService manages Telegram related components.
-type TelegramService struct {
-	bot  *telebot.Bot
-	room *TelegramRoom
-}
-
 // SmtpConfig stores the configuration for the SMTP server.
 type SmtpConfig struct {
 	host string
 	port string
+	// tlsConfig contains the certificate offered with STARTTLS, it is nil when STARTTLS isn't supported.
+	tlsConfig *tls.Config
+	// transcript logs the SMTP conversations, it is nil when they aren't logged.
+	transcript *TranscriptRecorder
+	// failedMessagesDir is the directory where the messages which couldn't be parsed are saved, if set.
+	failedMessagesDir string
 }
 
 // Service is an interface for handling third-party messaging services.
@@ -45,75 +44,71 @@ type Service interface {
 	// Init ensures the service is initialized based on the flags
 	// received by the application and returns an error in case of issues.
 	Init(flags map[string]string) error
-	// Send transfers the message to the service and returns
-	// an error if there was an issue during the transmission.
-	Send(msg string) error
+	// Send transfers the message to the service and returns an error if
+	// there was an issue during the transmission. The transmission is
+	// abandoned once the context is done. Issues which may be resolved
+	// by sending the message again later are returned as a TemporaryError.
+	Send(ctx context.Context, msg *Message) error
 	// IsMarkdownService validates whether the service is better
 	// suited to deal with markdown formatted messages.
 	IsMarkdownService() bool
+	// Close releases the resources used by the service, such as
+	// its connections, and returns an error in case of issues.
+	Close() error
 }
 
-func (r *TelegramRoom) Recipient() string {
-	return r.id
+// Renderer is implemented by the services formatting the messages they send, for example by
+// truncating them or converting them into a card. The payloads are shown by the dry runs of the
+// send command and by the web UI.
+type Renderer interface {
+	// Render returns the payload sent for a message without sending it, along with its format
+	// such as JSON or Markdown. The payload doesn't contain the credentials of the service.
+	Render(msg *Message) (format string, payload string, err error)
 }
 
-func (s *TelegramService) Init(flags map[string]string) error {
-	apiUrl := flags[telegramApiUrlFlag]
-	token := flags[telegramTokenFlag]
-	chatId := flags[telegramChatIdFlag]
-
-	if len(token) == 0 {
-		return errors.New("telegram token not set")
-	}
-
-	if len(chatId) == 0 {
-		return errors.New("telegram chat id not set")
-	}
-
-	bot, err := telebot.NewBot(telebot.Settings{
-		URL:       apiUrl,
-		Token:     token,
-		Poller:    &telebot.LongPoller{Timeout: 10 * time.Second},
-		ParseMode: telebot.ModeHTML,
-	})
+// TemporaryError is returned by a service when a message couldn't be sent because
+// of a temporary issue, meaning that sending it again later may succeed.
+type TemporaryError struct {
+	Err error
+}
 
-	if err != nil {
-		return err
-	}
+func (e *TemporaryError) Error() string {
+	return e.Err.Error()
+}
 
-	s.bot = bot
-	s.room = &TelegramRoom{id: chatId}
+func (e *TemporaryError) Unwrap() error {
+	return e.Err
+}
 
-	return nil
+// IsTemporaryError validates whether an error, or one of the errors it wraps, is temporary.
+func IsTemporaryError(err error) bool {
+	var temporaryError *TemporaryError
+	return errors.As(err, &temporaryError)
 }
 
-func (s *TelegramService) Send(msg string) error {
-	_, err := s.bot.Send(s.room, msg)
+func main() {
+	err := newApp().Run(sendmailArgs(os.Args))
+
 	if err != nil {
-		return err
+		fatal("Error while starting the app", "error", err)
 	}
-	return nil
-}
-
-func (s *TelegramService) IsMarkdownService() bool {
-	return false
 }
 
-func main() {
+// newApp creates the application, running the SMTP server by default.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Flags = GenerateCLIFlags()
-	app.Action = handleCli
-
-	err := app.Run(os.Args)
-
-	if err != nil {
-		log.Fatalf("Error while starting the app: %v", err)
+	app.Before = func(c *cli.Context) error {
+		return setupLogging(RetrieveFlags(c), c.App.ErrWriter)
 	}
+	app.Action = handleCli
+	app.Commands = []*cli.Command{sendCommand(), sendmailCommand(), checkConfigCommand(), telegramCommand()}
+	return app
 }
 
 // GenerateCLIFlags returns an array containing all the appropriate flags for the application.
 func GenerateCLIFlags() []cli.Flag {
-	return []cli.Flag{
+	flags := []cli.Flag{
 		&cli.StringFlag{
 			Name:    smtpHostFlag,
 			Value:   "127.0.0.1",
@@ -127,22 +122,38 @@ func GenerateCLIFlags() []cli.Flag {
 			EnvVars: []string{smtpPortEnv},
 		},
 		&cli.StringFlag{
-			Name:    telegramApiUrlFlag,
-			Value:   "https://api.telegram.org",
-			Usage:   "The API url used for communicating with Telegram (Optional)",
-			EnvVars: []string{telegramApiUrlEnv},
+			Name:    smtpTlsCertFlag,
+			Usage:   "The PEM certificate file offered with STARTTLS by the smtp server, along with smtp-tls-key (Optional)",
+			EnvVars: []string{smtpTlsCertEnv},
 		},
 		&cli.StringFlag{
-			Name:    telegramTokenFlag,
-			Usage:   "The token used for the Telegram bot",
-			EnvVars: []string{telegramTokenEnv},
+			Name:    smtpTlsKeyFlag,
+			Usage:   "The PEM private key file of the certificate offered with STARTTLS (Optional)",
+			EnvVars: []string{smtpTlsKeyEnv},
 		},
 		&cli.StringFlag{
-			Name:    telegramChatIdFlag,
-			Usage:   "The Telegram chat room id in which the email will be transferred to",
-			EnvVars: []string{telegramChatIdEnv},
+			Name:    shutdownTimeoutFlag,
+			Value:   "30",
+			Usage:   "The number of seconds given to the messages being received and sent to finish when stopping (Optional)",
+			EnvVars: []string{shutdownTimeoutEnv},
 		},
 	}
+
+	flags = append(flags, transcriptCLIFlags()...)
+	flags = append(flags, logCLIFlags()...)
+	flags = append(flags, queueCLIFlags()...)
+	flags = append(flags, httpCLIFlags()...)
+	flags = append(flags, healthCLIFlags()...)
+	flags = append(flags, adminCLIFlags()...)
+	flags = append(flags, webUiCLIFlags()...)
+	flags = append(flags, notifyCLIFlags()...)
+	flags = append(flags, sendmailCLIFlags()...)
+
+	for _, definition := range serviceDefinitions {
+		flags = append(flags, definition.CLIFlags()...)
+	}
+
+	return flags
 }
 
 // RetrieveFlags obtains all the values of the flags
@@ -157,53 +168,159 @@ func RetrieveFlags(c *cli.Context) map[string]string {
 	return flags
 }
 
-// initServices is responsible for initializing all messaging services. It returns the number of
-// successfully initialized services as well as a slice of initialized services
-func initServices(flags map[string]string) (int, []Service) {
-	services := []Service{&TelegramService{}}
-	successCount := 0
+// initServices is responsible for initializing the messaging services whose required flags are set.
+// It returns the number of successfully initialized services, a slice of initialized services
+// and the errors of the services which couldn't be initialized.
+func initServices(flags map[string]string) (int, []Service, []error) {
+	var initializedServices []Service
+	var initErrors []error
 
-	for _, service := range services {
-		err := service.Init(flags)
+	for _, definition := range serviceDefinitions {
+		service, err := definition.createService(flags)
 		if err != nil {
-			fmt.Printf("Error while initializing service: %v\n", err)
-		} else {
-			successCount++
+			slog.Error("Error while initializing service", "error", err)
+			initErrors = append(initErrors, err)
+		} else if service != nil {
+			initializedServices = append(initializedServices, service)
 		}
 	}
-	return successCount, services
+	return len(initializedServices), initializedServices, initErrors
 }
 
-// handleCli is the action function when Tegami is started.
+// closeServices releases the resources held by the services.
+func closeServices(services []Service) {
+	for _, service := range services {
+		if err := service.Close(); err != nil {
+			slog.Error("Error while closing service", "service", serviceName(service), "error", err)
+		}
+	}
+}
+
+// handleCli is the action function when Tegami is started. The server runs until an interrupt or
+// termination signal is received, after which it shuts down gracefully. The exit code is not zero
+// when messages may have been lost during the shutdown.
 func handleCli(c *cli.Context) error {
 	smtpHost := c.String(smtpHostFlag)
 	smtpPort := c.String(smtpPortFlag)
 	smtpAddr := fmt.Sprintf("%s:%s", smtpHost, smtpPort)
-	initServicesCount, services := initServices(RetrieveFlags(c))
+	flags := RetrieveFlags(c)
+	_, services, initErrors := initServices(flags)
+	notifyUrls := splitNotifyURLs(c.StringSlice(notifyFlag))
+	notifyServices, notifyErrors := initNotifyServices(notifyUrls, false)
+	services = append(services, notifyServices...)
+	initErrors = append(initErrors, notifyErrors...)
+
+	if len(services) == 0 {
+		fatal("Couldn't initialize any messaging service, exiting")
+	}
+
+	defer closeServices(services)
+
+	shutdownTimeout, err := parseOptionalInt(flags[shutdownTimeoutFlag], 30)
+	if err != nil || shutdownTimeout < 0 {
+		return errors.New("shutdown timeout is invalid")
+	}
+
+	queue, err := createDeliveryQueue(flags)
+	if err != nil {
+		return err
+	}
+
+	probeInterval, err := parseHealthProbeInterval(flags)
+	if err != nil {
+		return err
+	}
+
+	transcript, err := createTranscriptRecorder(flags)
+	if err != nil {
+		return err
+	}
 
-	if initServicesCount == 0 {
-		log.Fatalln("Couldn't initialize any messaging service, exiting.")
+	tlsConfig, err := loadSmtpTlsConfig(flags)
+	if err != nil {
+		return err
 	}
 
-	config := &SmtpConfig{smtpHost, smtpPort}
-	srv := CreateSmtpServer(config, services)
+	config := &SmtpConfig{
+		host:              smtpHost,
+		port:              smtpPort,
+		tlsConfig:         tlsConfig,
+		transcript:        transcript,
+		failedMessagesDir: flags[smtpFailedMessagesDirFlag],
+	}
+	srv := NewServer(config, services, queue)
+	health := NewHealthChecker(services, initErrors, srv.Accepting)
 
-	fmt.Printf("Starting SMTP Server at address %s\n", smtpAddr)
+	listener, err := net.Listen("tcp", smtpAddr)
+	if err != nil {
+		return err
+	}
 
-	if err := srv.ListenAndServe(); err != nil {
+	admin, err := createAdminApi(flags, notifyUrls, services, queue, health)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	ui, err := createWebUi(flags)
+	if err != nil {
+		listener.Close()
 		return err
 	}
 
+	stopHttpServer, err := startHttpServer(flags, health, admin, ui)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	defer stopHttpServer()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go health.Run(ctx, probeInterval)
+
+	slog.Info("Starting SMTP server", "address", smtpAddr)
+
+	if err = srv.Serve(ctx, listener, time.Duration(shutdownTimeout)*time.Second); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	slog.Info("SMTP server stopped")
 	return nil
 }
 
-// generateFlagNames retrieves the CLI flags names
+// loadSmtpTlsConfig loads the certificate offered with STARTTLS by the SMTP server, returning nil
+// when none is configured.
+func loadSmtpTlsConfig(flags map[string]string) (*tls.Config, error) {
+	certFile := flags[smtpTlsCertFlag]
+	keyFile := flags[smtpTlsKeyFlag]
+
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		return nil, nil
+	}
+
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("smtp tls cert and key must both be set")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("smtp tls certificate is invalid: %v", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}, nil
+}
+
+// generateFlagNames retrieves the names of the CLI flags holding a single value
 func generateFlagNames() []string {
-	flags := GenerateCLIFlags()
-	flagNames := make([]string, len(flags))
+	var flagNames []string
 
-	for i, flag := range flags {
-		flagNames[i] = flag.Names()[0]
+	for _, flag := range GenerateCLIFlags() {
+		if _, ok := flag.(*cli.StringFlag); ok {
+			flagNames = append(flagNames, flag.Names()[0])
+		}
 	}
 
 	return flagNames
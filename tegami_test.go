@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/tucnak/telebot.v2"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/smtp"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -27,7 +39,9 @@ const lineBreak = "\n"
 
 type RecorderService struct {
 	messageBody       string
+	message           *Message
 	isMarkdownService bool
+	sendErr           error
 }
 
 type mailContent struct {
@@ -45,15 +59,24 @@ func (s *RecorderService) Init(_ map[string]string) error {
 	return nil
 }
 
-func (s *RecorderService) Send(msg string) error {
-	s.messageBody = msg
-	return nil
+func (s *RecorderService) Send(_ context.Context, msg *Message) error {
+	if s.isMarkdownService {
+		s.messageBody = msg.Markdown
+	} else {
+		s.messageBody = msg.HTML
+	}
+	s.message = msg
+	return s.sendErr
 }
 
 func (s *RecorderService) IsMarkdownService() bool {
 	return s.isMarkdownService
 }
 
+func (s *RecorderService) Close() error {
+	return nil
+}
+
 func TestTelegramService(t *testing.T) {
 	t.Run("Init", func(t *testing.T) {
 		telegramService := &TelegramService{}
@@ -120,16 +143,25 @@ func TestTelegramService(t *testing.T) {
 			name               string
 			responseBody       string
 			expectedStatusCode int
+			wantTemporary      bool
 		}{
 			{
 				"Correct message",
 				`{"ok": true}`,
 				http.StatusOK,
+				false,
 			},
 			{
 				"Invalid information",
 				`{"ok": false, "error_code": 400, "description": "invalid information"}`,
 				http.StatusBadRequest,
+				false,
+			},
+			{
+				"Rate limited",
+				`{"ok": false, "error_code": 429, "description": "Too Many Requests: retry after 5", "parameters": {"retry_after": 5}}`,
+				http.StatusTooManyRequests,
+				true,
 			},
 		}
 
@@ -146,7 +178,7 @@ func TestTelegramService(t *testing.T) {
 				}))
 
 				service, server := createStubTelegramBotServer(t, mux)
-				err := service.Send(msg)
+				err := service.Send(context.Background(), &Message{HTML: msg})
 
 				json.Unmarshal([]byte(test.responseBody), &response)
 
@@ -159,9 +191,34 @@ func TestTelegramService(t *testing.T) {
 						"Expected error code %d; expected description: %s", response.ErrorCode, response.Description)
 				}
 
+				if IsTemporaryError(err) != test.wantTemporary {
+					t.Errorf("Unexpected temporary error: %v", err)
+				}
+
 				server.Close()
 			})
 		}
+
+		t.Run("Abandoned message", func(t *testing.T) {
+			release := make(chan struct{})
+			mux := http.NewServeMux()
+			mux.HandleFunc(fmt.Sprintf("/bot%s/sendMessage", telegramBotToken), func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				io.WriteString(w, `{"ok": true}`)
+			})
+
+			service, server := createStubTelegramBotServer(t, mux)
+			defer server.Close()
+			defer close(release)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := service.Send(ctx, &Message{HTML: "Backup done"})
+
+			if err == nil || IsTemporaryError(err) {
+				t.Errorf("Expected a permanent error, got %v", err)
+			}
+		})
 	})
 }
 
@@ -188,6 +245,55 @@ func TestAppStart(t *testing.T) {
 	})
 }
 
+func TestLoadSmtpTlsConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	var tests = []struct {
+		name    string
+		flags   map[string]string
+		wantErr string
+	}{
+		{"With certificate", map[string]string{smtpTlsCertFlag: certFile, smtpTlsKeyFlag: keyFile}, ""},
+		{"With missing key", map[string]string{smtpTlsCertFlag: certFile}, "smtp tls cert and key must both be set"},
+		{"With missing file", map[string]string{smtpTlsCertFlag: "/nonexistent/cert.pem", smtpTlsKeyFlag: keyFile},
+			"smtp tls certificate is invalid: open /nonexistent/cert.pem: no such file or directory"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadSmtpTlsConfig(test.flags)
+			assertInitError(t, err, test.wantErr)
+		})
+	}
+
+	t.Run("STARTTLS advertised", func(t *testing.T) {
+		tlsConfig, _ := loadSmtpTlsConfig(map[string]string{smtpTlsCertFlag: certFile, smtpTlsKeyFlag: keyFile})
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+		if err != nil {
+			t.Fatalf("Could not listen: %v", err)
+		}
+
+		srv := CreateSmtpServer(&SmtpConfig{tlsConfig: tlsConfig}, []Service{})
+		go srv.Serve(listener)
+		defer srv.Close()
+
+		c, err := smtp.Dial(listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+
+		defer c.Close()
+
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			t.Errorf("Expected STARTTLS advertised")
+		}
+	})
+
+	if config, err := loadSmtpTlsConfig(map[string]string{}); config != nil || err != nil {
+		t.Errorf("Expected STARTTLS disabled by default, got %v", err)
+	}
+}
+
 func assertMessageContent(t *testing.T, testName, got, want string) {
 	t.Helper()
 	if got != want {
@@ -251,3 +357,69 @@ func generateTestFlags() map[string]string {
 	flags[telegramChatIdFlag] = "1234"
 	return flags
 }
+
+// createTestCertificate generates a self-signed certificate valid for the local host.
+func createTestCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost", "example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeTestCertificate writes a self-signed certificate and its private key as PEM files, returning their paths.
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	certificate := createTestCertificate(t)
+	key, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+
+	if err != nil {
+		t.Fatalf("Could not encode key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0600); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+
+	return certFile, keyFile
+}
+
+// waitForCondition waits until the condition is met, failing the test after 5 seconds.
+func waitForCondition(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for: %s", description)
+}
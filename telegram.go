@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/tucnak/telebot.v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	telegramApiUrlFlag = "telegram-api-url"
+	telegramTokenFlag  = "telegram-token"
+	telegramChatIdFlag = "telegram-chat-id"
+	telegramApiUrlEnv  = "TEGAMI_TELEGRAM_API_URL"
+	telegramTokenEnv   = "TEGAMI_TELEGRAM_TOKEN"
+	telegramChatIdEnv  = "TEGAMI_TELEGRAM_CHAT_ID"
+)
+
+// TelegramRoom identifies Telegram chat rooms.
+type TelegramRoom struct {
+	id string
+}
+
+// TelegramService manages Telegram related components.
+type TelegramService struct {
+	bot  *telebot.Bot
+	room *TelegramRoom
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Telegram",
+		Prefix:   "telegram",
+		Flags:    telegramCLIFlags,
+		Required: [][]string{{telegramTokenFlag}, {telegramChatIdFlag}},
+		Secrets:  []string{telegramTokenFlag},
+		New:      func() Service { return &TelegramService{} },
+		Schemes:  []string{"tgram"},
+		ParseURL: parseTelegramNotifyURL,
+	})
+}
+
+func (r *TelegramRoom) Recipient() string {
+	return r.id
+}
+
+func (s *TelegramService) Init(flags map[string]string) error {
+	apiUrl := flags[telegramApiUrlFlag]
+	token := flags[telegramTokenFlag]
+	chatId := flags[telegramChatIdFlag]
+
+	if len(token) == 0 {
+		return errors.New("telegram token not set")
+	}
+
+	if len(chatId) == 0 {
+		return errors.New("telegram chat id not set")
+	}
+
+	bot, err := newTelegramBot(apiUrl, token, isOfflineInit(flags))
+	if err != nil {
+		return err
+	}
+
+	s.bot = bot
+	s.room = &TelegramRoom{id: chatId}
+
+	return nil
+}
+
+// newTelegramBot creates the bot, verifying its token with the API unless it is offline.
+func newTelegramBot(apiUrl, token string, offline bool) (*telebot.Bot, error) {
+	return telebot.NewBot(telebot.Settings{
+		URL:       apiUrl,
+		Token:     token,
+		Poller:    &telebot.LongPoller{Timeout: 10 * time.Second},
+		ParseMode: telebot.ModeHTML,
+		Client:    &http.Client{Timeout: serviceHttpTimeout},
+		Offline:   offline,
+	})
+}
+
+// Probe verifies that the token of the bot is still valid and that the bot can access the chat
+// room, which fails when the chat id is wrong or the bot isn't a member of the chat.
+func (s *TelegramService) Probe(ctx context.Context) error {
+	return runWithContext(ctx, func() error {
+		if _, err := s.bot.Raw("getMe", nil); err != nil {
+			return telegramError(err)
+		}
+
+		if _, err := s.bot.Raw("getChat", map[string]string{"chat_id": s.room.id}); err != nil {
+			return fmt.Errorf("chat %s: %w", s.room.id, telegramError(err))
+		}
+
+		return nil
+	})
+}
+
+// Send sends the message to the chat room. The requests made by the Telegram library can't be
+// cancelled, so the message may still be sent after the context is done. The error is permanent
+// in this case since sending the message again could deliver it twice.
+func (s *TelegramService) Send(ctx context.Context, msg *Message) error {
+	err := runWithContext(ctx, func() error {
+		_, err := s.bot.Send(s.room, msg.HTML)
+		return telegramError(err)
+	})
+
+	if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		return fmt.Errorf("telegram message abandoned while being sent: %v", ctxErr)
+	}
+
+	return err
+}
+
+func (s *TelegramService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *TelegramService) Close() error {
+	return nil
+}
+
+// telegramError marks the errors returned by the Telegram library as temporary when the API couldn't
+// be reached, is rate limiting the bot or has an internal issue.
+func telegramError(err error) error {
+	var floodError telebot.FloodError
+	var apiError *telebot.APIError
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &floodError):
+		telegramRateLimits.Inc()
+		return &TemporaryError{Err: err}
+	case errors.As(err, &apiError):
+		return statusError(apiError.Code, err)
+	case strings.HasPrefix(err.Error(), "telebot: "):
+		// Errors of the HTTP client are wrapped with this prefix.
+		return &TemporaryError{Err: err}
+	default:
+		return err
+	}
+}
+
+// parseTelegramNotifyURL converts URLs in the form tgram://token/chat-id into flags.
+func parseTelegramNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 || len(u.segments) != 1 {
+		return nil, errors.New("telegram url is invalid, expected tgram://token/chat-id")
+	}
+
+	// Messages are always sent as HTML, the parameter is only accepted for compatibility with other tools.
+	if mode := u.query.Get("parse"); len(mode) > 0 && !strings.EqualFold(mode, "html") {
+		return nil, fmt.Errorf("telegram parse mode is not supported: %s", mode)
+	}
+
+	u.query.Del("parse")
+	return map[string]string{telegramTokenFlag: u.host, telegramChatIdFlag: u.segments[0]}, nil
+}
+
+// telegramCLIFlags returns the flags used for configuring Telegram.
+func telegramCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    telegramApiUrlFlag,
+			Value:   "https://api.telegram.org",
+			Usage:   "The API url used for communicating with Telegram (Optional)",
+			EnvVars: []string{telegramApiUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    telegramTokenFlag,
+			Usage:   "The token used for the Telegram bot",
+			EnvVars: []string{telegramTokenEnv},
+		},
+		&cli.StringFlag{
+			Name:    telegramChatIdFlag,
+			Usage:   "The Telegram chat room id in which the email will be transferred to",
+			EnvVars: []string{telegramChatIdEnv},
+		},
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MessageTemplateData contains the values of a message available to the templates configured by the user.
+type MessageTemplateData struct {
+	// Subject is the subject of the email.
+	Subject string
+	// From is the sender of the email.
+	From string
+	// To contains the envelope recipients of the email.
+	To []string
+	// Recipient is the envelope recipient the template is rendered for.
+	Recipient string
+	// Date is the date of the email in the YYYY-MM-DD format.
+	Date string
+	// Time is the complete date of the email.
+	Time time.Time
+}
+
+// ParseMessageTemplate parses a template rendered using the values of a message.
+func ParseMessageTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// ExecuteMessageTemplate renders a template for a message and one of its recipients.
+func ExecuteMessageTemplate(tmpl *template.Template, msg *Message, recipient string) (string, error) {
+	var builder strings.Builder
+
+	data := &MessageTemplateData{
+		Subject:   msg.Subject,
+		From:      msg.From,
+		To:        msg.To,
+		Recipient: recipient,
+		Date:      msg.Date.Format("2006-01-02"),
+		Time:      msg.Date,
+	}
+
+	if err := tmpl.Execute(&builder, data); err != nil {
+		return "", err
+	}
+
+	return builder.String(), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageTemplate(t *testing.T) {
+	msg := &Message{
+		From:    "nas@example.com",
+		To:      []string{"alerts@example.com", "backup@example.com"},
+		Subject: "Backup done",
+		Date:    time.Date(2021, 10, 2, 15, 4, 5, 0, time.UTC),
+	}
+
+	var tests = []struct {
+		name     string
+		template string
+		want     string
+		isValid  bool
+	}{
+		{"Subject", "{{.Subject}}", "Backup done", true},
+		{"Recipient", "tegami/{{.Recipient}}", "tegami/backup@example.com", true},
+		{"Date", "{{.Date}}/{{.From}}", "2021-10-02/nas@example.com", true},
+		{"Time", "{{.Time.Format \"15:04\"}}", "15:04", true},
+		{"Unknown field", "{{.Foo}}", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := ParseMessageTemplate(test.name, test.template)
+
+			if err != nil {
+				t.Fatalf("Could not parse template: %v", err)
+			}
+
+			got, err := ExecuteMessageTemplate(tmpl, msg, "backup@example.com")
+
+			if test.isValid && err != nil {
+				t.Errorf("Error while we weren't supposed to get any: %v", err)
+			}
+
+			if !test.isValid && err == nil {
+				t.Errorf("We didn't get any error while we were supposed to get one")
+			}
+
+			assertMessageContent(t, test.name, got, test.want)
+		})
+	}
+}
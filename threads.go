@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+)
+
+// threadTrackerCapacity is the number of emails remembered by a ThreadTracker.
+const threadTrackerCapacity = 1000
+
+// ThreadTracker remembers the threads in which emails were posted so their
+// replies can be posted in the same threads. Only the most recent emails are remembered.
+type ThreadTracker struct {
+	mutex    sync.Mutex
+	capacity int
+	threads  map[string]string
+	keys     []string
+}
+
+// NewThreadTracker creates a ThreadTracker remembering a maximum number of emails.
+func NewThreadTracker(capacity int) *ThreadTracker {
+	return &ThreadTracker{
+		capacity: capacity,
+		threads:  make(map[string]string),
+	}
+}
+
+// Thread returns the thread of the email the message replies to in a destination. It returns
+// an empty string if the message is not a reply or if the original email is unknown.
+func (t *ThreadTracker) Thread(destination string, msg *Message) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, id := range replyIds(msg) {
+		if thread, ok := t.threads[threadKey(destination, id)]; ok {
+			return thread
+		}
+	}
+
+	return ""
+}
+
+// Track remembers the thread in which a message was posted in a destination.
+func (t *ThreadTracker) Track(destination string, msg *Message, thread string) {
+	id, err := msg.Header.MessageID()
+
+	if err != nil || len(id) == 0 || len(thread) == 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := threadKey(destination, id)
+
+	if _, ok := t.threads[key]; !ok {
+		t.keys = append(t.keys, key)
+	}
+
+	t.threads[key] = thread
+
+	if len(t.keys) > t.capacity {
+		delete(t.threads, t.keys[0])
+		t.keys = t.keys[1:]
+	}
+}
+
+// replyIds returns the ids of the emails a message replies to, starting from the most relevant one.
+func replyIds(msg *Message) []string {
+	ids, _ := msg.Header.MsgIDList("In-Reply-To")
+	references, _ := msg.Header.MsgIDList("References")
+
+	for i := len(references) - 1; i >= 0; i-- {
+		ids = append(ids, references[i])
+	}
+
+	return ids
+}
+
+func threadKey(destination, id string) string {
+	return destination + "\x00" + id
+}
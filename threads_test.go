@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/emersion/go-message/mail"
+	"testing"
+)
+
+func TestThreadTracker(t *testing.T) {
+	tracker := NewThreadTracker(2)
+	original := createThreadTestMessage("<1@example.com>", "", "")
+	reply := createThreadTestMessage("<2@example.com>", "<1@example.com>", "<1@example.com>")
+	laterReply := createThreadTestMessage("<3@example.com>", "<unknown@example.com>", "<1@example.com> <unknown@example.com>")
+
+	t.Run("Unknown email", func(t *testing.T) {
+		assertMessageContent(t, t.Name(), tracker.Thread("general", reply), "")
+	})
+
+	tracker.Track("general", original, "root")
+
+	t.Run("Reply to a known email", func(t *testing.T) {
+		assertMessageContent(t, t.Name(), tracker.Thread("general", reply), "root")
+	})
+
+	t.Run("Reply in another destination", func(t *testing.T) {
+		assertMessageContent(t, t.Name(), tracker.Thread("random", reply), "")
+	})
+
+	t.Run("Reply found through references", func(t *testing.T) {
+		assertMessageContent(t, t.Name(), tracker.Thread("general", laterReply), "root")
+	})
+
+	t.Run("Oldest email forgotten", func(t *testing.T) {
+		tracker.Track("general", reply, "root")
+		tracker.Track("general", laterReply, "root")
+		assertMessageContent(t, t.Name(), tracker.Thread("general", reply), "")
+	})
+}
+
+func createThreadTestMessage(id, inReplyTo, references string) *Message {
+	var header mail.Header
+	header.Set("Message-Id", id)
+
+	if len(inReplyTo) > 0 {
+		header.Set("In-Reply-To", inReplyTo)
+	}
+
+	if len(references) > 0 {
+		header.Set("References", references)
+	}
+
+	return &Message{Header: header, Subject: "Backup done", Markdown: "Backup **succeeded**"}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	smtpTranscriptFlag        = "smtp-transcript"
+	smtpTranscriptClientsFlag = "smtp-transcript-clients"
+	smtpFailedMessagesDirFlag = "smtp-failed-messages-dir"
+	smtpTranscriptEnv         = "TEGAMI_SMTP_TRANSCRIPT"
+	smtpTranscriptClientsEnv  = "TEGAMI_SMTP_TRANSCRIPT_CLIENTS"
+	smtpFailedMessagesDirEnv  = "TEGAMI_SMTP_FAILED_MESSAGES_DIR"
+)
+
+// transcriptMaxLineLength is the maximum number of characters of a line written in the transcripts.
+const transcriptMaxLineLength = 1000
+
+// TranscriptRecorder logs the SMTP conversations of the connections, identified by the ID of
+// their session. The payloads of the AUTH commands are masked while the content of the emails is
+// logged as a body, redacted unless sensitive values are logged.
+type TranscriptRecorder struct {
+	// clients contains the networks of the clients whose conversations are logged, all clients
+	// being logged when it is empty.
+	clients []*net.IPNet
+	// sessionIds contains the IDs of the sessions of the recorded connections by remote address.
+	sessionIds sync.Map
+}
+
+// NewTranscriptRecorder creates a recorder of the conversations of the clients within the networks,
+// or of all the clients if there are none.
+func NewTranscriptRecorder(clients []*net.IPNet) *TranscriptRecorder {
+	return &TranscriptRecorder{clients: clients}
+}
+
+// createTranscriptRecorder creates the recorder configured by the flags, or returns nil when the transcripts are disabled.
+func createTranscriptRecorder(flags map[string]string) (*TranscriptRecorder, error) {
+	enabled, err := parseOptionalBool(flags[smtpTranscriptFlag], false)
+	if err != nil {
+		return nil, errors.New("smtp transcript is invalid")
+	}
+
+	clients, err := parseNetworks(flags[smtpTranscriptClientsFlag])
+	if err != nil {
+		return nil, fmt.Errorf("smtp transcript clients are invalid: %v", err)
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	return NewTranscriptRecorder(clients), nil
+}
+
+// parseNetworks parses a comma separated list of IP addresses and CIDR networks.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, item := range splitList(value) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", item)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Listener returns a listener recording the conversations of the connections it accepts.
+func (r *TranscriptRecorder) Listener(listener net.Listener) net.Listener {
+	return &transcriptListener{Listener: listener, recorder: r}
+}
+
+// SessionId returns the ID of the session of a recorded connection from its remote address.
+func (r *TranscriptRecorder) SessionId(remoteAddr net.Addr) (string, bool) {
+	if remoteAddr == nil {
+		return "", false
+	}
+
+	id, ok := r.sessionIds.Load(remoteAddr.String())
+	if !ok {
+		return "", false
+	}
+
+	return id.(string), true
+}
+
+// records validates whether the conversation of a client is logged.
+func (r *TranscriptRecorder) records(remoteAddr net.Addr) bool {
+	if len(r.clients) == 0 {
+		return true
+	}
+
+	addr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range r.clients {
+		if network.Contains(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transcriptListener is a listener recording the conversations of its connections.
+type transcriptListener struct {
+	net.Listener
+	recorder *TranscriptRecorder
+}
+
+func (l *transcriptListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !l.recorder.records(conn.RemoteAddr()) {
+		return conn, err
+	}
+
+	id := newCorrelationId()
+	l.recorder.sessionIds.Store(conn.RemoteAddr().String(), id)
+	slog.Info("SMTP transcript started", "session", id, "remote_addr", conn.RemoteAddr().String())
+
+	return &transcriptConn{Conn: conn, recorder: l.recorder, logger: slog.With("session", id)}, nil
+}
+
+// transcriptConn is a connection logging each line read from the client and written by the server.
+type transcriptConn struct {
+	net.Conn
+	recorder  *TranscriptRecorder
+	logger    *slog.Logger
+	mutex     sync.Mutex
+	client    strings.Builder
+	server    strings.Builder
+	closeOnce sync.Once
+	// authenticating is set from an AUTH command until the server stops sending challenges.
+	authenticating bool
+	// inData is set while the client sends the content of an email, after DATA or BDAT.
+	inData bool
+}
+
+func (c *transcriptConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(&c.client, b[:n], c.logClientLine)
+	return n, err
+}
+
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.record(&c.server, b[:n], c.logServerLine)
+	return n, err
+}
+
+func (c *transcriptConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		if c.client.Len() > 0 {
+			c.flush(&c.client, c.logClientLine)
+		}
+		if c.server.Len() > 0 {
+			c.flush(&c.server, c.logServerLine)
+		}
+		c.mutex.Unlock()
+
+		c.recorder.sessionIds.Delete(c.RemoteAddr().String())
+		c.logger.Info("SMTP transcript ended")
+	})
+	return c.Conn.Close()
+}
+
+// record appends data to the pending line of one side of the conversation, logging the complete lines.
+func (c *transcriptConn) record(pending *strings.Builder, data []byte, log func(line string)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+
+		if end < 0 {
+			pending.Write(data)
+			return
+		}
+
+		pending.Write(data[:end])
+		data = data[end+1:]
+		c.flush(pending, log)
+	}
+}
+
+// flush logs the pending line of one side of the conversation, the mutex must be held.
+func (c *transcriptConn) flush(pending *strings.Builder, log func(line string)) {
+	line := strings.TrimSuffix(pending.String(), "\r")
+	pending.Reset()
+	log(truncateString(line, transcriptMaxLineLength))
+}
+
+// logClientLine logs a line sent by the client, masking the authentication payloads.
+func (c *transcriptConn) logClientLine(line string) {
+	if c.inData {
+		if line == "." {
+			c.inData = false
+		} else {
+			c.logger.Info("SMTP transcript", "direction", "client", "body", line)
+			return
+		}
+	}
+
+	fields := strings.Fields(line)
+
+	if c.authenticating {
+		line = redactedValue
+	} else if len(fields) > 0 && strings.EqualFold(fields[0], "AUTH") {
+		c.authenticating = true
+
+		if len(fields) > 2 {
+			line = strings.Join(fields[:2], " ") + " " + redactedValue
+		}
+	} else if len(fields) > 0 && strings.EqualFold(fields[0], "BDAT") {
+		c.inData = true
+	}
+
+	c.logger.Info("SMTP transcript", "direction", "client", "line", line)
+}
+
+// logServerLine logs a line sent by the server. The authentication ends once the server stops sending
+// challenges while the content of the email is sent from the server accepting it until its next reply.
+func (c *transcriptConn) logServerLine(line string) {
+	if !strings.HasPrefix(line, "334") {
+		c.authenticating = false
+	}
+
+	c.inData = strings.HasPrefix(line, "354")
+
+	c.logger.Info("SMTP transcript", "direction", "server", "line", line)
+}
+
+// saveFailedMessage writes the raw data of a message which couldn't be parsed in a directory, so it
+// can be attached to bug reports. It returns the path of the file.
+func saveFailedMessage(dir, sessionId string, data []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), sessionId)
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// transcriptCLIFlags returns the flags used for debugging the SMTP conversations.
+func transcriptCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    smtpTranscriptFlag,
+			Value:   "false",
+			Usage:   "Logs the SMTP conversations of the clients with their authentication payloads masked, for debugging (Optional)",
+			EnvVars: []string{smtpTranscriptEnv},
+		},
+		&cli.StringFlag{
+			Name:    smtpTranscriptClientsFlag,
+			Usage:   "Comma separated IP addresses or CIDR networks of the clients whose SMTP conversations are logged, all of them if not set (Optional)",
+			EnvVars: []string{smtpTranscriptClientsEnv},
+		},
+		&cli.StringFlag{
+			Name:    smtpFailedMessagesDirFlag,
+			Usage:   "Directory where the raw data of the emails which couldn't be parsed are saved, for bug reports (Optional)",
+			EnvVars: []string{smtpFailedMessagesDirEnv},
+		},
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateTranscriptRecorder(t *testing.T) {
+	var tests = []struct {
+		name    string
+		flags   map[string]string
+		enabled bool
+		wantErr bool
+	}{
+		{"Disabled", map[string]string{}, false, false},
+		{"Enabled", map[string]string{smtpTranscriptFlag: "true"}, true, false},
+		{"With clients", map[string]string{smtpTranscriptFlag: "true", smtpTranscriptClientsFlag: "192.168.1.10, 10.0.0.0/8,::1"}, true, false},
+		{"With invalid flag", map[string]string{smtpTranscriptFlag: "sometimes"}, false, true},
+		{"With invalid client", map[string]string{smtpTranscriptFlag: "true", smtpTranscriptClientsFlag: "nas.local"}, false, true},
+		{"With invalid network", map[string]string{smtpTranscriptFlag: "true", smtpTranscriptClientsFlag: "10.0.0.0/33"}, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder, err := createTranscriptRecorder(test.flags)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if (recorder != nil) != test.enabled {
+				t.Errorf("Expected the transcripts enabled to be %t", test.enabled)
+			}
+		})
+	}
+}
+
+func TestTranscriptRecorderClients(t *testing.T) {
+	clients, err := parseNetworks("192.168.1.10,10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("Could not parse the networks: %v", err)
+	}
+
+	recorder := NewTranscriptRecorder(clients)
+	var tests = []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"10.20.30.40", true},
+		{"::1", false},
+	}
+
+	for _, test := range tests {
+		if got := recorder.records(&net.TCPAddr{IP: net.ParseIP(test.ip), Port: 2525}); got != test.want {
+			t.Errorf("Expected the conversation of %s recorded to be %t, got %t", test.ip, test.want, got)
+		}
+	}
+
+	if !NewTranscriptRecorder(nil).records(&net.TCPAddr{IP: net.ParseIP("172.16.0.1")}) {
+		t.Errorf("Expected all the clients recorded without networks")
+	}
+}
+
+func TestSmtpTranscript(t *testing.T) {
+	output := setupTestLogging(t, map[string]string{logFormatFlag: "json"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	config := &SmtpConfig{transcript: NewTranscriptRecorder(nil)}
+	server := NewServer(config, []Service{&RecorderService{}}, nil)
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.Serve(ctx, listener, 5*time.Second)
+	}()
+
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+
+	payload := base64.StdEncoding.EncodeToString([]byte("other\x00nas\x00hunter22"))
+	// The identity is refused, which makes the server answer without a session.
+	commands := []struct {
+		line string
+		code int
+	}{
+		{"EHLO nas.local", 250},
+		{"AUTH PLAIN " + payload, 454},
+		{"MAIL FROM:<nas@example.com>", 250},
+		{"RCPT TO:<admin@example.com>", 250},
+		{"DATA", 354},
+		{strings.TrimSuffix(createTextMail(t, "Disk failure"), "\r\n") + "\r\n.", 250},
+		{"QUIT", 221},
+	}
+
+	if _, _, err = conn.ReadResponse(220); err != nil {
+		t.Fatalf("Unexpected greeting: %v", err)
+	}
+
+	for _, command := range commands {
+		if err = conn.PrintfLine("%s", command.line); err != nil {
+			t.Fatalf("Could not send %q: %v", command.line, err)
+		}
+
+		if _, _, err = conn.ReadResponse(command.code); err != nil {
+			t.Fatalf("Unexpected reply to %q: %v", command.line, err)
+		}
+	}
+
+	conn.Close()
+	cancel()
+
+	if err = <-serveErr; err != nil {
+		t.Fatalf("Unexpected shutdown error: %v", err)
+	}
+
+	logs := output.String()
+
+	if strings.Contains(logs, payload) || strings.Contains(logs, "hunter22") {
+		t.Errorf("Expected the authentication payload masked, got %s", logs)
+	}
+
+	var sessionId string
+	lines := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid log line %q: %v", scanner.Text(), err)
+		}
+
+		if record["msg"] == "Message received" {
+			sessionId, _ = record["session"].(string)
+		}
+
+		if record["msg"] == "SMTP transcript" {
+			if record["body"] != nil && record["body"] != redactedValue {
+				t.Errorf("Expected the body of the message redacted, got %v", record["body"])
+			}
+
+			if line, ok := record["line"].(string); ok {
+				lines[record["direction"].(string)+" "+line] = true
+			}
+		}
+	}
+
+	wantLines := []string{
+		"client AUTH PLAIN " + redactedValue,
+		"server 454 4.7.0 Identities not supported",
+		"client MAIL FROM:<nas@example.com>",
+		"server 354 2.0.0 Go ahead. End your data with <CR><LF>.<CR><LF>",
+		"client .",
+		"client QUIT",
+	}
+
+	for _, line := range wantLines {
+		if !lines[line] {
+			t.Errorf("Expected the transcript to contain %q, got %v", line, lines)
+		}
+	}
+
+	if len(sessionId) == 0 || strings.Count(logs, `"session":"`+sessionId+`"`) < len(lines) {
+		t.Errorf("Expected the transcript logged with the session %q, got %s", sessionId, logs)
+	}
+}
+
+func TestSaveFailedMessage(t *testing.T) {
+	setupTestLogging(t, map[string]string{})
+	dir := filepath.Join(t.TempDir(), "failed")
+	session := TegamiSession{services: []Service{&RecorderService{}}, id: "0123456789abcdef", failedMessagesDir: dir, ctx: context.Background()}
+	data := "Not a header\r\n\r\nDisk 2 failed"
+
+	if err := session.Data(strings.NewReader(data)); err == nil {
+		t.Fatalf("Expected the message to be rejected")
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected the message saved, got %v, %v", files, err)
+	}
+
+	if !strings.HasSuffix(files[0].Name(), "-0123456789abcdef.eml") {
+		t.Errorf("Expected the file named after the session, got %s", files[0].Name())
+	}
+
+	if saved, _ := os.ReadFile(filepath.Join(dir, files[0].Name())); string(saved) != data {
+		t.Errorf("Expected the raw data saved, got %q", saved)
+	}
+}
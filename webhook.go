@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	webhookUrlFlag     = "webhook-url"
+	webhookHeadersFlag = "webhook-headers"
+	webhookUrlEnv      = "TEGAMI_WEBHOOK_URL"
+	webhookHeadersEnv  = "TEGAMI_WEBHOOK_HEADERS"
+)
+
+// WebhookService posts each message as a JSON document to any HTTP endpoint, the document being
+// the one written by the debug service.
+type WebhookService struct {
+	client     *http.Client
+	webhookUrl string
+	headers    map[string]string
+}
+
+func init() {
+	RegisterService(&ServiceDefinition{
+		Name:     "Webhook",
+		Prefix:   "webhook",
+		Flags:    webhookCLIFlags,
+		Required: [][]string{{webhookUrlFlag}},
+		Secrets:  []string{webhookUrlFlag, webhookHeadersFlag},
+		New:      func() Service { return &WebhookService{} },
+		Schemes:  []string{"json", "jsons", "json+http", "json+https"},
+		ParseURL: parseWebhookNotifyURL,
+	})
+}
+
+func (s *WebhookService) Init(flags map[string]string) error {
+	webhookUrl := flags[webhookUrlFlag]
+
+	if len(webhookUrl) == 0 {
+		return errors.New("webhook url not set")
+	}
+
+	if u, err := url.ParseRequestURI(webhookUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("webhook url is invalid")
+	}
+
+	headers, err := parseWebhookHeaders(flags[webhookHeadersFlag])
+	if err != nil {
+		return err
+	}
+
+	s.client = &http.Client{Timeout: serviceHttpTimeout}
+	s.webhookUrl = webhookUrl
+	s.headers = headers
+	return nil
+}
+
+func (s *WebhookService) Send(ctx context.Context, msg *Message) error {
+	return postJSON(ctx, s.client, s.webhookUrl, s.headers, createDebugDocument(msg), nil)
+}
+
+func (s *WebhookService) Render(msg *Message) (string, string, error) {
+	return renderJSON(createDebugDocument(msg))
+}
+
+func (s *WebhookService) IsMarkdownService() bool {
+	return false
+}
+
+func (s *WebhookService) Close() error {
+	return nil
+}
+
+// parseWebhookHeaders parses the headers written as a comma separated list of "name=value" pairs.
+func parseWebhookHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+
+	for _, header := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(header)) == 0 {
+			continue
+		}
+
+		name, headerValue, found := strings.Cut(header, "=")
+		name = strings.TrimSpace(name)
+
+		if !found || len(name) == 0 {
+			return nil, fmt.Errorf("webhook header is invalid: %s", strings.TrimSpace(header))
+		}
+
+		headers[name] = strings.TrimSpace(headerValue)
+	}
+
+	return headers, nil
+}
+
+// parseWebhookNotifyURL converts URLs in the form json[s]://host/path or json+http[s]://host/path,
+// the webhook url with another scheme, into flags. The query parameters which aren't options of
+// the service are kept in the webhook url.
+func parseWebhookNotifyURL(u *notifyURL) (map[string]string, error) {
+	if len(u.host) == 0 {
+		return nil, errors.New("webhook url is invalid, expected json+https://host/path")
+	}
+
+	scheme := "http"
+	if u.scheme == "jsons" || u.scheme == "json+https" {
+		scheme = "https"
+	}
+
+	credentials := ""
+	if len(u.username) > 0 || len(u.password) > 0 {
+		credentials = url.UserPassword(u.username, u.password).String() + "@"
+	}
+
+	webhookQuery := url.Values{}
+	options := map[string]bool{"headers": true, "send-timeout": true}
+
+	for key, values := range u.query {
+		if !options[key] {
+			webhookQuery[key] = values
+			u.query.Del(key)
+		}
+	}
+
+	webhookUrl := scheme + "://" + credentials + u.host + u.path
+	if len(webhookQuery) > 0 {
+		webhookUrl += "?" + webhookQuery.Encode()
+	}
+
+	return map[string]string{webhookUrlFlag: webhookUrl}, nil
+}
+
+// webhookCLIFlags returns the flags used for configuring the webhook service.
+func webhookCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    webhookUrlFlag,
+			Usage:   "The url receiving each email as a JSON document in a POST request",
+			EnvVars: []string{webhookUrlEnv},
+		},
+		&cli.StringFlag{
+			Name:    webhookHeadersFlag,
+			Usage:   "Headers added to the requests in the form 'name=value', separated by commas, such as 'Authorization=Bearer token' (Optional)",
+			EnvVars: []string{webhookHeadersEnv},
+		},
+	}
+}
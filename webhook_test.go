@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookService(t *testing.T) {
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flags   map[string]string
+			wantErr string
+		}{
+			{"With valid arguments", map[string]string{webhookUrlFlag: "https://example.com/hook", webhookHeadersFlag: "X-Key=abc"}, ""},
+			{"With missing url", map[string]string{}, "webhook url not set"},
+			{"With invalid url", map[string]string{webhookUrlFlag: "ftp://example.com/hook"}, "webhook url is invalid"},
+			{"With invalid header", map[string]string{webhookUrlFlag: "https://example.com/hook", webhookHeadersFlag: "X-Key"}, "webhook header is invalid: X-Key"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := (&WebhookService{}).Init(test.flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		var document debugDocument
+		var authorization, query string
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &document)
+			authorization = r.Header.Get("Authorization")
+			query = r.URL.RawQuery
+		}))
+		defer srv.Close()
+
+		service := &WebhookService{}
+		flags := map[string]string{webhookUrlFlag: srv.URL + "/hook?token=abc", webhookHeadersFlag: "Authorization=Bearer xyz"}
+
+		if err := service.Init(flags); err != nil {
+			t.Fatalf("Could not start webhook service: %v", err)
+		}
+
+		msg := &Message{From: "nas@example.com", To: []string{"alerts@example.com"}, Subject: "Backup done", HTML: "Backup <b>succeeded</b>"}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		assertMessageContent(t, t.Name(), document.Subject, "Backup done")
+		assertMessageContent(t, t.Name(), document.From, "nas@example.com")
+		assertMessageContent(t, t.Name(), document.HTML, "Backup <b>succeeded</b>")
+		assertMessageContent(t, t.Name(), authorization, "Bearer xyz")
+		assertMessageContent(t, t.Name(), query, "token=abc")
+	})
+
+	t.Run("Send with error", func(t *testing.T) {
+		srv := createStubWebhookServer(t, nil, http.StatusServiceUnavailable)
+		defer srv.Close()
+
+		service := &WebhookService{}
+		service.Init(map[string]string{webhookUrlFlag: srv.URL})
+
+		if err := service.Send(context.Background(), &Message{}); !IsTemporaryError(err) {
+			t.Errorf("Expected a temporary error, got %v", err)
+		}
+	})
+}
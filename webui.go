@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	webUiFlag        = "web-ui"
+	webUiHistoryFlag = "web-ui-history"
+	webUiEnv         = "TEGAMI_WEB_UI"
+	webUiHistoryEnv  = "TEGAMI_WEB_UI_HISTORY"
+)
+
+// webFiles contains the templates and the static assets of the web UI.
+//
+//go:embed web
+var webFiles embed.FS
+
+// webTemplates are the pages of the web UI.
+var webTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"formatTime": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+	"preview":    func(body string, markdown bool) webPreview { return webPreview{Body: body, Markdown: markdown} },
+}).ParseFS(webFiles, "web/templates/*.html"))
+
+// webPreview is a body of a message, either the HTML or the Markdown one.
+type webPreview struct {
+	Body     string
+	Markdown bool
+}
+
+// webContentSecurityPolicy prevents the emails shown in the previews from running scripts or loading remote content.
+const webContentSecurityPolicy = "default-src 'none'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; frame-src 'self'"
+
+// messageHistory keeps the recent messages shown by the web UI. It doesn't keep any message until
+// its capacity is set.
+var messageHistory = &MessageHistory{}
+
+// MessageHistory keeps the most recent messages along with the result of their deliveries.
+type MessageHistory struct {
+	mutex    sync.RWMutex
+	capacity int
+	// messages contains the messages from the oldest to the most recent one.
+	messages []*HistoryMessage
+}
+
+// HistoryMessage is a message kept by the history.
+type HistoryMessage struct {
+	ID          string
+	SessionID   string
+	Subject     string
+	Sender      string
+	Recipients  string
+	Received    time.Time
+	HTML        string
+	Markdown    string
+	Attachments int
+	Deliveries  []*HistoryDelivery
+}
+
+// HistoryDelivery is the result of the last attempt of sending a message with a service.
+type HistoryDelivery struct {
+	Service string
+	// Format is the format of the payload sent by the service, such as JSON or Markdown.
+	Format string
+	// Payload is the payload rendered by the service for the message, or the reason it couldn't be rendered.
+	Payload string
+	// Result is the result of the last attempt, as reported by the metrics.
+	Result   string
+	Error    string
+	Attempts int
+	Updated  time.Time
+}
+
+// SetCapacity sets the maximum number of messages kept, forgetting the oldest ones if needed.
+func (h *MessageHistory) SetCapacity(capacity int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.capacity = capacity
+	h.trim()
+}
+
+// Add keeps a message which was just received.
+func (h *MessageHistory) Add(msg *Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.capacity == 0 {
+		return
+	}
+
+	h.messages = append(h.messages, &HistoryMessage{
+		ID:          msg.ID,
+		SessionID:   msg.SessionID,
+		Subject:     msg.Subject,
+		Sender:      msg.Sender(),
+		Recipients:  msg.Recipients(),
+		Received:    msg.Received,
+		HTML:        msg.HTML,
+		Markdown:    msg.Markdown,
+		Attachments: len(msg.Attachments),
+	})
+	h.trim()
+}
+
+// RecordDelivery updates the result of sending a message with a service, if the message is kept.
+// The payload of the service is rendered on the first attempt.
+func (h *MessageHistory) RecordDelivery(msg *Message, service Service, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	historyMessage := h.find(msg.ID)
+	if historyMessage == nil {
+		return
+	}
+
+	var delivery *HistoryDelivery
+	name := serviceName(service)
+
+	for _, existing := range historyMessage.Deliveries {
+		if existing.Service == name {
+			delivery = existing
+		}
+	}
+
+	if delivery == nil {
+		delivery = &HistoryDelivery{Service: name}
+		format, payload, renderErr := renderMessage(service, msg)
+
+		if renderErr != nil {
+			payload = fmt.Sprintf("The payload couldn't be rendered: %v", renderErr)
+		}
+
+		delivery.Format = format
+		delivery.Payload = payload
+		historyMessage.Deliveries = append(historyMessage.Deliveries, delivery)
+	}
+
+	delivery.Result = sendResult(err)
+	delivery.Error = ""
+	delivery.Attempts++
+	delivery.Updated = time.Now()
+
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+}
+
+// Recent returns copies of the kept messages, from the most recent to the oldest one.
+func (h *MessageHistory) Recent() []HistoryMessage {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	messages := make([]HistoryMessage, 0, len(h.messages))
+
+	for i := len(h.messages) - 1; i >= 0; i-- {
+		messages = append(messages, h.messages[i].copy())
+	}
+
+	return messages
+}
+
+// Find returns a copy of a kept message, or false if it isn't kept.
+func (h *MessageHistory) Find(id string) (HistoryMessage, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if msg := h.find(id); msg != nil {
+		return msg.copy(), true
+	}
+
+	return HistoryMessage{}, false
+}
+
+// find returns a kept message, or nil if it isn't kept. The mutex must be held.
+func (h *MessageHistory) find(id string) *HistoryMessage {
+	for _, msg := range h.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// trim forgets the oldest messages exceeding the capacity, the mutex must be held.
+func (h *MessageHistory) trim() {
+	if excess := len(h.messages) - h.capacity; excess > 0 {
+		h.messages = append([]*HistoryMessage(nil), h.messages[excess:]...)
+	}
+}
+
+// copy returns a copy of the message which can be read without holding the mutex of the history.
+func (m *HistoryMessage) copy() HistoryMessage {
+	msg := *m
+	msg.Deliveries = make([]*HistoryDelivery, len(m.Deliveries))
+
+	for i, delivery := range m.Deliveries {
+		deliveryCopy := *delivery
+		msg.Deliveries[i] = &deliveryCopy
+	}
+
+	return msg
+}
+
+// WebUi serves the pages listing the recent messages, previewing their bodies along with the
+// payloads rendered by each service.
+type WebUi struct {
+	history *MessageHistory
+	// token is the password asked by the pages.
+	token string
+}
+
+// createWebUi creates the web UI configured by the flags and starts keeping the recent messages, or
+// returns nil when the web UI is disabled. The pages show the content of the emails, so the web UI
+// can't be enabled without the admin token protecting them.
+func createWebUi(flags map[string]string) (*WebUi, error) {
+	capacity, err := parseWebUiHistory(flags)
+	if err != nil || capacity == 0 {
+		return nil, err
+	}
+
+	messageHistory.SetCapacity(capacity)
+	return &WebUi{history: messageHistory, token: flags[adminTokenFlag]}, nil
+}
+
+// parseWebUiHistory validates the flags of the web UI, returning the number of messages kept or 0
+// when the web UI is disabled.
+func parseWebUiHistory(flags map[string]string) (int, error) {
+	enabled, err := parseOptionalBool(flags[webUiFlag], false)
+	if err != nil {
+		return 0, errors.New("web ui is invalid")
+	}
+
+	capacity, err := parseOptionalInt(flags[webUiHistoryFlag], 100)
+	if err != nil || capacity <= 0 {
+		return 0, errors.New("web ui history is invalid")
+	}
+
+	if !enabled {
+		return 0, nil
+	}
+
+	if len(flags[adminTokenFlag]) == 0 {
+		return 0, errors.New("web ui requires the admin token")
+	}
+
+	return capacity, nil
+}
+
+// Register adds the pages of the web UI to a multiplexer.
+func (u *WebUi) Register(mux *http.ServeMux) {
+	static, _ := fs.Sub(webFiles, "web/static")
+	mux.Handle("GET /ui/static/", u.authenticate(http.StripPrefix("/ui/static/", http.FileServer(http.FS(static))).ServeHTTP))
+	mux.Handle("GET /ui/{$}", u.authenticate(u.serveMessages))
+	mux.Handle("GET /ui/messages/{id}", u.authenticate(u.serveMessage))
+}
+
+// authenticate asks for the token as the password of the basic authentication.
+func (u *WebUi) authenticate(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, _ := r.BasicAuth()
+
+		if len(u.token) == 0 || subtle.ConstantTimeCompare([]byte(password), []byte(u.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tegami"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Security-Policy", webContentSecurityPolicy)
+		handler(w, r)
+	})
+}
+
+// serveMessages renders the list of the recent messages.
+func (u *WebUi) serveMessages(w http.ResponseWriter, _ *http.Request) {
+	u.render(w, "messages.html", u.history.Recent())
+}
+
+// serveMessage renders a message along with its deliveries and the previews of its bodies.
+func (u *WebUi) serveMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := u.history.Find(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	u.render(w, "message.html", msg)
+}
+
+// render writes a page of the web UI.
+func (u *WebUi) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := webTemplates.ExecuteTemplate(w, name, data); err != nil {
+		slog.Error("Could not render the web UI", "page", name, "error", err)
+	}
+}
+
+// webUiCLIFlags returns the flags used for configuring the web UI.
+func webUiCLIFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    webUiFlag,
+			Value:   "false",
+			Usage:   "Serves a web UI showing the recent emails and their deliveries at /ui/ on the HTTP server, protected by the admin token which must be set (Optional)",
+			EnvVars: []string{webUiEnv},
+		},
+		&cli.StringFlag{
+			Name:    webUiHistoryFlag,
+			Value:   "100",
+			Usage:   "The number of recent emails kept in memory for the web UI (Optional)",
+			EnvVars: []string{webUiHistoryEnv},
+		},
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageHistory(t *testing.T) {
+	history := &MessageHistory{}
+	history.Add(&Message{ID: "ignored"})
+
+	if len(history.Recent()) != 0 {
+		t.Fatalf("Expected no message kept without capacity")
+	}
+
+	history.SetCapacity(2)
+
+	for _, id := range []string{"first", "second", "third"} {
+		history.Add(&Message{ID: id, Subject: "Disk failure"})
+	}
+
+	recent := history.Recent()
+	if len(recent) != 2 || recent[0].ID != "third" || recent[1].ID != "second" {
+		t.Fatalf("Expected the two most recent messages, got %+v", recent)
+	}
+
+	telegram := &timeoutService{Service: &RecorderService{}, name: "Telegram"}
+	mattermost := &timeoutService{Service: &MattermostService{}, name: "Mattermost"}
+	history.RecordDelivery(&Message{ID: "third", HTML: "<b>Disk 2</b> failed"}, telegram, &TemporaryError{Err: errors.New("server unavailable")})
+	history.RecordDelivery(&Message{ID: "third"}, telegram, nil)
+	history.RecordDelivery(&Message{ID: "third", Subject: "Disk failure", Markdown: "**Disk 2** failed"}, mattermost, errors.New("invalid token"))
+	history.RecordDelivery(&Message{ID: "first"}, telegram, nil)
+
+	msg, ok := history.Find("third")
+	if !ok || len(msg.Deliveries) != 2 {
+		t.Fatalf("Expected the deliveries recorded, got %+v", msg)
+	}
+
+	if delivery := msg.Deliveries[0]; delivery.Result != "success" || delivery.Attempts != 2 || delivery.Error != "" ||
+		delivery.Format != "HTML" || delivery.Payload != "<b>Disk 2</b> failed" {
+		t.Errorf("Unexpected Telegram delivery: %+v", delivery)
+	}
+
+	if delivery := msg.Deliveries[1]; delivery.Result != "permanent_failure" || delivery.Error != "invalid token" ||
+		delivery.Format != "Markdown" || delivery.Payload != "**Disk failure**\n\n**Disk 2** failed" {
+		t.Errorf("Unexpected Mattermost delivery: %+v", delivery)
+	}
+
+	if _, ok = history.Find("first"); ok {
+		t.Errorf("Expected the oldest message forgotten")
+	}
+}
+
+func TestWebUi(t *testing.T) {
+	t.Cleanup(func() {
+		messageHistory.SetCapacity(0)
+	})
+
+	ui, err := createWebUi(map[string]string{webUiFlag: "true", webUiHistoryFlag: "10", adminTokenFlag: testAdminToken})
+	if err != nil || ui == nil {
+		t.Fatalf("Could not create the web UI: %v", err)
+	}
+
+	msg := &Message{
+		ID:       "5f0c3d1e2a4b6c7d",
+		From:     "nas@example.com",
+		To:       []string{"admin@example.com"},
+		Subject:  "Disk <failure>",
+		Received: time.Now(),
+		HTML:     `<b>Disk 2 failed</b><script>alert("x")</script>`,
+		Markdown: "**Disk 2 failed**",
+	}
+	messageHistory.Add(msg)
+	service := &timeoutService{Service: &RecorderService{isMarkdownService: true}, name: "Mattermost", timeout: time.Second}
+	service.Send(context.Background(), msg)
+
+	server := httptest.NewServer(newHttpHandler(NewHealthChecker(nil, nil, func() bool { return true }), nil, ui))
+	defer server.Close()
+
+	if resp := webUiRequest(t, server, "/ui/", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the web UI protected by the admin token, got %d", resp.StatusCode)
+	}
+
+	resp := webUiRequest(t, server, "/ui/", testAdminToken)
+	page := readWebUiPage(t, resp)
+
+	if !strings.Contains(page, `href="/ui/messages/5f0c3d1e2a4b6c7d"`) || !strings.Contains(page, "Disk &lt;failure&gt;") ||
+		!strings.Contains(page, `<span class="result success">Mattermost</span>`) {
+		t.Errorf("Expected the message listed, got %s", page)
+	}
+
+	if resp.Header.Get("Content-Security-Policy") != webContentSecurityPolicy {
+		t.Errorf("Expected the content security policy set")
+	}
+
+	page = readWebUiPage(t, webUiRequest(t, server, "/ui/messages/"+msg.ID, testAdminToken))
+
+	if !strings.Contains(page, `<pre class="preview">**Disk 2 failed**</pre>`) || !strings.Contains(page, "nas@example.com") {
+		t.Errorf("Expected the Markdown preview, got %s", page)
+	}
+
+	if !strings.Contains(page, `<h2>Mattermost payload (Markdown)</h2>`) || !strings.Contains(page, `<pre class="preview">**Disk 2 failed**</pre>`) {
+		t.Errorf("Expected the payload of the service, got %s", page)
+	}
+
+	messageHistory.Add(&Message{ID: "0123456789abcdef", HTML: msg.HTML})
+	page = readWebUiPage(t, webUiRequest(t, server, "/ui/messages/0123456789abcdef", testAdminToken))
+
+	if !strings.Contains(page, `sandbox srcdoc="&lt;b&gt;Disk 2 failed&lt;/b&gt;&lt;script&gt;`) {
+		t.Errorf("Expected the HTML preview in a sandboxed frame, got %s", page)
+	}
+
+	if resp = webUiRequest(t, server, "/ui/messages/unknown", testAdminToken); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown message not found, got %d", resp.StatusCode)
+	}
+
+	if resp = webUiRequest(t, server, "/ui/static/style.css", testAdminToken); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the stylesheet served, got %d", resp.StatusCode)
+	}
+}
+
+func TestCreateWebUi(t *testing.T) {
+	var tests = []struct {
+		name    string
+		flags   map[string]string
+		wantErr string
+	}{
+		{"With invalid value", map[string]string{webUiFlag: "maybe"}, "web ui is invalid"},
+		{"With invalid history", map[string]string{webUiFlag: "true", webUiHistoryFlag: "0"}, "web ui history is invalid"},
+		{"Without admin token", map[string]string{webUiFlag: "true"}, "web ui requires the admin token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := createWebUi(test.flags)
+			assertInitError(t, err, test.wantErr)
+		})
+	}
+
+	if ui, err := createWebUi(map[string]string{}); ui != nil || err != nil {
+		t.Errorf("Expected the web UI disabled by default, got %v", err)
+	}
+}
+
+// webUiRequest requests a page of the web UI, authenticated with the password if it is not empty.
+func webUiRequest(t *testing.T, server *httptest.Server, path, password string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+
+	if err != nil {
+		t.Fatalf("Could not create the request: %v", err)
+	}
+
+	if len(password) > 0 {
+		req.SetBasicAuth("admin", password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not send the request: %v", err)
+	}
+
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readWebUiPage reads a page of the web UI which was rendered successfully.
+func readWebUiPage(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	page, err := io.ReadAll(resp.Body)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Could not read the page: %d %v", resp.StatusCode, err)
+	}
+
+	return string(page)
+}
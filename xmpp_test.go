@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeXmppStreamHeader = "<?xml version='1.0'?><stream:stream from='example.com' id='s1' version='1.0' " +
+	"xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"
+
+type fakeXmppMessage struct {
+	To   string `xml:"to,attr"`
+	Type string `xml:"type,attr"`
+	Body string `xml:"body"`
+	Url  string `xml:"jabber:x:oob x>url"`
+}
+
+type fakeXmppIq struct {
+	Id      string    `xml:"id,attr"`
+	To      string    `xml:"to,attr"`
+	Bind    *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Request *struct {
+		Filename string `xml:"filename,attr"`
+	} `xml:"urn:xmpp:http:upload:0 request"`
+	Query *struct {
+		XMLName xml.Name
+	} `xml:"query"`
+}
+
+// fakeXmppServer is a minimal XMPP server supporting the features used by the XMPP service.
+type fakeXmppServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	uploadUrl   string
+	mutex       sync.Mutex
+	allowResume bool
+	connections []net.Conn
+	messages    []fakeXmppMessage
+	presences   []string
+	binds       int
+	resumes     int
+	inbound     int
+}
+
+func TestXmppService(t *testing.T) {
+	var uploads []string
+	uploadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploads = append(uploads, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization")+" "+string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer uploadServer.Close()
+
+	server := startFakeXmppServer(t, uploadServer.URL)
+	defer server.listener.Close()
+
+	t.Run("Init", func(t *testing.T) {
+		var tests = []struct {
+			name    string
+			flag    string
+			value   string
+			wantErr string
+		}{
+			{"With missing jid", xmppJidFlag, "", "xmpp jid not set"},
+			{"With invalid jid", xmppJidFlag, "example.com", "xmpp jid is invalid"},
+			{"With missing password", xmppPasswordFlag, "", "xmpp password not set"},
+			{"With missing recipients", xmppRecipientsFlag, "", "xmpp recipients or rooms not set"},
+			{"With invalid password", xmppPasswordFlag, "foo", "xmpp authentication failed"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				flags := generateXmppTestFlags(server)
+				flags[xmppRoomsFlag] = ""
+				flags[test.flag] = test.value
+
+				service := &XmppService{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+				err := service.Init(flags)
+				assertInitError(t, err, test.wantErr)
+			})
+		}
+	})
+
+	service := &XmppService{tlsConfig: &tls.Config{InsecureSkipVerify: true}, reconnectDelay: 10 * time.Millisecond}
+
+	if err := service.Init(generateXmppTestFlags(server)); err != nil {
+		t.Fatalf("Could not start XMPP service: %v", err)
+	}
+
+	defer service.Close()
+
+	t.Run("Join rooms", func(t *testing.T) {
+		waitForCondition(t, "room joined", func() bool {
+			return server.hasPresence("room@conference.example.com/tegami")
+		})
+	})
+
+	t.Run("Send", func(t *testing.T) {
+		msg := &Message{
+			Subject:     "Backup done",
+			Markdown:    "Backup **succeeded** <3",
+			Attachments: []*Attachment{{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report")}},
+		}
+
+		if err := service.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "messages received", func() bool { return server.messageCount() == 4 })
+
+		messages := server.receivedMessages()
+		assertMessageContent(t, t.Name(), messages[0].To, "alice@example.com")
+		assertMessageContent(t, t.Name(), messages[0].Type, "chat")
+		assertMessageContent(t, t.Name(), messages[0].Body, "**Backup done**\n\nBackup **succeeded** <3")
+		assertMessageContent(t, t.Name(), messages[1].Url, uploadServer.URL+"/report.txt")
+		assertMessageContent(t, t.Name(), messages[2].To, "room@conference.example.com")
+		assertMessageContent(t, t.Name(), messages[2].Type, "groupchat")
+		assertMessageContent(t, t.Name(), fmt.Sprint(uploads), "[PUT /report.txt Bearer upload report]")
+	})
+
+	t.Run("Resume after interruption", func(t *testing.T) {
+		server.setAllowResume(true)
+		server.dropConnections()
+		waitForCondition(t, "session resumed", func() bool { return server.resumeCount() == 1 })
+
+		if err := service.Send(context.Background(), &Message{Markdown: "Resumed"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "messages received", func() bool { return server.messageCount() == 6 })
+		assertMessageContent(t, t.Name(), server.receivedMessages()[4].Body, "Resumed")
+
+		if server.bindCount() != 1 {
+			t.Errorf("Resource bound again while the session was resumed")
+		}
+	})
+
+	t.Run("Reconnect after interruption", func(t *testing.T) {
+		server.setAllowResume(false)
+		server.dropConnections()
+		waitForCondition(t, "new session", func() bool { return server.bindCount() == 2 })
+
+		if err := service.Send(context.Background(), &Message{Markdown: "Reconnected"}); err != nil {
+			t.Fatalf("Error while we weren't supposed to get any: %v", err)
+		}
+
+		waitForCondition(t, "messages received", func() bool { return server.messageCount() == 8 })
+		assertMessageContent(t, t.Name(), server.receivedMessages()[6].Body, "Reconnected")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		if err := service.Close(); err != nil {
+			t.Errorf("Error while closing the service: %v", err)
+		}
+
+		if err := service.Send(context.Background(), &Message{Markdown: "Closed"}); err == nil {
+			t.Errorf("We didn't get any error while we were supposed to get one")
+		}
+	})
+}
+
+func TestXmppSendStanzaWriteError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+
+	conn.Close()
+	service := &XmppService{conn: &xmppConn{Conn: conn}, streamId: "stream"}
+	err = service.sendStanza("<message/>", true)
+
+	if !IsTemporaryError(err) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+
+	if len(service.unacked) != 0 || service.outbound != 0 {
+		t.Errorf("Expected the stanza not kept for being sent again, got %d stanzas", len(service.unacked))
+	}
+}
+
+func startFakeXmppServer(t *testing.T, uploadUrl string) *fakeXmppServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Could not start XMPP server: %v", err)
+	}
+
+	server := &fakeXmppServer{
+		listener:  listener,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{createTestCertificate(t)}},
+		uploadUrl: uploadUrl,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mutex.Lock()
+			server.connections = append(server.connections, conn)
+			server.mutex.Unlock()
+			go server.handle(conn)
+		}
+	}()
+
+	return server
+}
+
+func (f *fakeXmppServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := xml.NewDecoder(conn)
+	if _, err := nextFakeXmppElement(decoder); err != nil {
+		return
+	}
+
+	io.WriteString(conn, fakeXmppStreamHeader+"<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/></stream:features>")
+
+	if element, err := nextFakeXmppElement(decoder); err != nil || element.Name.Local != "starttls" {
+		return
+	}
+
+	io.WriteString(conn, "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+	tlsConn := tls.Server(conn, f.tlsConfig)
+	decoder = xml.NewDecoder(tlsConn)
+
+	if _, err := nextFakeXmppElement(decoder); err != nil {
+		return
+	}
+
+	io.WriteString(tlsConn, fakeXmppStreamHeader+"<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>"+
+		"<mechanism>SCRAM-SHA-1</mechanism><mechanism>PLAIN</mechanism></mechanisms></stream:features>")
+
+	var credentials string
+	element, err := nextFakeXmppElement(decoder)
+
+	if err != nil || decoder.DecodeElement(&credentials, &element) != nil {
+		return
+	}
+
+	if decoded, _ := base64.StdEncoding.DecodeString(credentials); string(decoded) != "\x00tegami\x00secret" {
+		io.WriteString(tlsConn, "<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>")
+		return
+	}
+
+	io.WriteString(tlsConn, "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+	decoder = xml.NewDecoder(tlsConn)
+
+	if _, err := nextFakeXmppElement(decoder); err != nil {
+		return
+	}
+
+	io.WriteString(tlsConn, fakeXmppStreamHeader+"<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>"+
+		"<sm xmlns='urn:xmpp:sm:3'/></stream:features>")
+
+	for {
+		element, err := nextFakeXmppElement(decoder)
+		if err != nil {
+			return
+		}
+
+		f.mutex.Lock()
+
+		switch element.Name.Local {
+		case "enable":
+			decoder.Skip()
+			f.inbound = 0
+			io.WriteString(tlsConn, "<enabled xmlns='urn:xmpp:sm:3' id='sm-1' resume='true'/>")
+		case "resume":
+			decoder.Skip()
+			if f.allowResume {
+				f.resumes++
+				fmt.Fprintf(tlsConn, "<resumed xmlns='urn:xmpp:sm:3' previd='sm-1' h='%d'/>", f.inbound)
+			} else {
+				io.WriteString(tlsConn, "<failed xmlns='urn:xmpp:sm:3'/>")
+			}
+		case "r":
+			decoder.Skip()
+			fmt.Fprintf(tlsConn, "<a xmlns='urn:xmpp:sm:3' h='%d'/>", f.inbound)
+		case "presence":
+			to := attribute(element, "to")
+			decoder.Skip()
+			f.presences = append(f.presences, to)
+			f.inbound++
+		case "message":
+			var msg fakeXmppMessage
+			decoder.DecodeElement(&msg, &element)
+			f.messages = append(f.messages, msg)
+			f.inbound++
+		case "iq":
+			var iq fakeXmppIq
+			decoder.DecodeElement(&iq, &element)
+			f.handleIq(tlsConn, &iq)
+		default:
+			decoder.Skip()
+		}
+
+		f.mutex.Unlock()
+	}
+}
+
+func (f *fakeXmppServer) handleIq(conn io.Writer, iq *fakeXmppIq) {
+	switch {
+	case iq.Bind != nil:
+		f.binds++
+		fmt.Fprintf(conn, "<iq type='result' id='%s'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>"+
+			"<jid>tegami@example.com/tegami</jid></bind></iq>", iq.Id)
+		return
+	case iq.Request != nil:
+		fmt.Fprintf(conn, "<iq type='result' id='%s'><slot xmlns='urn:xmpp:http:upload:0'>"+
+			"<put url='%s/%s'><header name='Authorization'>Bearer upload</header></put><get url='%s/%s'/></slot></iq>",
+			iq.Id, f.uploadUrl, iq.Request.Filename, f.uploadUrl, iq.Request.Filename)
+	case iq.Query != nil && iq.Query.XMLName.Space == "http://jabber.org/protocol/disco#items":
+		fmt.Fprintf(conn, "<iq type='result' id='%s'><query xmlns='http://jabber.org/protocol/disco#items'>"+
+			"<item jid='conference.example.com'/><item jid='upload.example.com'/></query></iq>", iq.Id)
+	case iq.Query != nil && iq.To == "upload.example.com":
+		fmt.Fprintf(conn, "<iq type='result' id='%s'><query xmlns='http://jabber.org/protocol/disco#info'>"+
+			"<feature var='urn:xmpp:http:upload:0'/></query></iq>", iq.Id)
+	case iq.Query != nil:
+		fmt.Fprintf(conn, "<iq type='result' id='%s'><query xmlns='http://jabber.org/protocol/disco#info'>"+
+			"<feature var='http://jabber.org/protocol/disco#info'/></query></iq>", iq.Id)
+	}
+
+	f.inbound++
+}
+
+func (f *fakeXmppServer) dropConnections() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range f.connections {
+		conn.Close()
+	}
+	f.connections = nil
+}
+
+func (f *fakeXmppServer) setAllowResume(allowResume bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.allowResume = allowResume
+}
+
+func (f *fakeXmppServer) hasPresence(to string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, presence := range f.presences {
+		if presence == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeXmppServer) receivedMessages() []fakeXmppMessage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]fakeXmppMessage(nil), f.messages...)
+}
+
+func (f *fakeXmppServer) messageCount() int {
+	return len(f.receivedMessages())
+}
+
+func (f *fakeXmppServer) resumeCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.resumes
+}
+
+func (f *fakeXmppServer) bindCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.binds
+}
+
+func nextFakeXmppElement(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+func generateXmppTestFlags(server *fakeXmppServer) map[string]string {
+	flags := make(map[string]string)
+	flags[xmppJidFlag] = "tegami@example.com"
+	flags[xmppPasswordFlag] = "secret"
+	flags[xmppServerFlag] = server.listener.Addr().String()
+	flags[xmppRecipientsFlag] = "alice@example.com"
+	flags[xmppRoomsFlag] = "room@conference.example.com"
+	return flags
+}